@@ -1,15 +1,13 @@
 package main
 
 import (
-	"context"
 	utils2 "directoryCommunityWebsite/internal/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
-
-	"golang.org/x/oauth2"
 )
 
 func (app *App) handleAddRow(w http.ResponseWriter, r *http.Request) {
@@ -40,6 +38,17 @@ func (app *App) handleAddRow(w http.ResponseWriter, r *http.Request) {
 	// Get directory ID from query parameter or default to "default"
 	directoryID := utils2.GetDirectoryID(r)
 
+	// The row is written back as submitted and stored as the columns' normalisers make it
+	var invalid *invalidValueError
+	if err := app.validateSubmittedValues(directoryID, 0, addRowReq.Data); errors.As(err, &invalid) {
+		utils2.ValidationError(w, invalid.Error())
+		return
+	} else if err != nil {
+		log.Printf("Failed to check new row for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to apply column normalisers")
+		return
+	}
+
 	// Check user permissions and apply moderation workflow
 	userType, err := app.GetUserType(userEmail, directoryID)
 	if err != nil {
@@ -79,73 +88,27 @@ func (app *App) handleAddRow(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// For owners/admins or moderators without approval requirement, add directly
-	// Try to add the row to the original Google Sheet
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	go func() {
-		defer cancel()
-		app.addRowToSheet(ctx, addRowReq.Data, directoryID)
-	}()
-
-	utils2.RespondWithSuccess(w, nil, "Row added successfully")
-}
-
-func (app *App) addRowToSheet(ctx context.Context, rowData []string, directoryID string) {
-	// Get the latest admin session with a sheet URL
-	var userEmail, encryptedTokenJSON, sheetURL string
-	err := app.DB.QueryRow(`
-		SELECT user_email, token, sheet_url 
-		FROM admin_sessions 
-		WHERE sheet_url IS NOT NULL AND sheet_url != ''
-		ORDER BY created_at DESC 
-		LIMIT 1
-	`).Scan(&userEmail, &encryptedTokenJSON, &sheetURL)
-
-	select {
-	case <-ctx.Done():
-		fmt.Printf("Context cancelled while adding row to sheet: %v\n", ctx.Err())
-		return
-	default:
-	}
-
-	//TODO: These errors should be communicated to the user!!!!!
+	// The new row gets its key up front so a retried append can tell it is already in the sheet
+	rowKey, err := newRowKey()
 	if err != nil {
-		fmt.Printf("No admin session found for adding row to sheet: %v\n", err)
+		log.Printf("Failed to generate row key: %v", err)
+		utils2.InternalServerError(w, "Failed to queue new row")
 		return
 	}
 
-	spreadsheetID, err := extractSpreadsheetID(sheetURL)
-	if err != nil {
-		fmt.Printf("Failed to extract spreadsheet ID: %v\n", err)
+	// Queue the row for the original sheet; the sync worker appends it and re-imports
+	jobID, err := app.enqueueSyncJob(directoryID, SyncJobAppendRow, SyncJobPayload{Values: addRowReq.Data, RowKey: rowKey}, userEmail)
+	if errors.Is(err, errSourceReadOnly) {
+		utils2.ValidationError(w, err.Error())
 		return
 	}
-
-	// Decrypt the token
-	tokenJSON, err := app.EncryptionService.Decrypt(encryptedTokenJSON)
 	if err != nil {
-		fmt.Printf("Failed to decrypt token: %v\n", err)
-		return
-	}
-
-	var token oauth2.Token
-	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
-		fmt.Printf("Failed to unmarshal token: %v\n", err)
+		log.Printf("Failed to queue new row for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to queue new row")
 		return
 	}
 
-	// Append the row to the sheet
-	if err := app.appendRowToSheet(spreadsheetID, rowData, &token); err != nil {
-		fmt.Printf("Failed to append row to sheet: %v\n", err)
-		return
-	}
-
-	fmt.Printf("Successfully added new row to sheet with data: %v\n", rowData)
-
-	// Re-import the sheet to refresh our database
-	if err := app.reimportSheet(ctx, spreadsheetID, &token, directoryID); err != nil {
-		fmt.Printf("Failed to re-import sheet after adding row: %v\n", err)
-	} else {
-		fmt.Println("Successfully re-imported sheet data after adding row")
-	}
+	utils2.RespondWithSuccess(w, map[string]interface{}{"sync_job_id": jobID}, "Row added successfully")
 }
 
 // createPendingAddRow creates a pending change for row addition
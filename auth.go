@@ -210,6 +210,9 @@ func (app *App) handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The new token may fix directories whose sync credential was broken
+	app.recheckCredentials()
+
 	log.Printf("Creating session data structure")
 	csrfToken, err := GenerateCSRFToken()
 	if err != nil {
@@ -301,6 +304,15 @@ func (app *App) handleAdmin(w http.ResponseWriter, r *http.Request) {
 	importSuccess := r.URL.Query().Get("imported") == "true"
 	log.Printf("Import success flag: %v", importSuccess)
 
+	// Warn about sync credentials that are failing or about to
+	credentialHealth, err := app.GetCredentialHealth(directoryID)
+	if err != nil {
+		log.Printf("Failed to get credential health for directory %s: %v", directoryID, err)
+	}
+	if credentialHealth != nil && credentialHealth.State == CredentialHealthy {
+		credentialHealth = nil
+	}
+
 	// Use the proper owner template file instead of inline template
 	tmpl, err := template.ParseFiles("templates/owner.html")
 	if err != nil {
@@ -313,32 +325,38 @@ func (app *App) handleAdmin(w http.ResponseWriter, r *http.Request) {
 	viewDirectoryURL := "/"
 	importURL := "/import"
 	previewURL := "/api/preview-sheet"
+	validateImportURL := "/api/import/validate"
 	adminURL := "/owner"
 	if directoryID != "default" {
 		viewDirectoryURL += "?dir=" + directoryID
 		importURL += "?dir=" + directoryID
 		previewURL += "?dir=" + directoryID
+		validateImportURL += "?dir=" + directoryID
 		adminURL += "?dir=" + directoryID
 	}
 
 	data := struct {
-		UserEmail        string
-		CSRFToken        string
-		ImportSuccess    bool
-		Directory        *Directory
-		ViewDirectoryURL string
-		ImportURL        string
-		PreviewURL       string
-		AdminURL         string
+		UserEmail         string
+		CSRFToken         string
+		ImportSuccess     bool
+		Directory         *Directory
+		ViewDirectoryURL  string
+		ImportURL         string
+		PreviewURL        string
+		ValidateImportURL string
+		AdminURL          string
+		CredentialHealth  *CredentialHealth
 	}{
-		UserEmail:        userEmail,
-		CSRFToken:        csrfToken,
-		ImportSuccess:    importSuccess,
-		Directory:        directory,
-		ViewDirectoryURL: viewDirectoryURL,
-		ImportURL:        importURL,
-		PreviewURL:       previewURL,
-		AdminURL:         adminURL,
+		UserEmail:         userEmail,
+		CSRFToken:         csrfToken,
+		ImportSuccess:     importSuccess,
+		Directory:         directory,
+		ViewDirectoryURL:  viewDirectoryURL,
+		ImportURL:         importURL,
+		PreviewURL:        previewURL,
+		ValidateImportURL: validateImportURL,
+		AdminURL:          adminURL,
+		CredentialHealth:  credentialHealth,
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Cell rule kind constants
+const (
+	CellRuleFormula    = "formula"    // the cells are computed by formulas
+	CellRuleProtected  = "protected"  // the cells are in a protected range
+	CellRuleValidation = "validation" // the cells only accept values allowed by a validation rule
+)
+
+// SourceCellRule records what a source does with a block of cells beyond holding their values.
+// Rows are absolute 1-based source rows and columns count from the start of the range; a
+// LastRow of 0 or a LastColumn of -1 leaves the block open-ended.
+type SourceCellRule struct {
+	Kind        string          `json:"kind"`
+	FirstRow    int             `json:"first_row"`
+	LastRow     int             `json:"last_row"`
+	FirstColumn int             `json:"first_column"`
+	LastColumn  int             `json:"last_column"`
+	Formula     string          `json:"formula,omitempty"`      // formula of the block's first cell
+	Description string          `json:"description,omitempty"`  // why the range is protected
+	WarningOnly bool            `json:"warning_only,omitempty"` // protection only warns before an edit
+	Editable    bool            `json:"editable,omitempty"`     // the sync credential may edit the range anyway
+	Validation  *CellValidation `json:"validation,omitempty"`
+}
+
+// CellValidation is a data validation rule of the source, such as a dropdown
+type CellValidation struct {
+	Condition    string   `json:"condition"` // e.g. ONE_OF_LIST or NUMBER_BETWEEN
+	Values       []string `json:"values,omitempty"`
+	Strict       bool     `json:"strict"` // invalid values are rejected rather than flagged
+	InputMessage string   `json:"input_message,omitempty"`
+}
+
+// sourceCellsTableQuery creates the directory database table holding the rules read from
+// the source in the last import, in directory columns
+const sourceCellsTableQuery = `
+	CREATE TABLE IF NOT EXISTS _meta_source_cells (
+		kind TEXT NOT NULL,
+		firstRow INTEGER NOT NULL,
+		lastRow INTEGER NOT NULL,
+		firstColumn INTEGER NOT NULL,
+		lastColumn INTEGER NOT NULL,
+		rule TEXT NOT NULL
+	);
+`
+
+// cellRuleReader is implemented by sources that can report which of their cells hold
+// formulas, are protected or are validated. Formulas and validation rules are read for the
+// given absolute rows, or for the whole range if rows is nil.
+type cellRuleReader interface {
+	ReadCellRules(ctx context.Context, rows []int) ([]SourceCellRule, error)
+}
+
+// coversRow reports whether a rule applies to a row
+func (rule *SourceCellRule) coversRow(row int) bool {
+	return row >= rule.FirstRow && (rule.LastRow == 0 || row <= rule.LastRow)
+}
+
+// covers reports whether a rule applies to a cell
+func (rule *SourceCellRule) covers(row, col int) bool {
+	return rule.coversRow(row) && col >= rule.FirstColumn && (rule.LastColumn < 0 || col <= rule.LastColumn)
+}
+
+// protects reports whether a protected range stops the sync credential from writing its cells
+func (rule *SourceCellRule) protects() bool {
+	return rule.Kind == CellRuleProtected && !rule.WarningOnly && !rule.Editable
+}
+
+// blocksEdits reports whether a rule stops the cells it covers from being written
+func (rule *SourceCellRule) blocksEdits() bool {
+	return rule.Kind == CellRuleFormula || rule.protects()
+}
+
+// editError explains why a rule that blocks edits stops a cell from being written
+func (rule *SourceCellRule) editError() error {
+	if rule.Kind == CellRuleFormula {
+		return fmt.Errorf("the cell is computed by the formula %s in the source; change the formula there instead", rule.Formula)
+	}
+	if rule.Description != "" {
+		return fmt.Errorf("the cell is in a protected range of the source (%s)", rule.Description)
+	}
+	return fmt.Errorf("the cell is in a protected range of the source")
+}
+
+// cellRules is the set of rules read from a source
+type cellRules []SourceCellRule
+
+// checkWrite returns why value can't be written to a cell, or nil if the source accepts it.
+// Validation rules that only flag invalid values let them through, as the source does.
+func (rules cellRules) checkWrite(row, col int, value string) error {
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.covers(row, col) {
+			continue
+		}
+		if rule.blocksEdits() {
+			return rule.editError()
+		}
+		if rule.Kind == CellRuleValidation && rule.Validation != nil {
+			if err := rule.Validation.check(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDelete returns why a row can't be deleted, or nil. The source refuses to delete rows
+// holding protected cells; computed cells go with their row.
+func (rules cellRules) checkDelete(row int) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.protects() && rule.coversRow(row) {
+			return fmt.Errorf("the row holds cells of a protected range of the source")
+		}
+	}
+	return nil
+}
+
+// directoryCellRules converts rules read from a source to directory columns by leaving out
+// the row key column. Rules that only covered the row key column are dropped.
+func directoryCellRules(rules []SourceCellRule, keyIndex int) cellRules {
+	converted := make(cellRules, 0, len(rules))
+	for _, rule := range rules {
+		if keyIndex >= 0 {
+			if rule.FirstColumn > keyIndex {
+				rule.FirstColumn--
+			}
+			if rule.LastColumn >= keyIndex {
+				rule.LastColumn--
+			}
+			if rule.LastColumn >= 0 && rule.LastColumn < rule.FirstColumn {
+				continue
+			}
+		}
+		converted = append(converted, rule)
+	}
+	return converted
+}
+
+// check returns an error if a strict rule rejects value. Empty values are accepted, since
+// clearing a validated cell is allowed, and so are conditions that depend on other cells,
+// such as ONE_OF_RANGE and CUSTOM_FORMULA, which can only be checked by the source.
+func (v *CellValidation) check(value string) error {
+	value = strings.TrimSpace(value)
+	if !v.Strict || value == "" {
+		return nil
+	}
+
+	invalid := func(requirement string) error {
+		if v.InputMessage != "" {
+			return fmt.Errorf("%q is not allowed by the source's validation rule (%s): %s", value, v.InputMessage, requirement)
+		}
+		return fmt.Errorf("%q is not allowed by the source's validation rule: %s", value, requirement)
+	}
+
+	switch v.Condition {
+	case "ONE_OF_LIST":
+		for _, allowed := range v.Values {
+			if strings.EqualFold(strings.TrimSpace(allowed), value) {
+				return nil
+			}
+		}
+		return invalid("must be one of " + strings.Join(v.Values, ", "))
+
+	case "BOOLEAN":
+		allowed := []string{"TRUE", "FALSE"}
+		if len(v.Values) > 0 {
+			allowed = v.Values
+		}
+		for _, a := range allowed {
+			if strings.EqualFold(strings.TrimSpace(a), value) {
+				return nil
+			}
+		}
+		return invalid("must be one of " + strings.Join(allowed, ", "))
+
+	case "TEXT_CONTAINS", "TEXT_NOT_CONTAINS", "TEXT_EQ":
+		if len(v.Values) != 1 {
+			return nil
+		}
+		want := v.Values[0]
+		switch {
+		case v.Condition == "TEXT_CONTAINS" && !strings.Contains(value, want):
+			return invalid(fmt.Sprintf("must contain %q", want))
+		case v.Condition == "TEXT_NOT_CONTAINS" && strings.Contains(value, want):
+			return invalid(fmt.Sprintf("must not contain %q", want))
+		case v.Condition == "TEXT_EQ" && value != want:
+			return invalid(fmt.Sprintf("must be %q", want))
+		}
+		return nil
+
+	case "TEXT_IS_EMAIL":
+		if _, err := mail.ParseAddress(value); err != nil {
+			return invalid("must be an email address")
+		}
+		return nil
+
+	case "TEXT_IS_URL":
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return invalid("must be a URL")
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(v.Condition, "NUMBER_") {
+		return nil
+	}
+
+	bounds := make([]float64, len(v.Values))
+	for i, bound := range v.Values {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(bound), 64)
+		if err != nil {
+			return nil // bounds given as formulas can only be checked by the source
+		}
+		bounds[i] = parsed
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return invalid("must be a number")
+	}
+
+	requirement := func(text string, args ...interface{}) error {
+		return invalid(fmt.Sprintf(text, args...))
+	}
+	switch {
+	case len(bounds) == 1:
+		bound := bounds[0]
+		switch {
+		case v.Condition == "NUMBER_GREATER" && !(number > bound):
+			return requirement("must be greater than %v", bound)
+		case v.Condition == "NUMBER_GREATER_THAN_EQ" && !(number >= bound):
+			return requirement("must be at least %v", bound)
+		case v.Condition == "NUMBER_LESS" && !(number < bound):
+			return requirement("must be less than %v", bound)
+		case v.Condition == "NUMBER_LESS_THAN_EQ" && !(number <= bound):
+			return requirement("must be at most %v", bound)
+		case v.Condition == "NUMBER_EQ" && number != bound:
+			return requirement("must be %v", bound)
+		case v.Condition == "NUMBER_NOT_EQ" && number == bound:
+			return requirement("must not be %v", bound)
+		}
+	case len(bounds) == 2:
+		inside := number >= bounds[0] && number <= bounds[1]
+		switch {
+		case v.Condition == "NUMBER_BETWEEN" && !inside:
+			return requirement("must be between %v and %v", bounds[0], bounds[1])
+		case v.Condition == "NUMBER_NOT_BETWEEN" && inside:
+			return requirement("must not be between %v and %v", bounds[0], bounds[1])
+		}
+	}
+	return nil
+}
+
+// saveCellRules replaces the rules stored for a directory with the ones read in an import
+func saveCellRules(tx *sql.Tx, rules cellRules) error {
+	if _, err := tx.Exec("DELETE FROM _meta_source_cells"); err != nil {
+		return fmt.Errorf("failed to clear cell rules: %v", err)
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO _meta_source_cells (kind, firstRow, lastRow, firstColumn, lastColumn, rule)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare cell rule insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, rule := range rules {
+		ruleJSON, err := json.Marshal(rule)
+		if err != nil {
+			return fmt.Errorf("failed to marshal cell rule: %v", err)
+		}
+		if _, err := stmt.Exec(rule.Kind, rule.FirstRow, rule.LastRow, rule.FirstColumn, rule.LastColumn, string(ruleJSON)); err != nil {
+			return fmt.Errorf("failed to insert cell rule: %v", err)
+		}
+	}
+	return nil
+}
+
+// getCellRules returns the stored rules of a source row, in directory columns
+func (app *App) getCellRules(directoryID string, sheetRow int) (cellRules, error) {
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory database: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT rule FROM _meta_source_cells
+		WHERE firstRow <= ? AND (lastRow = 0 OR lastRow >= ?)
+	`, sheetRow, sheetRow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cell rules: %v", err)
+	}
+	defer rows.Close()
+
+	var rules cellRules
+	for rows.Next() {
+		var ruleJSON string
+		if err := rows.Scan(&ruleJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan cell rule: %v", err)
+		}
+		var rule SourceCellRule
+		if err := json.Unmarshal([]byte(ruleJSON), &rule); err != nil {
+			return nil, fmt.Errorf("failed to parse cell rule: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
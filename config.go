@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -23,6 +24,17 @@ type Config struct {
 	DatabasePath        string
 	Port                string
 	SheetRange          string
+	FileSourceDir       string
+	SyncMaxAttempts     int
+	SyncPullInterval    time.Duration
+	FileWatchInterval   time.Duration
+	DriveWebhookURL     string
+	DriveWatchFake      bool
+	HealthCheckInterval time.Duration
+	SnapshotInterval    time.Duration
+	SnapshotKeep        int
+	SheetsReadsPerMin   int
+	SheetsWritesPerMin  int
 	SessionMaxAge       int
 	LogLevel            string
 	Environment         string
@@ -64,7 +76,8 @@ func LoadConfig() (*Config, error) {
 	config.TwitterRedirectURL = getEnvWithDefault("TWITTER_REDIRECT_URL", "http://localhost:8080/auth/twitter/callback")
 	config.DatabasePath = getEnvWithDefault("DATABASE_PATH", "./private.db")
 	config.Port = getEnvWithDefault("PORT", "9090")
-	config.SheetRange = getEnvWithDefault("SHEET_RANGE", "A:Z")
+	config.SheetRange = getEnvWithDefault("SHEET_RANGE", "A:")
+	config.FileSourceDir = getEnvWithDefault("FILE_SOURCE_DIR", "./sources")
 	config.LogLevel = getEnvWithDefault("LOG_LEVEL", "INFO")
 	config.Environment = getEnvWithDefault("ENVIRONMENT", "development")
 
@@ -74,6 +87,61 @@ func LoadConfig() (*Config, error) {
 	}
 	config.SessionMaxAge = maxAge
 
+	syncMaxAttempts, err := strconv.Atoi(getEnvWithDefault("SYNC_MAX_ATTEMPTS", "8"))
+	if err != nil || syncMaxAttempts < 1 {
+		return nil, fmt.Errorf("invalid SYNC_MAX_ATTEMPTS: must be a positive integer")
+	}
+	config.SyncMaxAttempts = syncMaxAttempts
+
+	pullInterval, err := time.ParseDuration(getEnvWithDefault("SYNC_PULL_INTERVAL", "10m"))
+	if err != nil || pullInterval < 0 {
+		return nil, fmt.Errorf("invalid SYNC_PULL_INTERVAL: must be a duration such as 10m, or 0 to disable")
+	}
+	config.SyncPullInterval = pullInterval
+
+	fileWatchInterval, err := time.ParseDuration(getEnvWithDefault("FILE_WATCH_INTERVAL", "5s"))
+	if err != nil || fileWatchInterval < 0 {
+		return nil, fmt.Errorf("invalid FILE_WATCH_INTERVAL: must be a duration such as 5s, or 0 to disable")
+	}
+	config.FileWatchInterval = fileWatchInterval
+
+	// Drive only notifies HTTPS addresses; the fake channels used for local testing don't mind
+	config.DriveWebhookURL = os.Getenv("DRIVE_WEBHOOK_URL")
+	config.DriveWatchFake = os.Getenv("DRIVE_WATCH_FAKE") == "true"
+	if config.DriveWebhookURL != "" && !config.DriveWatchFake && !strings.HasPrefix(config.DriveWebhookURL, "https://") {
+		return nil, fmt.Errorf("invalid DRIVE_WEBHOOK_URL: Drive only sends notifications to https:// addresses")
+	}
+
+	healthCheckInterval, err := time.ParseDuration(getEnvWithDefault("CREDENTIAL_CHECK_INTERVAL", "1h"))
+	if err != nil || healthCheckInterval < 0 {
+		return nil, fmt.Errorf("invalid CREDENTIAL_CHECK_INTERVAL: must be a duration such as 1h, or 0 to disable")
+	}
+	config.HealthCheckInterval = healthCheckInterval
+
+	snapshotInterval, err := time.ParseDuration(getEnvWithDefault("SNAPSHOT_INTERVAL", "24h"))
+	if err != nil || snapshotInterval < 0 {
+		return nil, fmt.Errorf("invalid SNAPSHOT_INTERVAL: must be a duration such as 24h, or 0 to disable")
+	}
+	config.SnapshotInterval = snapshotInterval
+
+	snapshotKeep, err := strconv.Atoi(getEnvWithDefault("SNAPSHOT_KEEP", "10"))
+	if err != nil || snapshotKeep < 1 {
+		return nil, fmt.Errorf("invalid SNAPSHOT_KEEP: must be a positive integer")
+	}
+	config.SnapshotKeep = snapshotKeep
+
+	sheetsReads, err := strconv.Atoi(getEnvWithDefault("SHEETS_READS_PER_MINUTE", "60"))
+	if err != nil || sheetsReads < 1 {
+		return nil, fmt.Errorf("invalid SHEETS_READS_PER_MINUTE: must be a positive integer")
+	}
+	config.SheetsReadsPerMin = sheetsReads
+
+	sheetsWrites, err := strconv.Atoi(getEnvWithDefault("SHEETS_WRITES_PER_MINUTE", "60"))
+	if err != nil || sheetsWrites < 1 {
+		return nil, fmt.Errorf("invalid SHEETS_WRITES_PER_MINUTE: must be a positive integer")
+	}
+	config.SheetsWritesPerMin = sheetsWrites
+
 	// Load encryption key for token encryption
 	encryptionKey := os.Getenv("ENCRYPTION_KEY")
 	if encryptionKey == "" {
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"context"
 	utils2 "directoryCommunityWebsite/internal/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
-
-	"golang.org/x/oauth2"
 )
 
 func (app *App) handleCorrection(w http.ResponseWriter, r *http.Request) {
@@ -32,9 +30,9 @@ func (app *App) handleCorrection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if correction.Column > 49 {
+	if correction.Column >= MaxRowColumns {
 		log.Printf("Column exceeds limit: %d", correction.Column)
-		utils2.ValidationError(w, "Column exceeds maximum allowed (50)")
+		utils2.ValidationError(w, fmt.Sprintf("Column exceeds maximum allowed (%d)", MaxRowColumns))
 		return
 	}
 
@@ -56,18 +54,52 @@ func (app *App) handleCorrection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get actual row ID from the row index
-	actualRowID, err := app.getRowIDFromIndex(directoryID, correction.Row)
+	repo, err := app.rowRepository(directoryID)
 	if err != nil {
-		log.Printf("Failed to get row ID from index %d: %v", correction.Row, err)
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	row, err := repo.AtIndex(correction.Row)
+	if err != nil {
+		log.Printf("Failed to get row %d of directory %s: %v", correction.Row, directoryID, err)
 		utils2.NotFoundError(w, "Row")
 		return
 	}
 
+	columns := repo.Columns()
+	if correction.Column >= len(columns) {
+		log.Printf("Column %d is past the %d columns of directory %s", correction.Column, len(columns), directoryID)
+		utils2.ValidationError(w, "Invalid row or column")
+		return
+	}
+
+	// The value is written back as submitted and stored as the column's normalisers make it
+	var invalid *invalidValueError
+	if err := app.validateSubmittedValues(directoryID, correction.Column, []string{correction.Value}); errors.As(err, &invalid) {
+		utils2.ValidationError(w, invalid.Error())
+		return
+	} else if err != nil {
+		log.Printf("Failed to check correction for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to apply column normalisers")
+		return
+	}
+
+	// Refuse what the sheet wouldn't accept: computed or protected cells, and values its
+	// validation rules reject. The sync worker checks again against the sheet itself.
+	rules, err := app.getCellRules(directoryID, row.SheetRow)
+	if err != nil {
+		log.Printf("Failed to get cell rules for row %d of directory %s: %v", correction.Row, directoryID, err)
+	} else if err := rules.checkWrite(row.SheetRow, correction.Column, correction.Value); err != nil {
+		utils2.ValidationError(w, "The sheet doesn't accept this correction: "+err.Error())
+		return
+	}
+
 	if userType == UserTypeModerator {
 		// Check if moderator can access this row
 		filter := NewModerationFilter(app)
-		canAccess, err := filter.CanAccessRow(userEmail, directoryID, actualRowID)
+		canAccess, err := filter.CanAccessRow(userEmail, directoryID, int(row.ID))
 		if err != nil {
 			log.Printf("Failed to check row access: %v", err)
 			utils2.InternalServerError(w, "Permission check failed")
@@ -93,7 +125,7 @@ func (app *App) handleCorrection(w http.ResponseWriter, r *http.Request) {
 
 		if permissions.RequiresApproval {
 			// Create pending change instead of direct update
-			err = app.createPendingChange(directoryID, actualRowID, correction.Column, correction.Value, ChangeTypeEdit, userEmail)
+			err = app.createPendingChange(directoryID, int(row.ID), correction.Column, correction.Value, ChangeTypeEdit, userEmail)
 			if err != nil {
 				log.Printf("Failed to create pending change: %v", err)
 				utils2.InternalServerError(w, "Failed to submit change for approval")
@@ -108,35 +140,11 @@ func (app *App) handleCorrection(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// For owners/admins or moderators without approval requirement, apply directly
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
-	if err != nil {
-		log.Printf("Failed to get directory database for %s: %v", directoryID, err)
-		utils2.NotFoundError(w, "Directory")
-		return
-	}
+	rowData := row.Cells(columns)
 
-	// Get the current data for the specified row
-	var currentData string
-	err = db.QueryRow("SELECT data FROM directory ORDER BY id LIMIT 1 OFFSET ?", correction.Row).Scan(&currentData)
-	if err != nil {
-		log.Printf("Failed to get row %d: %v", correction.Row, err)
-		utils2.NotFoundError(w, "Row")
-		return
-	}
-
-	// Parse the current row data
-	var rowData []string
-	if err := json.Unmarshal([]byte(currentData), &rowData); err != nil {
-		log.Printf("Failed to unmarshal row data: %v", err)
-		utils2.InternalServerError(w, "Failed to parse row data")
-		return
-	}
-
-	// Extend the row data if necessary
-	for len(rowData) <= correction.Column {
-		rowData = append(rowData, "")
-	}
+	// Remember the source value the correction was made against so the write-back can detect
+	// edits made in the sheet since
+	baseValue := row.SourceValue(columns[correction.Column].Name)
 
 	// Update the specific column
 	rowData[correction.Column] = correction.Value
@@ -148,89 +156,27 @@ func (app *App) handleCorrection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try to update the original Google Sheet if we have the information
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	go func() {
-		defer cancel()
-		app.updateOriginalSheet(ctx, correction.Row, correction.Column, correction.Value, directoryID)
-	}()
-
-	utils2.RespondWithSuccess(w, nil, "Correction applied successfully")
-}
-
-func (app *App) updateOriginalSheet(ctx context.Context, row, col int, value string, directoryID string) {
-	// Get the latest admin session with a sheet URL
-	var userEmail, encryptedTokenJSON, sheetURL string
-	err := app.DB.QueryRow(`
-		SELECT user_email, token, sheet_url 
-		FROM admin_sessions 
-		WHERE sheet_url IS NOT NULL AND sheet_url != ''
-		ORDER BY created_at DESC 
-		LIMIT 1
-	`).Scan(&userEmail, &encryptedTokenJSON, &sheetURL)
-
-	select {
-	case <-ctx.Done():
-		fmt.Printf("Context cancelled while updating sheet: %v\n", ctx.Err())
-		return
-	default:
-	}
-
-	if err != nil {
-		fmt.Printf("No admin session found for sheet update: %v\n", err)
-		return
-	}
-
-	spreadsheetID, err := extractSpreadsheetID(sheetURL)
-	if err != nil {
-		fmt.Printf("Failed to extract spreadsheet ID: %v\n", err)
+	// Queue the write to the original sheet; the sync worker applies it and re-imports. The row
+	// is pinned by its source key so the write lands on it even if rows move in the sheet.
+	jobID, err := app.enqueueSyncJob(directoryID, SyncJobUpdateCell, SyncJobPayload{
+		Row:       correction.Row,
+		RowID:     int(row.ID),
+		RowKey:    row.Key,
+		Column:    correction.Column,
+		Value:     correction.Value,
+		BaseValue: &baseValue,
+	}, userEmail)
+	if errors.Is(err, errSourceReadOnly) {
+		utils2.ValidationError(w, err.Error())
 		return
 	}
-
-	// Decrypt the token
-	tokenJSON, err := app.EncryptionService.Decrypt(encryptedTokenJSON)
 	if err != nil {
-		fmt.Printf("Failed to decrypt token: %v\n", err)
+		log.Printf("Failed to queue correction for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to queue correction")
 		return
 	}
 
-	var token oauth2.Token
-	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
-		fmt.Printf("Failed to unmarshal token: %v\n", err)
-		return
-	}
-
-	// Update the sheet cell
-	if err := app.updateSheetCell(spreadsheetID, row, col, value, &token); err != nil {
-		fmt.Printf("Failed to update sheet cell: %v\n", err)
-		return
-	}
-
-	fmt.Printf("Successfully updated sheet cell at row %d, column %d with value: %s\n", row, col, value)
-
-	// Re-import the sheet to refresh our database
-	if err := app.reimportSheet(ctx, spreadsheetID, &token, directoryID); err != nil {
-		fmt.Printf("Failed to re-import sheet after update: %v\n", err)
-	} else {
-		fmt.Println("Successfully re-imported sheet data")
-	}
-}
-
-// getRowIDFromIndex converts a row index to the actual database row ID
-func (app *App) getRowIDFromIndex(directoryID string, rowIndex int) (int, error) {
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get directory database: %v", err)
-	}
-
-	var rowID int
-	err = db.QueryRow("SELECT id FROM directory ORDER BY id LIMIT 1 OFFSET ?", rowIndex).Scan(&rowID)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get row ID: %v", err)
-	}
-
-	return rowID, nil
+	utils2.RespondWithSuccess(w, map[string]interface{}{"sync_job_id": jobID}, "Correction applied successfully")
 }
 
 // createPendingChange creates a new pending change record
@@ -280,57 +226,29 @@ func (app *App) createPendingChange(directoryID string, rowID, columnIndex int,
 
 // getCurrentColumnSchema gets the current column names for a directory
 func (app *App) getCurrentColumnSchema(directoryID string) ([]string, error) {
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	repo, err := app.rowRepository(directoryID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get directory database: %v", err)
+		return nil, err
 	}
-
-	rows, err := db.Query(`
-		SELECT columnName 
-		FROM _meta_directory_column_types 
-		WHERE columnTable = ? 
-		ORDER BY rowid
-	`, directoryID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query column names: %v", err)
-	}
-	defer rows.Close()
-
-	var columnNames []string
-	for rows.Next() {
-		var columnName string
-		if err := rows.Scan(&columnName); err != nil {
-			return nil, fmt.Errorf("failed to scan column name: %v", err)
-		}
-		columnNames = append(columnNames, columnName)
-	}
-
-	return columnNames, nil
+	return repo.ColumnNames(), nil
 }
 
 // getColumnValue gets the current value of a specific column in a row
 func (app *App) getColumnValue(directoryID string, rowID, columnIndex int) (string, error) {
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	repo, err := app.rowRepository(directoryID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get directory database: %v", err)
+		return "", err
 	}
 
-	var dataJSON string
-	err = db.QueryRow("SELECT data FROM directory WHERE id = ?", rowID).Scan(&dataJSON)
+	row, err := repo.Get(int64(rowID))
 	if err != nil {
 		return "", fmt.Errorf("failed to get row data: %v", err)
 	}
 
-	var rowData []string
-	if err := json.Unmarshal([]byte(dataJSON), &rowData); err != nil {
-		return "", fmt.Errorf("failed to parse row data: %v", err)
-	}
-
-	if columnIndex >= len(rowData) {
-		return "", nil // Column doesn't exist yet
+	columns := repo.Columns()
+	if columnIndex >= len(columns) {
+		return "", nil // Column doesn't exist
 	}
 
-	return rowData[columnIndex], nil
+	return row.Values[columns[columnIndex].Name], nil
 }
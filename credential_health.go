@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Credential health state constants
+const (
+	CredentialHealthy  = "healthy"  // sync works with the preferred credential
+	CredentialDegraded = "degraded" // sync works, but only by falling back to another owner
+	CredentialExpiring = "expiring" // sync works until the token expires, as it can't be refreshed
+	CredentialBroken   = "broken"   // sync can't reach the source; write-back is paused
+)
+
+const credentialCheckTimeout = time.Minute
+
+// credentialErrorMarkers identify errors caused by credentials rather than by the network or
+// the source, in the text of errors from the OAuth and Sheets clients. Other 403s, such as
+// a write to a protected range, are failures of the job that made them.
+var credentialErrorMarkers = []string{
+	"invalid_grant",
+	"invalid_client",
+	"unauthorized_client",
+	"no refresh token available",
+	"Token has been expired or revoked",
+	"Error 401",
+	"The caller does not have permission", // the sheet is not shared with the credential
+	"insufficient authentication scopes",
+}
+
+// CredentialHealth is the last known state of the credential a directory's sheet is synced with
+type CredentialHealth struct {
+	DirectoryID  string     `json:"directory_id"`
+	State        string     `json:"state"`
+	Credential   string     `json:"credential,omitempty"` // service account or owner sync runs as
+	Message      string     `json:"message,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	CheckedAt    time.Time  `json:"checked_at"`
+}
+
+// isCredentialError reports whether an error means the credentials were refused, revoked or
+// can't reach the sheet, as opposed to a failure that is likely to pass on its own
+func isCredentialError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errNoSheetCredentials) {
+		return true
+	}
+
+	message := err.Error()
+	if strings.Contains(strings.ToLower(message), "ratelimitexceeded") {
+		return false
+	}
+	for _, marker := range credentialErrorMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialMonitor periodically checks the sync credential of every directory bound to a
+// Google Sheet and pauses write-back for the ones that are broken
+type CredentialMonitor struct {
+	app      *App
+	interval time.Duration
+	wake     chan struct{}
+}
+
+// NewCredentialMonitor creates a monitor that checks every directory each interval
+func NewCredentialMonitor(app *App, interval time.Duration) *CredentialMonitor {
+	return &CredentialMonitor{
+		app:      app,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Start checks every directory now and then each interval. Between checks, Notify rechecks
+// the directories that are not healthy.
+func (cm *CredentialMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(cm.interval)
+		defer ticker.Stop()
+		cm.checkAll(false)
+		for {
+			select {
+			case <-ticker.C:
+				cm.checkAll(false)
+			case <-cm.wake:
+				cm.checkAll(true)
+			}
+		}
+	}()
+}
+
+// Notify asks the monitor to recheck unhealthy directories, e.g. after an owner signed in again
+func (cm *CredentialMonitor) Notify() {
+	select {
+	case cm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// recheckCredentials rechecks the directories whose credential is not healthy, in the
+// background, after credentials changed
+func (app *App) recheckCredentials() {
+	if app.CredentialMonitor != nil {
+		app.CredentialMonitor.Notify()
+		return
+	}
+	go NewCredentialMonitor(app, 0).checkAll(true)
+}
+
+// checkAll checks each directory bound to a Google Sheet in turn, or only those whose last
+// check found a problem
+func (cm *CredentialMonitor) checkAll(unhealthyOnly bool) {
+	query := "SELECT directory_id FROM directory_sources WHERE source_type = ?"
+	args := []interface{}{SourceTypeGoogleSheet}
+	if unhealthyOnly {
+		query += " AND directory_id IN (SELECT directory_id FROM credential_health WHERE state != ?)"
+		args = append(args, CredentialHealthy)
+	}
+
+	rows, err := cm.app.DB.Query(query+" ORDER BY directory_id", args...)
+	if err != nil {
+		log.Printf("Failed to list directories for credential check: %v", err)
+		return
+	}
+
+	var directoryIDs []string
+	for rows.Next() {
+		var directoryID string
+		if err := rows.Scan(&directoryID); err != nil {
+			log.Printf("Failed to scan directory for credential check: %v", err)
+			continue
+		}
+		directoryIDs = append(directoryIDs, directoryID)
+	}
+	rows.Close()
+
+	for _, directoryID := range directoryIDs {
+		ctx, cancel := context.WithTimeout(context.Background(), credentialCheckTimeout)
+		_, err := cm.app.CheckDirectoryCredential(ctx, directoryID)
+		cancel()
+		if err != nil {
+			log.Printf("Credential check of directory %s failed: %v", directoryID, err)
+		}
+	}
+}
+
+// CheckDirectoryCredential resolves the credential a directory's sheet is synced with, makes
+// sure it can open the sheet and records the outcome. It returns nil if the directory isn't
+// bound to a Google Sheet, and an error without recording anything if the check itself
+// failed for a reason unrelated to credentials.
+func (app *App) CheckDirectoryCredential(ctx context.Context, directoryID string) (*CredentialHealth, error) {
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		return nil, err
+	}
+	if binding == nil || binding.SourceType != SourceTypeGoogleSheet {
+		return nil, nil
+	}
+
+	health := &CredentialHealth{DirectoryID: directoryID, State: CredentialHealthy}
+
+	credential, err := app.resolveSheetCredential(ctx, binding)
+	if err == nil {
+		health.Credential = credential.identity
+		var source DataSource
+		source, err = app.newSheetSource(ctx, binding, credential.tokenSource)
+		if err == nil {
+			_, err = source.Title(ctx)
+		}
+		if err != nil && isCredentialError(err) && credential.token == nil {
+			err = fmt.Errorf("service account %s can't open the sheet; share it with that address: %v", credential.identity, err)
+		}
+	}
+
+	switch {
+	case err != nil && !isCredentialError(err):
+		return nil, err
+
+	case err != nil:
+		health.State = CredentialBroken
+		health.Message = err.Error()
+
+	case credential.token != nil && credential.token.RefreshToken == "":
+		health.State = CredentialExpiring
+		health.Message = fmt.Sprintf("the Google credentials of %s can't be refreshed; they must sign in again", credential.identity)
+		if !credential.token.Expiry.IsZero() {
+			expiry := credential.token.Expiry
+			health.ExpiresAt = &expiry
+		}
+
+	case len(credential.skipped) > 0:
+		health.State = CredentialDegraded
+		health.Message = fmt.Sprintf("syncing as %s because the preferred credentials failed: %s",
+			credential.identity, strings.Join(credential.skipped, "; "))
+	}
+
+	if err := app.saveCredentialHealth(health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// recordCredentialFailure marks a directory's credential broken after a sync operation was
+// refused, which pauses its write-back until a check finds it working again
+func (app *App) recordCredentialFailure(directoryID string, cause error) {
+	previous, err := app.GetCredentialHealth(directoryID)
+	if err != nil {
+		log.Printf("Failed to get credential health of directory %s: %v", directoryID, err)
+	}
+
+	health := &CredentialHealth{DirectoryID: directoryID, State: CredentialBroken, Message: cause.Error()}
+	if previous != nil {
+		health.Credential = previous.Credential
+	}
+	if err := app.saveCredentialHealth(health); err != nil {
+		log.Printf("Failed to record credential failure of directory %s: %v", directoryID, err)
+	}
+}
+
+// saveCredentialHealth records the outcome of a credential check. A directory keeps the time
+// it started failing until it is healthy again, and its write-back resumes when a broken
+// credential starts working.
+func (app *App) saveCredentialHealth(health *CredentialHealth) error {
+	previous, err := app.GetCredentialHealth(health.DirectoryID)
+	if err != nil {
+		return err
+	}
+
+	health.CheckedAt = time.Now().UTC()
+	if health.State == CredentialBroken {
+		failingSince := health.CheckedAt
+		if previous != nil && previous.FailingSince != nil {
+			failingSince = *previous.FailingSince
+		}
+		health.FailingSince = &failingSince
+	}
+
+	_, err = app.DB.Exec(`
+		INSERT OR REPLACE INTO credential_health
+		(directory_id, state, credential, message, expires_at, failing_since, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, health.DirectoryID, health.State, health.Credential, health.Message, health.ExpiresAt,
+		health.FailingSince, health.CheckedAt)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConstraint, "failed to save credential health", err)
+	}
+
+	wasBroken := previous != nil && previous.State == CredentialBroken
+	switch {
+	case health.State == CredentialBroken && !wasBroken:
+		log.Printf("Pausing write-back of directory %s, its sync credential is broken: %s", health.DirectoryID, health.Message)
+	case health.State != CredentialBroken && wasBroken:
+		log.Printf("Resuming write-back of directory %s, its sync credential works again as %s", health.DirectoryID, health.Credential)
+		if app.SyncWorker != nil {
+			app.SyncWorker.Notify()
+		}
+	}
+	return nil
+}
+
+// GetCredentialHealth returns the last recorded credential state of a directory, or nil if
+// it has never been checked
+func (app *App) GetCredentialHealth(directoryID string) (*CredentialHealth, error) {
+	var health CredentialHealth
+	var expiresAt, failingSince sql.NullTime
+	err := app.DB.QueryRow(`
+		SELECT directory_id, state, COALESCE(credential, ''), COALESCE(message, ''), expires_at, failing_since, checked_at
+		FROM credential_health WHERE directory_id = ?
+	`, directoryID).Scan(&health.DirectoryID, &health.State, &health.Credential, &health.Message,
+		&expiresAt, &failingSince, &health.CheckedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query credential health", err)
+	}
+
+	if expiresAt.Valid {
+		health.ExpiresAt = &expiresAt.Time
+	}
+	if failingSince.Valid {
+		health.FailingSince = &failingSince.Time
+	}
+	return &health, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Source type constants
+const (
+	SourceTypeGoogleSheet = "google_sheet"
+	SourceTypeFile        = "file"
+)
+
+// DataSource is the spreadsheet-like store a directory is imported from and
+// written back to. Row numbers are 1-based and absolute, so the header is
+// row 1 and the first data row is row 2, matching the sheet's own numbering.
+type DataSource interface {
+	// Type returns one of the SourceType constants
+	Type() string
+	// Title returns a human readable name for the source (sheet title or file name)
+	Title(ctx context.Context) (string, error)
+	// ReadAll returns every row of the source, header row first
+	ReadAll(ctx context.Context) ([][]string, error)
+	// UpdateCell overwrites a single cell
+	UpdateCell(ctx context.Context, rowNumber, col int, value string) error
+	// UpdateColumn overwrites the cells of one column, starting at firstRow and moving down
+	UpdateColumn(ctx context.Context, col, firstRow int, values []string) error
+	// AppendRow adds a row after the last data row
+	AppendRow(ctx context.Context, values []string) error
+	// DeleteRow removes a row and shifts the rows below it up
+	DeleteRow(ctx context.Context, rowNumber int) error
+	// ApplyBatch applies writes in order, in a single call where the source supports it
+	ApplyBatch(ctx context.Context, writes []SourceWrite) error
+}
+
+// sourceReadChunkRows is how many rows are read from a source per request during an import
+const sourceReadChunkRows = 10000
+
+// chunkReader is implemented by sources that can be read a chunk of rows at a time, so a
+// large source is read in bounded requests rather than one response holding every row
+type chunkReader interface {
+	// ReadChunks calls fn with consecutive rows of the source, header row first, at most
+	// chunkRows at a time. Together the chunks hold the same rows ReadAll returns.
+	ReadChunks(ctx context.Context, chunkRows int, fn func(rows [][]string) error) error
+}
+
+// readSource reads every row of a source, a chunk at a time where the source supports it,
+// recording the data rows read so far
+func readSource(ctx context.Context, source DataSource, progress *importProgress) ([][]string, error) {
+	reader, ok := source.(chunkReader)
+	if !ok {
+		values, err := source.ReadAll(ctx)
+		if err == nil && len(values) > 0 {
+			progress.setRowsRead(len(values) - 1)
+		}
+		return values, err
+	}
+
+	var values [][]string
+	err := reader.ReadChunks(ctx, sourceReadChunkRows, func(rows [][]string) error {
+		values = append(values, rows...)
+		if len(values) > 0 {
+			progress.setRowsRead(len(values) - 1)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// DirectorySource is a directory's binding to the source it is imported from and written
+// back to. For Google Sheets it also names the tab and range that are read, any more tabs
+// combined with it, and the user whose OAuth credentials are used for sync when the
+// directory has no service account.
+type DirectorySource struct {
+	DirectoryID   string       `json:"directory_id"`
+	SourceType    string       `json:"source_type"`
+	Location      string       `json:"location"` // sheet URL or file path
+	SpreadsheetID string       `json:"spreadsheet_id,omitempty"`
+	SheetTab      string       `json:"sheet_tab,omitempty"`   // empty means the first tab
+	ExtraTabs     []string     `json:"extra_tabs,omitempty"`  // tabs combined with SheetTab; see MultiTabSource
+	SheetRange    string       `json:"sheet_range,omitempty"` // empty means the configured SHEET_RANGE
+	Header        HeaderLayout `json:"header"`                // where the header and data rows are, in each tab
+	SyncUserEmail string       `json:"sync_user_email,omitempty"`
+	ManageRowKeys bool         `json:"manage_row_keys"` // keep a hidden row key column in the source
+	ReadOnly      bool         `json:"read_only"`       // the source is only read; edits on the site are refused
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+// getDirectorySource returns the recorded source for a directory, or nil if none has been recorded
+func (app *App) getDirectorySource(directoryID string) (*DirectorySource, error) {
+	var source DirectorySource
+	var extraTabs, headerLayout string
+	err := app.DB.QueryRow(`
+		SELECT directory_id, source_type, location, COALESCE(spreadsheet_id, ''), COALESCE(sheet_tab, ''),
+		       COALESCE(extra_tabs, ''), COALESCE(sheet_range, ''), COALESCE(header_layout, ''),
+		       COALESCE(sync_user_email, ''), COALESCE(manage_row_keys, 0), COALESCE(read_only, 0), updated_at
+		FROM directory_sources WHERE directory_id = ?
+	`, directoryID).Scan(&source.DirectoryID, &source.SourceType, &source.Location, &source.SpreadsheetID,
+		&source.SheetTab, &extraTabs, &source.SheetRange, &headerLayout, &source.SyncUserEmail, &source.ManageRowKeys,
+		&source.ReadOnly, &source.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query directory source", err)
+	}
+
+	if extraTabs != "" {
+		if err := json.Unmarshal([]byte(extraTabs), &source.ExtraTabs); err != nil {
+			return nil, fmt.Errorf("failed to parse extra tabs of directory %s: %v", directoryID, err)
+		}
+	}
+
+	if headerLayout != "" {
+		if err := json.Unmarshal([]byte(headerLayout), &source.Header); err != nil {
+			return nil, fmt.Errorf("failed to parse header layout of directory %s: %v", directoryID, err)
+		}
+	}
+
+	// Bindings recorded before spreadsheet IDs were stored only have the URL
+	if source.SourceType == SourceTypeGoogleSheet && source.SpreadsheetID == "" {
+		if spreadsheetID, err := extractSpreadsheetID(source.Location); err == nil {
+			source.SpreadsheetID = spreadsheetID
+		}
+	}
+
+	return &source, nil
+}
+
+// saveDirectorySource records the source a directory is bound to
+func (app *App) saveDirectorySource(source *DirectorySource) error {
+	var extraTabs string
+	if len(source.ExtraTabs) > 0 {
+		tabsJSON, err := json.Marshal(source.ExtraTabs)
+		if err != nil {
+			return fmt.Errorf("failed to marshal extra tabs: %v", err)
+		}
+		extraTabs = string(tabsJSON)
+	}
+
+	var headerLayout string
+	if !source.Header.isDefault() {
+		layoutJSON, err := json.Marshal(source.Header)
+		if err != nil {
+			return fmt.Errorf("failed to marshal header layout: %v", err)
+		}
+		headerLayout = string(layoutJSON)
+	}
+
+	_, err := app.DB.Exec(`
+		INSERT OR REPLACE INTO directory_sources
+		(directory_id, source_type, location, spreadsheet_id, sheet_tab, extra_tabs, sheet_range, header_layout,
+		 sync_user_email, manage_row_keys, read_only, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, source.DirectoryID, source.SourceType, source.Location, source.SpreadsheetID,
+		source.SheetTab, extraTabs, source.SheetRange, headerLayout, source.SyncUserEmail, source.ManageRowKeys,
+		source.ReadOnly, time.Now())
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConstraint, "failed to save directory source", err)
+	}
+	return nil
+}
+
+// legacyDirectorySource builds a binding for a directory imported before bindings were
+// recorded, from the admin session that imported it. Only sessions tagged with this
+// directory are considered, so another directory's sheet is never picked up.
+func (app *App) legacyDirectorySource(directoryID string) (*DirectorySource, error) {
+	var userEmail, sheetURL string
+	err := app.DB.QueryRow(`
+		SELECT user_email, sheet_url
+		FROM admin_sessions
+		WHERE directory_id = ? AND sheet_url IS NOT NULL AND sheet_url != ''
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, directoryID).Scan(&userEmail, &sheetURL)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("directory %s is not bound to a source; re-link it from the owner page", directoryID)
+	}
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query admin sessions", err)
+	}
+
+	spreadsheetID, err := extractSpreadsheetID(sheetURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract spreadsheet ID: %v", err)
+	}
+
+	source := &DirectorySource{
+		DirectoryID:   directoryID,
+		SourceType:    SourceTypeGoogleSheet,
+		Location:      sheetURL,
+		SpreadsheetID: spreadsheetID,
+		SyncUserEmail: userEmail,
+	}
+	if err := app.saveDirectorySource(source); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+// validateSheetTabs checks the tab of a sheet binding and the tabs combined with it, which
+// must be named along with the first tab
+func validateSheetTabs(binding *DirectorySource) error {
+	if !ValidateSheetTab(binding.SheetTab) {
+		return fmt.Errorf("invalid sheet tab name")
+	}
+	if len(binding.ExtraTabs) == 0 {
+		return nil
+	}
+	if binding.SheetTab == "" {
+		return fmt.Errorf("name the first tab to combine other tabs with it")
+	}
+
+	seen := map[string]bool{binding.SheetTab: true}
+	for _, tab := range binding.ExtraTabs {
+		if tab == "" || !ValidateSheetTab(tab) {
+			return fmt.Errorf("invalid sheet tab name: %q", tab)
+		}
+		if seen[tab] {
+			return fmt.Errorf("tab %q is listed more than once", tab)
+		}
+		seen[tab] = true
+	}
+	return nil
+}
+
+// cleanTabList trims a list of tab names and drops the empty ones
+func cleanTabList(tabs []string) []string {
+	var cleaned []string
+	for _, tab := range tabs {
+		if tab = strings.TrimSpace(tab); tab != "" {
+			cleaned = append(cleaned, tab)
+		}
+	}
+	return cleaned
+}
+
+// resolveWriteBackSource opens the data source that edits to a directory should be written back to
+func (app *App) resolveWriteBackSource(ctx context.Context, directoryID string) (DataSource, error) {
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	if binding == nil {
+		binding, err = app.legacyDirectorySource(directoryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return app.openDirectorySource(ctx, binding)
+}
+
+// openDirectorySource opens the data source described by a binding, laid out by its header
+// layout. Sheets are opened with the credentials picked by sheetTokenSource.
+func (app *App) openDirectorySource(ctx context.Context, binding *DirectorySource) (DataSource, error) {
+	switch binding.SourceType {
+	case SourceTypeFile:
+		source, err := app.newFileSource(binding.DirectoryID, binding.Location)
+		if err != nil {
+			return nil, err
+		}
+		return binding.Header.wrap(source), nil
+
+	case SourceTypeGoogleSheet:
+		tokenSource, _, err := app.sheetTokenSource(ctx, binding)
+		if err != nil {
+			return nil, err
+		}
+
+		return app.newSheetSource(ctx, binding, tokenSource)
+
+	default:
+		return nil, fmt.Errorf("unknown source type %q", binding.SourceType)
+	}
+}
+
+// getUserToken returns a user's stored OAuth token, refreshed if it has expired
+func (app *App) getUserToken(userEmail string) (*oauth2.Token, error) {
+	token, err := app.getDecryptedToken(userEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshedToken, err := app.refreshTokenIfNeeded(userEmail, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token for %s: %v", userEmail, err)
+	}
+
+	return refreshedToken, nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UpdateSourceBindingRequest changes the tabs, range, header layout or sync user of a directory's
+// sheet binding. The binding's tabs and range are replaced; an empty sync_user_email keeps the
+// current sync user, and an omitted header or manage_row_keys keeps the current setting.
+type UpdateSourceBindingRequest struct {
+	SheetTab      string        `json:"sheet_tab"`
+	ExtraTabs     []string      `json:"extra_tabs"`
+	SheetRange    string        `json:"sheet_range"`
+	Header        *HeaderLayout `json:"header"`
+	SyncUserEmail string        `json:"sync_user_email"`
+	ManageRowKeys *bool         `json:"manage_row_keys"`
+}
+
+// RelinkSourceRequest points a directory at a different sheet or file. An omitted header or
+// read_only keeps the directory's current setting.
+type RelinkSourceRequest struct {
+	SourceType string        `json:"source_type"`
+	SheetURL   string        `json:"sheet_url"`
+	FilePath   string        `json:"file_path"`
+	SheetTab   string        `json:"sheet_tab"`
+	ExtraTabs  []string      `json:"extra_tabs"`
+	SheetRange string        `json:"sheet_range"`
+	Header     *HeaderLayout `json:"header"`
+	ReadOnly   *bool         `json:"read_only"`
+}
+
+// handleGetDirectorySource returns the directory's current source binding
+func (app *App) handleGetDirectorySource(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		log.Printf("Failed to get source for directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	if binding == nil {
+		utils2.NotFoundError(w, "Directory source")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, binding, "")
+}
+
+// handleUpdateDirectorySource changes the tabs, range or sync user of a sheet binding
+func (app *App) handleUpdateDirectorySource(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req UpdateSourceBindingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode update source request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		log.Printf("Failed to get source for directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	if binding == nil || binding.SourceType != SourceTypeGoogleSheet {
+		utils2.ValidationError(w, "Directory is not bound to a Google Sheet")
+		return
+	}
+
+	binding.SheetTab = strings.TrimSpace(req.SheetTab)
+	binding.ExtraTabs = cleanTabList(req.ExtraTabs)
+	binding.SheetRange = strings.ToUpper(strings.TrimSpace(req.SheetRange))
+
+	if err := validateSheetTabs(binding); err != nil {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	if binding.SheetRange != "" && !ValidateSheetRange(binding.SheetRange) {
+		utils2.ValidationError(w, "Invalid sheet range: use columns such as A:Z, or A: for every column")
+		return
+	}
+
+	if syncUser := strings.TrimSpace(req.SyncUserEmail); syncUser != "" && syncUser != binding.SyncUserEmail {
+		if err := app.validateSyncUser(directoryID, syncUser); err != nil {
+			log.Printf("Rejected sync user %s for directory %s: %v", syncUser, directoryID, err)
+			utils2.ValidationError(w, err.Error())
+			return
+		}
+		binding.SyncUserEmail = syncUser
+	}
+
+	if req.Header != nil {
+		if err := req.Header.validate(); err != nil {
+			utils2.ValidationError(w, err.Error())
+			return
+		}
+		binding.Header = *req.Header
+	}
+
+	if req.ManageRowKeys != nil {
+		binding.ManageRowKeys = *req.ManageRowKeys
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	source, err := app.openDirectorySource(ctx, binding)
+	if err != nil {
+		log.Printf("Failed to open source for directory %s: %v", directoryID, err)
+		utils2.ValidationError(w, fmt.Sprintf("Failed to open sheet: %v", err))
+		return
+	}
+
+	result, err := app.rebindDirectory(ctx, binding, source)
+	if err != nil {
+		log.Printf("Failed to update source of directory %s: %v", directoryID, err)
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	utils2.RespondWithSuccess(w, result, "Directory source updated")
+}
+
+// handleRelinkDirectorySource points a directory at a different sheet or file, using the
+// caller's credentials. The new source must have the same header as the directory.
+func (app *App) handleRelinkDirectorySource(w http.ResponseWriter, r *http.Request) {
+	userEmail, ok := utils2.RequireAuthentication(w, r)
+	if !ok {
+		return
+	}
+
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req RelinkSourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode relink source request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	binding := requestedSource(req.SourceType, SanitizeInput(req.SheetURL), req.FilePath, req.SheetTab, req.ExtraTabs,
+		req.SheetRange)
+	binding.DirectoryID = directoryID
+
+	// The new source keeps the directory's row key setting, and its header layout and
+	// read-only setting unless they are given
+	current, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		log.Printf("Failed to get source for directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+	if current != nil {
+		binding.ManageRowKeys = current.ManageRowKeys
+		binding.Header = current.Header
+		binding.ReadOnly = current.ReadOnly
+	}
+	if req.Header != nil {
+		binding.Header = *req.Header
+	}
+	if req.ReadOnly != nil {
+		binding.ReadOnly = *req.ReadOnly
+	}
+
+	source, ok := app.openRequestedSource(ctx, w, userEmail, binding)
+	if !ok {
+		return
+	}
+
+	result, err := app.rebindDirectory(ctx, binding, source)
+	if err != nil {
+		log.Printf("Failed to relink directory %s to %s: %v", directoryID, binding.Location, err)
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	if binding.SourceType == SourceTypeGoogleSheet {
+		_, err = app.DB.Exec("UPDATE admin_sessions SET sheet_url = ?, directory_id = ? WHERE user_email = ?", binding.Location, directoryID, userEmail)
+		if err != nil {
+			log.Printf("Failed to save sheet URL for user %s: %v", userEmail, err)
+		}
+	}
+
+	utils2.RespondWithSuccess(w, result, "Directory re-linked")
+}
+
+// validateSyncUser checks that a user may act as a directory's sync identity
+func (app *App) validateSyncUser(directoryID, userEmail string) error {
+	isOwner, err := app.IsDirectoryOwner(directoryID, userEmail)
+	if err != nil {
+		return err
+	}
+
+	if !isOwner {
+		isAdmin, err := app.IsAdmin(userEmail)
+		if err != nil {
+			return err
+		}
+		if !isAdmin {
+			return fmt.Errorf("%s is not an owner of this directory", userEmail)
+		}
+	}
+
+	if _, err := app.getDecryptedToken(userEmail); err != nil {
+		return fmt.Errorf("%s has no stored Google credentials; they need to sign in first", userEmail)
+	}
+
+	return nil
+}
+
+// rebindDirectory re-imports the directory from a new source and, if that succeeds, saves
+// the binding. Queued writes must be flushed or discarded first, since they were computed
+// against the old source.
+func (app *App) rebindDirectory(ctx context.Context, binding *DirectorySource, source DataSource) (*ImportResult, error) {
+	unlock := lockDirectorySync(binding.DirectoryID)
+	defer unlock()
+
+	outstanding, err := app.countOutstandingSyncJobs(binding.DirectoryID)
+	if err != nil {
+		return nil, err
+	}
+	if outstanding > 0 {
+		return nil, fmt.Errorf("%d sheet writes are still queued; retry or discard them before changing the source", outstanding)
+	}
+
+	columnNames, columnTypes, err := app.getDirectoryColumnConfig(binding.DirectoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := app.importDirectory(ctx, source, binding.DirectoryID, columnNames, columnTypes, binding.ManageRowKeys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := app.saveDirectorySource(binding); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// handleGetServiceAccount returns the service account the directory's sheet is synced with,
+// without its key
+func (app *App) handleGetServiceAccount(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	sa, err := app.getServiceAccount(directoryID)
+	if err != nil {
+		log.Printf("Failed to get service account for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to get service account")
+		return
+	}
+
+	if sa == nil {
+		utils2.NotFoundError(w, "Service account")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, sa, "")
+}
+
+// handleSetServiceAccount stores a service account key for the directory. If the directory
+// is bound to a sheet, the key is only accepted once the service account can open it.
+func (app *App) handleSetServiceAccount(w http.ResponseWriter, r *http.Request) {
+	userEmail, ok := utils2.RequireAuthentication(w, r)
+	if !ok {
+		return
+	}
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req SetServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode service account request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	// The key file may be sent as an object or as a string holding it
+	key := []byte(req.Credentials)
+	var keyText string
+	if json.Unmarshal(req.Credentials, &keyText) == nil {
+		key = []byte(keyText)
+	}
+
+	clientEmail, err := parseServiceAccountKey(key)
+	if err != nil {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	sa := &ServiceAccount{
+		DirectoryID: directoryID,
+		ClientEmail: clientEmail,
+		CreatedBy:   userEmail,
+		CreatedAt:   time.Now().UTC(),
+		key:         key,
+	}
+
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		log.Printf("Failed to get source for directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	if binding != nil && binding.SourceType == SourceTypeGoogleSheet {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		tokenSource, err := sa.tokenSource(ctx)
+		if err == nil {
+			var source DataSource
+			source, err = app.newSheetSource(ctx, binding, tokenSource)
+			if err == nil {
+				_, err = source.Title(ctx)
+			}
+		}
+		if err != nil {
+			log.Printf("Service account %s cannot open the sheet of directory %s: %v", clientEmail, directoryID, err)
+			utils2.ValidationError(w, fmt.Sprintf("The service account cannot open the sheet; share it with %s as an editor: %v", clientEmail, err))
+			return
+		}
+	}
+
+	if err := app.saveServiceAccount(sa); err != nil {
+		log.Printf("Failed to save service account for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to save service account")
+		return
+	}
+	log.Printf("User %s set service account %s for directory %s", userEmail, clientEmail, directoryID)
+	app.recheckCredentials()
+
+	utils2.RespondWithSuccess(w, sa, "Service account saved")
+}
+
+// handleDeleteServiceAccount removes the directory's service account, so sync goes back to
+// using owners' credentials
+func (app *App) handleDeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	deleted, err := app.deleteServiceAccount(directoryID)
+	if err != nil {
+		log.Printf("Failed to delete service account for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to delete service account")
+		return
+	}
+
+	if !deleted {
+		utils2.NotFoundError(w, "Service account")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, nil, "Service account removed")
+}
+
+// handleGetCredentialHealth returns the last recorded state of the credential the directory's
+// sheet is synced with, or null if it has not been checked
+func (app *App) handleGetCredentialHealth(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	health, err := app.GetCredentialHealth(directoryID)
+	if err != nil {
+		log.Printf("Failed to get credential health for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to get credential health")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, health, "")
+}
+
+// handleCheckCredentialHealth checks the directory's sync credential now, resuming write-back
+// if it was paused and the credential works again
+func (app *App) handleCheckCredentialHealth(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), credentialCheckTimeout)
+	defer cancel()
+
+	health, err := app.CheckDirectoryCredential(ctx, directoryID)
+	if err != nil {
+		log.Printf("Credential check of directory %s failed: %v", directoryID, err)
+		utils2.InternalServerError(w, "Credential check failed: "+err.Error())
+		return
+	}
+
+	if health == nil {
+		utils2.RespondWithSuccess(w, nil, "Directory is not synced with a Google Sheet")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, health, "Credential is "+health.State)
+}
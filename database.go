@@ -13,41 +13,23 @@ func (app *App) handleGetDirectory(w http.ResponseWriter, r *http.Request) {
 	// Get directory ID from query parameter or default to "default"
 	directoryID := utils2.GetDirectoryID(r)
 
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	repo, err := app.rowRepository(directoryID)
 	if err != nil {
-		log.Printf("Failed to get directory database for %s: %v", directoryID, err)
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
 		utils2.NotFoundError(w, "Directory")
 		return
 	}
 
-	rows, err := db.Query("SELECT id, data FROM directory ORDER BY id")
+	rows, err := repo.List()
 	if err != nil {
 		log.Printf("Failed to query directory: %v", err)
 		utils2.DatabaseError(w)
 		return
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			log.Printf("Failed to close rows: %v", err)
-		}
-	}()
-
-	var entries []DirectoryEntry
-	for rows.Next() {
-		var entry DirectoryEntry
-		if err := rows.Scan(&entry.ID, &entry.Data); err != nil {
-			log.Printf("Failed to scan directory row: %v", err)
-			utils2.DatabaseError(w)
-			return
-		}
-		entries = append(entries, entry)
-	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Row iteration error: %v", err)
-		utils2.DatabaseError(w)
-		return
+	entries := make([]DirectoryEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = DirectoryEntry{ID: row.ID, SheetRow: row.SheetRow, Data: row.Cells(repo.Columns()), Values: row.Values}
 	}
 
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -61,39 +43,18 @@ func (app *App) handleGetColumns(w http.ResponseWriter, r *http.Request) {
 	// Get directory ID from query parameter or default to "default"
 	directoryID := utils2.GetDirectoryID(r)
 
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	repo, err := app.rowRepository(directoryID)
 	if err != nil {
-		log.Printf("Failed to get directory database for %s: %v", directoryID, err)
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
 		utils2.NotFoundError(w, "Directory")
 		return
 	}
 
-	var columnsJSON string
-	err = db.QueryRow("SELECT columns FROM directory_columns WHERE id = 1").Scan(&columnsJSON)
-	if err != nil {
-		log.Printf("Failed to query columns: %v", err)
-		// Return default columns if none found
-		defaultColumns := []string{"Column 1", "Column 2", "Column 3"}
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		utils2.RespondWithJSON(w, 200, defaultColumns)
-		return
-	}
-
-	var columns []string
-	if err := json.Unmarshal([]byte(columnsJSON), &columns); err != nil {
-		log.Printf("Failed to unmarshal columns: %v", err)
-		defaultColumns := []string{"Column 1", "Column 2", "Column 3"}
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		utils2.RespondWithJSON(w, 200, defaultColumns)
-		return
-	}
-
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
 
-	utils2.RespondWithJSON(w, 200, columns)
+	utils2.RespondWithJSON(w, 200, repo.ColumnNames())
 }
 
 func (app *App) handleDownloadDB(w http.ResponseWriter, r *http.Request) {
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"context"
 	utils2 "directoryCommunityWebsite/internal/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
-
-	"golang.org/x/oauth2"
 )
 
 func (app *App) handleDeleteRow(w http.ResponseWriter, r *http.Request) {
@@ -51,10 +49,16 @@ func (app *App) handleDeleteRow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get actual row ID from the row index
-	actualRowID, err := app.getRowIDFromIndex(directoryID, deleteRowReq.Row)
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	row, err := repo.AtIndex(deleteRowReq.Row)
 	if err != nil {
-		log.Printf("Failed to get row ID from index %d: %v", deleteRowReq.Row, err)
+		log.Printf("Failed to get row %d of directory %s: %v", deleteRowReq.Row, directoryID, err)
 		utils2.NotFoundError(w, "Row")
 		return
 	}
@@ -62,7 +66,7 @@ func (app *App) handleDeleteRow(w http.ResponseWriter, r *http.Request) {
 	if userType == UserTypeModerator {
 		// Check if moderator can access this row
 		filter := NewModerationFilter(app)
-		canAccess, err := filter.CanAccessRow(userEmail, directoryID, actualRowID)
+		canAccess, err := filter.CanAccessRow(userEmail, directoryID, int(row.ID))
 		if err != nil {
 			log.Printf("Failed to check row access: %v", err)
 			utils2.InternalServerError(w, "Permission check failed")
@@ -88,7 +92,7 @@ func (app *App) handleDeleteRow(w http.ResponseWriter, r *http.Request) {
 
 		if permissions.RequiresApproval {
 			// Create pending change for row deletion
-			err = app.createPendingDeleteRow(directoryID, actualRowID, deleteRowReq.Reason, userEmail)
+			err = app.createPendingDeleteRow(directoryID, int(row.ID), deleteRowReq.Reason, userEmail)
 			if err != nil {
 				log.Printf("Failed to create pending delete row: %v", err)
 				utils2.InternalServerError(w, "Failed to submit change for approval")
@@ -103,79 +107,24 @@ func (app *App) handleDeleteRow(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// For owners/admins or moderators without approval requirement, delete directly
-	// Try to delete the row from the original Google Sheet
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	go func() {
-		defer cancel()
-		app.deleteRowFromSheet(ctx, deleteRowReq.Row, deleteRowReq.Reason, directoryID)
-	}()
-
-	utils2.RespondWithSuccess(w, nil, "Row deleted successfully")
-}
-
-func (app *App) deleteRowFromSheet(ctx context.Context, rowIndex int, reason string, directoryID string) {
-	// Get the latest admin session with a sheet URL
-	var userEmail, encryptedTokenJSON, sheetURL string
-	err := app.DB.QueryRow(`
-		SELECT user_email, token, sheet_url 
-		FROM admin_sessions 
-		WHERE sheet_url IS NOT NULL AND sheet_url != ''
-		ORDER BY created_at DESC 
-		LIMIT 1
-	`).Scan(&userEmail, &encryptedTokenJSON, &sheetURL)
-
-	select {
-	case <-ctx.Done():
-		fmt.Printf("Context cancelled while deleting row from sheet: %v\n", ctx.Err())
-		return
-	default:
-	}
-
-	if err != nil {
-		fmt.Printf("No admin session found for deleting row from sheet: %v\n", err)
-		return
-	}
-
-	spreadsheetID, err := extractSpreadsheetID(sheetURL)
-	if err != nil {
-		fmt.Printf("Failed to extract spreadsheet ID for deletion: %v\n", err)
+	// Queue the deletion for the original sheet; the sync worker removes it and re-imports.
+	// The row is pinned by its source key so the right listing is removed even if rows move.
+	jobID, err := app.enqueueSyncJob(directoryID, SyncJobDeleteRow, SyncJobPayload{
+		Row:    deleteRowReq.Row,
+		RowKey: row.Key,
+		Reason: deleteRowReq.Reason,
+	}, userEmail)
+	if errors.Is(err, errSourceReadOnly) {
+		utils2.ValidationError(w, err.Error())
 		return
 	}
-
-	// Decrypt the token
-	tokenJSON, err := app.EncryptionService.Decrypt(encryptedTokenJSON)
-	if err != nil {
-		fmt.Printf("Failed to decrypt token for deletion: %v\n", err)
-		return
-	}
-
-	var token oauth2.Token
-	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
-		fmt.Printf("Failed to unmarshal token for deletion: %v\n", err)
-		return
-	}
-
-	refreshedToken, err := app.refreshTokenIfNeeded(&token)
 	if err != nil {
-		fmt.Printf("Failed to refresh token for deletion: %v\n", err)
+		log.Printf("Failed to queue row deletion for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to queue row deletion")
 		return
 	}
-	token = *refreshedToken
 
-	// Delete the row from the sheet (we'll add 2 to account for header row and 0-indexing)
-	if err := app.deleteSheetRow(spreadsheetID, rowIndex+2, &token); err != nil {
-		fmt.Printf("Failed to delete row %d from sheet: %v\n", rowIndex, err)
-		return
-	}
-
-	fmt.Printf("Successfully deleted row %d from sheet. Reason: %s\n", rowIndex, reason)
-
-	// Re-import the sheet to refresh our database
-	if err := app.reimportSheet(ctx, spreadsheetID, &token, directoryID); err != nil {
-		fmt.Printf("Failed to re-import sheet after deletion: %v\n", err)
-	} else {
-		fmt.Println("Successfully re-imported sheet data after deletion")
-	}
+	utils2.RespondWithSuccess(w, map[string]interface{}{"sync_job_id": jobID}, "Row deleted successfully")
 }
 
 // createPendingDeleteRow creates a pending change for row deletion
@@ -218,22 +167,15 @@ func (app *App) createPendingDeleteRow(directoryID string, rowID int, reason, su
 
 // getFullRowData gets the complete row data as a string array
 func (app *App) getFullRowData(directoryID string, rowID int) ([]string, error) {
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	repo, err := app.rowRepository(directoryID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get directory database: %v", err)
+		return nil, err
 	}
 
-	var dataJSON string
-	err = db.QueryRow("SELECT data FROM directory WHERE id = ?", rowID).Scan(&dataJSON)
+	row, err := repo.Get(int64(rowID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get row data: %v", err)
 	}
 
-	var rowData []string
-	if err := json.Unmarshal([]byte(dataJSON), &rowData); err != nil {
-		return nil, fmt.Errorf("failed to parse row data: %v", err)
-	}
-
-	return rowData, nil
+	return row.Cells(repo.Columns()), nil
 }
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -188,25 +188,27 @@ func (app *App) initDirectoryDatabase(dbPath string) error {
 		return fmt.Errorf("failed to initialize directory database tables: %v", err)
 	}
 
-	return nil
-}
+	if _, err := db.Exec(sourceCellsTableQuery); err != nil {
+		return fmt.Errorf("failed to initialize directory database tables: %v", err)
+	}
 
-// copyDatabase copies a SQLite database file
-func (app *App) copyDatabase(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
+	if _, err := db.Exec(columnNormalizersTableQuery); err != nil {
+		return fmt.Errorf("failed to initialize directory database tables: %v", err)
 	}
-	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
+	return nil
+}
+
+// copyDatabase copies an open SQLite database to a new file with the online backup API, so
+// the copy is consistent even while other connections write to the database
+func (app *App) copyDatabase(ctx context.Context, src *sql.DB, dst string) error {
+	dstDB, err := sql.Open("sqlite3", dst)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create database copy: %v", err)
 	}
-	defer dstFile.Close()
+	defer dstDB.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	return backupDatabase(ctx, dstDB, src)
 }
 
 // isValidDirectoryID checks if a directory ID is URL-safe
@@ -225,6 +227,23 @@ func (app *App) DeleteDirectory(directoryID string) error {
 		return fmt.Errorf("cannot delete default directory")
 	}
 
+	// Keep a copy of the rows, as the database file is removed below
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	_, err := app.snapshotDirectory(ctx, directoryID, SnapshotReasonDelete, "")
+	cancel()
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConnection, "failed to snapshot directory before deleting it", err)
+	}
+
+	// Keep imports and write-back off the directory while it is removed
+	unlock := lockDirectorySync(directoryID)
+	defer unlock()
+
+	// Drive would otherwise keep notifying the app of changes to the directory's sheet
+	if app.DriveWatcher != nil {
+		app.DriveWatcher.stopDirectory(directoryID)
+	}
+
 	// Start a transaction
 	tx, err := app.DB.Begin()
 	if err != nil {
@@ -255,6 +274,26 @@ func (app *App) DeleteDirectory(directoryID string) error {
 		return WrapDatabaseError(ErrTypeConstraint, "failed to delete directory owners", err)
 	}
 
+	// Delete the directory's service account key
+	_, err = tx.Exec(`DELETE FROM directory_service_accounts WHERE directory_id = ?`, directoryID)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConstraint, "failed to delete directory service account", err)
+	}
+
+	// Delete the directory's credential health record
+	_, err = tx.Exec(`DELETE FROM credential_health WHERE directory_id = ?`, directoryID)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConstraint, "failed to delete credential health", err)
+	}
+
+	// Delete the directory's source binding, sync queue and history, import jobs and watch
+	// channels, so the background workers stop syncing a directory that no longer exists
+	for _, table := range []string{"directory_sources", "sync_jobs", "sync_events", "schema_proposals", "import_jobs", "drive_watch_channels"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE directory_id = ?", table), directoryID); err != nil {
+			return WrapDatabaseError(ErrTypeConstraint, "failed to delete "+strings.ReplaceAll(table, "_", " "), err)
+		}
+	}
+
 	// Delete directory record
 	_, err = tx.Exec(`DELETE FROM directories WHERE id = ?`, directoryID)
 	if err != nil {
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"directoryCommunityWebsite/internal/models"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Directory queries are answered a page at a time, by default and at most
+const (
+	defaultQueryLimit = 50
+	maxQueryLimit     = 500
+)
+
+// rowIndexColumn is the row index a query selects alongside each row
+const rowIndexColumn = "_rowIndex"
+
+// errInvalidQuery is wrapped by the errors of queries that can't be run as asked
+var errInvalidQuery = errors.New("invalid query")
+
+// DirectoryQuery asks for a page of a directory's rows. A row is returned when it matches
+// every filter and contains every word of the search in one of the searched columns. Rows
+// are sorted by the sort keys and then in source order; searches without sort keys rank the
+// best matches first when the directory has a search index.
+type DirectoryQuery struct {
+	Filters       models.Controls `json:"filters"`
+	Search        string          `json:"search"`
+	SearchColumns []string        `json:"search_columns"` // every column if empty
+	Sort          []QuerySort     `json:"sort"`
+	Limit         int             `json:"limit"`
+	Cursor        string          `json:"cursor"` // the previous page's next_cursor
+}
+
+// QuerySort is a column a query's results are sorted by
+type QuerySort struct {
+	Column     string `json:"column"`
+	Descending bool   `json:"descending"`
+}
+
+// QueriedRow is a row of a query's results with its row index, the position corrections and
+// deletions refer to it by. Rows found by a search have the HTML-escaped excerpts of the
+// cells the words were found in, with the words in <mark> tags, and with the search index,
+// a score that is higher the better the row matches.
+type QueriedRow struct {
+	DirectoryEntry
+	Index    int               `json:"index"`
+	Score    float64           `json:"score,omitempty"`
+	Snippets map[string]string `json:"snippets,omitempty"`
+}
+
+// DirectoryQueryResult is a page of a query's results
+type DirectoryQueryResult struct {
+	Columns    []DirectoryColumn `json:"columns"`
+	Rows       []QueriedRow      `json:"rows"`
+	Total      int               `json:"total"` // rows matching the filters and search, on every page
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// sortKey is an expression rows are ordered and paged by
+type sortKey struct {
+	expr       string
+	descending bool
+}
+
+// Query runs a query against the directory's table. Pages are cut by the sort keys of the
+// last row of the previous page rather than by offset, so paging stays cheap deep into a
+// directory and rows aren't skipped or repeated when others are added or removed meanwhile.
+func (repo *RowRepository) Query(query DirectoryQuery) (*DirectoryQueryResult, error) {
+	var conditions []string
+	var args []interface{}
+	for i, control := range query.Filters {
+		condition, conditionArgs, err := repo.filterCondition(control)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i+1, err)
+		}
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+
+	search, err := repo.planSearch(query.Search, query.SearchColumns)
+	if err != nil {
+		return nil, err
+	}
+	if search != nil {
+		conditions = append(conditions, search.condition)
+		args = append(args, search.args...)
+	}
+
+	keys, err := repo.sortKeys(query.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	// Searches through the index are ranked best match first, unless asked to sort otherwise
+	join := ""
+	var joinArgs []interface{}
+	ranked := search != nil && search.match != "" && len(query.Sort) == 0
+	if ranked {
+		join, joinArgs = search.rankJoin(searchTableName(repo.directoryID))
+		keys = append([]sortKey{{expr: "[_searchRank]"}}, keys...)
+	}
+
+	var cursor []interface{}
+	if query.Cursor != "" {
+		if cursor, err = decodeQueryCursor(query.Cursor, len(keys)); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := query.Limit
+	switch {
+	case limit <= 0:
+		limit = defaultQueryLimit
+	case limit > maxQueryLimit:
+		limit = maxQueryLimit
+	}
+
+	result := &DirectoryQueryResult{Columns: repo.columns, Rows: []QueriedRow{}}
+	if result.Columns == nil {
+		result.Columns = []DirectoryColumn{}
+	}
+	if !repo.hasTable {
+		return result, nil
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	if err := repo.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM '%s' %s", repo.directoryID, where), args...).
+		Scan(&result.Total); err != nil {
+		return nil, fmt.Errorf("failed to count matching rows: %v", err)
+	}
+
+	if cursor != nil {
+		condition, cursorArgs := keysetCondition(keys, cursor)
+		conditions = append(conditions, condition)
+		args = append(args, cursorArgs...)
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	selectKeys := make([]string, len(keys))
+	orderBy := make([]string, len(keys))
+	for i, key := range keys {
+		selectKeys[i] = ", " + key.expr
+		orderBy[i] = key.expr
+		if key.descending {
+			orderBy[i] += " DESC"
+		}
+	}
+
+	// The row index is numbered over the whole table, before the filters drop any rows
+	rows, err := repo.db.Query(fmt.Sprintf(`
+		SELECT %s, [%s]%s
+		FROM (SELECT *, ROW_NUMBER() OVER (ORDER BY COALESCE([%s], 0), rowID) - 1 AS [%s] FROM '%s') AS rows
+		%s
+		%s
+		ORDER BY %s
+		LIMIT %d`,
+		repo.rowColumns(), rowIndexColumn, strings.Join(selectKeys, ""),
+		sheetRowColumn, rowIndexColumn, repo.directoryID,
+		join, where, strings.Join(orderBy, ", "), limit+1), append(joinArgs, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query directory rows: %v", err)
+	}
+	defer rows.Close()
+
+	var lastKeys []interface{}
+	var found []*DirectoryRow
+	for rows.Next() {
+		if len(result.Rows) == limit {
+			result.NextCursor, err = encodeQueryCursor(lastKeys)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		var index int
+		values := make([]interface{}, len(keys))
+		extra := []interface{}{&index}
+		for i := range values {
+			extra = append(extra, &values[i])
+		}
+		row, err := repo.scanRow(rows, extra...)
+		if err != nil {
+			return nil, err
+		}
+
+		queried := QueriedRow{
+			DirectoryEntry: DirectoryEntry{ID: row.ID, SheetRow: row.SheetRow, Data: row.Cells(repo.columns), Values: row.Values},
+			Index:          index,
+		}
+		if rank, ok := values[0].(float64); ok && ranked {
+			queried.Score = -rank
+		}
+		result.Rows = append(result.Rows, queried)
+		found = append(found, row)
+		lastKeys = values
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read directory rows: %v", err)
+	}
+
+	if search != nil {
+		snippets, err := repo.snippets(search, found)
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Rows {
+			result.Rows[i].Snippets = snippets[result.Rows[i].ID]
+		}
+	}
+	return result, nil
+}
+
+// filterCondition returns the SQL condition of a filter, which matches a row when any of
+// the control's columns matches. Tag and location filters on tag and location columns are
+// answered from the column's tag table; on other columns they compare whole values.
+func (repo *RowRepository) filterCondition(control models.Control) (string, []interface{}, error) {
+	columns := repo.ColumnsOf(control.Column)
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("%w: no column matches %s", errInvalidQuery, describeColumnID(control.Column))
+	}
+
+	filter := control.Filter
+	switch filter.Type {
+	case models.FilterNumericRange:
+		if filter.Range == nil {
+			return "", nil, fmt.Errorf("%w: numeric range filter missing range specification", errInvalidQuery)
+		}
+		if filter.Range.Type == models.RangeFilterBetween && filter.Range.Min > filter.Range.Max {
+			return "", nil, fmt.Errorf("%w: range minimum is above its maximum", errInvalidQuery)
+		}
+	case models.FilterCategories, models.FilterTags, models.FilterLocations:
+		if len(filter.Values) == 0 {
+			return "", nil, fmt.Errorf("%w: %s filter has no values", errInvalidQuery, filter.Type)
+		}
+	default:
+		return "", nil, fmt.Errorf("%w: unsupported filter type: %s", errInvalidQuery, filter.Type)
+	}
+
+	values := make([]interface{}, len(filter.Values))
+	for i, value := range filter.Values {
+		values[i] = strings.TrimSpace(value)
+	}
+	placeholders := strings.TrimPrefix(strings.Repeat(", ?", len(values)), ", ")
+
+	var conditions []string
+	var args []interface{}
+	for _, column := range columns {
+		switch filter.Type {
+		case models.FilterNumericRange:
+			number := numericValueExpr(column.Name)
+			switch filter.Range.Type {
+			case models.RangeFilterAbove:
+				conditions = append(conditions, number+" > ?")
+				args = append(args, filter.Range.Threshold)
+			case models.RangeFilterBelow:
+				conditions = append(conditions, number+" < ?")
+				args = append(args, filter.Range.Threshold)
+			case models.RangeFilterBetween:
+				conditions = append(conditions, number+" BETWEEN ? AND ?")
+				args = append(args, filter.Range.Min, filter.Range.Max)
+			default:
+				return "", nil, fmt.Errorf("%w: unsupported range type: %s", errInvalidQuery, filter.Range.Type)
+			}
+			continue
+
+		case models.FilterTags, models.FilterLocations:
+			if isTagColumnType(column.Type) {
+				tableName, err := repo.tagTable(column.Name)
+				if err != nil {
+					return "", nil, err
+				}
+				if tableName != "" {
+					conditions = append(conditions, fmt.Sprintf("rowID IN (SELECT rowID FROM '%s' WHERE tag IN (%s))", tableName, placeholders))
+					args = append(args, values...)
+					continue
+				}
+			}
+		}
+
+		conditions = append(conditions, fmt.Sprintf("TRIM(COALESCE([%s], '')) COLLATE NOCASE IN (%s)", column.Name, placeholders))
+		args = append(args, values...)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args, nil
+}
+
+// sortKeys returns the keys rows are ordered by: the requested columns, then source order,
+// which also makes every row's keys unique. Numeric columns sort by value with the cells
+// that aren't numbers last; other columns sort as text, ignoring case.
+func (repo *RowRepository) sortKeys(sorts []QuerySort) ([]sortKey, error) {
+	var keys []sortKey
+	for _, sort := range sorts {
+		index := repo.ColumnIndex(sort.Column)
+		if index < 0 {
+			return nil, fmt.Errorf("%w: no column named %q to sort by", errInvalidQuery, sort.Column)
+		}
+
+		if repo.columns[index].Type == "numeric" {
+			number := numericValueExpr(sort.Column)
+			keys = append(keys,
+				sortKey{expr: fmt.Sprintf("(%s IS NULL)", number)},
+				sortKey{expr: fmt.Sprintf("COALESCE(%s, 0)", number), descending: sort.Descending})
+			continue
+		}
+		keys = append(keys, sortKey{expr: fmt.Sprintf("COALESCE([%s], '') COLLATE NOCASE", sort.Column), descending: sort.Descending})
+	}
+
+	return append(keys,
+		sortKey{expr: fmt.Sprintf("COALESCE([%s], 0)", sheetRowColumn)},
+		sortKey{expr: "rowID"}), nil
+}
+
+// numericValueExpr returns an SQL expression reading a numeric column's value as a number,
+// or NULL for cells that aren't one. Numeric columns are normalised to plain numbers on
+// import, so cells written any other way are ones that couldn't be read.
+func numericValueExpr(column string) string {
+	return fmt.Sprintf("(CASE WHEN TRIM([%[1]s]) <> '' AND TRIM([%[1]s]) NOT GLOB '*[^0-9.eE+-]*' THEN CAST(TRIM([%[1]s]) AS REAL) END)", column)
+}
+
+// keysetCondition returns the SQL condition selecting the rows that sort after a row with
+// the given keys
+func keysetCondition(keys []sortKey, values []interface{}) (string, []interface{}) {
+	var alternatives []string
+	var args []interface{}
+	for i, key := range keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, keys[j].expr+" = ?")
+			args = append(args, values[j])
+		}
+		if key.descending {
+			parts = append(parts, key.expr+" < ?")
+		} else {
+			parts = append(parts, key.expr+" > ?")
+		}
+		args = append(args, values[i])
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// encodeQueryCursor returns the cursor of the page after a row with the given sort keys
+func encodeQueryCursor(values []interface{}) (string, error) {
+	for i, value := range values {
+		if text, ok := value.([]byte); ok {
+			values[i] = string(text)
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode query cursor: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeQueryCursor reads the sort keys of a cursor, which must match the query's sort
+func decodeQueryCursor(cursor string, keyCount int) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", errInvalidQuery)
+	}
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil || len(values) != keyCount {
+		return nil, fmt.Errorf("%w: cursor doesn't belong to this sort", errInvalidQuery)
+	}
+	return values, nil
+}
+
+// describeColumnID names the column or columns a filter applies to
+func describeColumnID(columnID models.ColumnID) string {
+	if columnID.Type == models.ColumnIDRange {
+		return fmt.Sprintf("columns %q to %q", columnID.Start, columnID.End)
+	}
+	return fmt.Sprintf("column %q", columnID.Value)
+}
+
+// handleQueryDirectory returns a page of a directory's rows, filtered, searched and sorted
+// as the DirectoryQuery in the request body asks. An empty body asks for the first page in
+// source order.
+func (app *App) handleQueryDirectory(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var query DirectoryQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil && err != io.EOF {
+		log.Printf("Failed to decode directory query: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	result, err := repo.Query(query)
+	if errors.Is(err, errInvalidQuery) || errors.Is(err, errNotTagColumn) {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to query directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	utils2.RespondWithJSON(w, 200, result)
+}
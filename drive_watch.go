@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	utils2 "directoryCommunityWebsite/internal/utils"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// driveWatchScope is the OAuth scope watching a spreadsheet for changes needs
+const driveWatchScope = "https://www.googleapis.com/auth/drive.metadata.readonly"
+
+const (
+	driveChannelLifetime    = 24 * time.Hour   // the longest Drive keeps a file channel open
+	driveChannelRenewBefore = time.Hour        // channels are replaced when they have less than this left
+	driveWatchInterval      = 10 * time.Minute // how often channels are renewed and matched to the bindings
+	driveNotificationDelay  = 5 * time.Second  // notifications this close together are synced once
+)
+
+// driveChannelAPI registers and stops Drive watch channels on a spreadsheet
+type driveChannelAPI interface {
+	watch(ctx context.Context, binding *DirectorySource, channel *drive.Channel) (*drive.Channel, error)
+	stop(ctx context.Context, binding *DirectorySource, channel *drive.Channel) error
+}
+
+// googleDriveChannels calls the Drive API with the credentials the directory's sheet is synced with
+type googleDriveChannels struct {
+	app *App
+}
+
+func (g googleDriveChannels) service(ctx context.Context, binding *DirectorySource) (*drive.Service, error) {
+	tokenSource, _, err := g.app.sheetTokenSource(ctx, binding)
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(oauth2.NewClient(ctx, tokenSource)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Drive client: %v", err)
+	}
+	return srv, nil
+}
+
+func (g googleDriveChannels) watch(ctx context.Context, binding *DirectorySource, channel *drive.Channel) (*drive.Channel, error) {
+	srv, err := g.service(ctx, binding)
+	if err != nil {
+		return nil, err
+	}
+	return srv.Files.Watch(binding.SpreadsheetID, channel).SupportsAllDrives(true).Context(ctx).Do()
+}
+
+func (g googleDriveChannels) stop(ctx context.Context, binding *DirectorySource, channel *drive.Channel) error {
+	srv, err := g.service(ctx, binding)
+	if err != nil {
+		return err
+	}
+	return srv.Channels.Stop(&drive.Channel{Id: channel.Id, ResourceId: channel.ResourceId}).Context(ctx).Do()
+}
+
+// fakeDriveChannels accepts every channel without calling Drive, so the webhook can be
+// exercised locally with scripts/fake_drive_notification.sh
+type fakeDriveChannels struct{}
+
+func (fakeDriveChannels) watch(ctx context.Context, binding *DirectorySource, channel *drive.Channel) (*drive.Channel, error) {
+	registered := *channel
+	registered.ResourceId = "fake-" + binding.SpreadsheetID
+	return &registered, nil
+}
+
+func (fakeDriveChannels) stop(ctx context.Context, binding *DirectorySource, channel *drive.Channel) error {
+	return nil
+}
+
+// driveChannel is a watch channel recorded for a directory
+type driveChannel struct {
+	id            string
+	directoryID   string
+	spreadsheetID string
+	resourceID    string
+	token         string
+	expiresAt     time.Time
+}
+
+// DriveWatcher keeps a Drive watch channel open on the spreadsheet of every directory bound
+// to a sheet, and syncs a directory when Drive notifies the webhook that its sheet changed.
+// Directories with an open channel are left out of scheduled pulls.
+type DriveWatcher struct {
+	app     *App
+	api     driveChannelAPI
+	address string // public HTTPS URL of the webhook
+
+	mutex   sync.Mutex
+	pending map[string]bool // directories with a sync waiting for more notifications
+}
+
+// NewDriveWatcher creates a watcher whose channels notify address, using Drive itself or,
+// for local testing, a fake that accepts every channel
+func NewDriveWatcher(app *App, address string, fake bool) *DriveWatcher {
+	var api driveChannelAPI = googleDriveChannels{app: app}
+	if fake {
+		api = fakeDriveChannels{}
+	}
+	return &DriveWatcher{app: app, api: api, address: address, pending: make(map[string]bool)}
+}
+
+// Start opens the channels and keeps renewing them in the background
+func (dw *DriveWatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(driveWatchInterval)
+		defer ticker.Stop()
+		for {
+			dw.renewAll()
+			<-ticker.C
+		}
+	}()
+}
+
+// renewAll opens a channel for every sheet binding without a current one, replaces channels
+// that are about to expire and stops the channels of directories that no longer use them
+func (dw *DriveWatcher) renewAll() {
+	rows, err := dw.app.DB.Query("SELECT directory_id FROM directory_sources WHERE source_type = ? ORDER BY directory_id",
+		SourceTypeGoogleSheet)
+	if err != nil {
+		log.Printf("Failed to list sheet sources to watch: %v", err)
+		return
+	}
+
+	var directoryIDs []string
+	for rows.Next() {
+		var directoryID string
+		if err := rows.Scan(&directoryID); err != nil {
+			log.Printf("Failed to scan sheet source to watch: %v", err)
+			continue
+		}
+		directoryIDs = append(directoryIDs, directoryID)
+	}
+	rows.Close()
+
+	channels, err := dw.app.listDriveChannels()
+	if err != nil {
+		log.Printf("Failed to list Drive watch channels: %v", err)
+		return
+	}
+
+	bindings := make(map[string]*DirectorySource)
+	for _, directoryID := range directoryIDs {
+		binding, err := dw.app.getDirectorySource(directoryID)
+		if err != nil || binding == nil {
+			log.Printf("Failed to get source of directory %s to watch: %v", directoryID, err)
+			continue
+		}
+		bindings[directoryID] = binding
+	}
+
+	// Channels on a sheet the directory no longer reads from are stopped
+	current := make(map[string]*driveChannel)
+	for _, channel := range channels {
+		binding := bindings[channel.directoryID]
+		if binding == nil || binding.SpreadsheetID != channel.spreadsheetID {
+			dw.stopChannel(binding, channel)
+			continue
+		}
+		if latest := current[channel.directoryID]; latest == nil || channel.expiresAt.After(latest.expiresAt) {
+			current[channel.directoryID] = channel
+		}
+	}
+
+	for directoryID, binding := range bindings {
+		latest := current[directoryID]
+		if latest != nil && time.Until(latest.expiresAt) > driveChannelRenewBefore {
+			continue
+		}
+
+		if err := dw.openChannel(binding); err != nil {
+			log.Printf("Failed to watch the sheet of directory %s; it is pulled on schedule instead: %v", directoryID, err)
+			continue
+		}
+
+		// The new channel carries the notifications from here on
+		for _, channel := range channels {
+			if channel.directoryID == directoryID {
+				dw.stopChannel(binding, channel)
+			}
+		}
+
+		// Catch up on changes no channel was open for
+		dw.scheduleSync(directoryID)
+	}
+}
+
+// openChannel registers a new channel on a directory's spreadsheet and records it
+func (dw *DriveWatcher) openChannel(binding *DirectorySource) error {
+	channelID, err := GenerateSecureToken(16)
+	if err != nil {
+		return fmt.Errorf("failed to generate channel ID: %v", err)
+	}
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate channel token: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), credentialCheckTimeout)
+	defer cancel()
+
+	registered, err := dw.api.watch(ctx, binding, &drive.Channel{
+		Id:         channelID,
+		Type:       "web_hook",
+		Address:    dw.address,
+		Token:      token,
+		Expiration: time.Now().Add(driveChannelLifetime).UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Drive may shorten the channel's life
+	expiresAt := time.Now().Add(driveChannelLifetime)
+	if registered.Expiration > 0 {
+		expiresAt = time.UnixMilli(registered.Expiration)
+	}
+
+	_, err = dw.app.DB.Exec(`
+		INSERT INTO drive_watch_channels (channel_id, directory_id, spreadsheet_id, resource_id, token, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, channelID, binding.DirectoryID, binding.SpreadsheetID, registered.ResourceId, token, expiresAt.UTC(), time.Now().UTC())
+	if err != nil {
+		// Without its record the channel's notifications would be refused, so close it again
+		dw.api.stop(ctx, binding, registered)
+		return WrapDatabaseError(ErrTypeConstraint, "failed to record Drive watch channel", err)
+	}
+	return nil
+}
+
+// stopChannel stops a channel and forgets it. Channels Drive can't stop expire on their own,
+// and their notifications are ignored once they are forgotten.
+func (dw *DriveWatcher) stopChannel(binding *DirectorySource, channel *driveChannel) {
+	if binding != nil && time.Now().Before(channel.expiresAt) {
+		ctx, cancel := context.WithTimeout(context.Background(), credentialCheckTimeout)
+		err := dw.api.stop(ctx, binding, &drive.Channel{Id: channel.id, ResourceId: channel.resourceID})
+		cancel()
+		if err != nil {
+			log.Printf("Failed to stop Drive watch channel %s of directory %s: %v", channel.id, channel.directoryID, err)
+		}
+	}
+
+	if _, err := dw.app.DB.Exec("DELETE FROM drive_watch_channels WHERE channel_id = ?", channel.id); err != nil {
+		log.Printf("Failed to delete Drive watch channel %s: %v", channel.id, err)
+	}
+}
+
+// stopDirectory stops the channels of a directory that is being deleted, while its source
+// binding still holds the credentials to stop them with
+func (dw *DriveWatcher) stopDirectory(directoryID string) {
+	binding, err := dw.app.getDirectorySource(directoryID)
+	if err != nil {
+		log.Printf("Failed to get source of directory %s to stop watching: %v", directoryID, err)
+	}
+
+	channels, err := dw.app.listDriveChannels()
+	if err != nil {
+		log.Printf("Failed to list Drive watch channels: %v", err)
+		return
+	}
+	for _, channel := range channels {
+		if channel.directoryID == directoryID {
+			dw.stopChannel(binding, channel)
+		}
+	}
+}
+
+// scheduleSync pulls a directory shortly, once however many notifications arrive meanwhile,
+// since one edit in a sheet often sends several
+func (dw *DriveWatcher) scheduleSync(directoryID string) {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	if dw.pending[directoryID] {
+		return
+	}
+	dw.pending[directoryID] = true
+
+	time.AfterFunc(driveNotificationDelay, func() {
+		dw.mutex.Lock()
+		delete(dw.pending, directoryID)
+		dw.mutex.Unlock()
+
+		dw.sync(directoryID)
+	})
+}
+
+// sync pulls a directory whose sheet changed
+func (dw *DriveWatcher) sync(directoryID string) {
+	deferred, err := dw.app.pullDeferred(directoryID)
+	if err != nil {
+		log.Printf("Failed to check whether directory %s can be pulled: %v", directoryID, err)
+		return
+	}
+	if deferred {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	result, err := dw.app.pullDirectory(ctx, directoryID)
+	if err != nil {
+		log.Printf("Push sync of directory %s failed: %v", directoryID, err)
+		if isCredentialError(err) {
+			dw.app.recordCredentialFailure(directoryID, err)
+		}
+		return
+	}
+
+	if len(result.Changes) > 0 {
+		log.Printf("Push sync of directory %s: %d inserted, %d updated, %d deleted",
+			directoryID, result.Inserted, result.Updated, result.Deleted)
+	}
+}
+
+// listDriveChannels returns every recorded watch channel
+func (app *App) listDriveChannels() ([]*driveChannel, error) {
+	rows, err := app.DB.Query(`
+		SELECT channel_id, directory_id, spreadsheet_id, resource_id, token, expires_at
+		FROM drive_watch_channels ORDER BY expires_at
+	`)
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query Drive watch channels", err)
+	}
+	defer rows.Close()
+
+	var channels []*driveChannel
+	for rows.Next() {
+		var channel driveChannel
+		if err := rows.Scan(&channel.id, &channel.directoryID, &channel.spreadsheetID, &channel.resourceID,
+			&channel.token, &channel.expiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan Drive watch channel: %v", err)
+		}
+		channels = append(channels, &channel)
+	}
+	return channels, rows.Err()
+}
+
+// hasOpenDriveChannel reports whether Drive notifies the app of changes to a directory's sheet
+func (app *App) hasOpenDriveChannel(directoryID string) (bool, error) {
+	var count int
+	err := app.DB.QueryRow("SELECT COUNT(*) FROM drive_watch_channels WHERE directory_id = ? AND expires_at > ?",
+		directoryID, time.Now().UTC()).Scan(&count)
+	if err != nil {
+		return false, WrapDatabaseError(ErrTypeConnection, "failed to query Drive watch channels", err)
+	}
+	return count > 0, nil
+}
+
+// handleDriveNotification receives Drive's change notifications. A notification is only
+// trusted if it names a recorded channel with that channel's token and resource, and each
+// message is acted on once, as Drive retries deliveries it isn't sure of.
+func (app *App) handleDriveNotification(w http.ResponseWriter, r *http.Request) {
+	if app.DriveWatcher == nil {
+		utils2.NotFoundError(w, "Drive webhook")
+		return
+	}
+
+	channelID := r.Header.Get("X-Goog-Channel-ID")
+	state := r.Header.Get("X-Goog-Resource-State")
+	messageNumber, err := strconv.ParseInt(r.Header.Get("X-Goog-Message-Number"), 10, 64)
+	if channelID == "" || err != nil {
+		utils2.BadRequestError(w, "Not a Drive notification")
+		return
+	}
+
+	var channel driveChannel
+	var lastMessage int64
+	err = app.DB.QueryRow(`
+		SELECT channel_id, directory_id, resource_id, token, last_message_number
+		FROM drive_watch_channels WHERE channel_id = ?
+	`, channelID).Scan(&channel.id, &channel.directoryID, &channel.resourceID, &channel.token, &lastMessage)
+	if err == sql.ErrNoRows {
+		// A channel that was just replaced can still deliver a notification or two
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up Drive watch channel %s: %v", channelID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	token := r.Header.Get("X-Goog-Channel-Token")
+	resourceID := r.Header.Get("X-Goog-Resource-ID")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(channel.token)) != 1 || resourceID != channel.resourceID {
+		log.Printf("Rejected Drive notification for channel %s with a wrong token or resource", channelID)
+		utils2.AuthorizationError(w)
+		return
+	}
+
+	// Message numbers only increase within a channel, so a number seen before is a redelivery
+	result, err := app.DB.Exec(`
+		UPDATE drive_watch_channels SET last_message_number = ?, last_notified_at = ?
+		WHERE channel_id = ? AND last_message_number < ?
+	`, messageNumber, time.Now().UTC(), channelID, messageNumber)
+	if err != nil {
+		log.Printf("Failed to record Drive notification %d of channel %s: %v", messageNumber, channelID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// The first message only confirms the channel was opened
+	if state != "sync" {
+		app.DriveWatcher.scheduleSync(channel.directoryID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileSourceLocks serialises read-modify-write cycles on the same file
+var fileSourceLocks sync.Map
+
+// FileSource is a DataSource backed by a CSV or TSV file on local disk
+type FileSource struct {
+	path      string
+	delimiter rune
+}
+
+// fileSourceDir is the folder a directory's file sources are read from: FILE_SOURCE_DIR/<directory ID>/.
+// Each directory has its own, so owners can't read or write files bound to another directory.
+func (app *App) fileSourceDir(directoryID string) string {
+	return filepath.Join(app.Config.FileSourceDir, directoryID)
+}
+
+// newFileSource opens a file source, resolving the path inside the directory's source folder
+func (app *App) newFileSource(directoryID, location string) (*FileSource, error) {
+	if directoryID == "" {
+		return nil, fmt.Errorf("file sources belong to a directory")
+	}
+
+	path, err := resolveFileSourcePath(app.fileSourceDir(directoryID), location)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("unable to open source file: %v", err)
+	}
+
+	return &FileSource{path: path, delimiter: delimiterForPath(path)}, nil
+}
+
+// resolveFileSourcePath joins location onto baseDir and rejects paths that escape it,
+// including through symbolic links. The file must exist.
+func resolveFileSourcePath(baseDir, location string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("file path is required")
+	}
+
+	base, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid source directory: %v", err)
+	}
+
+	path := location
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	path = filepath.Clean(path)
+
+	// A link inside the source directory may point anywhere, so both sides are compared with
+	// their links followed
+	if base, err = filepath.EvalSymlinks(base); err != nil {
+		return "", fmt.Errorf("invalid source directory: %v", err)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", fmt.Errorf("unable to open source file: %v", err)
+	}
+
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file path must be inside %s", baseDir)
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".csv" && ext != ".tsv" && ext != ".tab" {
+		return "", fmt.Errorf("unsupported file type %q: expected .csv or .tsv", ext)
+	}
+
+	return path, nil
+}
+
+// delimiterForPath picks the field separator from the file extension
+func delimiterForPath(path string) rune {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".tab":
+		return '\t'
+	default:
+		return ','
+	}
+}
+
+func (fs *FileSource) lock() func() {
+	mutex, _ := fileSourceLocks.LoadOrStore(fs.path, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock
+}
+
+func (fs *FileSource) Type() string {
+	return SourceTypeFile
+}
+
+func (fs *FileSource) Title(ctx context.Context) (string, error) {
+	return filepath.Base(fs.path), nil
+}
+
+func (fs *FileSource) ReadAll(ctx context.Context) ([][]string, error) {
+	unlock := fs.lock()
+	defer unlock()
+
+	return fs.read()
+}
+
+// ReadChunks parses the file as it is read, handing over chunkRows rows at a time
+func (fs *FileSource) ReadChunks(ctx context.Context, chunkRows int, fn func(rows [][]string) error) error {
+	unlock := fs.lock()
+	defer unlock()
+
+	file, err := os.Open(fs.path)
+	if err != nil {
+		return fmt.Errorf("unable to open source file: %v", err)
+	}
+	defer file.Close()
+
+	reader := fs.csvReader(file)
+	chunk := make([][]string, 0, chunkRows)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to parse source file: %v", err)
+		}
+
+		chunk = append(chunk, row)
+		if len(chunk) == chunkRows {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk = make([][]string, 0, chunkRows)
+		}
+	}
+
+	if len(chunk) > 0 {
+		return fn(chunk)
+	}
+	return nil
+}
+
+func (fs *FileSource) UpdateCell(ctx context.Context, rowNumber, col int, value string) error {
+	return fs.modify(func(rows [][]string) ([][]string, error) {
+		if rowNumber < 1 || rowNumber > len(rows) {
+			return nil, fmt.Errorf("row %d is out of range (file has %d rows)", rowNumber, len(rows))
+		}
+		row := rows[rowNumber-1]
+		for len(row) <= col {
+			row = append(row, "")
+		}
+		row[col] = value
+		rows[rowNumber-1] = row
+		return rows, nil
+	})
+}
+
+func (fs *FileSource) UpdateColumn(ctx context.Context, col, firstRow int, values []string) error {
+	return fs.modify(func(rows [][]string) ([][]string, error) {
+		if firstRow < 1 {
+			return nil, fmt.Errorf("row %d is out of range", firstRow)
+		}
+		for len(rows) < firstRow-1+len(values) {
+			rows = append(rows, []string{})
+		}
+		for i, value := range values {
+			row := rows[firstRow-1+i]
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			row[col] = value
+			rows[firstRow-1+i] = row
+		}
+		return rows, nil
+	})
+}
+
+func (fs *FileSource) AppendRow(ctx context.Context, values []string) error {
+	return fs.modify(func(rows [][]string) ([][]string, error) {
+		return append(rows, values), nil
+	})
+}
+
+func (fs *FileSource) DeleteRow(ctx context.Context, rowNumber int) error {
+	return fs.modify(func(rows [][]string) ([][]string, error) {
+		if rowNumber < 2 || rowNumber > len(rows) {
+			return nil, fmt.Errorf("row %d is out of range (file has %d rows)", rowNumber, len(rows))
+		}
+		return append(rows[:rowNumber-1], rows[rowNumber:]...), nil
+	})
+}
+
+func (fs *FileSource) ApplyBatch(ctx context.Context, writes []SourceWrite) error {
+	return fs.modify(func(rows [][]string) ([][]string, error) {
+		for _, write := range writes {
+			switch write.Kind {
+			case SyncJobUpdateCell:
+				if write.RowNumber < 1 || write.RowNumber > len(rows) {
+					return nil, fmt.Errorf("row %d is out of range (file has %d rows)", write.RowNumber, len(rows))
+				}
+				row := rows[write.RowNumber-1]
+				for len(row) <= write.Column {
+					row = append(row, "")
+				}
+				row[write.Column] = write.Value
+				rows[write.RowNumber-1] = row
+			case SyncJobDeleteRow:
+				if write.RowNumber < 2 || write.RowNumber > len(rows) {
+					return nil, fmt.Errorf("row %d is out of range (file has %d rows)", write.RowNumber, len(rows))
+				}
+				rows = append(rows[:write.RowNumber-1], rows[write.RowNumber:]...)
+			case SyncJobAppendRow:
+				rows = append(rows, write.Values)
+			case sourceWriteInsertRow:
+				if write.RowNumber < 2 || write.RowNumber > len(rows)+1 {
+					return nil, fmt.Errorf("row %d is out of range (file has %d rows)", write.RowNumber, len(rows))
+				}
+				rows = append(rows[:write.RowNumber-1], append([][]string{write.Values}, rows[write.RowNumber-1:]...)...)
+			default:
+				return nil, fmt.Errorf("unknown write %q", write.Kind)
+			}
+		}
+		return rows, nil
+	})
+}
+
+// read parses the whole file; callers must hold the file lock
+func (fs *FileSource) read() ([][]string, error) {
+	file, err := os.Open(fs.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open source file: %v", err)
+	}
+	defer file.Close()
+
+	rows, err := fs.csvReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse source file: %v", err)
+	}
+
+	return rows, nil
+}
+
+// csvReader returns a reader that parses the file's delimiter and tolerates ragged rows
+func (fs *FileSource) csvReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = fs.delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	return reader
+}
+
+// errFileSourceChanged is returned when a source file is changed outside the app, for
+// example by a git pull, while a write-back is modifying it
+var errFileSourceChanged = errors.New("the source file changed while it was being written; the write will be retried against its new contents")
+
+// modify applies fn to the file contents and atomically replaces the file with the result.
+// The file is left alone if something else changes it in the meantime.
+func (fs *FileSource) modify(fn func(rows [][]string) ([][]string, error)) error {
+	unlock := fs.lock()
+	defer unlock()
+
+	before, err := os.Stat(fs.path)
+	if err != nil {
+		return fmt.Errorf("unable to open source file: %v", err)
+	}
+
+	rows, err := fs.read()
+	if err != nil {
+		return err
+	}
+
+	rows, err = fn(rows)
+	if err != nil {
+		return err
+	}
+
+	return fs.write(rows, before)
+}
+
+// write replaces the file by writing a temporary file alongside it and renaming it into
+// place, unless the file no longer matches before, the version the rows were read from
+func (fs *FileSource) write(rows [][]string, before os.FileInfo) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), "."+filepath.Base(fs.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := csv.NewWriter(tmp)
+	writer.Comma = fs.delimiter
+	if err := writer.WriteAll(rows); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write source file: %v", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to flush source file: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close temporary file: %v", err)
+	}
+
+	if info, err := os.Stat(fs.path); err == nil {
+		if !info.ModTime().Equal(before.ModTime()) || info.Size() != before.Size() {
+			return errFileSourceChanged
+		}
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return fmt.Errorf("unable to replace source file: %v", err)
+	}
+
+	// Make the rename itself durable; not every platform can sync a directory
+	if dir, err := os.Open(filepath.Dir(fs.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// fileWatchSettle is how long a changed file must stay untouched before it is re-synced, so
+// a file still being written by an editor or a git checkout isn't read half-way through
+const fileWatchSettle = time.Second
+
+// fileStamp identifies the version of a source file a directory was last synced with
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	hash    string // SHA-256 of the file's content
+}
+
+// FileWatcher re-syncs directories bound to a local file as soon as the file changes, with
+// the same incremental import and external edit events as a scheduled pull. Files are
+// polled rather than watched through the operating system, so changes are seen on any
+// filesystem and whether the file is edited in place or replaced, as git does.
+type FileWatcher struct {
+	app      *App
+	interval time.Duration
+	stamps   map[string]fileStamp // by directory
+}
+
+// NewFileWatcher creates a watcher that checks the files every interval
+func NewFileWatcher(app *App, interval time.Duration) *FileWatcher {
+	return &FileWatcher{app: app, interval: interval, stamps: make(map[string]fileStamp)}
+}
+
+// Start begins watching in the background. Every file is synced once at the start, to pick
+// up changes made while the server was down.
+func (fw *FileWatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(fw.interval)
+		defer ticker.Stop()
+		for {
+			fw.checkAll()
+			<-ticker.C
+		}
+	}()
+}
+
+// checkAll syncs each file-backed directory whose file has changed since its last sync
+func (fw *FileWatcher) checkAll() {
+	rows, err := fw.app.DB.Query("SELECT directory_id, location FROM directory_sources WHERE source_type = ? ORDER BY directory_id",
+		SourceTypeFile)
+	if err != nil {
+		log.Printf("Failed to list file sources to watch: %v", err)
+		return
+	}
+
+	locations := make(map[string]string)
+	for rows.Next() {
+		var directoryID, location string
+		if err := rows.Scan(&directoryID, &location); err != nil {
+			log.Printf("Failed to scan file source to watch: %v", err)
+			continue
+		}
+		locations[directoryID] = location
+	}
+	rows.Close()
+
+	// Directories that were re-linked to a sheet or deleted are no longer watched
+	for directoryID := range fw.stamps {
+		if _, ok := locations[directoryID]; !ok {
+			delete(fw.stamps, directoryID)
+		}
+	}
+
+	for directoryID, location := range locations {
+		if err := fw.check(directoryID, location); err != nil {
+			log.Printf("File watch of directory %s failed: %v", directoryID, err)
+		}
+	}
+}
+
+// check syncs a directory if its file has changed. The stamp is taken before the sync, so a
+// change made while it runs is synced on the next check.
+func (fw *FileWatcher) check(directoryID, location string) error {
+	path, err := resolveFileSourcePath(fw.app.fileSourceDir(directoryID), location)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to open source file: %v", err)
+	}
+
+	last, seen := fw.stamps[directoryID]
+	if seen && info.ModTime().Equal(last.modTime) && info.Size() == last.size {
+		return nil
+	}
+	if time.Since(info.ModTime()) < fileWatchSettle {
+		return nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	stamp := fileStamp{modTime: info.ModTime(), size: info.Size(), hash: hash}
+
+	// A file saved without changes, or rewritten by write-back as it already was, is left alone
+	if seen && hash == last.hash {
+		fw.stamps[directoryID] = stamp
+		return nil
+	}
+
+	deferred, err := fw.app.pullDeferred(directoryID)
+	if err != nil || deferred {
+		return err
+	}
+
+	// A file that fails to import is retried once it changes again; the error is shown with the pull status
+	fw.stamps[directoryID] = stamp
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	result, err := fw.app.pullDirectory(ctx, directoryID)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Changes) > 0 {
+		log.Printf("File watch of directory %s: %d inserted, %d updated, %d deleted",
+			directoryID, result.Inserted, result.Updated, result.Deleted)
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to open source file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("unable to read source file: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Merged header constants, for how the lines of a multi-line header become column names
+const (
+	MergedHeaderJoin = "join" // join the cells of each column, top to bottom
+	MergedHeaderFill = "fill" // like join, but a label carries over the blank cells to its right, as merged cells read
+	MergedHeaderLast = "last" // use the last line only
+)
+
+// Header layout limits
+const (
+	maxHeaderLines     = 5
+	maxLayoutRows      = 1000 // highest header row and most skipped rows
+	maxFooterMarkerLen = 100
+)
+
+// HeaderLayout says where a source's header and data are, for sources with title banners,
+// instruction rows, grouped headers or footers rather than a one-row header on row 1.
+// The zero value is that plain layout.
+type HeaderLayout struct {
+	HeaderRow    int    `json:"header_row,omitempty"`    // row of the header's first line; 0 means row 1
+	HeaderLines  int    `json:"header_lines,omitempty"`  // rows the header spans; 0 means 1
+	SkipRows     int    `json:"skip_rows,omitempty"`     // rows between the header and the first data row
+	FooterMarker string `json:"footer_marker,omitempty"` // data ends before the first row whose first filled cell starts with this
+	MergedHeader string `json:"merged_header,omitempty"` // one of the MergedHeader constants; empty means join
+}
+
+// isDefault reports whether the layout is a one-row header on row 1 followed by data
+func (layout HeaderLayout) isDefault() bool {
+	return layout.headerRow() == 1 && layout.headerLines() == 1 && layout.SkipRows == 0 && layout.FooterMarker == ""
+}
+
+func (layout HeaderLayout) headerRow() int {
+	if layout.HeaderRow < 1 {
+		return 1
+	}
+	return layout.HeaderRow
+}
+
+func (layout HeaderLayout) headerLines() int {
+	if layout.HeaderLines < 1 {
+		return 1
+	}
+	return layout.HeaderLines
+}
+
+// headerEnd is the source row of the header's last line, which is where header cells are written
+func (layout HeaderLayout) headerEnd() int {
+	return layout.headerRow() + layout.headerLines() - 1
+}
+
+// dataStart is the source row of the first data row
+func (layout HeaderLayout) dataStart() int {
+	return layout.headerEnd() + layout.SkipRows + 1
+}
+
+// validate checks the layout's settings
+func (layout HeaderLayout) validate() error {
+	switch {
+	case layout.HeaderRow < 0 || layout.HeaderRow > maxLayoutRows:
+		return fmt.Errorf("header row must be between 1 and %d", maxLayoutRows)
+	case layout.HeaderLines < 0 || layout.HeaderLines > maxHeaderLines:
+		return fmt.Errorf("the header can span at most %d rows", maxHeaderLines)
+	case layout.SkipRows < 0 || layout.SkipRows > maxLayoutRows:
+		return fmt.Errorf("rows to skip must be between 0 and %d", maxLayoutRows)
+	case len(layout.FooterMarker) > maxFooterMarkerLen:
+		return fmt.Errorf("footer marker exceeds maximum length (%d characters)", maxFooterMarkerLen)
+	}
+
+	switch layout.MergedHeader {
+	case "", MergedHeaderJoin, MergedHeaderFill, MergedHeaderLast:
+		return nil
+	default:
+		return fmt.Errorf("invalid merged header handling %q: use join, fill or last", layout.MergedHeader)
+	}
+}
+
+// isFooter reports whether a row is the footer the data ends before
+func (layout HeaderLayout) isFooter(cells []string) bool {
+	if layout.FooterMarker == "" {
+		return false
+	}
+	for _, cell := range cells {
+		if cell = strings.TrimSpace(cell); cell != "" {
+			return strings.HasPrefix(strings.ToLower(cell), strings.ToLower(strings.TrimSpace(layout.FooterMarker)))
+		}
+	}
+	return false
+}
+
+// combineHeader turns the lines of a header into one column name per column. A row key
+// column never takes a group label, since it is added after the sheet's own columns.
+func (layout HeaderLayout) combineHeader(lines [][]string) []string {
+	last := lines[len(lines)-1]
+	if len(lines) == 1 || layout.MergedHeader == MergedHeaderLast {
+		return last
+	}
+
+	width := 0
+	for _, line := range lines {
+		if len(line) > width {
+			width = len(line)
+		}
+	}
+
+	// Carry group labels over the blank cells to their right
+	filled := make([][]string, len(lines))
+	for i, line := range lines {
+		filled[i] = make([]string, width)
+		label := ""
+		for col := 0; col < width; col++ {
+			cell := strings.TrimSpace(cellValue(line, col))
+			if cell != "" || layout.MergedHeader != MergedHeaderFill || i == len(lines)-1 {
+				label = cell
+			}
+			filled[i][col] = label
+		}
+	}
+
+	header := make([]string, width)
+	for col := range header {
+		if strings.TrimSpace(cellValue(last, col)) == rowKeyHeader {
+			header[col] = rowKeyHeader
+			continue
+		}
+		var parts []string
+		for _, line := range filled {
+			if line[col] != "" {
+				parts = append(parts, line[col])
+			}
+		}
+		header[col] = strings.Join(parts, " ")
+	}
+	return header
+}
+
+// headerLayoutFromForm reads the header layout fields of an import form
+func headerLayoutFromForm(r *http.Request) (HeaderLayout, error) {
+	layout := HeaderLayout{
+		FooterMarker: strings.TrimSpace(r.FormValue("footer_marker")),
+		MergedHeader: strings.TrimSpace(r.FormValue("merged_header")),
+	}
+
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"header_row", &layout.HeaderRow},
+		{"header_lines", &layout.HeaderLines},
+		{"skip_rows", &layout.SkipRows},
+	} {
+		text := strings.TrimSpace(r.FormValue(field.name))
+		if text == "" {
+			continue
+		}
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return layout, fmt.Errorf("invalid %s: must be a whole number", strings.ReplaceAll(field.name, "_", " "))
+		}
+		*field.value = number
+	}
+
+	return layout, layout.validate()
+}
+
+// HeaderLayoutSource presents a source with a HeaderLayout as a plain one: its header on
+// row 1 and its data rows from row 2, leaving out the rows around them. Row numbers given
+// to it are converted to the source's rows. Writes that add rows go above the footer, so
+// as with a MultiTabSource they must come after a read, which finds it.
+type HeaderLayoutSource struct {
+	source   DataSource
+	layout   HeaderLayout
+	dataRows int  // data rows at the last read, or -1 before a read
+	footer   bool // the last read found the footer, which follows the data rows
+}
+
+// wrap returns source as laid out by the layout, or source itself for the plain layout
+func (layout HeaderLayout) wrap(source DataSource) DataSource {
+	if layout.isDefault() {
+		return source
+	}
+	return newHeaderLayoutSource(source, layout)
+}
+
+func newHeaderLayoutSource(source DataSource, layout HeaderLayout) *HeaderLayoutSource {
+	return &HeaderLayoutSource{source: source, layout: layout, dataRows: -1}
+}
+
+func (hs *HeaderLayoutSource) Type() string {
+	return hs.source.Type()
+}
+
+func (hs *HeaderLayoutSource) Title(ctx context.Context) (string, error) {
+	return hs.source.Title(ctx)
+}
+
+// sourceRow converts a row number to the source's row
+func (hs *HeaderLayoutSource) sourceRow(rowNumber int) int {
+	if rowNumber <= 1 {
+		return hs.layout.headerEnd()
+	}
+	return hs.layout.dataStart() + rowNumber - 2
+}
+
+// layoutReader picks the header and data rows out of a source's rows as they are read
+type layoutReader struct {
+	layout   HeaderLayout
+	row      int // source rows seen
+	lines    [][]string
+	dataRows int
+	footer   bool
+}
+
+// add returns the header, once its last line has been seen, and the data rows among rows
+func (lr *layoutReader) add(rows [][]string) [][]string {
+	var out [][]string
+	for _, cells := range rows {
+		lr.row++
+		switch {
+		case lr.footer || lr.row < lr.layout.headerRow():
+		case lr.row <= lr.layout.headerEnd():
+			lr.lines = append(lr.lines, cells)
+			if lr.row == lr.layout.headerEnd() {
+				out = append(out, lr.layout.combineHeader(lr.lines))
+			}
+		case lr.row < lr.layout.dataStart():
+		case lr.layout.isFooter(cells):
+			lr.footer = true
+		default:
+			out = append(out, cells)
+			lr.dataRows++
+		}
+	}
+	return out
+}
+
+// finish checks that the source reached the header
+func (lr *layoutReader) finish() error {
+	if lr.row > 0 && lr.row < lr.layout.headerEnd() {
+		return fmt.Errorf("the source has %d rows, but its header is set to end on row %d", lr.row, lr.layout.headerEnd())
+	}
+	return nil
+}
+
+// record keeps what a completed read found out about the data rows
+func (hs *HeaderLayoutSource) record(lr *layoutReader) error {
+	if err := lr.finish(); err != nil {
+		return err
+	}
+	hs.dataRows = lr.dataRows
+	hs.footer = lr.footer
+	return nil
+}
+
+func (hs *HeaderLayoutSource) ReadAll(ctx context.Context) ([][]string, error) {
+	values, err := hs.source.ReadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lr := &layoutReader{layout: hs.layout}
+	arranged := lr.add(values)
+	if err := hs.record(lr); err != nil {
+		return nil, err
+	}
+	return arranged, nil
+}
+
+// ReadChunks reads the source a chunk at a time where it supports it, handing over the
+// header and data rows of each chunk
+func (hs *HeaderLayoutSource) ReadChunks(ctx context.Context, chunkRows int, fn func(rows [][]string) error) error {
+	reader, ok := hs.source.(chunkReader)
+	if !ok {
+		values, err := hs.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(values); start += chunkRows {
+			end := start + chunkRows
+			if end > len(values) {
+				end = len(values)
+			}
+			if err := fn(values[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	lr := &layoutReader{layout: hs.layout}
+	err := reader.ReadChunks(ctx, chunkRows, func(rows [][]string) error {
+		if arranged := lr.add(rows); len(arranged) > 0 {
+			return fn(arranged)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return hs.record(lr)
+}
+
+func (hs *HeaderLayoutSource) UpdateCell(ctx context.Context, rowNumber, col int, value string) error {
+	return hs.source.UpdateCell(ctx, hs.sourceRow(rowNumber), col, value)
+}
+
+// UpdateColumn writes a header value to the header's last line and the rest to the data rows
+func (hs *HeaderLayoutSource) UpdateColumn(ctx context.Context, col, firstRow int, values []string) error {
+	if firstRow == 1 && len(values) > 0 && hs.layout.dataStart() != hs.layout.headerEnd()+1 {
+		if err := hs.source.UpdateColumn(ctx, col, hs.layout.headerEnd(), values[:1]); err != nil {
+			return err
+		}
+		values = values[1:]
+		firstRow = 2
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return hs.source.UpdateColumn(ctx, col, hs.sourceRow(firstRow), values)
+}
+
+// HideColumn hides the column where the source can hide columns
+func (hs *HeaderLayoutSource) HideColumn(ctx context.Context, col int) error {
+	if hider, ok := hs.source.(columnHider); ok {
+		return hider.HideColumn(ctx, col)
+	}
+	return nil
+}
+
+// AppendRow adds a row after the last data row, above the footer if there is one
+func (hs *HeaderLayoutSource) AppendRow(ctx context.Context, values []string) error {
+	writes, err := hs.sourceWrites(ctx, []SourceWrite{{Kind: SyncJobAppendRow, Values: values}})
+	if err != nil {
+		return err
+	}
+	if writes[0].Kind == SyncJobAppendRow {
+		return hs.source.AppendRow(ctx, values)
+	}
+	return hs.source.ApplyBatch(ctx, writes)
+}
+
+func (hs *HeaderLayoutSource) DeleteRow(ctx context.Context, rowNumber int) error {
+	if err := hs.source.DeleteRow(ctx, hs.sourceRow(rowNumber)); err != nil {
+		return err
+	}
+	if hs.dataRows > 0 {
+		hs.dataRows--
+	}
+	return nil
+}
+
+func (hs *HeaderLayoutSource) ApplyBatch(ctx context.Context, writes []SourceWrite) error {
+	writes, err := hs.sourceWrites(ctx, writes)
+	if err != nil {
+		return err
+	}
+	return hs.source.ApplyBatch(ctx, writes)
+}
+
+// sourceWrites converts writes to the source's rows. With a footer, appends become inserts
+// above it; the source is read first if it hasn't been, to find the footer.
+func (hs *HeaderLayoutSource) sourceWrites(ctx context.Context, writes []SourceWrite) ([]SourceWrite, error) {
+	if hs.layout.FooterMarker != "" && hs.dataRows < 0 {
+		if _, err := hs.ReadAll(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	converted := make([]SourceWrite, 0, len(writes))
+	dataRows := hs.dataRows
+	for _, write := range writes {
+		switch write.Kind {
+		case SyncJobAppendRow:
+			if hs.footer {
+				write.Kind = sourceWriteInsertRow
+				write.RowNumber = hs.layout.dataStart() + dataRows
+			}
+			dataRows++
+		case SyncJobDeleteRow:
+			write.RowNumber = hs.sourceRow(write.RowNumber)
+			dataRows--
+		default:
+			write.RowNumber = hs.sourceRow(write.RowNumber)
+		}
+		converted = append(converted, write)
+	}
+
+	if hs.dataRows >= 0 {
+		hs.dataRows = dataRows
+	}
+	return converted, nil
+}
+
+// ReadCellRules reads the source's rules for the data rows and moves them to the data's row
+// numbers; rules for the rows around the data are dropped
+func (hs *HeaderLayoutSource) ReadCellRules(ctx context.Context, rows []int) ([]SourceCellRule, error) {
+	reader, ok := hs.source.(cellRuleReader)
+	if !ok {
+		return nil, nil
+	}
+
+	var sourceRows []int
+	if rows != nil {
+		sourceRows = make([]int, 0, len(rows))
+		for _, row := range rows {
+			sourceRows = append(sourceRows, hs.sourceRow(row))
+		}
+	}
+
+	sourceRules, err := reader.ReadCellRules(ctx, sourceRows)
+	if err != nil {
+		return nil, err
+	}
+
+	dataStart := hs.layout.dataStart()
+	lastRow := 0 // last data row of the source, or 0 if there may be more rows of data
+	if hs.footer {
+		lastRow = dataStart + hs.dataRows - 1
+	}
+
+	var rules []SourceCellRule
+	for _, rule := range sourceRules {
+		if rule.FirstRow < dataStart {
+			rule.FirstRow = dataStart
+		}
+		if lastRow > 0 && (rule.LastRow == 0 || rule.LastRow > lastRow) {
+			rule.LastRow = lastRow
+		}
+		if rule.LastRow != 0 && rule.LastRow < rule.FirstRow {
+			continue
+		}
+
+		rule.FirstRow -= dataStart - 2
+		if rule.LastRow != 0 {
+			rule.LastRow -= dataStart - 2
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// errSyntheticReadOnly is returned by the write methods of a synthetic source
+var errSyntheticReadOnly = errors.New("synthetic source is read-only")
+
+// syntheticSource is a read-only DataSource that generates its rows instead of reading
+// them, for measuring import throughput without a sheet. Every editEvery-th row reads
+// differently in each generation, so importing a new generation updates those rows.
+type syntheticSource struct {
+	rows       int
+	columns    int
+	editEvery  int
+	generation int
+}
+
+func (ss *syntheticSource) Type() string {
+	return "synthetic"
+}
+
+func (ss *syntheticSource) Title(ctx context.Context) (string, error) {
+	return fmt.Sprintf("synthetic (%d rows, %d columns)", ss.rows, ss.columns), nil
+}
+
+// header names the columns Column 1, Column 2 and so on
+func (ss *syntheticSource) header() []string {
+	header := make([]string, ss.columns)
+	for j := range header {
+		header[j] = fmt.Sprintf("Column %d", j+1)
+	}
+	return header
+}
+
+// row generates data row i; the last column is numeric
+func (ss *syntheticSource) row(i int) []string {
+	row := make([]string, ss.columns)
+	for j := range row {
+		row[j] = fmt.Sprintf("Listing %d value %d", i, j)
+	}
+	row[ss.columns-1] = strconv.Itoa(i)
+	if ss.editEvery > 0 && i%ss.editEvery == 0 {
+		row[0] += fmt.Sprintf(" (edit %d)", ss.generation)
+	}
+	return row
+}
+
+func (ss *syntheticSource) ReadAll(ctx context.Context) ([][]string, error) {
+	var values [][]string
+	err := ss.ReadChunks(ctx, ss.rows+1, func(rows [][]string) error {
+		values = append(values, rows...)
+		return nil
+	})
+	return values, err
+}
+
+func (ss *syntheticSource) ReadChunks(ctx context.Context, chunkRows int, fn func(rows [][]string) error) error {
+	chunk := [][]string{ss.header()}
+	for i := 0; i < ss.rows; i++ {
+		if len(chunk) == chunkRows {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk = make([][]string, 0, chunkRows)
+		}
+		chunk = append(chunk, ss.row(i))
+	}
+	return fn(chunk)
+}
+
+func (ss *syntheticSource) UpdateCell(ctx context.Context, rowNumber, col int, value string) error {
+	return errSyntheticReadOnly
+}
+
+func (ss *syntheticSource) UpdateColumn(ctx context.Context, col, firstRow int, values []string) error {
+	return errSyntheticReadOnly
+}
+
+func (ss *syntheticSource) AppendRow(ctx context.Context, values []string) error {
+	return errSyntheticReadOnly
+}
+
+func (ss *syntheticSource) DeleteRow(ctx context.Context, rowNumber int) error {
+	return errSyntheticReadOnly
+}
+
+func (ss *syntheticSource) ApplyBatch(ctx context.Context, writes []SourceWrite) error {
+	return errSyntheticReadOnly
+}
+
+// Size of the synthetic source the import benchmarks read
+const (
+	benchmarkRows      = 10000
+	benchmarkColumns   = 8
+	benchmarkEditEvery = 10
+)
+
+// BenchmarkImport measures a first import, an unchanged re-import and a re-import with
+// edits of a synthetic source. It runs with `go test -bench=Import -run=^$`.
+func BenchmarkImport(b *testing.B) {
+	app := newBenchmarkApp(b)
+	source := &syntheticSource{rows: benchmarkRows, columns: benchmarkColumns, editEvery: benchmarkEditEvery}
+	columnNames := source.header()
+	columnTypes := make([]string, benchmarkColumns)
+	for j := range columnTypes {
+		columnTypes[j] = "basic"
+	}
+	columnTypes[benchmarkColumns-1] = "numeric"
+
+	runImport := func(b *testing.B, directoryID string) *ImportResult {
+		result, err := app.importDirectory(context.Background(), source, directoryID, columnNames, columnTypes, false, nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return result
+	}
+	// Sub-benchmarks run more than once, so every run imports into a new directory
+	directories := 0
+	newDirectory := func(b *testing.B) string {
+		directories++
+		directoryID := fmt.Sprintf("bench-%d", directories)
+		createBenchmarkDirectory(b, app, directoryID)
+		return directoryID
+	}
+	reportRows := func(b *testing.B) {
+		b.ReportMetric(float64(benchmarkRows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+	}
+
+	b.Run("first import", func(b *testing.B) {
+		source.generation = 0
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			directoryID := newDirectory(b)
+			b.StartTimer()
+
+			runImport(b, directoryID)
+		}
+		reportRows(b)
+	})
+
+	b.Run("unchanged re-import", func(b *testing.B) {
+		source.generation = 0
+		directoryID := newDirectory(b)
+		runImport(b, directoryID)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if result := runImport(b, directoryID); result.Unchanged != benchmarkRows {
+				b.Fatalf("%d of %d rows unchanged", result.Unchanged, benchmarkRows)
+			}
+		}
+		reportRows(b)
+	})
+
+	b.Run("re-import with edits", func(b *testing.B) {
+		source.generation = 0
+		directoryID := newDirectory(b)
+		runImport(b, directoryID)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			source.generation = i + 1
+			if result := runImport(b, directoryID); result.Updated != benchmarkRows/benchmarkEditEvery {
+				b.Fatalf("%d rows updated, want %d", result.Updated, benchmarkRows/benchmarkEditEvery)
+			}
+		}
+		reportRows(b)
+	})
+}
+
+// newBenchmarkApp returns an app with a private database in a temporary folder, which
+// needs none of the server's configuration
+func newBenchmarkApp(b *testing.B) *App {
+	b.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "private.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	app := &App{DB: db, Config: &Config{SheetRange: "A:Z"}}
+	if err := app.initDatabase(); err != nil {
+		b.Fatal(err)
+	}
+	app.DirectoryDBManager = NewDirectoryDatabaseManager(app)
+	b.Cleanup(func() {
+		app.DirectoryDBManager.CloseAll()
+		db.Close()
+	})
+	return app
+}
+
+// createBenchmarkDirectory adds an empty directory with its own database
+func createBenchmarkDirectory(b *testing.B, app *App, directoryID string) {
+	b.Helper()
+	dbPath := filepath.Join(b.TempDir(), directoryID+".db")
+	_, err := app.DB.Exec(`
+		INSERT INTO directories (id, name, description, database_path, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, directoryID, "Import benchmark", "", dbPath, time.Now(), time.Now())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := app.initDirectoryDatabase(dbPath); err != nil {
+		b.Fatal(err)
+	}
+}
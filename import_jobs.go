@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Import job status constants
+const (
+	ImportJobRunning   = "running"
+	ImportJobCompleted = "completed"
+	ImportJobFailed    = "failed"
+	ImportJobCancelled = "cancelled"
+)
+
+// Import phase constants, in the order an import goes through them
+const (
+	ImportPhaseQueued  = "queued"   // waiting for other syncs of the directory to finish
+	ImportPhaseReading = "reading"  // reading the source
+	ImportPhaseRowKeys = "row_keys" // writing missing row keys to the source
+	ImportPhaseWriting = "writing"  // writing rows to the directory
+	ImportPhaseDone    = "done"
+)
+
+const (
+	importJobTimeout       = 30 * time.Minute
+	importProgressInterval = time.Second
+)
+
+// errImportJobRunning is returned when a directory already has an import in progress
+var errImportJobRunning = errors.New("an import is already running for this directory")
+
+// importJobCancels holds the cancel function of each import running in this process
+var importJobCancels sync.Map
+
+// ImportJob is an import running, or run, in the background
+type ImportJob struct {
+	ID          int64         `json:"id"`
+	DirectoryID string        `json:"directory_id"`
+	Status      string        `json:"status"`
+	Phase       string        `json:"phase"`
+	SourceType  string        `json:"source_type"`
+	Location    string        `json:"location"`
+	RowsRead    int           `json:"rows_read"`    // data rows read from the source
+	RowsWritten int           `json:"rows_written"` // data rows written to the directory so far
+	Result      *ImportResult `json:"result,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	CreatedBy   string        `json:"created_by"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	FinishedAt  *time.Time    `json:"finished_at,omitempty"`
+}
+
+// ImportJobActionRequest identifies an import job to cancel
+type ImportJobActionRequest struct {
+	JobID int64 `json:"job_id"`
+}
+
+// importProgress records how far an import job has got. A nil *importProgress records
+// nothing, for imports that don't run as a job.
+type importProgress struct {
+	app         *App
+	jobID       int64
+	phase       string
+	rowsRead    int
+	rowsWritten int
+	savedAt     time.Time
+}
+
+// setPhase records that the import moved on to another phase
+func (p *importProgress) setPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.phase = phase
+	p.save()
+}
+
+// setRowsRead records how many data rows were read from the source
+func (p *importProgress) setRowsRead(rows int) {
+	if p == nil {
+		return
+	}
+	p.rowsRead = rows
+	p.save()
+}
+
+// rowWritten counts a data row written to the directory, saving the count now and then
+func (p *importProgress) rowWritten() {
+	if p == nil {
+		return
+	}
+	p.rowsWritten++
+	if time.Since(p.savedAt) >= importProgressInterval {
+		p.save()
+	}
+}
+
+func (p *importProgress) save() {
+	p.savedAt = time.Now()
+	_, err := p.app.DB.Exec(`
+		UPDATE import_jobs SET phase = ?, rows_read = ?, rows_written = ?, updated_at = ? WHERE id = ?
+	`, p.phase, p.rowsRead, p.rowsWritten, time.Now().UTC(), p.jobID)
+	if err != nil {
+		log.Printf("Failed to save progress of import job %d: %v", p.jobID, err)
+	}
+}
+
+// createImportJob records a new running import for a directory, unless one is already running
+func (app *App) createImportJob(binding *DirectorySource, createdBy string) (*ImportJob, error) {
+	now := time.Now().UTC()
+	result, err := app.DB.Exec(`
+		INSERT INTO import_jobs (directory_id, status, phase, source_type, location, created_by, created_at, updated_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM import_jobs WHERE directory_id = ? AND status = ?)
+	`, binding.DirectoryID, ImportJobRunning, ImportPhaseQueued, binding.SourceType, binding.Location, createdBy, now, now,
+		binding.DirectoryID, ImportJobRunning)
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConstraint, "failed to create import job", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, errImportJobRunning
+	}
+
+	jobID, err := result.LastInsertId()
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to get import job ID", err)
+	}
+
+	return app.getImportJob(binding.DirectoryID, jobID)
+}
+
+// startImportJob imports a directory in the background. The job can be cancelled as soon as
+// this returns. The source must have been opened with ctx, which cancel cancels.
+func (app *App) startImportJob(
+	ctx context.Context, cancel context.CancelFunc, job *ImportJob, source DataSource,
+	binding *DirectorySource, columnNames []string, columnTypes []string, normalizers map[string]ColumnNormalizers,
+) {
+	importJobCancels.Store(job.ID, cancel)
+	go app.runImportJob(ctx, cancel, job, source, binding, columnNames, columnTypes, normalizers)
+}
+
+// runImportJob imports a directory and records the outcome
+func (app *App) runImportJob(
+	ctx context.Context, cancel context.CancelFunc, job *ImportJob, source DataSource,
+	binding *DirectorySource, columnNames []string, columnTypes []string, normalizers map[string]ColumnNormalizers,
+) {
+	defer cancel()
+	defer importJobCancels.Delete(job.ID)
+
+	// Keep the write-back worker and scheduled pulls off the directory while it is replaced
+	unlock := lockDirectorySync(job.DirectoryID)
+	defer unlock()
+
+	progress := &importProgress{app: app, jobID: job.ID}
+	result, err := app.importDirectory(ctx, source, job.DirectoryID, columnNames, columnTypes, binding.ManageRowKeys, normalizers, progress)
+	if err == nil {
+		err = app.saveImportedSource(binding, job.CreatedBy)
+	}
+
+	status := ImportJobCompleted
+	switch {
+	case err != nil && errors.Is(ctx.Err(), context.Canceled):
+		status = ImportJobCancelled
+		err = errors.New("import cancelled before its rows were committed")
+	case err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status = ImportJobFailed
+		err = fmt.Errorf("import timed out after %v: %v", importJobTimeout, err)
+	case err != nil:
+		status = ImportJobFailed
+	}
+
+	if err != nil {
+		log.Printf("Import job %d for directory %s %s: %v", job.ID, job.DirectoryID, status, err)
+	} else {
+		log.Printf("Import job %d imported directory %s: %d inserted, %d updated, %d deleted, %d unchanged",
+			job.ID, job.DirectoryID, result.Inserted, result.Updated, result.Deleted, result.Unchanged)
+	}
+
+	if err := app.finishImportJob(job.ID, status, progress, result, err); err != nil {
+		log.Printf("Failed to record outcome of import job %d: %v", job.ID, err)
+	}
+}
+
+// saveImportedSource binds a directory to the source it was just imported from
+func (app *App) saveImportedSource(binding *DirectorySource, userEmail string) error {
+	if err := app.saveDirectorySource(binding); err != nil {
+		return fmt.Errorf("failed to save directory source: %v", err)
+	}
+
+	if binding.SourceType == SourceTypeGoogleSheet {
+		_, err := app.DB.Exec("UPDATE admin_sessions SET sheet_url = ?, directory_id = ? WHERE user_email = ?",
+			binding.Location, binding.DirectoryID, userEmail)
+		if err != nil {
+			return fmt.Errorf("failed to save sheet URL for user %s: %v", userEmail, err)
+		}
+	}
+	return nil
+}
+
+// finishImportJob records the final state of an import job
+func (app *App) finishImportJob(jobID int64, status string, progress *importProgress, result *ImportResult, jobErr error) error {
+	var resultJSON, errorMessage sql.NullString
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("failed to marshal import result: %v", err)
+		}
+		resultJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	if jobErr != nil {
+		errorMessage = sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+
+	now := time.Now().UTC()
+	_, err := app.DB.Exec(`
+		UPDATE import_jobs SET status = ?, phase = ?, rows_read = ?, rows_written = ?, result = ?, error = ?,
+		       updated_at = ?, finished_at = ?
+		WHERE id = ?
+	`, status, ImportPhaseDone, progress.rowsRead, progress.rowsWritten, resultJSON, errorMessage, now, now, jobID)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConnection, "failed to finish import job", err)
+	}
+	return nil
+}
+
+// failInterruptedImportJobs marks imports that were running when the server stopped as failed
+func (app *App) failInterruptedImportJobs() {
+	now := time.Now().UTC()
+	_, err := app.DB.Exec(`
+		UPDATE import_jobs SET status = ?, phase = ?, error = ?, updated_at = ?, finished_at = ?
+		WHERE status = ?
+	`, ImportJobFailed, ImportPhaseDone, "interrupted by a server restart before its rows were committed",
+		now, now, ImportJobRunning)
+	if err != nil {
+		log.Printf("Failed to fail interrupted import jobs: %v", err)
+	}
+}
+
+// CancelImportJob stops a running import. The import rolls back whatever it has not
+// committed yet and records itself as cancelled.
+func (app *App) CancelImportJob(directoryID string, jobID int64) error {
+	job, err := app.getImportJob(directoryID, jobID)
+	if err != nil {
+		return err
+	}
+	if job.Status != ImportJobRunning {
+		return fmt.Errorf("import job %d is already %s", jobID, job.Status)
+	}
+
+	cancel, ok := importJobCancels.Load(jobID)
+	if !ok {
+		return fmt.Errorf("import job %d is not running in this process", jobID)
+	}
+	cancel.(context.CancelFunc)()
+	return nil
+}
+
+// getImportJob loads one of a directory's import jobs
+func (app *App) getImportJob(directoryID string, jobID int64) (*ImportJob, error) {
+	row := app.DB.QueryRow(`
+		SELECT id, directory_id, status, phase, COALESCE(source_type, ''), COALESCE(location, ''), rows_read,
+		       rows_written, result, COALESCE(error, ''), COALESCE(created_by, ''), created_at, updated_at, finished_at
+		FROM import_jobs WHERE id = ? AND directory_id = ?
+	`, jobID, directoryID)
+
+	job, err := scanImportJob(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("import job %d not found", jobID)
+	}
+	return job, err
+}
+
+// getLatestImportJob returns a directory's most recent import job, or nil if it has none
+func (app *App) getLatestImportJob(directoryID string) (*ImportJob, error) {
+	row := app.DB.QueryRow(`
+		SELECT id, directory_id, status, phase, COALESCE(source_type, ''), COALESCE(location, ''), rows_read,
+		       rows_written, result, COALESCE(error, ''), COALESCE(created_by, ''), created_at, updated_at, finished_at
+		FROM import_jobs WHERE directory_id = ? ORDER BY id DESC LIMIT 1
+	`, directoryID)
+
+	job, err := scanImportJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+func scanImportJob(scanner rowScanner) (*ImportJob, error) {
+	var job ImportJob
+	var resultJSON sql.NullString
+	var finishedAt sql.NullTime
+	err := scanner.Scan(&job.ID, &job.DirectoryID, &job.Status, &job.Phase, &job.SourceType, &job.Location,
+		&job.RowsRead, &job.RowsWritten, &resultJSON, &job.Error, &job.CreatedBy, &job.CreatedAt, &job.UpdatedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if resultJSON.Valid {
+		if err := json.Unmarshal([]byte(resultJSON.String), &job.Result); err != nil {
+			return nil, fmt.Errorf("failed to parse result of import job %d: %v", job.ID, err)
+		}
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	return &job, nil
+}
+
+// handleGetImportJob reports the progress of an import job. Pass ?id=<job ID>, or leave it
+// out for the directory's most recent import (null if it has none).
+func (app *App) handleGetImportJob(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var job *ImportJob
+	var err error
+	if param := r.URL.Query().Get("id"); param != "" {
+		jobID, parseErr := strconv.ParseInt(param, 10, 64)
+		if parseErr != nil {
+			utils2.ValidationError(w, "Invalid import job ID")
+			return
+		}
+		job, err = app.getImportJob(directoryID, jobID)
+		if err != nil {
+			utils2.NotFoundError(w, "Import job")
+			return
+		}
+	} else {
+		job, err = app.getLatestImportJob(directoryID)
+		if err != nil {
+			log.Printf("Failed to get latest import job for directory %s: %v", directoryID, err)
+			utils2.InternalServerError(w, "Failed to get import job")
+			return
+		}
+	}
+
+	utils2.RespondWithSuccess(w, job, "")
+}
+
+// handleCancelImportJob stops a running import
+func (app *App) handleCancelImportJob(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req ImportJobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode cancel import request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	if err := app.CancelImportJob(directoryID, req.JobID); err != nil {
+		log.Printf("Failed to cancel import job %d: %v", req.JobID, err)
+		utils2.NotFoundError(w, "Running import job")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, nil, "Import cancelling")
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sheetRowColumn stores the absolute 1-based source row a directory row was last seen at
+const sheetRowColumn = "_sheetRow"
+
+// ImportResult summarises the changes an import applied to a directory table
+type ImportResult struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Unchanged int `json:"unchanged"`
+
+	// Changes lists every inserted, updated and deleted row
+	Changes []RowChange `json:"-"`
+}
+
+// Row change type constants
+const (
+	RowChangeInsert = "insert"
+	RowChangeUpdate = "update"
+	RowChangeDelete = "delete"
+)
+
+// RowChange describes one row an import changed. For updates only the columns whose
+// value changed are listed; inserts and deletes carry the whole row.
+type RowChange struct {
+	RowID      int64             `json:"row_id"`
+	ChangeType string            `json:"change_type"`
+	SheetRow   int               `json:"sheet_row"`
+	OldValues  map[string]string `json:"old_values,omitempty"`
+	NewValues  map[string]string `json:"new_values,omitempty"`
+}
+
+// rowValueMap pairs a row's cells with column names
+func rowValueMap(columnNames, values []string) map[string]string {
+	result := make(map[string]string, len(columnNames))
+	for i, name := range columnNames {
+		if i < len(values) {
+			result[name] = values[i]
+		}
+	}
+	return result
+}
+
+// changedValueMaps returns the old and new values of the columns that differ
+func changedValueMaps(columnNames, oldValues, newValues []string) (map[string]string, map[string]string) {
+	before := make(map[string]string)
+	after := make(map[string]string)
+	for i, name := range columnNames {
+		if oldValues[i] != newValues[i] {
+			before[name] = oldValues[i]
+			after[name] = newValues[i]
+		}
+	}
+	return before, after
+}
+
+// existingRow is a directory row as currently stored, used when diffing against the source
+type existingRow struct {
+	rowID    int64
+	sheetRow int
+	key      string
+	values   []string
+	raw      string // rawValuesColumn
+	claimed  bool
+}
+
+// incomingRow is a source row waiting to be matched against an existing row
+type incomingRow struct {
+	sheetRow int
+	key      string
+	values   []string // normalised values
+	raw      string   // source values the normalisers changed, as stored in rawValuesColumn
+	match    *existingRow
+}
+
+// rowContentKey builds a comparison key from a row's cell values
+func rowContentKey(values []string) string {
+	return strings.Join(values, "\x1f")
+}
+
+// ensureDirectoryTable creates the typed directory table if needed, or copies its rows into
+// one with the new columns when the column set no longer matches, and reports whether a new
+// empty table was created. Legacy tables without the source row, row key and raw value
+// columns are upgraded in place so their row IDs are kept.
+func ensureDirectoryTable(db *sql.DB, directoryID string, columnNames []string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info('%s')", directoryID))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect directory table: %v", err)
+	}
+
+	existing := make(map[string]bool)
+	hasSheetRow := false
+	hasRowKey := false
+	hasRawValues := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("failed to scan directory table info: %v", err)
+		}
+		switch name {
+		case "rowID":
+		case sheetRowColumn:
+			hasSheetRow = true
+		case rowKeyColumn:
+			hasRowKey = true
+		case rawValuesColumn:
+			hasRawValues = true
+		default:
+			existing[name] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to read directory table info: %v", err)
+	}
+
+	if len(existing) > 0 {
+		sameColumns := len(existing) == len(columnNames)
+		for _, name := range columnNames {
+			if !existing[name] {
+				sameColumns = false
+				break
+			}
+		}
+
+		if sameColumns {
+			if !hasSheetRow {
+				if err := addSheetRowColumn(db, directoryID); err != nil {
+					return false, err
+				}
+			}
+			if !hasRowKey {
+				if _, err := db.Exec(fmt.Sprintf("ALTER TABLE '%s' ADD COLUMN [%s] TEXT", directoryID, rowKeyColumn)); err != nil {
+					return false, fmt.Errorf("failed to add row key column: %v", err)
+				}
+			}
+			if !hasRawValues {
+				if _, err := db.Exec(fmt.Sprintf("ALTER TABLE '%s' ADD COLUMN [%s] TEXT", directoryID, rawValuesColumn)); err != nil {
+					return false, fmt.Errorf("failed to add raw value column: %v", err)
+				}
+			}
+			return false, nil
+		}
+
+		// The header changed, so the rows move into a table with the new columns and keep
+		// their IDs; the sync below then updates them in place
+		if err := copyDirectoryTable(db, directoryID, columnNames, existing,
+			hasSheetRow, hasRowKey, hasRawValues); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	// Create column definitions for the new table
+	columnDefs := []string{
+		"rowID INTEGER PRIMARY KEY AUTOINCREMENT",
+		fmt.Sprintf("[%s] INTEGER", sheetRowColumn),
+		fmt.Sprintf("[%s] TEXT", rowKeyColumn),
+		fmt.Sprintf("[%s] TEXT", rawValuesColumn),
+	}
+	for i := range columnNames {
+		// Use TEXT type for all columns since tags and locations will be handled in separate tables
+		// Quote column names to handle spaces and special characters
+		columnDefs = append(columnDefs, fmt.Sprintf("[%s] TEXT", columnNames[i]))
+	}
+
+	query := fmt.Sprintf("CREATE TABLE '%s' (%s)", directoryID, strings.Join(columnDefs, ", "))
+	if _, err := db.Exec(query); err != nil {
+		return false, fmt.Errorf("failed to create directory table based on query %v: %v ", query, err)
+	}
+
+	return true, nil
+}
+
+// copyDirectoryTable replaces the directory table with one holding the given columns,
+// copying every row with its ID and the values of the columns both tables share
+func copyDirectoryTable(
+	db *sql.DB, directoryID string, columnNames []string, existing map[string]bool,
+	hasSheetRow, hasRowKey, hasRawValues bool,
+) error {
+	definitions := []string{
+		"rowID INTEGER PRIMARY KEY AUTOINCREMENT",
+		fmt.Sprintf("[%s] INTEGER", sheetRowColumn),
+		fmt.Sprintf("[%s] TEXT", rowKeyColumn),
+		fmt.Sprintf("[%s] TEXT", rawValuesColumn),
+	}
+	targets := []string{"rowID"}
+	for _, column := range []struct {
+		name    string
+		present bool
+	}{{sheetRowColumn, hasSheetRow}, {rowKeyColumn, hasRowKey}, {rawValuesColumn, hasRawValues}} {
+		if column.present {
+			targets = append(targets, fmt.Sprintf("[%s]", column.name))
+		}
+	}
+	for _, name := range columnNames {
+		definitions = append(definitions, fmt.Sprintf("[%s] TEXT", name))
+		if existing[name] {
+			targets = append(targets, fmt.Sprintf("[%s]", name))
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	copyTable := directoryID + "_header_change"
+	columns := strings.Join(targets, ", ")
+	statements := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS '%s'", copyTable),
+		fmt.Sprintf("CREATE TABLE '%s' (%s)", copyTable, strings.Join(definitions, ", ")),
+		fmt.Sprintf("INSERT INTO '%s' (%s) SELECT %s FROM '%s'", copyTable, columns, columns, directoryID),
+		fmt.Sprintf("DROP TABLE '%s'", directoryID),
+		fmt.Sprintf("ALTER TABLE '%s' RENAME TO '%s'", copyTable, directoryID),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to copy directory table: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// addSheetRowColumn upgrades a table created before source rows were tracked. Rows were
+// inserted in sheet order, so their rank by rowID gives their sheet position.
+func addSheetRowColumn(db *sql.DB, directoryID string) error {
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE '%s' ADD COLUMN [%s] INTEGER", directoryID, sheetRowColumn)); err != nil {
+		return fmt.Errorf("failed to add source row column: %v", err)
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`
+		UPDATE '%[1]s' SET [%[2]s] = 1 + (
+			SELECT COUNT(*) FROM '%[1]s' AS earlier WHERE earlier.rowID <= '%[1]s'.rowID
+		)`, directoryID, sheetRowColumn))
+	if err != nil {
+		return fmt.Errorf("failed to backfill source row column: %v", err)
+	}
+
+	return nil
+}
+
+// loadExistingRows reads every stored row of the directory table in source order
+func loadExistingRows(tx *sql.Tx, directoryID string, columnNames []string) ([]*existingRow, error) {
+	quotedColumns := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		quotedColumns[i] = fmt.Sprintf("[%s]", name)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(
+		"SELECT rowID, COALESCE([%s], 0), COALESCE([%s], ''), COALESCE([%s], ''), %s FROM '%s' ORDER BY [%s], rowID",
+		sheetRowColumn, rowKeyColumn, rawValuesColumn, strings.Join(quotedColumns, ", "), directoryID, sheetRowColumn))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query existing rows: %v", err)
+	}
+	defer rows.Close()
+
+	var existing []*existingRow
+	for rows.Next() {
+		row := &existingRow{values: make([]string, len(columnNames))}
+		cells := make([]sql.NullString, len(columnNames))
+		dest := []interface{}{&row.rowID, &row.sheetRow, &row.key, &row.raw}
+		for i := range cells {
+			dest = append(dest, &cells[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan existing row: %v", err)
+		}
+		for i, cell := range cells {
+			row.values[i] = cell.String
+		}
+		existing = append(existing, row)
+	}
+
+	return existing, rows.Err()
+}
+
+// matchRows pairs source rows with stored rows. Rows carrying the same row key are always
+// the same listing, wherever they moved. Of the rest, rows with identical content are
+// matched next, in order, so unchanged listings keep their ID even when rows above them
+// were inserted or removed. The matched rows then act as anchors: leftover rows that sit
+// between the same two anchors on both sides are paired in order and treated as edits.
+// Anything left over after that is an insert or a delete.
+func matchRows(existing []*existingRow, incoming []*incomingRow) {
+	anchors := make(map[*existingRow]int)
+
+	byRowKey := make(map[string]*existingRow)
+	for _, row := range existing {
+		if row.key != "" && byRowKey[row.key] == nil {
+			byRowKey[row.key] = row
+		}
+	}
+	for _, row := range incoming {
+		if candidate := byRowKey[row.key]; row.key != "" && candidate != nil && !candidate.claimed {
+			row.match = candidate
+			candidate.claimed = true
+			anchors[candidate] = row.sheetRow
+		}
+	}
+
+	byContent := make(map[string][]*existingRow)
+	for _, row := range existing {
+		if row.claimed {
+			continue
+		}
+		key := rowContentKey(row.values)
+		byContent[key] = append(byContent[key], row)
+	}
+
+	for _, row := range incoming {
+		if row.match != nil {
+			continue
+		}
+		key := rowContentKey(row.values)
+		candidates := byContent[key]
+		if len(candidates) == 0 {
+			continue
+		}
+		row.match = candidates[0]
+		row.match.claimed = true
+		anchors[row.match] = row.sheetRow
+		byContent[key] = candidates[1:]
+	}
+
+	// Group leftover stored rows by the source row of the anchor above them
+	leftovers := make(map[int][]*existingRow)
+	anchor := 0
+	for _, row := range existing {
+		if row.claimed {
+			anchor = anchors[row]
+			continue
+		}
+		leftovers[anchor] = append(leftovers[anchor], row)
+	}
+
+	anchor = 0
+	for _, row := range incoming {
+		if row.match != nil {
+			anchor = row.sheetRow
+			continue
+		}
+		if candidates := leftovers[anchor]; len(candidates) > 0 {
+			row.match = candidates[0]
+			row.match.claimed = true
+			leftovers[anchor] = candidates[1:]
+		}
+	}
+}
+
+// syncDirectoryRows applies the difference between the stored rows and the source rows in
+// one transaction, which is rolled back if ctx is cancelled before it commits. dataRows
+// excludes the header; the first data row is source row 2. rowKeys holds the row key of
+// each data row, or "" where the source has none. Values are stored as the columns'
+// normalisers make them, keeping the source values they changed alongside.
+func (app *App) syncDirectoryRows(
+	ctx context.Context, directoryID string, columnNames []string, columnTypes []string,
+	dataRows [][]string, rowKeys []string, progress *importProgress,
+) (*ImportResult, error) {
+	incoming := make([]*incomingRow, len(dataRows))
+	for i, row := range dataRows {
+		values := make([]string, len(columnNames))
+		for j := range columnNames {
+			if j < len(row) {
+				values[j] = row[j]
+			}
+		}
+		incoming[i] = &incomingRow{sheetRow: i + 2, key: rowKeys[i], values: values}
+	}
+
+	result := &ImportResult{}
+	err := app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		existing, err := loadExistingRows(tx, directoryID, columnNames)
+		if err != nil {
+			return err
+		}
+
+		normalizers, err := loadColumnNormalizers(tx, columnNames, columnTypes)
+		if err != nil {
+			return err
+		}
+		for _, row := range incoming {
+			if row.raw, err = normalizeRow(columnNames, normalizers, row.values); err != nil {
+				return err
+			}
+		}
+
+		matchRows(existing, incoming)
+
+		tags, err := newTagIndexer(tx, directoryID, columnNames, columnTypes)
+		if err != nil {
+			return err
+		}
+		defer tags.Close()
+
+		quotedColumns := make([]string, len(columnNames))
+		assignments := make([]string, len(columnNames))
+		placeholders := make([]string, len(columnNames))
+		for i, name := range columnNames {
+			quotedColumns[i] = fmt.Sprintf("[%s]", name)
+			assignments[i] = fmt.Sprintf("[%s] = ?", name)
+			placeholders[i] = "?"
+		}
+
+		insertQuery := fmt.Sprintf("INSERT INTO '%s' ([%s], [%s], [%s], %s) VALUES (?, ?, NULLIF(?, ''), %s)",
+			directoryID, sheetRowColumn, rowKeyColumn, rawValuesColumn, strings.Join(quotedColumns, ", "),
+			strings.Join(placeholders, ", "))
+		updateQuery := fmt.Sprintf("UPDATE '%s' SET [%s] = ?, [%s] = ?, [%s] = NULLIF(?, ''), %s WHERE rowID = ?",
+			directoryID, sheetRowColumn, rowKeyColumn, rawValuesColumn, strings.Join(assignments, ", "))
+		moveQuery := fmt.Sprintf("UPDATE '%s' SET [%s] = ?, [%s] = ?, [%s] = NULLIF(?, '') WHERE rowID = ?",
+			directoryID, sheetRowColumn, rowKeyColumn, rawValuesColumn)
+		deleteQuery := fmt.Sprintf("DELETE FROM '%s' WHERE rowID = ?", directoryID)
+
+		// Every row goes through one of these, so they are prepared once per import
+		var insertStmt, updateStmt, moveStmt, deleteStmt *sql.Stmt
+		for _, statement := range []struct {
+			stmt  **sql.Stmt
+			query string
+		}{
+			{&insertStmt, insertQuery}, {&updateStmt, updateQuery}, {&moveStmt, moveQuery}, {&deleteStmt, deleteQuery},
+		} {
+			stmt, err := tx.Prepare(statement.query)
+			if err != nil {
+				return fmt.Errorf("failed to prepare %q: %v", statement.query, err)
+			}
+			defer stmt.Close()
+			*statement.stmt = stmt
+		}
+
+		// Delete stored rows that no longer exist in the source
+		var deleted []*existingRow
+		for _, row := range existing {
+			if !row.claimed {
+				deleted = append(deleted, row)
+			}
+		}
+		sort.Slice(deleted, func(i, j int) bool { return deleted[i].rowID < deleted[j].rowID })
+		for _, row := range deleted {
+			if err := tags.remove(row.rowID); err != nil {
+				return err
+			}
+			if _, err := deleteStmt.Exec(row.rowID); err != nil {
+				return fmt.Errorf("failed to delete row %d: %v", row.rowID, err)
+			}
+			result.Deleted++
+			result.Changes = append(result.Changes, RowChange{
+				RowID:      row.rowID,
+				ChangeType: RowChangeDelete,
+				SheetRow:   row.sheetRow,
+				OldValues:  rowValueMap(columnNames, row.values),
+			})
+		}
+
+		for _, row := range incoming {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			switch {
+			case row.match == nil:
+				args := []interface{}{row.sheetRow, row.key, row.raw}
+				for _, value := range row.values {
+					args = append(args, value)
+				}
+				res, err := insertStmt.Exec(args...)
+				if err != nil {
+					return fmt.Errorf("failed to insert row %d: %v", row.sheetRow, err)
+				}
+				rowID, err := res.LastInsertId()
+				if err != nil {
+					return fmt.Errorf("failed to get last insert ID for row %d: %v", row.sheetRow, err)
+				}
+				if err := tags.add(rowID, row.values); err != nil {
+					return err
+				}
+				result.Inserted++
+				result.Changes = append(result.Changes, RowChange{
+					RowID:      rowID,
+					ChangeType: RowChangeInsert,
+					SheetRow:   row.sheetRow,
+					NewValues:  rowValueMap(columnNames, row.values),
+				})
+
+			case rowContentKey(row.match.values) != rowContentKey(row.values):
+				args := []interface{}{row.sheetRow, row.key, row.raw}
+				for _, value := range row.values {
+					args = append(args, value)
+				}
+				args = append(args, row.match.rowID)
+				if _, err := updateStmt.Exec(args...); err != nil {
+					return fmt.Errorf("failed to update row %d: %v", row.match.rowID, err)
+				}
+				if err := tags.remove(row.match.rowID); err != nil {
+					return err
+				}
+				if err := tags.add(row.match.rowID, row.values); err != nil {
+					return err
+				}
+				result.Updated++
+				before, after := changedValueMaps(columnNames, row.match.values, row.values)
+				result.Changes = append(result.Changes, RowChange{
+					RowID:      row.match.rowID,
+					ChangeType: RowChangeUpdate,
+					SheetRow:   row.sheetRow,
+					OldValues:  before,
+					NewValues:  after,
+				})
+
+			default:
+				// Rows whose source values normalise the same way are unchanged, but keep their latest source values
+				if row.match.sheetRow != row.sheetRow || row.match.key != row.key || row.match.raw != row.raw {
+					if _, err := moveStmt.Exec(row.sheetRow, row.key, row.raw, row.match.rowID); err != nil {
+						return fmt.Errorf("failed to update source row of row %d: %v", row.match.rowID, err)
+					}
+				}
+				result.Unchanged++
+			}
+			progress.rowWritten()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchRows(t *testing.T) {
+	type stored struct {
+		rowID int64
+		key   string
+		value string
+	}
+	type source struct {
+		key   string
+		value string
+	}
+
+	tests := []struct {
+		name     string
+		existing []stored
+		incoming []source
+		want     []int64 // matched row ID of each incoming row, 0 for an insert
+	}{
+		{
+			name:     "unchanged rows keep their IDs",
+			existing: []stored{{1, "", "a"}, {2, "", "b"}},
+			incoming: []source{{"", "a"}, {"", "b"}},
+			want:     []int64{1, 2},
+		},
+		{
+			name:     "reordered rows follow their content",
+			existing: []stored{{1, "", "a"}, {2, "", "b"}, {3, "", "c"}},
+			incoming: []source{{"", "c"}, {"", "a"}, {"", "b"}},
+			want:     []int64{3, 1, 2},
+		},
+		{
+			name:     "reordered rows follow their key when edited",
+			existing: []stored{{1, "k1", "a"}, {2, "k2", "b"}},
+			incoming: []source{{"k2", "b2"}, {"k1", "a2"}},
+			want:     []int64{2, 1},
+		},
+		{
+			name:     "deleted rows are left unmatched",
+			existing: []stored{{1, "", "a"}, {2, "", "b"}, {3, "", "c"}},
+			incoming: []source{{"", "a"}, {"", "c"}},
+			want:     []int64{1, 3},
+		},
+		{
+			name:     "edited row between anchors is paired in place",
+			existing: []stored{{1, "", "a"}, {2, "", "b"}, {3, "", "c"}},
+			incoming: []source{{"", "a"}, {"", "b2"}, {"", "c"}},
+			want:     []int64{1, 2, 3},
+		},
+		{
+			name:     "inserted row gets no match",
+			existing: []stored{{1, "", "a"}, {2, "", "b"}},
+			incoming: []source{{"", "a"}, {"", "new"}, {"", "b"}},
+			want:     []int64{1, 0, 2},
+		},
+		{
+			name:     "duplicate source key matches the stored row once",
+			existing: []stored{{1, "k", "a"}, {2, "", "b"}},
+			incoming: []source{{"k", "a"}, {"k", "b"}},
+			want:     []int64{1, 2},
+		},
+		{
+			name:     "duplicate stored key is matched by the first stored row",
+			existing: []stored{{1, "k", "a"}, {2, "k", "b"}},
+			incoming: []source{{"k", "b"}},
+			want:     []int64{1},
+		},
+		{
+			name:     "duplicate content is matched in order",
+			existing: []stored{{1, "", "a"}, {2, "", "a"}},
+			incoming: []source{{"", "a"}, {"", "a"}, {"", "a"}},
+			want:     []int64{1, 2, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := make([]*existingRow, len(tt.existing))
+			for i, row := range tt.existing {
+				existing[i] = &existingRow{rowID: row.rowID, sheetRow: i + 2, key: row.key, values: []string{row.value}}
+			}
+			incoming := make([]*incomingRow, len(tt.incoming))
+			for i, row := range tt.incoming {
+				incoming[i] = &incomingRow{sheetRow: i + 2, key: row.key, values: []string{row.value}}
+			}
+
+			matchRows(existing, incoming)
+
+			got := make([]int64, len(incoming))
+			for i, row := range incoming {
+				if row.match != nil {
+					got[i] = row.match.rowID
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched row IDs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDirectoryRows(t *testing.T) {
+	tests := []struct {
+		name       string
+		columns    []string
+		initial    [][]string
+		initialKey []string
+		rows       [][]string
+		rowKeys    []string
+		want       ImportResult
+		wantRows   []string // rowID:Name of the stored rows in source order
+	}{
+		{
+			name:     "reordered rows keep their IDs",
+			columns:  []string{"Name", "Town"},
+			initial:  [][]string{{"A", "x"}, {"B", "y"}, {"C", "z"}},
+			rows:     [][]string{{"C", "z"}, {"A", "x"}, {"B", "y"}},
+			want:     ImportResult{Unchanged: 3},
+			wantRows: []string{"3:C", "1:A", "2:B"},
+		},
+		{
+			name:     "deleted rows are removed",
+			columns:  []string{"Name", "Town"},
+			initial:  [][]string{{"A", "x"}, {"B", "y"}, {"C", "z"}},
+			rows:     [][]string{{"A", "x"}, {"C", "z"}},
+			want:     ImportResult{Deleted: 1, Unchanged: 2},
+			wantRows: []string{"1:A", "3:C"},
+		},
+		{
+			name:       "duplicate keys insert the second row",
+			columns:    []string{"Name", "Town"},
+			initial:    [][]string{{"A", "x"}},
+			initialKey: []string{"k"},
+			rows:       [][]string{{"A", "x"}, {"B", "y"}},
+			rowKeys:    []string{"k", "k"},
+			want:       ImportResult{Inserted: 1, Unchanged: 1},
+			wantRows:   []string{"1:A", "2:B"},
+		},
+		{
+			name:     "edited rows are updated in place",
+			columns:  []string{"Name", "Town"},
+			initial:  [][]string{{"A", "x"}, {"B", "y"}, {"C", "z"}},
+			rows:     [][]string{{"A", "x"}, {"B2", "y"}, {"C", "z"}, {"D", "w"}},
+			want:     ImportResult{Inserted: 1, Updated: 1, Unchanged: 2},
+			wantRows: []string{"1:A", "2:B2", "3:C", "4:D"},
+		},
+		{
+			name:       "changed header keeps row IDs",
+			columns:    []string{"Name", "Region"},
+			initial:    [][]string{{"A", "x"}, {"B", "y"}, {"C", "z"}},
+			initialKey: []string{"k1", "k2", "k3"},
+			rows:       [][]string{{"C", "south"}, {"A", "north"}},
+			rowKeys:    []string{"k3", "k1"},
+			want:       ImportResult{Updated: 2, Deleted: 1},
+			wantRows:   []string{"3:C", "1:A"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newImportTestApp(t)
+			ctx := context.Background()
+
+			initialColumns := []string{"Name", "Town"}
+			syncTestRows(t, app, initialColumns, tt.initial, tt.initialKey)
+			got := syncTestRows(t, app, tt.columns, tt.rows, tt.rowKeys)
+
+			counts := ImportResult{Inserted: got.Inserted, Updated: got.Updated, Deleted: got.Deleted, Unchanged: got.Unchanged}
+			if !reflect.DeepEqual(counts, tt.want) {
+				t.Errorf("result = %+v, want %+v", counts, tt.want)
+			}
+
+			db, err := app.DirectoryDBManager.GetDirectoryDB("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT rowID, [Name] FROM 'test' ORDER BY [%s]", sheetRowColumn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var stored []string
+			for rows.Next() {
+				var rowID int64
+				var name string
+				if err := rows.Scan(&rowID, &name); err != nil {
+					t.Fatal(err)
+				}
+				stored = append(stored, fmt.Sprintf("%d:%s", rowID, name))
+			}
+			if !reflect.DeepEqual(stored, tt.wantRows) {
+				t.Errorf("stored rows = %v, want %v", stored, tt.wantRows)
+			}
+		})
+	}
+}
+
+// newImportTestApp returns an app with an empty directory "test" in a temporary folder
+func newImportTestApp(t *testing.T) *App {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "main.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{DB: db, Config: &Config{}}
+	if err := app.initDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO directories (id, name, description, database_path) VALUES ('test', 'test', '', ?)",
+		filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	app.DirectoryDBManager = NewDirectoryDatabaseManager(app)
+	t.Cleanup(func() {
+		app.DirectoryDBManager.CloseAll()
+		db.Close()
+	})
+	return app
+}
+
+// syncTestRows stores rows of basic columns in the test directory the way an import does
+func syncTestRows(t *testing.T, app *App, columns []string, rows [][]string, rowKeys []string) *ImportResult {
+	t.Helper()
+	db, err := app.DirectoryDBManager.GetDirectoryDB("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(columnNormalizersTableQuery); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureDirectoryTable(db, "test", columns); err != nil {
+		t.Fatal(err)
+	}
+
+	types := make([]string, len(columns))
+	for i := range types {
+		types[i] = "basic"
+	}
+	if rowKeys == nil {
+		rowKeys = make([]string, len(rows))
+	}
+	result, err := app.syncDirectoryRows(context.Background(), "test", columns, types, rows, rowKeys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
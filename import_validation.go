@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	utils2 "directoryCommunityWebsite/internal/utils"
+)
+
+// Import issue types
+const (
+	ImportIssueHeader     = "header_mismatch"
+	ImportIssueRequired   = "missing_value"
+	ImportIssueNumber     = "invalid_number"
+	ImportIssueList       = "invalid_list"
+	ImportIssueCategory   = "unknown_category"
+	ImportIssueDuplicate  = "duplicate_row"
+	ImportIssueExtraCells = "extra_cells"
+)
+
+// maxImportIssues caps how many issues a validation report lists; the counts cover all of them
+const maxImportIssues = 500
+
+// validColumnTypes are the column types a directory column can be imported as
+var validColumnTypes = map[string]bool{
+	"basic": true, "numeric": true, "location": true,
+	"tag": true, "category": true,
+}
+
+// ImportColumn is one column as configured by the owner for an import
+type ImportColumn struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Required   bool     `json:"required"`
+	Vocabulary []string `json:"vocabulary,omitempty"` // allowed values of a category column; empty allows any
+
+	Normalizers ColumnNormalizers `json:"normalizers"` // applied to the column's values before they are checked and stored
+}
+
+// ImportIssue is one problem found in a source row, or in one of its cells if Column is set
+type ImportIssue struct {
+	Row     int    `json:"row"` // row number in the source, the header being row 1
+	Column  string `json:"column,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// ImportValidationReport is the result of a dry-run import
+type ImportValidationReport struct {
+	RowsChecked    int            `json:"rows_checked"`
+	RowsWithIssues int            `json:"rows_with_issues"`
+	IssueCount     int            `json:"issue_count"`
+	IssuesByType   map[string]int `json:"issues_by_type"`
+	Issues         []ImportIssue  `json:"issues"`
+	Truncated      bool           `json:"truncated"` // more issues were found than are listed
+}
+
+// add records an issue, keeping the counts complete once the list is full
+func (report *ImportValidationReport) add(issue ImportIssue) {
+	report.IssueCount++
+	report.IssuesByType[issue.Type]++
+	if len(report.Issues) < maxImportIssues {
+		report.Issues = append(report.Issues, issue)
+	} else {
+		report.Truncated = true
+	}
+}
+
+// parseImportColumns reads the column configuration of an import form. Columns come as
+// column_name_0, column_type_0, column_required_0, column_vocabulary_0 and
+// column_normalizers_0, and so on. Columns without a normaliser field get their type's defaults.
+func parseImportColumns(r *http.Request) ([]ImportColumn, error) {
+	var columns []ImportColumn
+	for i := 0; ; i++ {
+		name := r.FormValue(fmt.Sprintf("column_name_%d", i))
+		columnType := r.FormValue(fmt.Sprintf("column_type_%d", i))
+		if name == "" && columnType == "" {
+			break
+		}
+		if name == "" || columnType == "" {
+			return nil, errors.New("column names and types count mismatch")
+		}
+		if !validColumnTypes[columnType] {
+			return nil, fmt.Errorf("invalid column type: %s", columnType)
+		}
+
+		column := ImportColumn{
+			Name:     SanitizeInput(name),
+			Type:     columnType,
+			Required: r.FormValue(fmt.Sprintf("column_required_%d", i)) == "on",
+		}
+		if columnType == "category" {
+			column.Vocabulary = splitListCell(SanitizeInput(r.FormValue(fmt.Sprintf("column_vocabulary_%d", i))))
+		}
+
+		column.Normalizers = defaultNormalizers(columnType)
+		if list, ok := r.Form[fmt.Sprintf("column_normalizers_%d", i)]; ok {
+			normalizers, err := parseNormalizers(strings.Join(list, ","))
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", column.Name, err)
+			}
+			column.Normalizers = normalizers
+		}
+		columns = append(columns, column)
+	}
+
+	if len(columns) == 0 {
+		return nil, errors.New("no columns specified")
+	}
+	if len(columns) > MaxRowColumns {
+		return nil, fmt.Errorf("a directory can have at most %d columns", MaxRowColumns)
+	}
+	return columns, nil
+}
+
+// importColumnConfig returns the column names and types of an import configuration
+func importColumnConfig(columns []ImportColumn) ([]string, []string) {
+	names := make([]string, len(columns))
+	types := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+		types[i] = column.Type
+	}
+	return names, types
+}
+
+// importColumnNormalizers returns the normalisers of an import configuration by column name
+func importColumnNormalizers(columns []ImportColumn) map[string]ColumnNormalizers {
+	normalizers := make(map[string]ColumnNormalizers, len(columns))
+	for _, column := range columns {
+		normalizers[column.Name] = column.Normalizers
+	}
+	return normalizers
+}
+
+// validateSourceHeader checks that the source header holds exactly the configured columns, in order
+func validateSourceHeader(header []string, columnNames []string) error {
+	if len(columnNames) != len(header) {
+		return fmt.Errorf("column count mismatch: expected %d columns, sheet has %d",
+			len(columnNames), len(header))
+	}
+
+	for i, expectedCol := range columnNames {
+		if strings.TrimSpace(expectedCol) != strings.TrimSpace(header[i]) {
+			return fmt.Errorf("column name mismatch at position %d: expected '%s', sheet has '%s'",
+				i, expectedCol, strings.TrimSpace(header[i]))
+		}
+	}
+	return nil
+}
+
+// splitListCell splits a tag or location cell into its trimmed entries, dropping empty ones
+func splitListCell(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// validateImportRows runs every cell of the source rows through its column's normalisers and
+// configured type, without writing anything. The row key column must already have been removed.
+func validateImportRows(values [][]string, columns []ImportColumn) *ImportValidationReport {
+	report := &ImportValidationReport{
+		IssuesByType: make(map[string]int),
+		Issues:       []ImportIssue{},
+	}
+	if len(values) == 0 {
+		return report
+	}
+
+	names, _ := importColumnConfig(columns)
+	if err := validateSourceHeader(values[0], names); err != nil {
+		// Cells can't be matched to columns, so there is nothing more to check
+		report.add(ImportIssue{Row: 1, Type: ImportIssueHeader, Message: err.Error()})
+		return report
+	}
+
+	vocabularies := make([]map[string]bool, len(columns))
+	for i, column := range columns {
+		if len(column.Vocabulary) > 0 {
+			vocabularies[i] = make(map[string]bool)
+			for _, value := range column.Vocabulary {
+				vocabularies[i][strings.ToLower(value)] = true
+			}
+		}
+	}
+
+	seen := make(map[string]int)
+	for i := 1; i < len(values); i++ {
+		row := values[i]
+		// The header is row 1 of the source
+		rowNumber := i + 1
+		before := report.IssueCount
+		report.RowsChecked++
+
+		cells := make([]string, len(columns))
+		for col, column := range columns {
+			// A value that should be a number but isn't is checked as it is, and reported as such
+			value, _ := column.Normalizers.apply(cellValue(row, col))
+			value = strings.TrimSpace(value)
+			cells[col] = value
+			for _, issue := range validateImportCell(column, vocabularies[col], value) {
+				issue.Row = rowNumber
+				report.add(issue)
+			}
+		}
+
+		for col := len(columns); col < len(row); col++ {
+			if strings.TrimSpace(row[col]) != "" {
+				report.add(ImportIssue{
+					Row:     rowNumber,
+					Value:   row[col],
+					Type:    ImportIssueExtraCells,
+					Message: fmt.Sprintf("cell in column %d is outside the %d configured columns", col+1, len(columns)),
+				})
+				break
+			}
+		}
+
+		content := strings.Join(cells, "\x1f")
+		if strings.Trim(content, "\x1f") != "" {
+			if first, ok := seen[content]; ok {
+				report.add(ImportIssue{
+					Row:     rowNumber,
+					Type:    ImportIssueDuplicate,
+					Message: fmt.Sprintf("duplicate of row %d", first),
+				})
+			} else {
+				seen[content] = rowNumber
+			}
+		}
+
+		if report.IssueCount > before {
+			report.RowsWithIssues++
+		}
+	}
+
+	return report
+}
+
+// validateImportCell checks one trimmed cell against its column's type and rules
+func validateImportCell(column ImportColumn, vocabulary map[string]bool, value string) []ImportIssue {
+	if value == "" {
+		if column.Required {
+			return []ImportIssue{{Column: column.Name, Type: ImportIssueRequired, Message: "required value is empty"}}
+		}
+		return nil
+	}
+
+	issue := func(issueType, message string) []ImportIssue {
+		return []ImportIssue{{Column: column.Name, Value: value, Type: issueType, Message: message}}
+	}
+
+	switch column.Type {
+	case "numeric":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return issue(ImportIssueNumber, fmt.Sprintf("%q is not a number", value))
+		}
+
+	case "tag", "location":
+		seen := make(map[string]bool)
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				return issue(ImportIssueList, "list has an empty entry")
+			}
+			if seen[strings.ToLower(entry)] {
+				return issue(ImportIssueList, fmt.Sprintf("%q is listed more than once", entry))
+			}
+			seen[strings.ToLower(entry)] = true
+		}
+
+	case "category":
+		if vocabulary != nil && !vocabulary[strings.ToLower(value)] {
+			return issue(ImportIssueCategory, fmt.Sprintf("%q is not one of the allowed categories", value))
+		}
+	}
+
+	return nil
+}
+
+// handleValidateImport performs a dry run of an import: it reads the source and reports every
+// cell that doesn't fit its configured column, without touching the directory or the source
+func (app *App) handleValidateImport(w http.ResponseWriter, r *http.Request) {
+	userEmail, ok := utils2.RequireAuthentication(w, r)
+	if !ok {
+		return
+	}
+
+	directoryID := utils2.GetDirectoryID(r)
+
+	columns, err := parseImportColumns(r)
+	if err != nil {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	binding := requestedSource(r.FormValue("source_type"), SanitizeInput(r.FormValue("sheet_url")),
+		r.FormValue("file_path"), r.FormValue("sheet_tab"), strings.Split(r.FormValue("extra_tabs"), "\n"),
+		r.FormValue("sheet_range"))
+	binding.DirectoryID = directoryID
+	source, ok := app.openRequestedSource(ctx, w, userEmail, binding)
+	if !ok {
+		return
+	}
+
+	values, err := source.ReadAll(ctx)
+	if err != nil {
+		log.Printf("Failed to read %s source %s for validation: %v", source.Type(), binding.Location, err)
+		utils2.InternalServerError(w, fmt.Sprintf("Unable to retrieve data from source: %v", err))
+		return
+	}
+
+	if len(values) == 0 {
+		utils2.ValidationError(w, "No data found in source")
+		return
+	}
+
+	// The row key column is managed by the import, so it is never checked
+	values, _ = splitRowKeys(values)
+
+	report := validateImportRows(values, columns)
+	utils2.RespondWithSuccess(w, report, "")
+}
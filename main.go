@@ -26,11 +26,19 @@ type App struct {
 	EncryptionService  *EncryptionService
 	DirectoryDBManager *DirectoryDatabaseManager
 	PermissionCache    *utils2.PermissionCache
+	SyncWorker         *SyncWorker
+	SheetsQuota        *SheetsQuota
+	CredentialMonitor  *CredentialMonitor
+	DriveWatcher       *DriveWatcher
 }
 
+// DirectoryEntry is a directory row as listed by /api/directory, with its cells in column
+// order and by column name
 type DirectoryEntry struct {
-	ID   int    `json:"id"`
-	Data string `json:"data"`
+	ID       int64             `json:"id"`
+	SheetRow int               `json:"sheet_row"`
+	Data     []string          `json:"data"`
+	Values   map[string]string `json:"values"`
 }
 
 type CorrectionRequest struct {
@@ -49,7 +57,13 @@ type DeleteRowRequest struct {
 }
 
 type PreviewRequest struct {
-	SheetURL string `json:"sheet_url"`
+	SourceType string       `json:"source_type"`
+	SheetURL   string       `json:"sheet_url"`
+	FilePath   string       `json:"file_path"`
+	SheetTab   string       `json:"sheet_tab"`
+	ExtraTabs  []string     `json:"extra_tabs"`
+	SheetRange string       `json:"sheet_range"`
+	Header     HeaderLayout `json:"header"`
 }
 
 type PreviewResponse struct {
@@ -100,6 +114,12 @@ func main() {
 		},
 	}
 
+	// Watching sheets needs Drive access, which users are only asked for when it is configured.
+	// Sheets of owners who signed in without it are pulled on schedule instead.
+	if config.DriveWebhookURL != "" {
+		app.OAuthConfig.Scopes = append(app.OAuthConfig.Scopes, driveWatchScope)
+	}
+
 	// Initialize Twitter OAuth config if configured
 	app.TwitterOAuthConfig = app.TwitterConfig()
 
@@ -121,6 +141,46 @@ func main() {
 	app.DirectoryDBManager = NewDirectoryDatabaseManager(app)
 	app.PermissionCache = utils2.NewPermissionCache()
 
+	// Throttle Google Sheets API calls per spreadsheet
+	app.SheetsQuota = NewSheetsQuota(config.SheetsReadsPerMin, config.SheetsWritesPerMin)
+
+	// Imports that were running when the server stopped will never finish
+	app.failInterruptedImportJobs()
+
+	// Directory databases may predate the typed row table or the tag tables
+	app.migrateDirectoryDatabases()
+
+	// Start the background worker that writes queued edits back to directory sources
+	app.SyncWorker = NewSyncWorker(app)
+	app.SyncWorker.Start()
+
+	// Periodically pull bound sources to pick up edits made directly in them
+	if config.SyncPullInterval > 0 {
+		NewPullScheduler(app, config.SyncPullInterval).Start()
+	}
+
+	// Re-sync directories backed by a local file whenever the file changes
+	if config.FileWatchInterval > 0 {
+		NewFileWatcher(app, config.FileWatchInterval).Start()
+	}
+
+	// Have Drive notify the app of sheet changes instead of waiting for the next pull
+	if config.DriveWebhookURL != "" {
+		app.DriveWatcher = NewDriveWatcher(app, config.DriveWebhookURL, config.DriveWatchFake)
+		app.DriveWatcher.Start()
+	}
+
+	// Periodically check that each directory's sheet can still be reached with its credentials
+	if config.HealthCheckInterval > 0 {
+		app.CredentialMonitor = NewCredentialMonitor(app, config.HealthCheckInterval)
+		app.CredentialMonitor.Start()
+	}
+
+	// Periodically snapshot directory databases, on top of the snapshot taken before each import
+	if config.SnapshotInterval > 0 {
+		NewSnapshotScheduler(app, config.SnapshotInterval).Start()
+	}
+
 	//create default DB
 	//if err := app.CreateDirectory("default", "default", "", ""); err != nil {
 	//	log.Fatal("Failed to create defualt DB:", err)
@@ -145,15 +205,56 @@ func main() {
 	r.HandleFunc("/debug-middleware", app.AuthMiddleware(app.handleDebugMiddleware)).Methods("GET")
 	r.HandleFunc("/owner", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleAdmin))).Methods("GET")
 	r.HandleFunc("/import", app.AuthMiddleware(app.CSRFMiddleware(app.handleImport))).Methods("POST")
-	r.HandleFunc("/api/preview-sheet", app.AuthMiddleware(app.CSRFMiddleware(app.handlePreviewSheet))).Methods("POST")
+	r.HandleFunc("/api/preview-sheet", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handlePreviewSheet)))).Methods("POST")
+	r.HandleFunc("/api/import/jobs", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetImportJob))).Methods("GET")
+	r.HandleFunc("/api/import/jobs/cancel", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleCancelImportJob)))).Methods("POST")
+	r.HandleFunc("/api/import/validate", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleValidateImport)))).Methods("POST")
 	r.HandleFunc("/api/directory", app.handleGetDirectory).Methods("GET")
+	r.HandleFunc("/api/directory/query", app.handleQueryDirectory).Methods("POST")
+	r.HandleFunc("/api/directory/search", app.handleSearchDirectory).Methods("GET")
 	r.HandleFunc("/api/columns", app.handleGetColumns).Methods("GET")
+	r.HandleFunc("/api/tags", app.handleGetTags).Methods("GET")
+	r.HandleFunc("/api/tags/rows", app.handleGetTagRows).Methods("GET")
 	r.HandleFunc("/api/user-directories", app.AuthMiddleware(app.handleGetUserDirectories)).Methods("GET")
 	r.HandleFunc("/api/corrections", app.AuthMiddleware(app.CSRFMiddleware(app.handleCorrection))).Methods("POST")
 	r.HandleFunc("/api/add-row", app.AuthMiddleware(app.CSRFMiddleware(app.handleAddRow))).Methods("POST")
 	r.HandleFunc("/api/delete-row", app.AuthMiddleware(app.CSRFMiddleware(app.handleDeleteRow))).Methods("DELETE")
 	r.HandleFunc("/download/directory.db", app.handleDownloadDB).Methods("GET")
 
+	// Drive change notifications, verified by their channel token
+	r.HandleFunc("/webhooks/drive", app.handleDriveNotification).Methods("POST")
+
+	// Source binding routes (directory owners)
+	r.HandleFunc("/api/directory-source", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetDirectorySource))).Methods("GET")
+	r.HandleFunc("/api/directory-source", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleUpdateDirectorySource)))).Methods("POST")
+	r.HandleFunc("/api/directory-source/relink", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleRelinkDirectorySource)))).Methods("POST")
+	r.HandleFunc("/api/directory-source/service-account", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetServiceAccount))).Methods("GET")
+	r.HandleFunc("/api/directory-source/service-account", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleSetServiceAccount)))).Methods("POST")
+	r.HandleFunc("/api/directory-source/service-account", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleDeleteServiceAccount)))).Methods("DELETE")
+	r.HandleFunc("/api/directory-source/credential-health", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetCredentialHealth))).Methods("GET")
+	r.HandleFunc("/api/directory-source/credential-health/check", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleCheckCredentialHealth)))).Methods("POST")
+
+	// Search settings routes (directory owners)
+	r.HandleFunc("/api/search/weights", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetSearchWeights))).Methods("GET")
+	r.HandleFunc("/api/search/weights", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleSetSearchWeights)))).Methods("POST")
+
+	// Snapshot routes (directory owners)
+	r.HandleFunc("/api/snapshots", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleListSnapshots))).Methods("GET")
+	r.HandleFunc("/api/snapshots/diff", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleDiffSnapshots))).Methods("GET")
+	r.HandleFunc("/api/snapshots/restore", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleRestoreSnapshot)))).Methods("POST")
+
+	// Write-back queue routes (directory owners)
+	r.HandleFunc("/api/sync/jobs", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetSyncJobs))).Methods("GET")
+	r.HandleFunc("/api/sync/jobs/retry", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleRetrySyncJob)))).Methods("POST")
+	r.HandleFunc("/api/sync/events", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetSyncEvents))).Methods("GET")
+	r.HandleFunc("/api/sync/pull", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handlePullDirectory)))).Methods("POST")
+	r.HandleFunc("/api/sync/jobs/discard", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleDiscardSyncJob)))).Methods("DELETE")
+
+	// Schema change routes (directory owners)
+	r.HandleFunc("/api/schema/proposal", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.handleGetSchemaProposal))).Methods("GET")
+	r.HandleFunc("/api/schema/proposal/confirm", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleConfirmSchemaProposal)))).Methods("POST")
+	r.HandleFunc("/api/schema/proposal/reject", app.AuthMiddleware(app.DirectoryAuthMiddleware(app.CSRFMiddleware(app.handleRejectSchemaProposal)))).Methods("POST")
+
 	// Admin routes (platform-wide)
 	r.HandleFunc("/admin", app.AuthMiddleware(app.AdminMiddleware(app.displayAdmin))).Methods("GET")
 	r.HandleFunc("/api/admin/directories", app.AuthMiddleware(app.AdminMiddleware(app.handleGetAllDirectories))).Methods("GET")
@@ -185,11 +286,6 @@ func main() {
 
 func (app *App) initDatabase() error {
 	query := `
-		CREATE TABLE IF NOT EXISTS directory (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			data TEXT NOT NULL
-		);
-		
 		CREATE TABLE IF NOT EXISTS admin_sessions (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_email TEXT NOT NULL,
@@ -269,7 +365,7 @@ func (app *App) initDatabase() error {
 			column_name TEXT NOT NULL,
 			old_value TEXT,
 			new_value TEXT NOT NULL,
-			change_type TEXT NOT NULL, -- 'edit', 'add', 'delete'
+			change_type TEXT NOT NULL, -- 'edit', 'add', 'delete', 'conflict'
 			submitted_by TEXT NOT NULL, -- moderator email
 			status TEXT NOT NULL DEFAULT 'pending', -- 'pending', 'approved', 'rejected', 'invalid'
 			reviewed_by TEXT, -- approver email
@@ -277,10 +373,147 @@ func (app *App) initDatabase() error {
 			reason TEXT, -- reason for rejection or notes
 			column_schema TEXT, -- JSON array of column names when change was submitted
 			invalid_reason TEXT, -- reason why change became invalid
+			sheet_value TEXT, -- value found in the sheet, for 'conflict' changes
+			sync_job_id INTEGER, -- write-back job a 'conflict' change was raised by
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (directory_id) REFERENCES directories(id)
 		);
 		
+		CREATE TABLE IF NOT EXISTS directory_sources (
+			directory_id TEXT PRIMARY KEY,
+			source_type TEXT NOT NULL DEFAULT 'google_sheet', -- 'google_sheet' or 'file'
+			location TEXT NOT NULL, -- sheet URL or file path
+			spreadsheet_id TEXT,
+			sheet_tab TEXT, -- empty for the first tab
+			extra_tabs TEXT, -- JSON array of tabs combined with sheet_tab
+			sheet_range TEXT, -- empty for SHEET_RANGE
+			header_layout TEXT, -- JSON header layout, empty for a one-row header on row 1
+			sync_user_email TEXT, -- user whose credentials are used for sync
+			manage_row_keys INTEGER NOT NULL DEFAULT 0, -- keep a hidden row key column in the source
+			read_only INTEGER NOT NULL DEFAULT 0, -- refuse edits rather than writing them back
+			last_pulled_at DATETIME,
+			last_pull_error TEXT,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE TABLE IF NOT EXISTS sync_jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			directory_id TEXT NOT NULL,
+			job_type TEXT NOT NULL, -- 'update_cell', 'append_row', 'delete_row'
+			payload TEXT NOT NULL, -- JSON SyncJobPayload
+			status TEXT NOT NULL DEFAULT 'pending', -- 'pending', 'running', 'failed', 'dead', 'completed', 'discarded'
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_error TEXT,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_sync_jobs_status ON sync_jobs(status, next_attempt_at);
+		CREATE INDEX IF NOT EXISTS idx_sync_jobs_directory ON sync_jobs(directory_id, id);
+		
+		CREATE TABLE IF NOT EXISTS sync_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			directory_id TEXT NOT NULL,
+			event_type TEXT NOT NULL, -- 'external_edit'
+			change_type TEXT NOT NULL, -- 'insert', 'update', 'delete'
+			row_id INTEGER NOT NULL,
+			sheet_row INTEGER,
+			old_values TEXT, -- JSON object of column name to value
+			new_values TEXT, -- JSON object of column name to value
+			detected_at DATETIME NOT NULL,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_sync_events_directory ON sync_events(directory_id, detected_at);
+		
+		CREATE TABLE IF NOT EXISTS schema_proposals (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			directory_id TEXT NOT NULL,
+			old_columns TEXT NOT NULL, -- JSON array of the directory's column names
+			new_header TEXT NOT NULL, -- JSON array of the source's header
+			columns TEXT NOT NULL, -- JSON array of column mappings
+			status TEXT NOT NULL DEFAULT 'pending', -- 'pending', 'confirmed', 'rejected', 'superseded'
+			created_at DATETIME NOT NULL,
+			resolved_by TEXT,
+			resolved_at DATETIME,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_schema_proposals_directory ON schema_proposals(directory_id, status);
+		
+		CREATE TABLE IF NOT EXISTS directory_service_accounts (
+			directory_id TEXT PRIMARY KEY,
+			client_email TEXT NOT NULL,
+			credentials TEXT NOT NULL, -- service account key file, encrypted
+			created_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE TABLE IF NOT EXISTS import_jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			directory_id TEXT NOT NULL,
+			status TEXT NOT NULL, -- 'running', 'completed', 'failed', 'cancelled'
+			phase TEXT NOT NULL, -- 'queued', 'reading', 'row_keys', 'writing', 'done'
+			source_type TEXT,
+			location TEXT, -- sheet URL or file path
+			rows_read INTEGER NOT NULL DEFAULT 0,
+			rows_written INTEGER NOT NULL DEFAULT 0,
+			result TEXT, -- JSON ImportResult once completed
+			error TEXT,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			finished_at DATETIME,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_import_jobs_directory ON import_jobs(directory_id, status);
+		
+		CREATE TABLE IF NOT EXISTS credential_health (
+			directory_id TEXT PRIMARY KEY,
+			state TEXT NOT NULL, -- 'healthy', 'degraded', 'expiring', 'broken'
+			credential TEXT, -- service account or owner email sync runs as
+			message TEXT,
+			expires_at DATETIME, -- when an unrefreshable token stops working
+			failing_since DATETIME, -- first failure while broken
+			checked_at DATETIME NOT NULL,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE TABLE IF NOT EXISTS drive_watch_channels (
+			channel_id TEXT PRIMARY KEY,
+			directory_id TEXT NOT NULL,
+			spreadsheet_id TEXT NOT NULL,
+			resource_id TEXT NOT NULL, -- Drive's ID of the watched file, sent with each notification
+			token TEXT NOT NULL, -- secret Drive sends with each notification
+			expires_at DATETIME NOT NULL,
+			last_message_number INTEGER NOT NULL DEFAULT 0, -- highest notification acted on
+			last_notified_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (directory_id) REFERENCES directories(id)
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_drive_watch_channels_directory ON drive_watch_channels(directory_id, expires_at);
+		
+		CREATE TABLE IF NOT EXISTS directory_snapshots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			directory_id TEXT NOT NULL, -- kept after the directory is deleted
+			reason TEXT NOT NULL, -- 'import', 'scheduled', 'restore', 'delete'
+			path TEXT NOT NULL, -- copy of the directory database
+			fingerprint TEXT NOT NULL, -- hash of the columns and rows, to skip unchanged snapshots
+			row_count INTEGER NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			created_by TEXT,
+			created_at DATETIME NOT NULL
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_directory_snapshots_directory ON directory_snapshots(directory_id, reason, id);
+		
 		CREATE TABLE IF NOT EXISTS user_profiles (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_email TEXT NOT NULL UNIQUE,
@@ -314,6 +547,28 @@ func (app *App) initDatabase() error {
 		log.Printf("Note: Could not add invalid_reason column to pending_changes: %v", err)
 	}
 
+	_, err = app.DB.Exec(`ALTER TABLE pending_changes ADD COLUMN sheet_value TEXT`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		log.Printf("Note: Could not add sheet_value column to pending_changes: %v", err)
+	}
+
+	_, err = app.DB.Exec(`ALTER TABLE pending_changes ADD COLUMN sync_job_id INTEGER`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		log.Printf("Note: Could not add sync_job_id column to pending_changes: %v", err)
+	}
+
+	// Add sheet binding and pull sync columns to directory_sources if they don't exist (migration)
+	for _, column := range []string{
+		"spreadsheet_id TEXT", "sheet_tab TEXT", "extra_tabs TEXT", "sheet_range TEXT", "header_layout TEXT",
+		"sync_user_email TEXT", "last_pulled_at DATETIME", "last_pull_error TEXT",
+		"manage_row_keys INTEGER NOT NULL DEFAULT 0", "read_only INTEGER NOT NULL DEFAULT 0",
+	} {
+		_, err = app.DB.Exec(fmt.Sprintf(`ALTER TABLE directory_sources ADD COLUMN %s`, column))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Printf("Note: Could not add %s column to directory_sources: %v", column, err)
+		}
+	}
+
 	return nil
 }
 
@@ -390,6 +390,26 @@ func ValidateSheetURL(url string) bool {
 	return sheetRegex.MatchString(url)
 }
 
+// ValidateSheetRange accepts a column range such as "A:Z" or "C:AF", or one without an end
+// column such as "A:" that runs to the last column of the tab
+func ValidateSheetRange(sheetRange string) bool {
+	rangeRegex := regexp.MustCompile(`^[A-Z]{1,3}:([A-Z]{1,3})?$`)
+	return rangeRegex.MatchString(sheetRange)
+}
+
+// ValidateSheetTab accepts a tab title as Google Sheets allows it
+func ValidateSheetTab(sheetTab string) bool {
+	if len(sheetTab) > 100 {
+		return false
+	}
+	for _, r := range sheetTab {
+		if r < 32 {
+			return false
+		}
+	}
+	return true
+}
+
 func SanitizeInput(input string) string {
 	input = strings.TrimSpace(input)
 	input = html.EscapeString(input)
@@ -399,13 +419,16 @@ func SanitizeInput(input string) string {
 	return input
 }
 
+// MaxRowColumns is the most columns a directory row may have
+const MaxRowColumns = 200
+
 func ValidateRowData(data []string) error {
 	if len(data) == 0 {
 		return &ValidationError{"Row data cannot be empty"}
 	}
 
-	if len(data) > 50 {
-		return &ValidationError{"Row cannot have more than 50 columns"}
+	if len(data) > MaxRowColumns {
+		return &ValidationError{fmt.Sprintf("Row cannot have more than %d columns", MaxRowColumns)}
 	}
 
 	for i, cell := range data {
@@ -6,18 +6,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 )
 
-// ModerationFilter handles filter-based row access for moderators
+// ModerationFilter handles filter-based row access for moderators. It is made for one check
+// and keeps the tag lookups it makes, so it shouldn't outlive a request.
 type ModerationFilter struct {
-	app *App
+	app        *App
+	repos      map[string]*RowRepository  // by directory
+	taggedRows map[string]map[int64]bool // rows carrying a filter's tags, by directory, column and tags
 }
 
 // NewModerationFilter creates a new moderation filter instance
 func NewModerationFilter(app *App) *ModerationFilter {
-	return &ModerationFilter{app: app}
+	return &ModerationFilter{
+		app:        app,
+		repos:      make(map[string]*RowRepository),
+		taggedRows: make(map[string]map[int64]bool),
+	}
 }
 
 // CanAccessRow checks if a moderator can access a specific row based on their filter configuration
@@ -40,7 +46,7 @@ func (mf *ModerationFilter) CanAccessRow(moderatorEmail, directoryID string, row
 	}
 
 	// Check if the row matches any of the configured filters
-	return mf.rowMatchesFilters(controls, rowData, directoryID)
+	return mf.rowMatchesFilters(controls, rowID, rowData, directoryID)
 }
 
 // GetAccessibleRows returns all row IDs that a moderator can access
@@ -64,7 +70,7 @@ func (mf *ModerationFilter) GetAccessibleRows(moderatorEmail, directoryID string
 	}
 
 	for rowID, rowData := range rows {
-		matches, err := mf.rowMatchesFilters(controls, rowData, directoryID)
+		matches, err := mf.rowMatchesFilters(controls, rowID, rowData, directoryID)
 		if err != nil {
 			log.Printf("Error checking row %d against filters: %v", rowID, err)
 			continue
@@ -107,122 +113,56 @@ func (mf *ModerationFilter) getModeratorFilters(moderatorEmail, directoryID stri
 
 // getRowData retrieves the data for a specific row
 func (mf *ModerationFilter) getRowData(directoryID string, rowID int) (map[string]string, error) {
-	// Get directory-specific database connection
-	db, err := mf.app.DirectoryDBManager.GetDirectoryDB(directoryID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get directory database: %v", err)
-	}
-
-	// Get column names from meta table
-	columnNames, err := mf.getColumnNames(db, directoryID)
+	repo, err := mf.rowRepository(directoryID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the row data
-	var dataJSON string
-	err = db.QueryRow("SELECT data FROM directory WHERE id = ?", rowID).Scan(&dataJSON)
+	row, err := repo.Get(int64(rowID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get row data: %v", err)
 	}
 
-	var rowDataArray []string
-	if err := json.Unmarshal([]byte(dataJSON), &rowDataArray); err != nil {
-		return nil, fmt.Errorf("failed to parse row data: %v", err)
-	}
-
-	// Map column names to values
-	rowData := make(map[string]string)
-	for i, columnName := range columnNames {
-		if i < len(rowDataArray) {
-			rowData[columnName] = rowDataArray[i]
-		} else {
-			rowData[columnName] = ""
-		}
-	}
-
-	return rowData, nil
+	return row.Values, nil
 }
 
 // getAllRows retrieves all rows in the directory
 func (mf *ModerationFilter) getAllRows(directoryID string) (map[int]map[string]string, error) {
-	// Get directory-specific database connection
-	db, err := mf.app.DirectoryDBManager.GetDirectoryDB(directoryID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get directory database: %v", err)
-	}
-
-	// Get column names from meta table
-	columnNames, err := mf.getColumnNames(db, directoryID)
+	repo, err := mf.rowRepository(directoryID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get all rows
-	rows, err := db.Query("SELECT id, data FROM directory ORDER BY id")
+	rows, err := repo.List()
 	if err != nil {
-		return nil, fmt.Errorf("failed to query directory rows: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
 
 	allRows := make(map[int]map[string]string)
-	for rows.Next() {
-		var id int
-		var dataJSON string
-		if err := rows.Scan(&id, &dataJSON); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
-		}
-
-		var rowDataArray []string
-		if err := json.Unmarshal([]byte(dataJSON), &rowDataArray); err != nil {
-			log.Printf("Failed to parse row %d data: %v", id, err)
-			continue
-		}
-
-		// Map column names to values
-		rowData := make(map[string]string)
-		for i, columnName := range columnNames {
-			if i < len(rowDataArray) {
-				rowData[columnName] = rowDataArray[i]
-			} else {
-				rowData[columnName] = ""
-			}
-		}
-		allRows[id] = rowData
+	for _, row := range rows {
+		allRows[int(row.ID)] = row.Values
 	}
 
 	return allRows, nil
 }
 
-// getColumnNames retrieves column names from the meta table
-func (mf *ModerationFilter) getColumnNames(db *sql.DB, directoryID string) ([]string, error) {
-	rows, err := db.Query(`
-		SELECT columnName 
-		FROM _meta_directory_column_types 
-		WHERE columnTable = ? 
-		ORDER BY rowid
-	`, directoryID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query column names: %v", err)
+// rowRepository opens the rows of a directory once per filter
+func (mf *ModerationFilter) rowRepository(directoryID string) (*RowRepository, error) {
+	if repo, ok := mf.repos[directoryID]; ok {
+		return repo, nil
 	}
-	defer rows.Close()
-
-	var columnNames []string
-	for rows.Next() {
-		var columnName string
-		if err := rows.Scan(&columnName); err != nil {
-			return nil, fmt.Errorf("failed to scan column name: %v", err)
-		}
-		columnNames = append(columnNames, columnName)
+	repo, err := mf.app.rowRepository(directoryID)
+	if err != nil {
+		return nil, err
 	}
-
-	return columnNames, nil
+	mf.repos[directoryID] = repo
+	return repo, nil
 }
 
 // rowMatchesFilters checks if a row matches the configured filters
-func (mf *ModerationFilter) rowMatchesFilters(controls models.Controls, rowData map[string]string, directoryID string) (bool, error) {
+func (mf *ModerationFilter) rowMatchesFilters(controls models.Controls, rowID int, rowData map[string]string, directoryID string) (bool, error) {
 	for _, control := range controls {
-		matches, err := mf.controlMatches(control, rowData, directoryID)
+		matches, err := mf.controlMatches(control, rowID, rowData, directoryID)
 		if err != nil {
 			return false, err
 		}
@@ -234,7 +174,12 @@ func (mf *ModerationFilter) rowMatchesFilters(controls models.Controls, rowData
 }
 
 // controlMatches checks if a specific control (column-filter pair) matches the row data
-func (mf *ModerationFilter) controlMatches(control models.Control, rowData map[string]string, directoryID string) (bool, error) {
+func (mf *ModerationFilter) controlMatches(control models.Control, rowID int, rowData map[string]string, directoryID string) (bool, error) {
+	// Tags and locations are looked up in the column's tag table
+	if control.Filter.Type == models.FilterTags || control.Filter.Type == models.FilterLocations {
+		return mf.matchesIndexedTags(control, rowID, rowData, directoryID)
+	}
+
 	// Get the column value(s) based on the column ID
 	columnValues, err := mf.getColumnValues(control.Column, rowData)
 	if err != nil {
@@ -276,15 +221,9 @@ func (mf *ModerationFilter) filterMatches(filter models.Filter, values []string,
 	case models.FilterNumericRange:
 		return mf.matchesNumericRange(filter, values)
 
-	case models.FilterLocations:
-		return mf.matchesLocationFilter(filter, values, directoryID)
-
 	case models.FilterCategories:
 		return mf.matchesStringValues(filter.Values, values)
 
-	case models.FilterTags:
-		return mf.matchesTagFilter(filter, values, directoryID)
-
 	default:
 		return false, fmt.Errorf("unsupported filter type: %s", filter.Type)
 	}
@@ -301,8 +240,9 @@ func (mf *ModerationFilter) matchesNumericRange(filter models.Filter, values []s
 			continue
 		}
 
-		numValue, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
-		if err != nil {
+		// Values with currency symbols or thousands separators, such as "$1,200" or "1.200,50", are numbers too
+		numValue, ok := parseNumericValue(value)
+		if !ok {
 			continue // Skip non-numeric values
 		}
 
@@ -325,26 +265,59 @@ func (mf *ModerationFilter) matchesNumericRange(filter models.Filter, values []s
 	return false, nil
 }
 
-// matchesLocationFilter checks if any of the values match the location filter
-func (mf *ModerationFilter) matchesLocationFilter(filter models.Filter, values []string, directoryID string) (bool, error) {
-	// For location filters, we need to check against the tag tables
-	// This is similar to tag matching but for location-type columns
-	return mf.matchesStringValues(filter.Values, values)
-}
+// matchesIndexedTags checks if a row carries any of a tag or location filter's values in the
+// control's columns. Tag and location columns are looked up in their tag tables; other
+// columns, and columns not indexed yet, are compared by cell, split into tags for tag filters.
+func (mf *ModerationFilter) matchesIndexedTags(control models.Control, rowID int, rowData map[string]string, directoryID string) (bool, error) {
+	repo, err := mf.rowRepository(directoryID)
+	if err != nil {
+		return false, err
+	}
 
-// matchesTagFilter checks if any of the values match the tag filter
-func (mf *ModerationFilter) matchesTagFilter(filter models.Filter, values []string, directoryID string) (bool, error) {
-	// For tag filters, the values might be comma-separated
-	// We need to split them and check against the filter values
-	allTags := []string{}
-	for _, value := range values {
-		tags := strings.Split(value, ",")
-		for _, tag := range tags {
-			allTags = append(allTags, strings.TrimSpace(tag))
+	for _, column := range repo.ColumnsOf(control.Column) {
+		if isTagColumnType(column.Type) {
+			tagged, err := mf.rowsWithTags(repo, column.Name, control.Filter.Values)
+			if err != nil {
+				return false, err
+			}
+			if tagged != nil {
+				if tagged[int64(rowID)] {
+					return true, nil
+				}
+				continue
+			}
 		}
+
+		values := []string{rowData[column.Name]}
+		if control.Filter.Type == models.FilterTags {
+			values = splitListCell(rowData[column.Name])
+		}
+		matches, err := mf.matchesStringValues(control.Filter.Values, values)
+		if err != nil || matches {
+			return matches, err
+		}
+	}
+	return false, nil
+}
+
+// rowsWithTags returns the IDs of the rows carrying any of the tags in a tag or location
+// column, looked up once per filter, or nil if the column has no tag table yet
+func (mf *ModerationFilter) rowsWithTags(repo *RowRepository, column string, tags []string) (map[int64]bool, error) {
+	key := repo.directoryID + "\x00" + column + "\x00" + strings.Join(tags, "\x00")
+	if tagged, ok := mf.taggedRows[key]; ok {
+		return tagged, nil
+	}
+
+	tableName, err := repo.tagTable(column)
+	if err != nil || tableName == "" {
+		return nil, err
+	}
+	tagged, err := repo.RowIDsWithTag(column, tags...)
+	if err != nil {
+		return nil, err
 	}
-	
-	return mf.matchesStringValues(filter.Values, allTags)
+	mf.taggedRows[key] = tagged
+	return tagged, nil
 }
 
 // matchesStringValues checks if any of the actual values match any of the filter values
@@ -361,20 +334,14 @@ func (mf *ModerationFilter) matchesStringValues(filterValues, actualValues []str
 
 // ValidateFilters validates that the filter configuration is valid for the given directory
 func (mf *ModerationFilter) ValidateFilters(controls models.Controls, directoryID string) error {
-	// Get directory-specific database connection
-	db, err := mf.app.DirectoryDBManager.GetDirectoryDB(directoryID)
-	if err != nil {
-		return fmt.Errorf("failed to get directory database: %v", err)
-	}
-
-	// Get valid column names
-	columnNames, err := mf.getColumnNames(db, directoryID)
+	repo, err := mf.app.rowRepository(directoryID)
 	if err != nil {
 		return err
 	}
 
+	// Get valid column names
 	columnMap := make(map[string]bool)
-	for _, name := range columnNames {
+	for _, name := range repo.ColumnNames() {
 		columnMap[name] = true
 	}
 
@@ -130,7 +130,7 @@ func (app *App) handleGetModeratorPermissions(w http.ResponseWriter, r *http.Req
 
 	// Only allow users to see their own permissions unless they're owner/admin
 	userType, _ := app.GetUserType(userEmail, directoryID)
-	if targetEmail != userEmail && userType != UserTypeOwner && userType != UserTypeOwner {
+	if targetEmail != userEmail && userType != UserTypeOwner && userType != UserTypeAdmin {
 		utils2.AuthorizationError(w)
 		return
 	}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"directoryCommunityWebsite/internal/models"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -382,8 +383,9 @@ func (app *App) GetPendingChanges(directoryID, moderatorEmail string) ([]Pending
 		// For moderators, only show changes in their domain
 		query = `
 			SELECT pc.id, pc.directory_id, pc.row_id, pc.column_name, pc.old_value, pc.new_value,
-			       pc.change_type, pc.submitted_by, pc.status, pc.reviewed_by, pc.reviewed_at,
-			       pc.reason, pc.column_schema, pc.invalid_reason, pc.created_at
+			       pc.change_type, pc.submitted_by, pc.status, COALESCE(pc.reviewed_by, ''), pc.reviewed_at,
+			       COALESCE(pc.reason, ''), COALESCE(pc.column_schema, ''), COALESCE(pc.invalid_reason, ''),
+			       COALESCE(pc.sheet_value, ''), pc.created_at
 			FROM pending_changes pc
 			INNER JOIN moderator_domains md ON md.moderator_email = ?
 			WHERE pc.directory_id = ? AND pc.status IN (?, ?) AND md.directory_id = pc.directory_id
@@ -394,8 +396,9 @@ func (app *App) GetPendingChanges(directoryID, moderatorEmail string) ([]Pending
 		// For admins/super admins, show all pending changes
 		query = `
 			SELECT id, directory_id, row_id, column_name, old_value, new_value,
-			       change_type, submitted_by, status, reviewed_by, reviewed_at,
-			       reason, column_schema, invalid_reason, created_at
+			       change_type, submitted_by, status, COALESCE(reviewed_by, ''), reviewed_at,
+			       COALESCE(reason, ''), COALESCE(column_schema, ''), COALESCE(invalid_reason, ''),
+			       COALESCE(sheet_value, ''), created_at
 			FROM pending_changes
 			WHERE directory_id = ? AND status IN (?, ?)
 			ORDER BY created_at DESC
@@ -415,7 +418,7 @@ func (app *App) GetPendingChanges(directoryID, moderatorEmail string) ([]Pending
 		err := rows.Scan(&change.ID, &change.DirectoryID, &change.RowID, &change.ColumnName,
 			&change.OldValue, &change.NewValue, &change.ChangeType, &change.SubmittedBy,
 			&change.Status, &change.ReviewedBy, &change.ReviewedAt, &change.Reason, 
-			&change.ColumnSchema, &change.InvalidReason, &change.CreatedAt)
+			&change.ColumnSchema, &change.InvalidReason, &change.SheetValue, &change.CreatedAt)
 		if err != nil {
 			return nil, WrapDatabaseError(ErrTypeConnection, "failed to scan pending change", err)
 		}
@@ -529,7 +532,7 @@ func (app *App) moderatorCanApproveSpecificChange(moderatorEmail, directoryID st
 	var change PendingChange
 	err = app.DB.QueryRow(`
 		SELECT id, directory_id, row_id, column_name, old_value, new_value, change_type, 
-		       submitted_by, status, reviewed_by, reviewed_at, reason, created_at
+		       submitted_by, status, COALESCE(reviewed_by, ''), reviewed_at, COALESCE(reason, ''), created_at
 		FROM pending_changes 
 		WHERE id = ? AND directory_id = ?
 	`, changeID, directoryID).Scan(
@@ -608,12 +611,15 @@ func (app *App) ProcessChangeApproval(changeID int, reviewerEmail, action, reaso
 	
 	// Get the pending change
 	var change PendingChange
+	var syncJobID sql.NullInt64
 	err = tx.QueryRow(`
-		SELECT id, directory_id, row_id, column_name, old_value, new_value, change_type, submitted_by
+		SELECT id, directory_id, row_id, column_name, old_value, new_value, change_type, submitted_by,
+		       COALESCE(sheet_value, ''), sync_job_id
 		FROM pending_changes
 		WHERE id = ? AND status = ?
 	`, changeID, ChangeStatusPending).Scan(&change.ID, &change.DirectoryID, &change.RowID,
-		&change.ColumnName, &change.OldValue, &change.NewValue, &change.ChangeType, &change.SubmittedBy)
+		&change.ColumnName, &change.OldValue, &change.NewValue, &change.ChangeType, &change.SubmittedBy,
+		&change.SheetValue, &syncJobID)
 	
 	if err == sql.ErrNoRows {
 		return fmt.Errorf("pending change not found")
@@ -638,12 +644,27 @@ func (app *App) ProcessChangeApproval(changeID int, reviewerEmail, action, reaso
 		return WrapDatabaseError(ErrTypeConstraint, "failed to update change status", err)
 	}
 	
-	// If approved, apply the change to the directory database
+	// An approved edit, addition or deletion is written to the source like an owner's, and
+	// reaches the directory with the re-import that follows. The write is queued in the same
+	// transaction, so a change is never left approved without it.
 	if action == "approve" {
-		err = app.applyApprovedChange(tx, change)
+		job, err := app.planApprovedChange(change)
 		if err != nil {
 			return err
 		}
+		if job != nil {
+			if _, err := app.insertSyncJob(tx, change.DirectoryID, job.jobType, job.payload, change.SubmittedBy); err != nil {
+				return fmt.Errorf("failed to queue source write: %v", err)
+			}
+		}
+	}
+	
+	// An approved conflict writes the proposed value to the sheet after all; a rejected one
+	// keeps the sheet's value, which the next pull brings into the directory
+	if change.ChangeType == ChangeTypeConflict && action == "approve" && syncJobID.Valid {
+		if err := app.resolveConflictWithProposed(tx, change, int(syncJobID.Int64)); err != nil {
+			return fmt.Errorf("failed to queue sheet write: %v", err)
+		}
 	}
 	
 	// Commit the transaction
@@ -651,66 +672,88 @@ func (app *App) ProcessChangeApproval(changeID int, reviewerEmail, action, reaso
 		return WrapDatabaseError(ErrTypeConnection, "failed to commit transaction", err)
 	}
 	
+	if action == "approve" && app.SyncWorker != nil {
+		app.SyncWorker.Notify()
+	}
+	
 	log.Printf("Change %d %s by %s (reviewer: %s)", changeID, action, reviewerEmail, reviewerEmail)
 	return nil
 }
 
-// applyApprovedChange applies an approved change to the directory database
-func (app *App) applyApprovedChange(tx *sql.Tx, change PendingChange) error {
-	// Get directory-specific database connection
-	db, err := app.DirectoryDBManager.GetDirectoryDB(change.DirectoryID)
+// approvedChangeJob is the source write an approved change is applied with
+type approvedChangeJob struct {
+	jobType string
+	payload SyncJobPayload
+}
+
+// planApprovedChange builds the source write of an approved edit, addition or deletion.
+// Rows are located where they are now, since the source may have changed after the change
+// was submitted. Conflicts are resolved separately and need none.
+func (app *App) planApprovedChange(change PendingChange) (*approvedChangeJob, error) {
+	if change.ChangeType == ChangeTypeConflict {
+		return nil, nil
+	}
+	
+	// The change could never reach a source that is only read
+	binding, err := app.getDirectorySource(change.DirectoryID)
 	if err != nil {
-		return fmt.Errorf("failed to get directory database: %v", err)
+		return nil, err
+	}
+	if binding != nil && binding.ReadOnly {
+		return nil, errSourceReadOnly
 	}
 	
-	switch change.ChangeType {
-	case ChangeTypeEdit:
-		// For edits, we need to update the specific row and rebuild the data JSON
-		// This is a simplified implementation - in practice you'd want more sophisticated handling
-		var currentData string
-		err = db.QueryRow("SELECT data FROM directory WHERE id = ?", change.RowID).Scan(&currentData)
-		if err != nil {
-			return fmt.Errorf("failed to get current row data: %v", err)
-		}
-		
-		// Parse current data and update the specific column
-		var rowData []string
-		if err = json.Unmarshal([]byte(currentData), &rowData); err != nil {
-			return fmt.Errorf("failed to parse current row data: %v", err)
+	if change.ChangeType == ChangeTypeAdd {
+		var values []string
+		if err := json.Unmarshal([]byte(change.NewValue), &values); err != nil {
+			return nil, fmt.Errorf("failed to parse added row: %v", err)
 		}
-		
-		// TODO: Map column name to column index
-		// For now, assume column_name is a number
-		columnIndex := 0 // This should be derived from column_name
-		
-		if columnIndex < len(rowData) {
-			rowData[columnIndex] = change.NewValue
-		}
-		
-		newData, err := json.Marshal(rowData)
+		rowKey, err := newRowKey()
 		if err != nil {
-			return fmt.Errorf("failed to marshal updated row data: %v", err)
+			return nil, err
 		}
-		
-		_, err = db.Exec("UPDATE directory SET data = ? WHERE id = ?", string(newData), change.RowID)
-		if err != nil {
-			return fmt.Errorf("failed to update directory row: %v", err)
+		return &approvedChangeJob{SyncJobAppendRow, SyncJobPayload{Values: values, RowKey: rowKey}}, nil
+	}
+	
+	repo, err := app.rowRepository(change.DirectoryID)
+	if err != nil {
+		return nil, err
+	}
+	
+	row, err := repo.Get(int64(change.RowID))
+	if errors.Is(err, errRowNotFound) {
+		return nil, fmt.Errorf("row %d is no longer in the directory", change.RowID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	index, err := repo.IndexOf(row)
+	if err != nil {
+		return nil, err
+	}
+	
+	switch change.ChangeType {
+	case ChangeTypeEdit:
+		column := repo.ColumnIndex(change.ColumnName)
+		if column < 0 {
+			return nil, fmt.Errorf("column %q is no longer in the directory", change.ColumnName)
 		}
 		
-	case ChangeTypeAdd:
-		// For adds, insert new row
-		_, err = db.Exec("INSERT INTO directory (data) VALUES (?)", change.NewValue)
-		if err != nil {
-			return fmt.Errorf("failed to add directory row: %v", err)
-		}
+		// The change is approved against the value the directory holds now
+		baseValue := row.SourceValue(change.ColumnName)
+		return &approvedChangeJob{SyncJobUpdateCell, SyncJobPayload{
+			Row:       index,
+			RowID:     change.RowID,
+			RowKey:    row.Key,
+			Column:    column,
+			Value:     change.NewValue,
+			BaseValue: &baseValue,
+		}}, nil
 		
 	case ChangeTypeDelete:
-		// For deletes, remove the row
-		_, err = db.Exec("DELETE FROM directory WHERE id = ?", change.RowID)
-		if err != nil {
-			return fmt.Errorf("failed to delete directory row: %v", err)
-		}
+		return &approvedChangeJob{SyncJobDeleteRow, SyncJobPayload{Row: index, RowKey: row.Key}}, nil
 	}
 	
-	return nil
-}
\ No newline at end of file
+	return nil, nil
+}
@@ -56,6 +56,7 @@ type PendingChange struct {
 	Reason        string     `json:"reason"`
 	ColumnSchema  string     `json:"column_schema"`  // JSON array of column names when submitted
 	InvalidReason string     `json:"invalid_reason"` // Why change became invalid
+	SheetValue    string     `json:"sheet_value,omitempty"` // Value found in the sheet, for conflicts
 	CreatedAt     time.Time  `json:"created_at"`
 }
 
@@ -124,4 +125,6 @@ const (
 	ChangeTypeEdit   = "edit"
 	ChangeTypeAdd    = "add"
 	ChangeTypeDelete = "delete"
+	// ChangeTypeConflict is a write-back stopped because the sheet changed after the edit was made
+	ChangeTypeConflict = "conflict"
 )
\ No newline at end of file
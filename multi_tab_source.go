@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/sheets/v4"
+)
+
+// sourceTabHeader is the header of the column a multi-tab source adds after the tabs' own
+// columns, naming the tab each row comes from
+const sourceTabHeader = "Source Tab"
+
+// errSourceTabReadOnly is returned when a write targets the source tab column
+var errSourceTabReadOnly = errors.New("the source tab column can't be changed; move the row to another tab in the sheet instead")
+
+// MultiTabSource combines tabs of one spreadsheet that share a header into a single source.
+// Rows follow each other in tab order and every row names its tab in a column added after
+// the tabs' own columns. Row numbers are those of the combined rows, so writes must come
+// after a read, which records where each tab's rows start. Every tab has the binding's
+// header layout.
+type MultiTabSource struct {
+	tabs      []*GoogleSheetSource
+	views     []*HeaderLayoutSource // each tab as laid out by the header layout
+	titles    []string
+	rowCounts []int // data rows of each tab at the last read
+	width     int   // columns of the tabs' header at the last read, which is the source tab column
+}
+
+// newMultiTabSource opens every tab a binding combines, with the same range and credentials
+func (app *App) newMultiTabSource(
+	ctx context.Context, binding *DirectorySource, tokenSource oauth2.TokenSource,
+) (*MultiTabSource, error) {
+	titles := append([]string{binding.SheetTab}, binding.ExtraTabs...)
+	mts := &MultiTabSource{titles: titles, width: -1}
+	for _, title := range titles {
+		tab, err := app.newGoogleSheetSource(ctx, binding.SpreadsheetID, title, binding.SheetRange, tokenSource)
+		if err != nil {
+			return nil, err
+		}
+		mts.tabs = append(mts.tabs, tab)
+		mts.views = append(mts.views, newHeaderLayoutSource(tab, binding.Header))
+	}
+	return mts, nil
+}
+
+func (mts *MultiTabSource) Type() string {
+	return SourceTypeGoogleSheet
+}
+
+// Title lists the combined tabs, after making sure the first one exists
+func (mts *MultiTabSource) Title(ctx context.Context) (string, error) {
+	if _, err := mts.tabs[0].Title(ctx); err != nil {
+		return "", err
+	}
+	return strings.Join(mts.titles, ", "), nil
+}
+
+// ReadAll reads every tab and combines their rows under one header. Tabs must have the same
+// header, except that a tab may lack a row key column that is the last column of the others.
+func (mts *MultiTabSource) ReadAll(ctx context.Context) ([][]string, error) {
+	tabValues := make([][][]string, len(mts.tabs))
+	for i, view := range mts.views {
+		values, err := view.ReadAll(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("tab %q: %v", mts.titles[i], err)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("tab %q is empty; give it the same header as the other tabs", mts.titles[i])
+		}
+		tabValues[i] = values
+	}
+	return mts.combine(tabValues)
+}
+
+// combine checks the tabs' headers and joins their rows, recording where each tab's rows
+// start and where the source tab column is
+func (mts *MultiTabSource) combine(tabValues [][][]string) ([][]string, error) {
+	var header []string
+	for _, values := range tabValues {
+		if len(trimCells(values[0])) > len(header) {
+			header = trimCells(values[0])
+		}
+	}
+
+	for _, name := range header {
+		if name == sourceTabHeader {
+			return nil, fmt.Errorf("the tabs already have a %q column, which combining tabs adds", sourceTabHeader)
+		}
+	}
+
+	keyIndex := rowKeyIndex(header)
+	for i, values := range tabValues {
+		tabHeader := trimCells(values[0])
+		matches := strings.Join(tabHeader, "\x1f") == strings.Join(header, "\x1f")
+		if !matches && keyIndex == len(header)-1 {
+			matches = strings.Join(tabHeader, "\x1f") == strings.Join(header[:keyIndex], "\x1f")
+		}
+		if !matches {
+			return nil, fmt.Errorf("tab %q has the header %s, but %q has %s; combined tabs need the same columns",
+				mts.titles[i], strings.Join(tabHeader, ", "), mts.titles[0], strings.Join(header, ", "))
+		}
+	}
+
+	mts.width = len(header)
+	mts.rowCounts = make([]int, len(tabValues))
+	combined := [][]string{append(append([]string{}, header...), sourceTabHeader)}
+	for i, values := range tabValues {
+		mts.rowCounts[i] = len(values) - 1
+		for _, row := range values[1:] {
+			cells := make([]string, mts.width+1)
+			copy(cells, row)
+			cells[mts.width] = mts.titles[i]
+			combined = append(combined, cells)
+		}
+	}
+	return combined, nil
+}
+
+// tabRow finds the tab and tab row of a combined row number
+func (mts *MultiTabSource) tabRow(rowNumber int) (int, int, error) {
+	if mts.rowCounts == nil {
+		return 0, 0, fmt.Errorf("the tabs must be read before they are written")
+	}
+	row := rowNumber - 2
+	for i, count := range mts.rowCounts {
+		if row >= 0 && row < count {
+			return i, row + 2, nil
+		}
+		row -= count
+	}
+	return 0, 0, fmt.Errorf("row %d is not in any of the combined tabs", rowNumber)
+}
+
+// tabColumn converts a combined column to the column of the tabs, skipping the source tab column
+func (mts *MultiTabSource) tabColumn(col int) (int, error) {
+	if mts.width < 0 {
+		return 0, fmt.Errorf("the tabs must be read before they are written")
+	}
+	switch {
+	case col < mts.width:
+		return col, nil
+	case col == mts.width:
+		return 0, errSourceTabReadOnly
+	default:
+		return col - 1, nil
+	}
+}
+
+func (mts *MultiTabSource) UpdateCell(ctx context.Context, rowNumber, col int, value string) error {
+	tab, row, err := mts.tabRow(rowNumber)
+	if err != nil {
+		return err
+	}
+	tabCol, err := mts.tabColumn(col)
+	if err != nil {
+		return err
+	}
+	return mts.views[tab].UpdateCell(ctx, row, tabCol, value)
+}
+
+// UpdateColumn writes each tab's share of the column; a header value is written to every tab
+func (mts *MultiTabSource) UpdateColumn(ctx context.Context, col, firstRow int, values []string) error {
+	tabCol, err := mts.tabColumn(col)
+	if err != nil {
+		return err
+	}
+
+	var header []string
+	if firstRow == 1 && len(values) > 0 {
+		header = values[:1]
+		values = values[1:]
+		firstRow = 2
+	}
+
+	start := 2 // combined row number of each tab's first data row
+	for i, count := range mts.rowCounts {
+		first, last := start, start+count-1
+		if firstRow > first {
+			first = firstRow
+		}
+		if end := firstRow + len(values) - 1; end < last {
+			last = end
+		}
+
+		tabValues := append([]string{}, header...)
+		if first <= last {
+			tabValues = append(tabValues, values[first-firstRow:last-firstRow+1]...)
+		}
+		tabFirstRow := first - start + 2
+		if header != nil {
+			tabFirstRow = 1
+		}
+		if len(tabValues) > 0 {
+			if err := mts.views[i].UpdateColumn(ctx, tabCol, tabFirstRow, tabValues); err != nil {
+				return fmt.Errorf("tab %q: %v", mts.titles[i], err)
+			}
+		}
+		start += count
+	}
+	return nil
+}
+
+// HideColumn hides the column in every tab
+func (mts *MultiTabSource) HideColumn(ctx context.Context, col int) error {
+	tabCol, err := mts.tabColumn(col)
+	if err != nil {
+		return err
+	}
+	for i, tab := range mts.tabs {
+		if err := tab.HideColumn(ctx, tabCol); err != nil {
+			return fmt.Errorf("tab %q: %v", mts.titles[i], err)
+		}
+	}
+	return nil
+}
+
+// appendTab picks the tab a new row goes to from its source tab column, or the first tab
+func (mts *MultiTabSource) appendTab(values []string) int {
+	if mts.width >= 0 && mts.width < len(values) {
+		for i, title := range mts.titles {
+			if strings.TrimSpace(values[mts.width]) == title {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// tabValues removes the source tab column from a combined row
+func (mts *MultiTabSource) tabValues(values []string) []string {
+	if mts.width < 0 || mts.width >= len(values) {
+		return values
+	}
+	return append(append([]string{}, values[:mts.width]...), values[mts.width+1:]...)
+}
+
+func (mts *MultiTabSource) AppendRow(ctx context.Context, values []string) error {
+	return mts.views[mts.appendTab(values)].AppendRow(ctx, mts.tabValues(values))
+}
+
+func (mts *MultiTabSource) DeleteRow(ctx context.Context, rowNumber int) error {
+	tab, row, err := mts.tabRow(rowNumber)
+	if err != nil {
+		return err
+	}
+	return mts.views[tab].DeleteRow(ctx, row)
+}
+
+// ApplyBatch converts the writes to each tab's rows and columns and sends them all in one
+// spreadsheets.batchUpdate call. Each tab's writes keep their order, so its row numbers
+// stay valid while they are applied.
+func (mts *MultiTabSource) ApplyBatch(ctx context.Context, writes []SourceWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	tabWrites := make([][]SourceWrite, len(mts.tabs))
+	for _, write := range writes {
+		tab := 0
+		switch write.Kind {
+		case SyncJobAppendRow:
+			tab = mts.appendTab(write.Values)
+			write.Values = mts.tabValues(write.Values)
+		default:
+			var err error
+			tab, write.RowNumber, err = mts.tabRow(write.RowNumber)
+			if err != nil {
+				return err
+			}
+			if write.Kind == SyncJobUpdateCell {
+				if write.Column, err = mts.tabColumn(write.Column); err != nil {
+					return err
+				}
+			}
+		}
+		tabWrites[tab] = append(tabWrites[tab], write)
+	}
+
+	var requests []*sheets.Request
+	for i, tab := range mts.tabs {
+		if len(tabWrites[i]) == 0 {
+			continue
+		}
+		sourceWrites, err := mts.views[i].sourceWrites(ctx, tabWrites[i])
+		if err != nil {
+			return fmt.Errorf("tab %q: %v", mts.titles[i], err)
+		}
+		tabRequests, err := tab.batchRequests(ctx, sourceWrites)
+		if err != nil {
+			return fmt.Errorf("tab %q: %v", mts.titles[i], err)
+		}
+		requests = append(requests, tabRequests...)
+	}
+
+	first := mts.tabs[0]
+	if err := first.quota.WaitWrite(ctx, first.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err := first.srv.Spreadsheets.BatchUpdate(first.spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).
+		Context(ctx).Do()
+
+	return err
+}
+
+// ReadCellRules reads each tab's rules and moves them to the combined rows and columns. The
+// source tab column is reported as protected, since a row's tab can only be changed in the sheet.
+func (mts *MultiTabSource) ReadCellRules(ctx context.Context, rows []int) ([]SourceCellRule, error) {
+	if mts.rowCounts == nil {
+		return nil, fmt.Errorf("the tabs must be read before their cell rules")
+	}
+
+	rules := []SourceCellRule{{
+		Kind:        CellRuleProtected,
+		FirstRow:    2,
+		FirstColumn: mts.width,
+		LastColumn:  mts.width,
+		Description: "the tab each row comes from",
+	}}
+
+	start := 2
+	for i, view := range mts.views {
+		count := mts.rowCounts[i]
+		last := start + count - 1
+
+		var tabRows []int
+		if rows != nil {
+			for _, row := range rows {
+				if row >= start && row <= last {
+					tabRows = append(tabRows, row-start+2)
+				}
+			}
+		}
+
+		if count > 0 && (rows == nil || len(tabRows) > 0) {
+			tabRules, err := view.ReadCellRules(ctx, tabRows)
+			if err != nil {
+				return nil, fmt.Errorf("tab %q: %v", mts.titles[i], err)
+			}
+
+			for _, rule := range tabRules {
+				// The header row is shared, and open-ended rules end with the tab's rows
+				if rule.FirstRow < 2 {
+					rule.FirstRow = 2
+				}
+				if rule.LastRow == 0 || rule.LastRow > count+1 {
+					rule.LastRow = count + 1
+				}
+				if rule.LastRow < rule.FirstRow {
+					continue
+				}
+				rule.FirstRow += start - 2
+				rule.LastRow += start - 2
+
+				if rule.FirstColumn >= mts.width {
+					rule.FirstColumn++
+				}
+				if rule.LastColumn >= mts.width {
+					rule.LastColumn++
+				}
+				rules = append(rules, rule)
+			}
+		}
+		start += count
+	}
+	return rules, nil
+}
@@ -202,6 +202,13 @@ func (app *App) SpecialRateLimitMiddleware() func(http.Handler) http.Handler {
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Drive sends every notification from a few Google addresses and each one is
+			// verified by its channel token, so the webhook isn't limited per IP
+			if r.URL.Path == "/webhooks/drive" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			var limiter *RateLimiter
 			
 			// Choose limiter based on path
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// rowKeyHeader is the header of the hidden source column holding each row's key
+const rowKeyHeader = "_directory_row_key"
+
+// rowKeyColumn stores the source row key of a directory row
+const rowKeyColumn = "_rowKey"
+
+// errSourceRowNotFound is returned when no source row holds the key a job refers to
+var errSourceRowNotFound = errors.New("row no longer exists in the source")
+
+// columnHider is implemented by sources that can hide a column from people editing them
+type columnHider interface {
+	HideColumn(ctx context.Context, col int) error
+}
+
+// newRowKey generates a random key identifying one source row
+func newRowKey() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate row key: %v", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// rowKeyIndex returns the position of the row key column in a header, or -1 if there is none
+func rowKeyIndex(header []string) int {
+	for i, cell := range header {
+		if strings.TrimSpace(cell) == rowKeyHeader {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitRowKeys removes the row key column from the source rows and returns the rows without
+// it along with the key of each data row. Keys are empty if the source has no key column.
+func splitRowKeys(values [][]string) ([][]string, []string) {
+	keys := make([]string, len(values)-1)
+	index := rowKeyIndex(values[0])
+	if index < 0 {
+		return values, keys
+	}
+
+	stripped := make([][]string, len(values))
+	for i, row := range values {
+		if index < len(row) {
+			if i > 0 {
+				keys[i-1] = strings.TrimSpace(row[index])
+			}
+			row = append(append([]string{}, row[:index]...), row[index+1:]...)
+		}
+		stripped[i] = row
+	}
+	return stripped, keys
+}
+
+// sourceColumn converts a directory column index to the source column index, skipping
+// over the row key column
+func sourceColumn(col, keyIndex int) int {
+	if keyIndex >= 0 && col >= keyIndex {
+		return col + 1
+	}
+	return col
+}
+
+// ensureRowKeys adds the row key column to the source if it is missing and gives every row
+// without a key, or with a key already used by a row above it, a new one. It returns the
+// source rows as they are after the keys were written.
+func (app *App) ensureRowKeys(ctx context.Context, source DataSource, values [][]string) ([][]string, error) {
+	index := rowKeyIndex(values[0])
+	created := index < 0
+	if created {
+		index = len(values[0])
+	}
+
+	column := make([]string, len(values))
+	column[0] = rowKeyHeader
+	changed := created
+	seen := make(map[string]bool)
+	for i := 1; i < len(values); i++ {
+		var key string
+		if index < len(values[i]) {
+			key = strings.TrimSpace(values[i][index])
+		}
+		if key == "" || seen[key] {
+			generated, err := newRowKey()
+			if err != nil {
+				return nil, err
+			}
+			key = generated
+			changed = true
+		}
+		seen[key] = true
+		column[i] = key
+	}
+
+	if !changed {
+		return values, nil
+	}
+
+	if err := source.UpdateColumn(ctx, index, 1, column); err != nil {
+		return nil, fmt.Errorf("failed to write row keys to source: %v", err)
+	}
+
+	if hider, ok := source.(columnHider); ok && created {
+		if err := hider.HideColumn(ctx, index); err != nil {
+			return nil, fmt.Errorf("failed to hide row key column: %v", err)
+		}
+	}
+
+	for i, key := range column {
+		for len(values[i]) <= index {
+			values[i] = append(values[i], "")
+		}
+		values[i][index] = key
+	}
+	return values, nil
+}
+
+// withRowKey returns a copy of a directory row with key inserted at the source's row key column
+func withRowKey(values []string, keyIndex int, key string) []string {
+	row := append([]string{}, values...)
+	for len(row) < keyIndex {
+		row = append(row, "")
+	}
+	return append(row[:keyIndex], append([]string{key}, row[keyIndex:]...)...)
+}
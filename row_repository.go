@@ -0,0 +1,483 @@
+package main
+
+import (
+	"database/sql"
+	"directoryCommunityWebsite/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Directory rows are stored in one table per directory database, named after the directory ID:
+//
+//	rowID       INTEGER PRIMARY KEY AUTOINCREMENT  the listing's ID, kept across imports and
+//	                                               referenced by pending changes and tag tables
+//	_sheetRow   INTEGER  the 1-based source row the listing was last read from
+//	_rowKey     TEXT     the listing's hidden row key in the source, if it has one
+//	_rawValues  TEXT     the source values the column normalisers changed, as a JSON object
+//	                     by column name, or NULL
+//	[<column>]  TEXT     one column per source header, holding the normalised value
+//
+// The directory's columns, in source order, and their types are the rows of
+// _meta_directory_column_types for the table, in the order they were inserted. Listings are
+// shown in source order, by _sheetRow and then rowID; a listing's position in that order is
+// the row index the page sends with corrections and deletions. Imports are the only writer:
+// edits made on the site are written to the source and read back by the re-import.
+//
+// Older directory databases kept each listing as a JSON array of cells in a `directory`
+// table. migrateLegacyDirectoryTable converts them.
+
+// errRowNotFound is returned when a directory has no row with the given ID or index
+var errRowNotFound = errors.New("row not found")
+
+// legacyDirectoryTable is the table of JSON arrays directories used to be stored in
+const legacyDirectoryTable = "directory"
+
+// legacyBackupTable is what the legacy table is renamed to once its rows have been moved, so
+// they can still be checked against the typed table
+const legacyBackupTable = "_meta_legacy_directory"
+
+// DirectoryColumn is a directory column and its type
+type DirectoryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// DirectoryRow is a stored listing with its values by column name
+type DirectoryRow struct {
+	ID       int64             `json:"id"`
+	SheetRow int               `json:"sheet_row"`
+	Key      string            `json:"-"`
+	Values   map[string]string `json:"values"`
+	Raw      map[string]string `json:"-"` // source values the normalisers changed
+}
+
+// SourceValue returns a column's value as it stands in the source, before normalisation
+func (row *DirectoryRow) SourceValue(column string) string {
+	if raw, ok := row.Raw[column]; ok {
+		return raw
+	}
+	return row.Values[column]
+}
+
+// Cells returns the row's values in column order
+func (row *DirectoryRow) Cells(columns []DirectoryColumn) []string {
+	cells := make([]string, len(columns))
+	for i, column := range columns {
+		cells[i] = row.Values[column.Name]
+	}
+	return cells
+}
+
+// RowRepository reads a directory's rows from its database
+type RowRepository struct {
+	directoryID string
+	db          *sql.DB
+	columns     []DirectoryColumn
+	hasTable    bool // false until the directory's first import
+}
+
+// rowRepository opens the rows of a directory
+func (app *App) rowRepository(directoryID string) (*RowRepository, error) {
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory database: %v", err)
+	}
+
+	columns, err := loadDirectoryColumns(db, directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", directoryID).
+		Scan(&count); err != nil {
+		return nil, fmt.Errorf("failed to look up directory table: %v", err)
+	}
+
+	return &RowRepository{directoryID: directoryID, db: db, columns: columns, hasTable: count > 0}, nil
+}
+
+// loadDirectoryColumns reads a directory's columns in source order
+func loadDirectoryColumns(q queryer, directoryID string) ([]DirectoryColumn, error) {
+	rows, err := q.Query(`
+		SELECT columnName, columnType
+		FROM _meta_directory_column_types
+		WHERE columnTable = ?
+		ORDER BY rowid`, directoryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query column types: %v", err)
+	}
+	defer rows.Close()
+
+	var columns []DirectoryColumn
+	for rows.Next() {
+		var column DirectoryColumn
+		if err := rows.Scan(&column.Name, &column.Type); err != nil {
+			return nil, fmt.Errorf("failed to scan column type: %v", err)
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// Columns returns the directory's columns in source order
+func (repo *RowRepository) Columns() []DirectoryColumn {
+	return repo.columns
+}
+
+// ColumnNames returns the names of the directory's columns in source order
+func (repo *RowRepository) ColumnNames() []string {
+	names := make([]string, len(repo.columns))
+	for i, column := range repo.columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// ColumnIndex returns the position of a column, or -1 if the directory has no such column
+func (repo *RowRepository) ColumnIndex(name string) int {
+	for i, column := range repo.columns {
+		if column.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ColumnsOf returns the columns a filter's column ID names: one column, or every column whose
+// name sorts between the ends of a range
+func (repo *RowRepository) ColumnsOf(columnID models.ColumnID) []DirectoryColumn {
+	var columns []DirectoryColumn
+	for _, column := range repo.columns {
+		switch columnID.Type {
+		case models.ColumnIDSingle:
+			if column.Name == columnID.Value {
+				columns = append(columns, column)
+			}
+		case models.ColumnIDRange:
+			if column.Name >= columnID.Start && column.Name <= columnID.End {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
+
+// List returns every row in source order
+func (repo *RowRepository) List() ([]*DirectoryRow, error) {
+	return repo.query("", "")
+}
+
+// Get returns the row with the given ID
+func (repo *RowRepository) Get(rowID int64) (*DirectoryRow, error) {
+	rows, err := repo.query("WHERE rowID = ?", "", rowID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errRowNotFound
+	}
+	return rows[0], nil
+}
+
+// AtIndex returns the row at the given position in source order
+func (repo *RowRepository) AtIndex(index int) (*DirectoryRow, error) {
+	if index < 0 {
+		return nil, errRowNotFound
+	}
+	rows, err := repo.query("", "LIMIT 1 OFFSET ?", index)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errRowNotFound
+	}
+	return rows[0], nil
+}
+
+// IndexOf returns the position of a row in source order
+func (repo *RowRepository) IndexOf(row *DirectoryRow) (int, error) {
+	var index int
+	err := repo.db.QueryRow(fmt.Sprintf(
+		"SELECT COUNT(*) FROM '%s' WHERE COALESCE([%s], 0) < ? OR (COALESCE([%s], 0) = ? AND rowID < ?)",
+		repo.directoryID, sheetRowColumn, sheetRowColumn), row.SheetRow, row.SheetRow, row.ID).Scan(&index)
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate row %d: %v", row.ID, err)
+	}
+	return index, nil
+}
+
+// query reads the rows matching a WHERE clause, in source order
+func (repo *RowRepository) query(where, limit string, args ...interface{}) ([]*DirectoryRow, error) {
+	if !repo.hasTable {
+		return nil, nil
+	}
+
+	rows, err := repo.db.Query(fmt.Sprintf(
+		"SELECT %s FROM '%s' %s ORDER BY COALESCE([%s], 0), rowID %s",
+		repo.rowColumns(), repo.directoryID, where, sheetRowColumn, limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query directory rows: %v", err)
+	}
+	defer rows.Close()
+
+	var result []*DirectoryRow
+	for rows.Next() {
+		row, err := repo.scanRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// rowColumns returns the select list scanRow reads
+func (repo *RowRepository) rowColumns() string {
+	quotedColumns := make([]string, len(repo.columns))
+	for i, column := range repo.columns {
+		quotedColumns[i] = fmt.Sprintf(", [%s]", column.Name)
+	}
+	return fmt.Sprintf("rowID, COALESCE([%s], 0), COALESCE([%s], ''), COALESCE([%s], '')%s",
+		sheetRowColumn, rowKeyColumn, rawValuesColumn, strings.Join(quotedColumns, ""))
+}
+
+// scanRow reads a row selected with rowColumns, followed by any extra columns into extra
+func (repo *RowRepository) scanRow(rows *sql.Rows, extra ...interface{}) (*DirectoryRow, error) {
+	row := &DirectoryRow{Values: make(map[string]string, len(repo.columns))}
+	var raw string
+	cells := make([]sql.NullString, len(repo.columns))
+	dest := []interface{}{&row.ID, &row.SheetRow, &row.Key, &raw}
+	for i := range cells {
+		dest = append(dest, &cells[i])
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, fmt.Errorf("failed to scan directory row: %v", err)
+	}
+
+	for i, column := range repo.columns {
+		row.Values[column.Name] = cells[i].String
+	}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &row.Raw); err != nil {
+			return nil, fmt.Errorf("failed to parse raw values of row %d: %v", row.ID, err)
+		}
+	}
+	return row, nil
+}
+
+// migrateDirectoryDatabases brings every directory database up to the current layout: it
+// converts the legacy table of JSON arrays, indexes tag and location columns that have no
+// tag table yet and builds missing search indexes. Directories that fail are logged and
+// left as they are.
+func (app *App) migrateDirectoryDatabases() {
+	rows, err := app.DB.Query("SELECT id FROM directories ORDER BY id")
+	if err != nil {
+		log.Printf("Failed to list directories to migrate: %v", err)
+		return
+	}
+
+	var directoryIDs []string
+	for rows.Next() {
+		var directoryID string
+		if err := rows.Scan(&directoryID); err != nil {
+			log.Printf("Failed to scan directory to migrate: %v", err)
+			continue
+		}
+		directoryIDs = append(directoryIDs, directoryID)
+	}
+	rows.Close()
+
+	for _, directoryID := range directoryIDs {
+		if err := app.migrateLegacyDirectoryTable(directoryID); err != nil {
+			log.Printf("Failed to migrate legacy rows of directory %s: %v", directoryID, err)
+		}
+		if err := app.indexTagColumns(directoryID); err != nil {
+			log.Printf("Failed to index tags of directory %s: %v", directoryID, err)
+		}
+		if err := app.indexSearch(directoryID); err != nil {
+			log.Printf("Failed to build search index of directory %s: %v", directoryID, err)
+		}
+	}
+}
+
+// migrateLegacyDirectoryTable moves the rows of a directory's legacy `directory` table into
+// its typed table, keeping their IDs so pending changes still point at them, and renames the
+// legacy table to _meta_legacy_directory. Cells are named after the directory's columns; a
+// directory that was never imported gets "Column 1", "Column 2" and so on. The rows are taken
+// to be in source order and normalised as an import would. Nothing is migrated if any row
+// would be lost: a row that can't be parsed, a row with more cells than the directory has
+// columns, or legacy rows in a directory whose typed table already holds rows. Such a
+// directory keeps its legacy table until it is sorted out by hand.
+func (app *App) migrateLegacyDirectoryTable(directoryID string) error {
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return fmt.Errorf("failed to get directory database: %v", err)
+	}
+
+	var legacy int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+		legacyDirectoryTable).Scan(&legacy); err != nil {
+		return fmt.Errorf("failed to look up legacy directory table: %v", err)
+	}
+	if legacy == 0 || directoryID == legacyDirectoryTable {
+		return nil
+	}
+
+	legacyRows, err := loadLegacyRows(db)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS _meta_directory_column_types (
+			columnName TEXT NOT NULL,
+			columnTable TEXT NOT NULL,
+			columnType TEXT CHECK (columnType IN ('basic', 'numeric', 'location', 'tag', 'category')) NOT NULL,
+			PRIMARY KEY (columnName, columnTable)
+		)`); err != nil {
+		return fmt.Errorf("failed to create _meta_directory_column_types: %v", err)
+	}
+	if _, err := db.Exec(columnNormalizersTableQuery); err != nil {
+		return fmt.Errorf("failed to create _meta_column_normalizers: %v", err)
+	}
+
+	columns, err := loadDirectoryColumns(db, directoryID)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		width := 0
+		for _, row := range legacyRows {
+			if len(row.cells) > width {
+				width = len(row.cells)
+			}
+		}
+		for i := 0; i < width; i++ {
+			columns = append(columns, DirectoryColumn{Name: fmt.Sprintf("Column %d", i+1), Type: "basic"})
+		}
+	}
+
+	columnNames := make([]string, len(columns))
+	columnTypes := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = column.Name
+		columnTypes[i] = column.Type
+	}
+
+	// Empty trailing cells are all the typed table may leave behind
+	for _, row := range legacyRows {
+		for i := len(columnNames); i < len(row.cells); i++ {
+			if strings.TrimSpace(row.cells[i]) != "" {
+				return fmt.Errorf("legacy row %d has %d cells but the directory has %d columns; not migrating",
+					row.id, len(row.cells), len(columnNames))
+			}
+		}
+	}
+
+	if len(columns) > 0 {
+		if _, err := ensureDirectoryTable(db, directoryID, columnNames); err != nil {
+			return err
+		}
+	}
+
+	normalizers, err := loadColumnNormalizers(db, columnNames, columnTypes)
+	if err != nil {
+		return err
+	}
+
+	return app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		stored, err := loadDirectoryColumns(tx, directoryID)
+		if err != nil {
+			return err
+		}
+		if len(stored) == 0 {
+			for _, column := range columns {
+				if _, err := tx.Exec(
+					"INSERT INTO _meta_directory_column_types (columnName, columnTable, columnType) VALUES (?, ?, ?)",
+					column.Name, directoryID, column.Type); err != nil {
+					return fmt.Errorf("failed to insert column type %v for column %v: %v", column.Type, column.Name, err)
+				}
+			}
+		}
+
+		var existing int
+		if len(columns) > 0 {
+			if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM '%s'", directoryID)).Scan(&existing); err != nil {
+				return fmt.Errorf("failed to count directory rows: %v", err)
+			}
+		}
+
+		if existing > 0 && len(legacyRows) > 0 {
+			return fmt.Errorf("directory was imported since its %d legacy rows were written; not migrating them over its %d rows",
+				len(legacyRows), existing)
+		}
+		if existing == 0 && len(columns) > 0 {
+			targets := []string{"rowID", fmt.Sprintf("[%s]", sheetRowColumn), fmt.Sprintf("[%s]", rawValuesColumn)}
+			for _, name := range columnNames {
+				targets = append(targets, fmt.Sprintf("[%s]", name))
+			}
+			insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO '%s' (%s) VALUES (?, ?, NULLIF(?, '')%s)",
+				directoryID, strings.Join(targets, ", "), strings.Repeat(", ?", len(columnNames))))
+			if err != nil {
+				return fmt.Errorf("failed to prepare legacy row insert: %v", err)
+			}
+			defer insert.Close()
+
+			for i, row := range legacyRows {
+				values := make([]string, len(columnNames))
+				copy(values, row.cells) // only empty cells are left out, as checked above
+				raw, err := normalizeRow(columnNames, normalizers, values)
+				if err != nil {
+					return err
+				}
+
+				args := []interface{}{row.id, i + 2, raw}
+				for _, value := range values {
+					args = append(args, value)
+				}
+				if _, err := insert.Exec(args...); err != nil {
+					return fmt.Errorf("failed to move legacy row %d: %v", row.id, err)
+				}
+			}
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE '%s' RENAME TO '%s'", legacyDirectoryTable, legacyBackupTable)); err != nil {
+			return fmt.Errorf("failed to set legacy directory table aside: %v", err)
+		}
+		return nil
+	})
+}
+
+// legacyRow is a row of the legacy `directory` table
+type legacyRow struct {
+	id    int64
+	cells []string
+}
+
+// loadLegacyRows reads the legacy `directory` table in ID order. It fails on a row whose data
+// isn't a JSON array of strings, rather than leave the row behind.
+func loadLegacyRows(db *sql.DB) ([]legacyRow, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT id, data FROM '%s' ORDER BY id", legacyDirectoryTable))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query legacy directory rows: %v", err)
+	}
+	defer rows.Close()
+
+	var result []legacyRow
+	for rows.Next() {
+		var row legacyRow
+		var data string
+		if err := rows.Scan(&row.id, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan legacy directory row: %v", err)
+		}
+		if err := json.Unmarshal([]byte(data), &row.cells); err != nil {
+			return nil, fmt.Errorf("legacy directory row %d can't be parsed, not migrating: %v", row.id, err)
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
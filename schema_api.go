@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// handleGetSchemaProposal returns the schema change waiting for the owner, or null if the
+// source's header matches the directory
+func (app *App) handleGetSchemaProposal(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	proposal, err := app.GetPendingSchemaProposal(directoryID)
+	if err != nil {
+		log.Printf("Failed to get schema proposal for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to get schema proposal")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, proposal, "")
+}
+
+// handleConfirmSchemaProposal migrates the directory to the source's new header using the
+// proposed mapping, or the corrected one sent with the request, then pulls the source
+func (app *App) handleConfirmSchemaProposal(w http.ResponseWriter, r *http.Request) {
+	userEmail, ok := utils2.RequireAuthentication(w, r)
+	if !ok {
+		return
+	}
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req ConfirmSchemaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode confirm schema request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	proposal, err := app.getSchemaProposal(directoryID, req.ProposalID)
+	if err != nil {
+		log.Printf("Failed to get schema proposal %d: %v", req.ProposalID, err)
+		utils2.NotFoundError(w, "Schema proposal")
+		return
+	}
+	if proposal.Status != SchemaProposalPending {
+		utils2.ValidationError(w, "Schema proposal is already "+proposal.Status)
+		return
+	}
+
+	columns := req.Columns
+	if len(columns) == 0 {
+		columns = proposal.Columns
+	}
+	columns, err = validateSchemaMapping(proposal, columns)
+	if err != nil {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	if err := app.ApplySchemaProposal(proposal, columns, userEmail); err != nil {
+		log.Printf("Failed to apply schema proposal %d to directory %s: %v", proposal.ID, directoryID, err)
+		utils2.InternalServerError(w, "Failed to apply schema change: "+err.Error())
+		return
+	}
+	log.Printf("User %s confirmed schema change %d for directory %s", userEmail, proposal.ID, directoryID)
+
+	// Fill the new columns and pick up anything else that changed in the source
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	message := "Schema change applied"
+	if _, err := app.pullDirectory(ctx, directoryID); err != nil {
+		log.Printf("Pull after schema change of directory %s failed: %v", directoryID, err)
+		message = "Schema change applied, but pulling the source failed: " + err.Error()
+	}
+
+	if app.SyncWorker != nil {
+		app.SyncWorker.Notify()
+	}
+
+	proposal, err = app.getSchemaProposal(directoryID, proposal.ID)
+	if err != nil {
+		log.Printf("Failed to reload schema proposal: %v", err)
+		utils2.RespondWithSuccess(w, nil, message)
+		return
+	}
+
+	utils2.RespondWithSuccess(w, proposal, message)
+}
+
+// handleRejectSchemaProposal dismisses a schema change, for when the owner would rather put
+// the source's header back
+func (app *App) handleRejectSchemaProposal(w http.ResponseWriter, r *http.Request) {
+	userEmail, ok := utils2.RequireAuthentication(w, r)
+	if !ok {
+		return
+	}
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req SchemaProposalActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode reject schema request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	if err := app.RejectSchemaProposal(directoryID, req.ProposalID, userEmail); err != nil {
+		log.Printf("Failed to reject schema proposal %d: %v", req.ProposalID, err)
+		utils2.NotFoundError(w, "Pending schema proposal")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, nil, "Schema change rejected; a new one is proposed if the source's header still differs on the next sync")
+}
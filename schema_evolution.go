@@ -0,0 +1,820 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Schema proposal status constants
+const (
+	SchemaProposalPending    = "pending"    // waiting for the owner
+	SchemaProposalConfirmed  = "confirmed"  // mapping applied to the directory
+	SchemaProposalRejected   = "rejected"   // dismissed by the owner
+	SchemaProposalSuperseded = "superseded" // the source's header changed again before it was resolved
+)
+
+// Schema column action constants
+const (
+	SchemaActionKeep   = "keep"   // same column, possibly moved
+	SchemaActionRename = "rename" // stored column carried over under a new name
+	SchemaActionAdd    = "add"    // column new to the directory
+)
+
+// HeaderMismatchError is returned by an import when the source's header no longer matches
+// the directory's columns
+type HeaderMismatchError struct {
+	Header []string // the source's header, without the row key column
+	Err    error
+}
+
+func (e *HeaderMismatchError) Error() string {
+	return e.Err.Error()
+}
+
+// SchemaColumnMapping says where one column of the source's new header takes its data from
+type SchemaColumnMapping struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	OldName string `json:"old_name,omitempty"` // stored column carried over; empty for a new column
+	Action  string `json:"action"`
+}
+
+// SchemaProposal is a header change detected in a directory's source, with the column
+// mapping proposed for it. Stored columns that no column maps from are dropped.
+type SchemaProposal struct {
+	ID          int                   `json:"id"`
+	DirectoryID string                `json:"directory_id"`
+	OldColumns  []string              `json:"old_columns"`
+	NewHeader   []string              `json:"new_header"`
+	Columns     []SchemaColumnMapping `json:"columns"`
+	Dropped     []string              `json:"dropped"`
+	Reordered   bool                  `json:"reordered"`
+	Status      string                `json:"status"`
+	CreatedAt   time.Time             `json:"created_at"`
+	ResolvedBy  string                `json:"resolved_by,omitempty"`
+	ResolvedAt  *time.Time            `json:"resolved_at,omitempty"`
+}
+
+// ConfirmSchemaRequest confirms a schema proposal, optionally with a corrected mapping
+type ConfirmSchemaRequest struct {
+	ProposalID int                   `json:"proposal_id"`
+	Columns    []SchemaColumnMapping `json:"columns,omitempty"` // the proposed mapping is used if empty
+}
+
+// SchemaProposalActionRequest identifies a schema proposal to reject
+type SchemaProposalActionRequest struct {
+	ProposalID int `json:"proposal_id"`
+}
+
+// normalizeColumnName reduces a column name to its lower-case letters and digits, so that
+// changes in case, spacing or punctuation alone are recognised as renames
+func normalizeColumnName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// proposeSchemaMapping guesses how the columns of a new header relate to the stored ones.
+// Columns that kept their name are kept wherever they moved. Of the rest, a column whose
+// name differs only in case or punctuation from a stored one, or that took the place of a
+// stored column that is gone, is taken to be a rename. Anything else is a new column.
+func proposeSchemaMapping(oldNames, oldTypes, header []string) []SchemaColumnMapping {
+	oldType := make(map[string]string, len(oldNames))
+	for i, name := range oldNames {
+		oldType[name] = oldTypes[i]
+	}
+
+	columns := make([]SchemaColumnMapping, len(header))
+	claimed := make(map[string]bool)
+	carry := func(i int, oldName, action string) {
+		columns[i] = SchemaColumnMapping{Name: header[i], Type: oldType[oldName], OldName: oldName, Action: action}
+		claimed[oldName] = true
+	}
+
+	for i, name := range header {
+		if _, ok := oldType[name]; ok && !claimed[name] {
+			carry(i, name, SchemaActionKeep)
+		}
+	}
+
+	for i, name := range header {
+		if columns[i].OldName != "" {
+			continue
+		}
+		for _, oldName := range oldNames {
+			if !claimed[oldName] && normalizeColumnName(oldName) == normalizeColumnName(name) {
+				carry(i, oldName, SchemaActionRename)
+				break
+			}
+		}
+	}
+
+	for i := range header {
+		if columns[i].OldName == "" && i < len(oldNames) && !claimed[oldNames[i]] {
+			carry(i, oldNames[i], SchemaActionRename)
+		}
+	}
+
+	for i, name := range header {
+		if columns[i].OldName == "" {
+			columns[i] = SchemaColumnMapping{Name: name, Type: "basic", Action: SchemaActionAdd}
+		}
+	}
+
+	return columns
+}
+
+// schemaChanges returns the stored columns a mapping drops and whether it changes the order
+// of the columns it keeps
+func schemaChanges(oldNames []string, columns []SchemaColumnMapping) ([]string, bool) {
+	oldIndex := make(map[string]int, len(oldNames))
+	for i, name := range oldNames {
+		oldIndex[name] = i
+	}
+
+	used := make(map[string]bool)
+	reordered := false
+	last := -1
+	for _, column := range columns {
+		if column.OldName == "" {
+			continue
+		}
+		used[column.OldName] = true
+		if oldIndex[column.OldName] < last {
+			reordered = true
+		}
+		last = oldIndex[column.OldName]
+	}
+
+	dropped := []string{}
+	for _, name := range oldNames {
+		if !used[name] {
+			dropped = append(dropped, name)
+		}
+	}
+	return dropped, reordered
+}
+
+// validateSchemaMapping checks a mapping submitted for a proposal and fills in each column's
+// name from the source's header and its action from the old name
+func validateSchemaMapping(proposal *SchemaProposal, columns []SchemaColumnMapping) ([]SchemaColumnMapping, error) {
+	if len(columns) != len(proposal.NewHeader) {
+		return nil, fmt.Errorf("mapping has %d columns, the source has %d", len(columns), len(proposal.NewHeader))
+	}
+
+	oldColumns := make(map[string]bool, len(proposal.OldColumns))
+	for _, name := range proposal.OldColumns {
+		oldColumns[name] = true
+	}
+
+	names := make(map[string]bool)
+	used := make(map[string]bool)
+	result := make([]SchemaColumnMapping, len(columns))
+	for i, column := range columns {
+		name := proposal.NewHeader[i]
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("column %d of the source has no header", i+1)
+		case name == "rowID" || name == sheetRowColumn || name == rowKeyColumn || name == rawValuesColumn:
+			return nil, fmt.Errorf("column name %q is reserved", name)
+		case names[name]:
+			return nil, fmt.Errorf("the source has more than one column named %q", name)
+		case column.Name != "" && strings.TrimSpace(column.Name) != name:
+			return nil, fmt.Errorf("column %d is %q in the source, not %q", i+1, name, column.Name)
+		case !validColumnTypes[column.Type]:
+			return nil, fmt.Errorf("invalid column type for %q: %s", name, column.Type)
+		case column.OldName != "" && !oldColumns[column.OldName]:
+			return nil, fmt.Errorf("%q is not a column of the directory", column.OldName)
+		case column.OldName != "" && used[column.OldName]:
+			return nil, fmt.Errorf("column %q is mapped more than once", column.OldName)
+		}
+		names[name] = true
+		used[column.OldName] = true
+
+		action := SchemaActionAdd
+		if column.OldName == name {
+			action = SchemaActionKeep
+		} else if column.OldName != "" {
+			action = SchemaActionRename
+		}
+		result[i] = SchemaColumnMapping{Name: name, Type: column.Type, OldName: column.OldName, Action: action}
+	}
+
+	return result, nil
+}
+
+// schemaChangeError explains why syncing a directory stopped after its source's header changed
+func schemaChangeError(proposal *SchemaProposal, mismatch *HeaderMismatchError) error {
+	return fmt.Errorf("source columns changed (%v); confirm schema change %d to resume syncing", mismatch.Err, proposal.ID)
+}
+
+// checkSourceHeader returns a HeaderMismatchError if the source rows' header no longer
+// matches the directory's columns
+func (app *App) checkSourceHeader(directoryID string, values [][]string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	columnNames, _, err := app.getDirectoryColumnConfig(directoryID)
+	if err != nil {
+		return err
+	}
+
+	values, _ = splitRowKeys(values)
+	if err := validateSourceHeader(values[0], columnNames); err != nil {
+		return &HeaderMismatchError{Header: trimCells(values[0]), Err: err}
+	}
+	return nil
+}
+
+// trimCells returns a copy of a row with every cell trimmed
+func trimCells(row []string) []string {
+	trimmed := make([]string, len(row))
+	for i, cell := range row {
+		trimmed[i] = strings.TrimSpace(cell)
+	}
+	return trimmed
+}
+
+// recordSchemaProposal stores a proposal for a directory whose source now has the given
+// header, unless the pending proposal is already for that header. A pending proposal for
+// a different header is superseded.
+func (app *App) recordSchemaProposal(directoryID string, header []string) (*SchemaProposal, error) {
+	current, err := app.GetPendingSchemaProposal(directoryID)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && schemasEqual(current.NewHeader, header) {
+		return current, nil
+	}
+
+	oldNames, oldTypes, err := app.getDirectoryColumnConfig(directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal := &SchemaProposal{
+		DirectoryID: directoryID,
+		OldColumns:  oldNames,
+		NewHeader:   header,
+		Columns:     proposeSchemaMapping(oldNames, oldTypes, header),
+		Status:      SchemaProposalPending,
+		CreatedAt:   time.Now().UTC(),
+	}
+	proposal.Dropped, proposal.Reordered = schemaChanges(oldNames, proposal.Columns)
+
+	oldJSON, err := json.Marshal(proposal.OldColumns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal old columns: %v", err)
+	}
+	headerJSON, err := json.Marshal(proposal.NewHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal new header: %v", err)
+	}
+	columnsJSON, err := json.Marshal(proposal.Columns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal column mapping: %v", err)
+	}
+
+	err = app.WithTransaction(func(tx *sql.Tx) error {
+		if current != nil {
+			_, err := tx.Exec("UPDATE schema_proposals SET status = ?, resolved_at = ? WHERE id = ?",
+				SchemaProposalSuperseded, proposal.CreatedAt, current.ID)
+			if err != nil {
+				return WrapDatabaseError(ErrTypeConstraint, "failed to supersede schema proposal", err)
+			}
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO schema_proposals (directory_id, old_columns, new_header, columns, status, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, directoryID, string(oldJSON), string(headerJSON), string(columnsJSON), proposal.Status, proposal.CreatedAt)
+		if err != nil {
+			return WrapDatabaseError(ErrTypeConstraint, "failed to insert schema proposal", err)
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return WrapDatabaseError(ErrTypeConnection, "failed to get schema proposal ID", err)
+		}
+		proposal.ID = int(id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Source columns of directory %s changed; schema change %d is waiting for the owner", directoryID, proposal.ID)
+	return proposal, nil
+}
+
+// dismissSchemaProposals supersedes the pending proposal of a directory whose source matches
+// its columns again, and reports whether there was one
+func (app *App) dismissSchemaProposals(directoryID string) (bool, error) {
+	result, err := app.DB.Exec(`
+		UPDATE schema_proposals SET status = ?, resolved_at = ? WHERE directory_id = ? AND status = ?
+	`, SchemaProposalSuperseded, time.Now().UTC(), directoryID, SchemaProposalPending)
+	if err != nil {
+		return false, WrapDatabaseError(ErrTypeConnection, "failed to dismiss schema proposals", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// GetPendingSchemaProposal returns the proposal waiting for the directory's owner, or nil
+func (app *App) GetPendingSchemaProposal(directoryID string) (*SchemaProposal, error) {
+	row := app.DB.QueryRow(`
+		SELECT id, directory_id, old_columns, new_header, columns, status, created_at,
+		       COALESCE(resolved_by, ''), resolved_at
+		FROM schema_proposals WHERE directory_id = ? AND status = ?
+		ORDER BY id DESC LIMIT 1
+	`, directoryID, SchemaProposalPending)
+
+	proposal, err := scanSchemaProposal(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return proposal, err
+}
+
+// getSchemaProposal loads one of a directory's proposals
+func (app *App) getSchemaProposal(directoryID string, proposalID int) (*SchemaProposal, error) {
+	row := app.DB.QueryRow(`
+		SELECT id, directory_id, old_columns, new_header, columns, status, created_at,
+		       COALESCE(resolved_by, ''), resolved_at
+		FROM schema_proposals WHERE id = ? AND directory_id = ?
+	`, proposalID, directoryID)
+
+	proposal, err := scanSchemaProposal(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("schema proposal %d not found", proposalID)
+	}
+	return proposal, err
+}
+
+func scanSchemaProposal(scanner rowScanner) (*SchemaProposal, error) {
+	var proposal SchemaProposal
+	var oldJSON, headerJSON, columnsJSON string
+	var resolvedAt sql.NullTime
+	err := scanner.Scan(&proposal.ID, &proposal.DirectoryID, &oldJSON, &headerJSON, &columnsJSON,
+		&proposal.Status, &proposal.CreatedAt, &proposal.ResolvedBy, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(oldJSON), &proposal.OldColumns); err != nil {
+		return nil, fmt.Errorf("failed to parse old columns of schema proposal %d: %v", proposal.ID, err)
+	}
+	if err := json.Unmarshal([]byte(headerJSON), &proposal.NewHeader); err != nil {
+		return nil, fmt.Errorf("failed to parse new header of schema proposal %d: %v", proposal.ID, err)
+	}
+	if err := json.Unmarshal([]byte(columnsJSON), &proposal.Columns); err != nil {
+		return nil, fmt.Errorf("failed to parse columns of schema proposal %d: %v", proposal.ID, err)
+	}
+	if resolvedAt.Valid {
+		proposal.ResolvedAt = &resolvedAt.Time
+	}
+	proposal.Dropped, proposal.Reordered = schemaChanges(proposal.OldColumns, proposal.Columns)
+
+	return &proposal, nil
+}
+
+// RejectSchemaProposal dismisses a pending proposal. If the source's header still doesn't
+// match the directory on the next sync, a new proposal is made.
+func (app *App) RejectSchemaProposal(directoryID string, proposalID int, rejectedBy string) error {
+	result, err := app.DB.Exec(`
+		UPDATE schema_proposals SET status = ?, resolved_by = ?, resolved_at = ?
+		WHERE id = ? AND directory_id = ? AND status = ?
+	`, SchemaProposalRejected, rejectedBy, time.Now().UTC(), proposalID, directoryID, SchemaProposalPending)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConnection, "failed to reject schema proposal", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("no pending schema proposal %d in directory %s", proposalID, directoryID)
+	}
+	return nil
+}
+
+// ApplySchemaProposal migrates a directory to the columns of a confirmed mapping: the
+// directory table and column types first, then the pending changes and queued write-back
+// jobs that refer to columns by name or position. Row IDs are kept throughout.
+func (app *App) ApplySchemaProposal(proposal *SchemaProposal, columns []SchemaColumnMapping, confirmedBy string) error {
+	unlock := lockDirectorySync(proposal.DirectoryID)
+	defer unlock()
+
+	var status string
+	if err := app.DB.QueryRow("SELECT status FROM schema_proposals WHERE id = ?", proposal.ID).Scan(&status); err != nil {
+		return WrapDatabaseError(ErrTypeConnection, "failed to check schema proposal", err)
+	}
+	if status != SchemaProposalPending {
+		return fmt.Errorf("schema proposal %d is already %s", proposal.ID, status)
+	}
+
+	oldNames, oldTypes, err := app.getDirectoryColumnConfig(proposal.DirectoryID)
+	if err != nil {
+		return err
+	}
+
+	// The directory table and the pending changes live in different databases. If updating
+	// the pending changes failed after the table was migrated, confirming again only
+	// updates them.
+	if !columnsMatchMapping(oldNames, oldTypes, columns) {
+		if !schemasEqual(oldNames, proposal.OldColumns) {
+			return fmt.Errorf("the directory's columns changed since schema proposal %d was made", proposal.ID)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		_, err := app.snapshotDirectory(ctx, proposal.DirectoryID, SnapshotReasonSchema, confirmedBy)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to snapshot directory before migrating it: %v", err)
+		}
+
+		if err := app.migrateDirectoryTable(proposal.DirectoryID, oldNames, oldTypes, columns); err != nil {
+			return err
+		}
+	}
+
+	if err := app.migrateSchemaReferences(proposal, columns, confirmedBy); err != nil {
+		return fmt.Errorf("directory table migrated, but failed to update pending changes: %v", err)
+	}
+
+	return nil
+}
+
+// columnsMatchMapping reports whether a directory already has the columns of a mapping
+func columnsMatchMapping(names, types []string, columns []SchemaColumnMapping) bool {
+	if len(names) != len(columns) || len(types) != len(columns) {
+		return false
+	}
+	for i, column := range columns {
+		if names[i] != column.Name || types[i] != column.Type {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateDirectoryTable copies the directory table into one with the mapped columns, and
+// updates the column types, tag tables and search index to match
+func (app *App) migrateDirectoryTable(
+	directoryID string, oldNames, oldTypes []string, columns []SchemaColumnMapping,
+) error {
+	return app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		existing, err := tableColumns(tx, directoryID)
+		if err != nil {
+			return err
+		}
+
+		sourceColumn := func(name string) string {
+			if existing[name] {
+				return fmt.Sprintf("[%s]", name)
+			}
+			return "NULL"
+		}
+
+		definitions := []string{
+			"rowID INTEGER PRIMARY KEY AUTOINCREMENT",
+			fmt.Sprintf("[%s] INTEGER", sheetRowColumn),
+			fmt.Sprintf("[%s] TEXT", rowKeyColumn),
+			// Raw values are keyed by the old column names; the import after the migration stores them again
+			fmt.Sprintf("[%s] TEXT", rawValuesColumn),
+		}
+		targets := []string{
+			"rowID", fmt.Sprintf("[%s]", sheetRowColumn), fmt.Sprintf("[%s]", rowKeyColumn), fmt.Sprintf("[%s]", rawValuesColumn),
+		}
+		sources := []string{"rowID", sourceColumn(sheetRowColumn), sourceColumn(rowKeyColumn), "NULL"}
+		for _, column := range columns {
+			definitions = append(definitions, fmt.Sprintf("[%s] TEXT", column.Name))
+			targets = append(targets, fmt.Sprintf("[%s]", column.Name))
+			if column.OldName != "" {
+				sources = append(sources, sourceColumn(column.OldName))
+			} else {
+				sources = append(sources, "NULL")
+			}
+		}
+
+		migrationTable := directoryID + "_schema_migration"
+		statements := []string{
+			fmt.Sprintf("DROP TABLE IF EXISTS '%s'", migrationTable),
+			fmt.Sprintf("CREATE TABLE '%s' (%s)", migrationTable, strings.Join(definitions, ", ")),
+			fmt.Sprintf("INSERT INTO '%s' (%s) SELECT %s FROM '%s'",
+				migrationTable, strings.Join(targets, ", "), strings.Join(sources, ", "), directoryID),
+			fmt.Sprintf("DROP TABLE '%s'", directoryID),
+			fmt.Sprintf("ALTER TABLE '%s' RENAME TO '%s'", migrationTable, directoryID),
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("failed to migrate directory table: %v", err)
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM _meta_directory_column_types WHERE columnTable = ?", directoryID); err != nil {
+			return fmt.Errorf("failed to clear column types: %v", err)
+		}
+		for _, column := range columns {
+			if _, err := tx.Exec(
+				"INSERT INTO _meta_directory_column_types (columnName, columnTable, columnType) VALUES (?, ?, ?)",
+				column.Name, directoryID, column.Type); err != nil {
+				return fmt.Errorf("failed to insert column type %v for column %v: %v", column.Type, column.Name, err)
+			}
+		}
+
+		if err := migrateColumnNormalizers(tx, oldNames, oldTypes, columns); err != nil {
+			return err
+		}
+
+		if err := migrateSearchWeights(tx, oldNames, columns); err != nil {
+			return err
+		}
+
+		if err := migrateTagTables(tx, directoryID, oldNames, oldTypes, columns); err != nil {
+			return err
+		}
+
+		names := make([]string, len(columns))
+		for i, column := range columns {
+			names[i] = column.Name
+		}
+		return ensureSearchIndex(tx, directoryID, names)
+	})
+}
+
+// migrateColumnNormalizers keeps the normalisers chosen for every column carried over with
+// its type. Columns that are new or change type start with their type's defaults.
+func migrateColumnNormalizers(tx *sql.Tx, oldNames, oldTypes []string, columns []SchemaColumnMapping) error {
+	if _, err := tx.Exec(columnNormalizersTableQuery); err != nil {
+		return fmt.Errorf("failed to create _meta_column_normalizers: %v", err)
+	}
+
+	old, err := loadColumnNormalizers(tx, oldNames, oldTypes)
+	if err != nil {
+		return err
+	}
+	oldIndex := make(map[string]int, len(oldNames))
+	for i, name := range oldNames {
+		oldIndex[name] = i
+	}
+
+	normalizers := make(map[string]ColumnNormalizers)
+	for _, column := range columns {
+		if i, ok := oldIndex[column.OldName]; ok && column.OldName != "" && oldTypes[i] == column.Type {
+			normalizers[column.Name] = old[i]
+		}
+	}
+	return saveColumnNormalizers(tx, normalizers)
+}
+
+// migrateTagTables drops the tag index of every old tag column and indexes every new one
+// from the migrated rows, which keep their IDs
+func migrateTagTables(tx *sql.Tx, directoryID string, oldNames, oldTypes []string, columns []SchemaColumnMapping) error {
+	for i, name := range oldNames {
+		if !isTagColumnType(oldTypes[i]) {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS '%s'", tagTableName(directoryID, name))); err != nil {
+			return fmt.Errorf("failed to drop tag table of column %s: %v", name, err)
+		}
+	}
+
+	for _, column := range columns {
+		if !isTagColumnType(column.Type) {
+			continue
+		}
+		if _, err := ensureTagTable(tx, directoryID, column.Name); err != nil {
+			return err
+		}
+		if err := indexTagColumn(tx, directoryID, column.Name, column.Type); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tableColumns returns the names of a table's columns
+func tableColumns(tx *sql.Tx, tableName string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info('%s')", tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect table %s: %v", tableName, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("failed to scan table info of %s: %v", tableName, err)
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// tableExists reports whether a table exists
+func tableExists(tx *sql.Tx, tableName string) (bool, error) {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up table %s: %v", tableName, err)
+	}
+	return count > 0, nil
+}
+
+// migrateSchemaReferences rewrites the pending changes submitted against the old columns and
+// the outstanding write-back jobs to the new columns, and marks the proposal confirmed.
+// Changes and jobs for a dropped column can no longer be applied and are set aside.
+func (app *App) migrateSchemaReferences(proposal *SchemaProposal, columns []SchemaColumnMapping, confirmedBy string) error {
+	oldIndex := make(map[string]int, len(proposal.OldColumns))
+	for i, name := range proposal.OldColumns {
+		oldIndex[name] = i
+	}
+
+	newNames := make([]string, len(columns))
+	newName := make(map[string]string)
+	newIndex := make(map[int]int)
+	for i, column := range columns {
+		newNames[i] = column.Name
+		if column.OldName != "" {
+			newName[column.OldName] = column.Name
+			newIndex[oldIndex[column.OldName]] = i
+		}
+	}
+
+	// remap moves the cells of a whole row from the old column order to the new one
+	remap := func(values []string) []string {
+		result := make([]string, len(columns))
+		for i, column := range columns {
+			if column.OldName != "" && oldIndex[column.OldName] < len(values) {
+				result[i] = values[oldIndex[column.OldName]]
+			}
+		}
+		return result
+	}
+
+	newSchemaJSON, err := json.Marshal(newNames)
+	if err != nil {
+		return fmt.Errorf("failed to marshal column schema: %v", err)
+	}
+	columnsJSON, err := json.Marshal(columns)
+	if err != nil {
+		return fmt.Errorf("failed to marshal column mapping: %v", err)
+	}
+
+	return app.WithTransaction(func(tx *sql.Tx) error {
+		changes, err := tx.Query(`
+			SELECT id, column_name, COALESCE(old_value, ''), COALESCE(new_value, ''), change_type, COALESCE(column_schema, '')
+			FROM pending_changes WHERE directory_id = ? AND status = ?
+		`, proposal.DirectoryID, ChangeStatusPending)
+		if err != nil {
+			return WrapDatabaseError(ErrTypeConnection, "failed to query pending changes", err)
+		}
+		var pending []PendingChange
+		for changes.Next() {
+			var change PendingChange
+			if err := changes.Scan(&change.ID, &change.ColumnName, &change.OldValue, &change.NewValue,
+				&change.ChangeType, &change.ColumnSchema); err != nil {
+				changes.Close()
+				return fmt.Errorf("failed to scan pending change: %v", err)
+			}
+			pending = append(pending, change)
+		}
+		changes.Close()
+
+		for _, change := range pending {
+			var submittedSchema []string
+			if err := json.Unmarshal([]byte(change.ColumnSchema), &submittedSchema); err != nil ||
+				!schemasEqual(submittedSchema, proposal.OldColumns) {
+				// Submitted against some other schema; validatePendingChangesSchema deals with it
+				continue
+			}
+
+			status, invalidReason := ChangeStatusPending, ""
+			switch change.ChangeType {
+			case ChangeTypeAdd, ChangeTypeDelete:
+				// Whole rows are stored as JSON arrays in column order
+				for _, value := range []*string{&change.NewValue, &change.OldValue} {
+					var row []string
+					if json.Unmarshal([]byte(*value), &row) != nil {
+						continue
+					}
+					remapped, err := json.Marshal(remap(row))
+					if err != nil {
+						return fmt.Errorf("failed to marshal row of pending change %d: %v", change.ID, err)
+					}
+					*value = string(remapped)
+				}
+			default:
+				if name, ok := newName[change.ColumnName]; ok {
+					change.ColumnName = name
+				} else {
+					status = ChangeStatusInvalid
+					invalidReason = fmt.Sprintf("Column %q was removed from the source", change.ColumnName)
+				}
+			}
+
+			_, err := tx.Exec(`
+				UPDATE pending_changes
+				SET column_name = ?, old_value = ?, new_value = ?, column_schema = ?, status = ?, invalid_reason = ?
+				WHERE id = ?
+			`, change.ColumnName, change.OldValue, change.NewValue, string(newSchemaJSON), status, invalidReason, change.ID)
+			if err != nil {
+				return WrapDatabaseError(ErrTypeConstraint, "failed to migrate pending change", err)
+			}
+		}
+
+		jobs, err := tx.Query(`
+			SELECT id, job_type, payload FROM sync_jobs WHERE directory_id = ? AND status IN (?, ?, ?, ?, ?, ?)
+		`, proposal.DirectoryID, SyncStatusPending, SyncStatusRunning, SyncStatusFailed, SyncStatusDead, SyncStatusConflict,
+			SyncStatusRefused)
+		if err != nil {
+			return WrapDatabaseError(ErrTypeConnection, "failed to query sync jobs", err)
+		}
+		var outstanding []SyncJob
+		for jobs.Next() {
+			var job SyncJob
+			var payloadJSON string
+			if err := jobs.Scan(&job.ID, &job.JobType, &payloadJSON); err != nil {
+				jobs.Close()
+				return fmt.Errorf("failed to scan sync job: %v", err)
+			}
+			if err := json.Unmarshal([]byte(payloadJSON), &job.Payload); err != nil {
+				jobs.Close()
+				return fmt.Errorf("failed to parse payload of sync job %d: %v", job.ID, err)
+			}
+			outstanding = append(outstanding, job)
+		}
+		jobs.Close()
+
+		now := time.Now().UTC()
+		for _, job := range outstanding {
+			switch job.JobType {
+			case SyncJobUpdateCell:
+				column, ok := newIndex[job.Payload.Column]
+				if !ok {
+					_, err := tx.Exec("UPDATE sync_jobs SET status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+						SyncStatusDiscarded, "column was removed from the source", now, job.ID)
+					if err != nil {
+						return WrapDatabaseError(ErrTypeConstraint, "failed to discard sync job", err)
+					}
+					continue
+				}
+				job.Payload.Column = column
+			case SyncJobAppendRow:
+				job.Payload.Values = remap(job.Payload.Values)
+			default:
+				continue
+			}
+
+			payloadJSON, err := json.Marshal(job.Payload)
+			if err != nil {
+				return fmt.Errorf("failed to marshal sync job payload: %v", err)
+			}
+			if _, err := tx.Exec("UPDATE sync_jobs SET payload = ?, updated_at = ? WHERE id = ?",
+				string(payloadJSON), now, job.ID); err != nil {
+				return WrapDatabaseError(ErrTypeConstraint, "failed to migrate sync job", err)
+			}
+		}
+
+		_, err = tx.Exec(`
+			UPDATE schema_proposals SET status = ?, columns = ?, resolved_by = ?, resolved_at = ? WHERE id = ?
+		`, SchemaProposalConfirmed, string(columnsJSON), confirmedBy, now, proposal.ID)
+		if err != nil {
+			return WrapDatabaseError(ErrTypeConstraint, "failed to confirm schema proposal", err)
+		}
+		return nil
+	})
+}
+
+// holdForSchemaChange stops a batch whose source header changed. The jobs' column positions
+// refer to the old header, so they go back to the queue and wait for the owner to confirm
+// the new one; the worker skips directories with a pending proposal.
+func (sw *SyncWorker) holdForSchemaChange(jobs []*SyncJob, mismatch *HeaderMismatchError) int {
+	proposal, err := sw.app.recordSchemaProposal(jobs[0].DirectoryID, mismatch.Header)
+	if err != nil {
+		for _, job := range jobs {
+			sw.recordFailure(job, fmt.Errorf("%v; failed to record schema change: %v", mismatch, err))
+		}
+		return len(jobs)
+	}
+
+	for _, job := range jobs {
+		sw.releaseJob(job)
+	}
+	log.Printf("Holding %d sync jobs for directory %s: %v", len(jobs), jobs[0].DirectoryID, schemaChangeError(proposal, mismatch))
+	return 0
+}
@@ -0,0 +1,44 @@
+#!/bin/bash
+# Sends a Drive change notification for a directory's watch channel to a locally running
+# server, as Drive would. Run the server with DRIVE_WEBHOOK_URL set and DRIVE_WATCH_FAKE=true
+# so channels are opened without calling Drive.
+#
+# Usage: scripts/fake_drive_notification.sh DIRECTORY_ID [STATE] [MESSAGE_NUMBER]
+#
+# STATE is the X-Goog-Resource-State header: update (the default), sync, trash and so on.
+# MESSAGE_NUMBER defaults to one more than the last one the server acted on; send the same
+# number twice to check that redeliveries are ignored. Set TOKEN to send a wrong token.
+#
+# Reads DATABASE_PATH and PORT like the server does, with the same defaults.
+
+set -euo pipefail
+
+if [ $# -lt 1 ]; then
+    echo "usage: $0 DIRECTORY_ID [STATE] [MESSAGE_NUMBER]" >&2
+    exit 2
+fi
+
+directory_id="$1"
+state="${2:-update}"
+database="${DATABASE_PATH:-./private.db}"
+port="${PORT:-9090}"
+
+channel=$(sqlite3 -separator ' ' "$database" \
+    "SELECT channel_id, resource_id, token, last_message_number FROM drive_watch_channels
+     WHERE directory_id = '${directory_id//\'/\'\'}' ORDER BY expires_at DESC LIMIT 1")
+if [ -z "$channel" ]; then
+    echo "directory $directory_id has no watch channel; is the server running with DRIVE_WEBHOOK_URL set?" >&2
+    exit 1
+fi
+read -r channel_id resource_id token last_message <<< "$channel"
+
+message="${3:-$((last_message + 1))}"
+
+curl --silent --show-error --write-out 'HTTP %{http_code}\n' --request POST \
+    --header "X-Goog-Channel-ID: $channel_id" \
+    --header "X-Goog-Channel-Token: ${TOKEN:-$token}" \
+    --header "X-Goog-Resource-ID: $resource_id" \
+    --header "X-Goog-Resource-State: $state" \
+    --header "X-Goog-Message-Number: $message" \
+    --header "X-Goog-Changed: content" \
+    "http://localhost:$port/webhooks/drive"
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"database/sql"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Directory rows are searched through an FTS5 table in each directory database, named
+// _meta_<directory>_search, with one column per directory column in the same order. It is an
+// external-content table over the directory table: it holds only the index, and triggers on
+// the directory table keep it in step with every insert, update and delete, so imports and
+// the edits they read back are indexed as they are stored. Only the directory's own columns
+// are indexed, never row keys or raw source values, so search finds what the listing shows.
+//
+// Words are matched by prefix with diacritics folded, so "cafe" finds "Cafés", and ranked
+// with BM25 weighted by the owner's per-column search weights.
+//
+// SQLite only has FTS5 when the server is built with -tags sqlite_fts5. Without it, search
+// falls back to matching words anywhere in a cell with LIKE, unranked and without folding.
+
+// searchWeightsTableQuery creates the directory database table holding the search weight the
+// owner chose for each column. Columns without an entry weigh defaultSearchWeight.
+const searchWeightsTableQuery = `
+	CREATE TABLE IF NOT EXISTS _meta_column_search_weights (
+		columnName TEXT PRIMARY KEY,
+		weight REAL NOT NULL
+	);
+`
+
+// Search weights scale how much a match in a column counts towards a row's rank. A column
+// weighing 0 isn't searched at all.
+const (
+	defaultSearchWeight = 1.0
+	maxSearchWeight     = 10.0
+)
+
+// Snippets are cut from the FTS5 index with these markers around each match and then
+// HTML-escaped, so the markers become <mark> tags and cell content can't inject markup
+const (
+	snippetOpen   = "\x02"
+	snippetClose  = "\x03"
+	snippetTokens = 12
+)
+
+var (
+	fts5Once    sync.Once
+	fts5Enabled bool
+)
+
+// queryRower is implemented by *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// fts5Available reports whether SQLite was built with FTS5
+func fts5Available(q queryRower) bool {
+	fts5Once.Do(func() {
+		var used int
+		if err := q.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used); err != nil {
+			log.Printf("Failed to check for FTS5, searching without it: %v", err)
+		}
+		fts5Enabled = used == 1
+		if !fts5Enabled {
+			log.Printf("SQLite was built without FTS5; build with -tags sqlite_fts5 for ranked full-text search")
+		}
+	})
+	return fts5Enabled
+}
+
+// searchTableName returns the FTS5 table of a directory
+func searchTableName(directoryID string) string {
+	return fmt.Sprintf("_meta_%s_search", directoryID)
+}
+
+// searchTriggerNames returns the triggers keeping a directory's search index in step with
+// its table, on insert, delete and update
+func searchTriggerNames(directoryID string) []string {
+	tableName := searchTableName(directoryID)
+	return []string{tableName + "_insert", tableName + "_delete", tableName + "_update"}
+}
+
+// ensureSearchIndex creates a directory's search index and its triggers, and indexes the
+// stored rows, unless an index of the same columns is already kept. Without FTS5 the
+// triggers are dropped, since they would fail every write to the directory table.
+func ensureSearchIndex(tx *sql.Tx, directoryID string, columnNames []string) error {
+	if !fts5Available(tx) {
+		for _, trigger := range searchTriggerNames(directoryID) {
+			if _, err := tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS '%s'", trigger)); err != nil {
+				return fmt.Errorf("failed to drop search trigger: %v", err)
+			}
+		}
+		return nil
+	}
+	if len(columnNames) == 0 {
+		return nil
+	}
+
+	current, err := searchIndexCurrent(tx, directoryID, columnNames)
+	if err != nil || current {
+		return err
+	}
+
+	tableName := searchTableName(directoryID)
+	triggers := searchTriggerNames(directoryID)
+	quoted := make([]string, len(columnNames))
+	newValues := make([]string, len(columnNames))
+	oldValues := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		quoted[i] = fmt.Sprintf("[%s]", name)
+		newValues[i] = fmt.Sprintf("new.[%s]", name)
+		oldValues[i] = fmt.Sprintf("old.[%s]", name)
+	}
+	columns := strings.Join(quoted, ", ")
+	insertNew := fmt.Sprintf("INSERT INTO '%s' (rowid, %s) VALUES (new.rowID, %s);",
+		tableName, columns, strings.Join(newValues, ", "))
+	deleteOld := fmt.Sprintf("INSERT INTO '%[1]s' ([%[1]s], rowid, %[2]s) VALUES ('delete', old.rowID, %[3]s);",
+		tableName, columns, strings.Join(oldValues, ", "))
+
+	statements := []string{}
+	for _, trigger := range triggers {
+		statements = append(statements, fmt.Sprintf("DROP TRIGGER IF EXISTS '%s'", trigger))
+	}
+	statements = append(statements,
+		fmt.Sprintf("DROP TABLE IF EXISTS '%s'", tableName),
+		fmt.Sprintf(`CREATE VIRTUAL TABLE '%s' USING fts5(%s,
+			content = '%s', content_rowid = 'rowID',
+			tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3')`,
+			tableName, columns, directoryID),
+		fmt.Sprintf("CREATE TRIGGER '%s' AFTER INSERT ON '%s' BEGIN %s END", triggers[0], directoryID, insertNew),
+		fmt.Sprintf("CREATE TRIGGER '%s' AFTER DELETE ON '%s' BEGIN %s END", triggers[1], directoryID, deleteOld),
+		// Rows moving in the source don't change what they are found by
+		fmt.Sprintf("CREATE TRIGGER '%s' AFTER UPDATE OF %s ON '%s' BEGIN %s %s END",
+			triggers[2], columns, directoryID, deleteOld, insertNew),
+		fmt.Sprintf("INSERT INTO '%[1]s' ([%[1]s]) VALUES ('rebuild')", tableName),
+	)
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to build search index: %v", err)
+		}
+	}
+	return nil
+}
+
+// searchIndexCurrent reports whether a directory has a search index of the given columns
+// with all its triggers. The triggers go with the directory table whenever it is rebuilt.
+func searchIndexCurrent(tx *sql.Tx, directoryID string, columnNames []string) (bool, error) {
+	triggers := searchTriggerNames(directoryID)
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ? AND name IN (?, ?, ?)",
+		directoryID, triggers[0], triggers[1], triggers[2]).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up search triggers: %v", err)
+	}
+	if count < len(triggers) {
+		return false, nil
+	}
+
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid", searchTableName(directoryID))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect search index: %v", err)
+	}
+	defer rows.Close()
+
+	var indexed []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, fmt.Errorf("failed to scan search index column: %v", err)
+		}
+		indexed = append(indexed, name)
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to read search index columns: %v", err)
+	}
+	return schemasEqual(indexed, columnNames), nil
+}
+
+// indexSearch builds the search index of a directory that has none, as for directories
+// imported before search was indexed or while the server was built without FTS5
+func (app *App) indexSearch(directoryID string) error {
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return fmt.Errorf("failed to get directory database: %v", err)
+	}
+	if _, err := db.Exec(searchWeightsTableQuery); err != nil {
+		return fmt.Errorf("failed to create _meta_column_search_weights: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN (?, ?)",
+		directoryID, "_meta_directory_column_types").Scan(&count); err != nil {
+		return fmt.Errorf("failed to look up directory table: %v", err)
+	}
+	if count < 2 {
+		return nil // never imported
+	}
+
+	columns, err := loadDirectoryColumns(db, directoryID)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+
+	return app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		return ensureSearchIndex(tx, directoryID, names)
+	})
+}
+
+// loadSearchWeights returns the search weight of each column
+func loadSearchWeights(q queryer, columnNames []string) ([]float64, error) {
+	stored := make(map[string]float64)
+	rows, err := q.Query("SELECT columnName, weight FROM _meta_column_search_weights")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query search weights: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var weight float64
+		if err := rows.Scan(&name, &weight); err != nil {
+			return nil, fmt.Errorf("failed to scan search weight: %v", err)
+		}
+		stored[name] = weight
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read search weights: %v", err)
+	}
+
+	weights := make([]float64, len(columnNames))
+	for i, name := range columnNames {
+		if weight, ok := stored[name]; ok {
+			weights[i] = weight
+		} else {
+			weights[i] = defaultSearchWeight
+		}
+	}
+	return weights, nil
+}
+
+// saveSearchWeights replaces the search weights chosen for a directory's columns
+func saveSearchWeights(tx *sql.Tx, weights map[string]float64) error {
+	if _, err := tx.Exec("DELETE FROM _meta_column_search_weights"); err != nil {
+		return fmt.Errorf("failed to clear search weights: %v", err)
+	}
+	for name, weight := range weights {
+		if _, err := tx.Exec("INSERT INTO _meta_column_search_weights (columnName, weight) VALUES (?, ?)", name, weight); err != nil {
+			return fmt.Errorf("failed to insert search weight of column %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// migrateSearchWeights keeps the search weight chosen for every column carried over
+func migrateSearchWeights(tx *sql.Tx, oldNames []string, columns []SchemaColumnMapping) error {
+	if _, err := tx.Exec(searchWeightsTableQuery); err != nil {
+		return fmt.Errorf("failed to create _meta_column_search_weights: %v", err)
+	}
+
+	old, err := loadSearchWeights(tx, oldNames)
+	if err != nil {
+		return err
+	}
+	oldIndex := make(map[string]int, len(oldNames))
+	for i, name := range oldNames {
+		oldIndex[name] = i
+	}
+
+	weights := make(map[string]float64)
+	for _, column := range columns {
+		if i, ok := oldIndex[column.OldName]; ok && column.OldName != "" && old[i] != defaultSearchWeight {
+			weights[column.Name] = old[i]
+		}
+	}
+	return saveSearchWeights(tx, weights)
+}
+
+// searchPlan is how a query's free-text search is run
+type searchPlan struct {
+	condition string // selects the matching rows
+	args      []interface{}
+	words     []string
+	columns   []int // indexes of the searched columns
+
+	// With FTS5, the match expression and the BM25 weight of every column
+	match   string
+	weights []float64
+}
+
+// planSearch works out how to run a search: through the search index if the directory has
+// one, otherwise with LIKE. Every word must appear in one of the searched columns, which are
+// the requested ones, or all, less the columns weighing 0. It returns nil for a search
+// without any words.
+func (repo *RowRepository) planSearch(search string, searchColumns []string) (*searchPlan, error) {
+	var words []string
+	for _, word := range strings.Fields(search) {
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	if len(searchColumns) == 0 {
+		searchColumns = repo.ColumnNames()
+	}
+	requested := make(map[string]bool, len(searchColumns))
+	for _, column := range searchColumns {
+		if repo.ColumnIndex(column) < 0 {
+			return nil, fmt.Errorf("%w: no column named %q to search", errInvalidQuery, column)
+		}
+		requested[column] = true
+	}
+
+	weights, err := loadSearchWeights(repo.db, repo.ColumnNames())
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &searchPlan{words: words, weights: weights}
+	for i, column := range repo.columns {
+		if requested[column.Name] && weights[i] > 0 {
+			plan.columns = append(plan.columns, i)
+		}
+	}
+	if len(plan.columns) == 0 {
+		return nil, fmt.Errorf("%w: none of the columns searched is searchable", errInvalidQuery)
+	}
+
+	tableName, err := repo.searchTable()
+	if err != nil {
+		return nil, err
+	}
+	if tableName == "" {
+		plan.condition, plan.args = likeSearchCondition(repo.columns, plan.columns, words)
+		return plan, nil
+	}
+
+	// Each word is quoted, so nothing typed is read as query syntax, and matched as a prefix
+	columnSet := make([]string, len(plan.columns))
+	for i, index := range plan.columns {
+		columnSet[i] = ftsQuote(repo.columns[index].Name)
+	}
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = ftsQuote(word) + "*"
+	}
+	plan.match = fmt.Sprintf("{%s} : (%s)", strings.Join(columnSet, " "), strings.Join(terms, " AND "))
+	plan.condition = fmt.Sprintf("rowID IN (SELECT rowid FROM '%[1]s' WHERE [%[1]s] MATCH ?)", tableName)
+	plan.args = []interface{}{plan.match}
+	return plan, nil
+}
+
+// searchTable returns the directory's search index, or "" if it has none to search
+func (repo *RowRepository) searchTable() (string, error) {
+	if !repo.hasTable || !fts5Available(repo.db) {
+		return "", nil
+	}
+
+	tableName := searchTableName(repo.directoryID)
+	var count int
+	if err := repo.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).
+		Scan(&count); err != nil {
+		return "", fmt.Errorf("failed to look up search index: %v", err)
+	}
+	if count == 0 {
+		return "", nil
+	}
+	return tableName, nil
+}
+
+// rankJoin returns the join adding each matching row's BM25 rank, as the [_searchRank]
+// column, to a query of the directory table aliased rows. Lower ranks are better matches.
+func (plan *searchPlan) rankJoin(tableName string) (string, []interface{}) {
+	weights := make([]string, len(plan.weights))
+	for i, weight := range plan.weights {
+		weights[i] = strconv.FormatFloat(weight, 'f', -1, 64)
+	}
+	return fmt.Sprintf(`JOIN (
+			SELECT rowid AS [_searchRowID], bm25([%[1]s], %[2]s) AS [_searchRank]
+			FROM '%[1]s' WHERE [%[1]s] MATCH ?
+		) AS search ON search.[_searchRowID] = rows.rowID`,
+		tableName, strings.Join(weights, ", ")), []interface{}{plan.match}
+}
+
+// snippets returns the highlighted excerpts of the searched columns of each row that the
+// search matched, by row ID and column name
+func (repo *RowRepository) snippets(plan *searchPlan, rows []*DirectoryRow) (map[int64]map[string]string, error) {
+	snippets := make(map[int64]map[string]string)
+	if len(rows) == 0 {
+		return snippets, nil
+	}
+
+	add := func(rowID int64, column, snippet string) {
+		if !strings.Contains(snippet, snippetOpen) {
+			return
+		}
+		if snippets[rowID] == nil {
+			snippets[rowID] = make(map[string]string)
+		}
+		snippets[rowID][column] = markSnippet(snippet)
+	}
+
+	if plan.match == "" {
+		pattern := likeWordsPattern(plan.words)
+		for _, row := range rows {
+			for _, index := range plan.columns {
+				column := repo.columns[index].Name
+				add(row.ID, column, excerptMatches(row.Values[column], pattern))
+			}
+		}
+		return snippets, nil
+	}
+
+	tableName := searchTableName(repo.directoryID)
+	selects := make([]string, len(plan.columns))
+	for i, index := range plan.columns {
+		selects[i] = fmt.Sprintf(", snippet([%s], %d, char(%d), char(%d), '…', %d)",
+			tableName, index, snippetOpen[0], snippetClose[0], snippetTokens)
+	}
+	args := []interface{}{plan.match}
+	for _, row := range rows {
+		args = append(args, row.ID)
+	}
+	result, err := repo.db.Query(fmt.Sprintf("SELECT rowid%s FROM '%[2]s' WHERE [%[2]s] MATCH ? AND rowid IN (?%[3]s)",
+		strings.Join(selects, ""), tableName, strings.Repeat(", ?", len(rows)-1)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cut search snippets: %v", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var rowID int64
+		texts := make([]sql.NullString, len(plan.columns))
+		dest := []interface{}{&rowID}
+		for i := range texts {
+			dest = append(dest, &texts[i])
+		}
+		if err := result.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan search snippets: %v", err)
+		}
+		for i, index := range plan.columns {
+			add(rowID, repo.columns[index].Name, texts[i].String)
+		}
+	}
+	return snippets, result.Err()
+}
+
+// ftsQuote quotes a word or column name for an FTS5 query
+func ftsQuote(text string) string {
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+}
+
+// likeSearchCondition returns the condition matching rows where every word appears, in any
+// case, in one of the searched columns
+func likeSearchCondition(columns []DirectoryColumn, searched []int, words []string) (string, []interface{}) {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	var conditions []string
+	var args []interface{}
+	for _, word := range words {
+		matches := make([]string, len(searched))
+		for i, index := range searched {
+			matches[i] = fmt.Sprintf(`[%s] LIKE ? ESCAPE '\'`, columns[index].Name)
+			args = append(args, "%"+escaper.Replace(word)+"%")
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+// likeWordsPattern matches any of the words, in any case
+func likeWordsPattern(words []string) *regexp.Regexp {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// excerptMatches cuts the part of a value around its first match, with the snippet markers
+// around every match, as snippet() does for the search index. It returns "" without a match.
+func excerptMatches(value string, pattern *regexp.Regexp) string {
+	matches := pattern.FindAllStringIndex(value, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+
+	const before, after = 30, 60
+	start, end := matches[0][0]-before, matches[0][1]+after
+	if start < 0 {
+		start = 0
+	}
+	if end > len(value) {
+		end = len(value)
+	}
+	for start > 0 && !utf8.RuneStart(value[start]) {
+		start--
+	}
+	for end < len(value) && !utf8.RuneStart(value[end]) {
+		end++
+	}
+
+	var excerpt strings.Builder
+	if start > 0 {
+		excerpt.WriteString("…")
+	}
+	position := start
+	for _, match := range matches {
+		if match[0] < position || match[1] > end {
+			continue
+		}
+		excerpt.WriteString(value[position:match[0]])
+		excerpt.WriteString(snippetOpen + value[match[0]:match[1]] + snippetClose)
+		position = match[1]
+	}
+	excerpt.WriteString(value[position:end])
+	if end < len(value) {
+		excerpt.WriteString("…")
+	}
+	return excerpt.String()
+}
+
+// markSnippet escapes a snippet for HTML and turns its markers into <mark> tags
+func markSnippet(snippet string) string {
+	return strings.NewReplacer(snippetOpen, "<mark>", snippetClose, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// ColumnSearchWeight is a column's search weight as shown to and set by the owner
+type ColumnSearchWeight struct {
+	Column string  `json:"column"`
+	Weight float64 `json:"weight"`
+}
+
+// handleSearchDirectory searches a directory's rows for the words of ?q=, best matches first,
+// with highlighted snippets of the cells they were found in. ?columns= limits the search to
+// a comma-separated list of columns; ?limit= and ?cursor= page as for queries.
+func (app *App) handleSearchDirectory(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+	params := r.URL.Query()
+
+	query := DirectoryQuery{Search: params.Get("q"), Cursor: params.Get("cursor")}
+	if strings.TrimSpace(query.Search) == "" {
+		utils2.ValidationError(w, "q is required")
+		return
+	}
+	if columns := params.Get("columns"); columns != "" {
+		query.SearchColumns = splitListCell(columns)
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			utils2.ValidationError(w, "limit must be a number")
+			return
+		}
+	}
+
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	result, err := repo.Query(query)
+	if errors.Is(err, errInvalidQuery) {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to search directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	utils2.RespondWithJSON(w, 200, result)
+}
+
+// handleGetSearchWeights lists the search weight of each of the directory's columns
+func (app *App) handleGetSearchWeights(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+	if _, err := repo.db.Exec(searchWeightsTableQuery); err != nil {
+		log.Printf("Failed to create search weights of directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	weights, err := loadSearchWeights(repo.db, repo.ColumnNames())
+	if err != nil {
+		log.Printf("Failed to load search weights of directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	columns := make([]ColumnSearchWeight, len(weights))
+	for i, name := range repo.ColumnNames() {
+		columns[i] = ColumnSearchWeight{Column: name, Weight: weights[i]}
+	}
+	utils2.RespondWithSuccess(w, map[string]interface{}{
+		"weights":   columns,
+		"full_text": fts5Available(repo.db),
+	}, "")
+}
+
+// handleSetSearchWeights replaces the search weights of the directory's columns. Columns left
+// out weigh the default again.
+func (app *App) handleSetSearchWeights(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req struct {
+		Weights []ColumnSearchWeight `json:"weights"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	weights := make(map[string]float64, len(req.Weights))
+	for _, weight := range req.Weights {
+		if repo.ColumnIndex(weight.Column) < 0 {
+			utils2.ValidationError(w, fmt.Sprintf("no column named %q", weight.Column))
+			return
+		}
+		if weight.Weight < 0 || weight.Weight > maxSearchWeight {
+			utils2.ValidationError(w, fmt.Sprintf("search weights must be between 0 and %g", maxSearchWeight))
+			return
+		}
+		weights[weight.Column] = weight.Weight
+	}
+
+	if err := app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(searchWeightsTableQuery); err != nil {
+			return fmt.Errorf("failed to create _meta_column_search_weights: %v", err)
+		}
+		return saveSearchWeights(tx, weights)
+	}); err != nil {
+		log.Printf("Failed to save search weights of directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	utils2.RespondWithSuccess(w, nil, "Search weights saved")
+}
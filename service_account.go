@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// sheetsScope is the OAuth scope sheet sync needs
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+// ServiceAccount is the Google service account a directory's sheet is synced with, so sync
+// doesn't depend on one owner's personal credentials. The key is stored encrypted and is
+// never returned by the API.
+type ServiceAccount struct {
+	DirectoryID string    `json:"directory_id"`
+	ClientEmail string    `json:"client_email"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	key []byte
+}
+
+// SetServiceAccountRequest uploads a service account key, either as the key file's JSON
+// object or as a string holding it
+type SetServiceAccountRequest struct {
+	Credentials json.RawMessage `json:"credentials"`
+}
+
+// parseServiceAccountKey checks that a key file is a Google service account key and returns
+// its client email
+func parseServiceAccountKey(key []byte) (string, error) {
+	var fields struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(key, &fields); err != nil {
+		return "", fmt.Errorf("credentials are not valid JSON")
+	}
+	if fields.Type != "service_account" {
+		return "", fmt.Errorf("credentials are not a service account key")
+	}
+	if fields.ClientEmail == "" {
+		return "", fmt.Errorf("service account key has no client_email")
+	}
+
+	if _, err := google.JWTConfigFromJSON(key, sheetsScope); err != nil {
+		return "", fmt.Errorf("invalid service account key: %v", err)
+	}
+	return fields.ClientEmail, nil
+}
+
+// tokenSource returns a token source that signs in as the service account
+func (sa *ServiceAccount) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	config, err := google.JWTConfigFromJSON(sa.key, sheetsScope, driveWatchScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account key: %v", err)
+	}
+	return config.TokenSource(ctx), nil
+}
+
+// getServiceAccount returns a directory's service account, or nil if it has none
+func (app *App) getServiceAccount(directoryID string) (*ServiceAccount, error) {
+	var sa ServiceAccount
+	var encryptedKey string
+	err := app.DB.QueryRow(`
+		SELECT directory_id, client_email, credentials, created_by, created_at
+		FROM directory_service_accounts WHERE directory_id = ?
+	`, directoryID).Scan(&sa.DirectoryID, &sa.ClientEmail, &encryptedKey, &sa.CreatedBy, &sa.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query service account", err)
+	}
+
+	key, err := app.EncryptionService.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt service account key for directory %s: %v", directoryID, err)
+	}
+	sa.key = []byte(key)
+
+	return &sa, nil
+}
+
+// saveServiceAccount stores a directory's service account, replacing any previous one
+func (app *App) saveServiceAccount(sa *ServiceAccount) error {
+	encryptedKey, err := app.EncryptionService.Encrypt(string(sa.key))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt service account key: %v", err)
+	}
+
+	_, err = app.DB.Exec(`
+		INSERT OR REPLACE INTO directory_service_accounts (directory_id, client_email, credentials, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, sa.DirectoryID, sa.ClientEmail, encryptedKey, sa.CreatedBy, sa.CreatedAt)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConstraint, "failed to save service account", err)
+	}
+	return nil
+}
+
+// deleteServiceAccount removes a directory's service account and reports whether it had one
+func (app *App) deleteServiceAccount(directoryID string) (bool, error) {
+	result, err := app.DB.Exec("DELETE FROM directory_service_accounts WHERE directory_id = ?", directoryID)
+	if err != nil {
+		return false, WrapDatabaseError(ErrTypeConnection, "failed to delete service account", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// getDirectoryOwnerEmails lists a directory's owners, longest-standing first
+func (app *App) getDirectoryOwnerEmails(directoryID string) ([]string, error) {
+	rows, err := app.DB.Query(`
+		SELECT user_email FROM directory_owners WHERE directory_id = ? ORDER BY created_at, id
+	`, directoryID)
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query directory owners", err)
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("failed to scan directory owner: %v", err)
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// errNoSheetCredentials is returned when none of a directory's credentials can produce a token
+var errNoSheetCredentials = errors.New("no usable Google credentials")
+
+// sheetCredential is the credential a directory's sheet is synced with
+type sheetCredential struct {
+	tokenSource oauth2.TokenSource
+	identity    string        // service account or owner email
+	token       *oauth2.Token // the owner's token; nil for a service account
+	skipped     []string      // why preferred credentials were passed over
+}
+
+// resolveSheetCredential picks the credentials a directory's sheet is synced with: the
+// directory's service account, then the bound sync user, then any other owner with stored
+// credentials. Credentials that can't produce a token are skipped.
+func (app *App) resolveSheetCredential(ctx context.Context, binding *DirectorySource) (*sheetCredential, error) {
+	var failures []string
+
+	sa, err := app.getServiceAccount(binding.DirectoryID)
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+	if sa != nil {
+		tokenSource, err := sa.tokenSource(ctx)
+		if err == nil {
+			_, err = tokenSource.Token()
+		}
+		if err == nil {
+			return &sheetCredential{tokenSource: tokenSource, identity: sa.ClientEmail, skipped: failures}, nil
+		}
+		failures = append(failures, fmt.Sprintf("service account %s: %v", sa.ClientEmail, err))
+	}
+
+	candidates := []string{}
+	if binding.SyncUserEmail != "" {
+		candidates = append(candidates, binding.SyncUserEmail)
+	}
+	owners, err := app.getDirectoryOwnerEmails(binding.DirectoryID)
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+	for _, owner := range owners {
+		if owner != binding.SyncUserEmail {
+			candidates = append(candidates, owner)
+		}
+	}
+
+	for _, userEmail := range candidates {
+		token, err := app.getUserToken(userEmail)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		return &sheetCredential{
+			tokenSource: app.OAuthConfig.TokenSource(ctx, token),
+			identity:    userEmail,
+			token:       token,
+			skipped:     failures,
+		}, nil
+	}
+
+	if len(failures) == 0 {
+		return nil, fmt.Errorf("%w for directory %s: it has no service account and no owner with stored Google credentials",
+			errNoSheetCredentials, binding.DirectoryID)
+	}
+	return nil, fmt.Errorf("%w for directory %s: %s", errNoSheetCredentials, binding.DirectoryID, strings.Join(failures, "; "))
+}
+
+// sheetTokenSource returns the token source picked by resolveSheetCredential and who the
+// credentials belong to
+func (app *App) sheetTokenSource(ctx context.Context, binding *DirectorySource) (oauth2.TokenSource, string, error) {
+	credential, err := app.resolveSheetCredential(ctx, binding)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(credential.skipped) > 0 {
+		log.Printf("Syncing directory %s as %s: %s", binding.DirectoryID, credential.identity, strings.Join(credential.skipped, "; "))
+	}
+	return credential.tokenSource, credential.identity, nil
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	utils2 "directoryCommunityWebsite/internal/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,61 +20,69 @@ import (
 	"google.golang.org/api/sheets/v4"
 )
 
-func (app *App) importDirectoryFromSheet(
-	ctx context.Context, spreadsheetID string,
-	token *oauth2.Token, directoryID string,
-	columnNames []string, columnTypes []string,
-) error {
-	client := app.OAuthConfig.Client(ctx, token)
-
-	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
+// importDirectory reads a source into a directory. normalizers replaces the normalisers
+// chosen for the directory's columns; nil keeps the ones stored.
+func (app *App) importDirectory(
+	ctx context.Context, source DataSource, directoryID string,
+	columnNames []string, columnTypes []string, manageRowKeys bool,
+	normalizers map[string]ColumnNormalizers, progress *importProgress,
+) (*ImportResult, error) {
+	progress.setPhase(ImportPhaseReading)
+	values, err := readSource(ctx, source, progress)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve Sheets client: %v", err)
+		return nil, fmt.Errorf("unable to retrieve data from source: %v", err)
 	}
 
-	resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, app.Config.SheetRange).Do()
-	if err != nil {
-		return fmt.Errorf("unable to retrieve data from sheet: %v", err)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no data found in source")
 	}
 
-	if len(resp.Values) == 0 {
-		return fmt.Errorf("no data found in sheet")
+	if manageRowKeys {
+		progress.setPhase(ImportPhaseRowKeys)
+		values, err = app.ensureRowKeys(ctx, source, values)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	// The row key column identifies rows; it is not part of the directory itself
+	keyIndex := rowKeyIndex(values[0])
+	values, rowKeys := splitRowKeys(values)
+
 	// Validate column names match the sheet header
-	if len(resp.Values) > 0 {
-		sheetColumns := make([]string, len(resp.Values[0]))
-		for i, cell := range resp.Values[0] {
-			if cell != nil {
-				sheetColumns[i] = strings.TrimSpace(fmt.Sprintf("%v", cell))
-			}
-		}
+	if err := validateSourceHeader(values[0], columnNames); err != nil {
+		return nil, &HeaderMismatchError{Header: trimCells(values[0]), Err: err}
+	}
 
-		if len(columnNames) != len(sheetColumns) {
-			return fmt.Errorf("column count mismatch: expected %d columns, sheet has %d",
-				len(columnNames), len(sheetColumns))
+	// Formulas, protected ranges and validation rules decide which cells write-back may touch
+	var rules cellRules
+	if reader, ok := source.(cellRuleReader); ok {
+		sourceRules, err := reader.ReadCellRules(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve cell rules from source: %v", err)
 		}
+		rules = directoryCellRules(sourceRules, keyIndex)
+	}
 
-		for i, expectedCol := range columnNames {
-			if i < len(sheetColumns) && strings.TrimSpace(expectedCol) != sheetColumns[i] {
-				return fmt.Errorf("column name mismatch at position %d: expected '%s', sheet has '%s'",
-					i, expectedCol, sheetColumns[i])
-			}
-		}
+	// Nothing in the directory has been touched yet, so a cancelled import stops here
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	progress.setPhase(ImportPhaseWriting)
+
+	// Keep the rows as they were, so an import that wipes them can be undone
+	if _, err := app.snapshotDirectory(ctx, directoryID, SnapshotReasonImport, ""); err != nil {
+		return nil, fmt.Errorf("failed to snapshot directory before import: %v", err)
 	}
 
 	// Get directory-specific database connection
 	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
 	if err != nil {
-		return fmt.Errorf("failed to get directory database: %v", err)
-	}
-
-	if _, err := db.Exec("DROP TABLE IF EXISTS _meta_directory_column_types"); err != nil {
-		return fmt.Errorf("failed to clear column types table: %v", err)
+		return nil, fmt.Errorf("failed to get directory database: %v", err)
 	}
 
 	_, err = db.Exec(`
-		CREATE Table _meta_directory_column_types (
+		CREATE TABLE IF NOT EXISTS _meta_directory_column_types (
   	columnName TEXT NOT NULL,
   	columnTable TEXT NOT NULL,
   	columnType TEXT CHECK (
@@ -85,138 +97,144 @@ func (app *App) importDirectoryFromSheet(
   	PRIMARY KEY (columnName, columnTable)
   );
 	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create _meta_directory_column_types: %v", err)
+	}
+
+	if _, err := db.Exec(sourceCellsTableQuery); err != nil {
+		return nil, fmt.Errorf("failed to create _meta_source_cells: %v", err)
+	}
+
+	if _, err := db.Exec(columnNormalizersTableQuery); err != nil {
+		return nil, fmt.Errorf("failed to create _meta_column_normalizers: %v", err)
+	}
 
+	if _, err := db.Exec(searchWeightsTableQuery); err != nil {
+		return nil, fmt.Errorf("failed to create _meta_column_search_weights: %v", err)
+	}
+
+	previousColumns, err := loadDirectoryColumns(db, directoryID)
 	if err != nil {
-		return fmt.Errorf("failed to reset _meta_directory_column_types: %v", err)
+		return nil, err
 	}
 
-	for i := range columnNames {
-		if _, err := db.Exec(
-			`INSERT INTO _meta_directory_column_types (
+	if err := app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM _meta_directory_column_types WHERE columnTable = ?", directoryID); err != nil {
+			return fmt.Errorf("failed to clear column types: %v", err)
+		}
+
+		for i := range columnNames {
+			if _, err := tx.Exec(
+				`INSERT INTO _meta_directory_column_types (
                                           columnName,
                                           columnTable,
                                           columnType
                     ) VALUES (?, ?, ?)`,
-			columnNames[i], directoryID, columnTypes[i]); err != nil {
-			return fmt.Errorf("failed to insert column type %v for column %v: %v",
-				columnTypes[i], columnNames[i], err)
-		}
-
-		if columnTypes[i] == "tag" || columnTypes[i] == "location" {
-			tableName := fmt.Sprintf("_meta_%v_tag_%v", directoryID, columnNames[i])
-
-			if _, err := db.Exec(
-				`CREATE TABLE ? (
-                       columnTable TEXT NOT NULL,
-                       rowID integer NOT NULL,
-                       tag TEXT NOT NULL)
-                       FOREIGN KEY (rowID) REFERENCES ?(rowID);`,
-				tableName, directoryID); err != nil {
-				return fmt.Errorf("failed to create tag table %v for %v: %v", tableName, directoryID, err)
+				columnNames[i], directoryID, columnTypes[i]); err != nil {
+				return fmt.Errorf("failed to insert column type %v for column %v: %v",
+					columnTypes[i], columnNames[i], err)
 			}
-
 		}
-
-	}
-
-	// Drop the old directory table if it exists
-	if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS '%s'", directoryID)); err != nil {
-		return fmt.Errorf("failed to drop old directory table: %v", err)
-	}
-
-	// Create column definitions for the new table
-	columnDefs := []string{"rowID INTEGER PRIMARY KEY AUTOINCREMENT"}
-	for i := range columnNames {
-		// Use TEXT type for all columns since tags and locations will be handled in separate tables
-		// Quote column names to handle spaces and special characters
-		columnDefs = append(columnDefs, fmt.Sprintf("[%s] TEXT", columnNames[i]))
+		if normalizers != nil {
+			if err := saveColumnNormalizers(tx, normalizers); err != nil {
+				return err
+			}
+		}
+		return saveCellRules(tx, rules)
+	}); err != nil {
+		return nil, err
 	}
 
-	// Create the new directory table
-	query := fmt.Sprintf("CREATE TABLE '%s' (%s)", directoryID, strings.Join(columnDefs, ", "))
-	if _, err := db.Exec(query); err != nil {
-		return fmt.Errorf("failed to create directory table based on query %v: %v ", query, err)
+	if _, err := ensureDirectoryTable(db, directoryID, columnNames); err != nil {
+		return nil, err
 	}
 
-	// Insert data from the sheet
-	if len(resp.Values) > 1 {
-		// Prepare column list for INSERT statement - quote column names
-		quotedColumns := make([]string, len(columnNames))
+	if err := app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		// Columns that are no longer tag or location columns lose their index
+		tagColumns := make(map[string]bool)
 		for i, name := range columnNames {
-			quotedColumns[i] = fmt.Sprintf("[%s]", name)
-		}
-		columnList := strings.Join(quotedColumns, ", ")
-		placeholders := make([]string, len(columnNames))
-		for i := range placeholders {
-			placeholders[i] = "?"
+			tagColumns[name] = isTagColumnType(columnTypes[i])
 		}
-		insertQuery := fmt.Sprintf("INSERT INTO '%s' (%s) VALUES (%s)",
-			directoryID, columnList, strings.Join(placeholders, ", "))
-
-		for i := 1; i < len(resp.Values); i++ { // Skip header row
-			row := resp.Values[i]
-			rowData := make([]interface{}, len(columnNames))
-
-			for j := range columnNames {
-				var cellValue string
-				if j < len(row) && row[j] != nil {
-					cellValue = fmt.Sprintf("%v", row[j])
+		for _, column := range previousColumns {
+			if isTagColumnType(column.Type) && !tagColumns[column.Name] {
+				if _, err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS '%s'", tagTableName(directoryID, column.Name))); err != nil {
+					return fmt.Errorf("failed to drop tag table of column %s: %v", column.Name, err)
 				}
-				rowData[j] = cellValue
 			}
+		}
 
-			// Insert the main row
-			result, err := db.Exec(insertQuery, rowData...)
-			if err != nil {
-				return fmt.Errorf("failed to insert row %d: %v", insertQuery, err)
+		for i := range columnNames {
+			if !isTagColumnType(columnTypes[i]) {
+				continue
 			}
 
-			// Get the inserted row ID
-			rowID, err := result.LastInsertId()
+			created, err := ensureTagTable(tx, directoryID, columnNames[i])
 			if err != nil {
-				return fmt.Errorf("failed to get last insert ID for row %d: %v", i, err)
+				return err
 			}
 
-			// Handle tag and location columns
-			for j, columnType := range columnTypes {
-				if columnType == "tag" || columnType == "location" {
-					if j < len(row) && row[j] != nil {
-						cellValue := fmt.Sprintf("%v", row[j])
-						if cellValue != "" {
-							// Split comma-separated values
-							tags := strings.Split(cellValue, ",")
-							tableName := fmt.Sprintf("_meta_%s_tag_%s", directoryID, columnNames[j])
-
-							for _, tag := range tags {
-								tag = strings.TrimSpace(tag)
-								if tag != "" {
-									_, err := db.Exec(
-										fmt.Sprintf("INSERT INTO '%s' (columnTable, rowID, tag) VALUES (?, ?, ?)", tableName),
-										directoryID, rowID, tag)
-									if err != nil {
-										return fmt.Errorf("failed to insert tag %s for column %s: %v",
-											tag, columnNames[j], err)
-									}
-								}
-							}
-						}
-					}
+			// A new index starts from the rows already stored, since the sync below only
+			// indexes the rows it changes
+			if created {
+				if err := indexTagColumn(tx, directoryID, columnNames[i], columnTypes[i]); err != nil {
+					return err
 				}
 			}
 		}
+
+		// The search index follows the rows through triggers on the table, which go with it when its header changes
+		return ensureSearchIndex(tx, directoryID, columnNames)
+	}); err != nil {
+		return nil, err
 	}
 
-	return nil
+	// Apply the difference between the stored rows and the source in one transaction
+	return app.syncDirectoryRows(ctx, directoryID, columnNames, columnTypes, values[1:], rowKeys, progress)
+}
+func (app *App) reimportDirectory(ctx context.Context, source DataSource, directoryID string) (*ImportResult, error) {
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	columnNames, columnTypes, err := app.getDirectoryColumnConfig(directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := app.importDirectory(ctx, source, directoryID, columnNames, columnTypes, binding != nil && binding.ManageRowKeys, nil, nil)
+
+	// A changed header waits for the owner to confirm how the old columns map to the new ones
+	var mismatch *HeaderMismatchError
+	if errors.As(err, &mismatch) {
+		proposal, proposalErr := app.recordSchemaProposal(directoryID, mismatch.Header)
+		if proposalErr != nil {
+			return nil, fmt.Errorf("%v; failed to record schema change: %v", err, proposalErr)
+		}
+		return nil, schemaChangeError(proposal, mismatch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The source matches the directory again, so any proposal waiting for the owner is moot
+	dismissed, err := app.dismissSchemaProposals(directoryID)
+	if err != nil {
+		return nil, err
+	}
+	if dismissed && app.SyncWorker != nil {
+		app.SyncWorker.Notify()
+	}
 
+	return result, nil
 }
-func (app *App) reimportSheet(
-	ctx context.Context, spreadsheetID string,
-	token *oauth2.Token, directoryID string,
-) error {
+
+// getDirectoryColumnConfig returns the column names and types a directory was imported with
+func (app *App) getDirectoryColumnConfig(directoryID string) ([]string, []string, error) {
 	// Get column names and types from database for re-import
 	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
 	if err != nil {
-		return fmt.Errorf("Failed to get directory database for re-import: %v\n", err)
+		return nil, nil, fmt.Errorf("Failed to get directory database for re-import: %v\n", err)
 	}
 
 	// Query column types from meta table
@@ -226,7 +244,7 @@ func (app *App) reimportSheet(
 		WHERE columnTable = ? 
 		ORDER BY rowid`, directoryID)
 	if err != nil {
-		return fmt.Errorf("Failed to query column types for re-import: %v\n", err)
+		return nil, nil, fmt.Errorf("Failed to query column types for re-import: %v\n", err)
 	}
 	defer rows.Close()
 
@@ -236,25 +254,26 @@ func (app *App) reimportSheet(
 	for rows.Next() {
 		var columnName, columnType string
 		if err := rows.Scan(&columnName, &columnType); err != nil {
-			return fmt.Errorf("Failed to scan column data for re-import: %v\n", err)
+			return nil, nil, fmt.Errorf("Failed to scan column data for re-import: %v\n", err)
 		}
 		columnNames = append(columnNames, columnName)
 		columnTypes = append(columnTypes, columnType)
 	}
 
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("Error iterating column rows for re-import: %v\n", err)
+		return nil, nil, fmt.Errorf("Error iterating column rows for re-import: %v\n", err)
 	}
 
 	if len(columnNames) == 0 {
-		return fmt.Errorf("No column configuration found for directory %s, skipping re-import\n", directoryID)
+		return nil, nil, fmt.Errorf("No column configuration found for directory %s, skipping re-import\n", directoryID)
 
 	}
 
-	return app.importDirectoryFromSheet(ctx, spreadsheetID, token, directoryID, columnNames, columnTypes)
-
+	return columnNames, columnTypes, nil
 }
 
+// handleImport starts importing a directory from a sheet or file in the background and
+// returns the import job, whose progress can be polled at /api/import/jobs
 func (app *App) handleImport(w http.ResponseWriter, r *http.Request) {
 	userEmail, ok := utils2.RequireAuthentication(w, r)
 	if !ok {
@@ -285,128 +304,54 @@ func (app *App) handleImport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sheetURL := SanitizeInput(r.FormValue("sheet_url"))
-	if sheetURL == "" {
-		utils2.ValidationError(w, "Sheet URL is required")
-		return
-	}
-
-	if !ValidateSheetURL(sheetURL) {
-		log.Printf("Invalid sheet URL provided: %s", sheetURL)
-		utils2.ValidationError(w, "Invalid Google Sheets URL format")
-		return
-	}
-
-	spreadsheetID, err := extractSpreadsheetID(sheetURL)
+	columns, err := parseImportColumns(r)
 	if err != nil {
-		log.Printf("Failed to extract spreadsheet ID from URL %s: %v", sheetURL, err)
-		utils2.ValidationError(w, "Invalid Google Sheets URL")
-		return
-	}
-
-	// Parse column names and types from form data
-	var columnNames []string
-	var columnTypes []string
-
-	// Parse column names (assuming they come as column_name_0, column_name_1, etc.)
-	for i := 0; ; i++ {
-		columnName := r.FormValue(fmt.Sprintf("column_name_%d", i))
-		if columnName == "" {
-			break
-		}
-		columnNames = append(columnNames, SanitizeInput(columnName))
-	}
-
-	// Parse column types (assuming they come as column_type_0, column_type_1, etc.)
-	for i := 0; ; i++ {
-		columnType := r.FormValue(fmt.Sprintf("column_type_%d", i))
-		if columnType == "" {
-			break
-		}
-		// Validate column type
-		validTypes := map[string]bool{
-			"basic": true, "numeric": true, "location": true,
-			"tag": true, "category": true,
-		}
-		if !validTypes[columnType] {
-			log.Printf("Invalid column type provided: %s", columnType)
-			utils2.ValidationError(w, fmt.Sprintf("Invalid column type: %s", columnType))
-			return
-		}
-		columnTypes = append(columnTypes, columnType)
-	}
-
-	// Validate that we have the same number of column names and types
-	if len(columnNames) != len(columnTypes) {
-		log.Printf("Column names count (%d) doesn't match column types count (%d)",
-			len(columnNames), len(columnTypes))
-		utils2.ValidationError(w, "Column names and types count mismatch")
-		return
-	}
-
-	if len(columnNames) == 0 {
-		utils2.ValidationError(w, "No columns specified")
+		log.Printf("Invalid import columns: %v", err)
+		utils2.ValidationError(w, err.Error())
 		return
 	}
+	columnNames, columnTypes := importColumnConfig(columns)
 
-	token, err := app.getDecryptedToken(userEmail)
+	header, err := headerLayoutFromForm(r)
 	if err != nil {
-		log.Printf("Failed to get token for user %s: %v", userEmail, err)
-		utils2.InternalServerError(w, "Session not found")
+		utils2.ValidationError(w, err.Error())
 		return
 	}
 
-	refreshedToken, err := app.refreshTokenIfNeeded(token)
-	if err != nil {
-		log.Printf("Failed to refresh token: %v", err)
-		utils2.InternalServerError(w, "Token refresh failed")
-		return
-	}
-	token = refreshedToken
+	// The import outlives this request, so the source is opened with the job's own context
+	ctx, cancel := context.WithTimeout(context.Background(), importJobTimeout)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
-	if err := app.importDirectoryFromSheet(ctx, spreadsheetID, refreshedToken, directoryID, columnNames, columnTypes); err != nil {
-		log.Printf("Failed to import sheet %s: %v", spreadsheetID, err)
-		utils2.InternalServerError(w, fmt.Sprintf("Failed to import sheet: %v", err))
+	binding := requestedSource(r.FormValue("source_type"), SanitizeInput(r.FormValue("sheet_url")),
+		r.FormValue("file_path"), r.FormValue("sheet_tab"), strings.Split(r.FormValue("extra_tabs"), "\n"),
+		r.FormValue("sheet_range"))
+	binding.DirectoryID = directoryID
+	binding.Header = header
+	binding.ManageRowKeys = r.FormValue("manage_row_keys") == "on"
+	binding.ReadOnly = r.FormValue("read_only") == "on"
+	source, ok := app.openRequestedSource(ctx, w, userEmail, binding)
+	if !ok {
+		cancel()
 		return
 	}
 
-	_, err = app.DB.Exec("UPDATE admin_sessions SET sheet_url = ?, directory_id = ? WHERE user_email = ?", sheetURL, directoryID, userEmail)
-	if err != nil {
-		log.Printf("Failed to save sheet URL for user %s: %v", userEmail, err)
-		utils2.InternalServerError(w, "Failed to save sheet URL")
+	job, err := app.createImportJob(binding, userEmail)
+	if errors.Is(err, errImportJobRunning) {
+		cancel()
+		utils2.RespondWithError(w, http.StatusConflict, "An import is already running for this directory")
 		return
 	}
-
-	log.Printf("Import successful, redirecting to admin page with success message")
-	redirectURL := "/owner?imported=true"
-	if directoryID != "default" {
-		redirectURL += "&dir=" + directoryID
-	}
-	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
-}
-
-func (app *App) updateSheetCell(spreadsheetID string, row, col int, value string, token *oauth2.Token) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	client := app.OAuthConfig.Client(ctx, token)
-
-	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		return fmt.Errorf("unable to retrieve Sheets client: %v", err)
-	}
-
-	cellRange := fmt.Sprintf("%s%d", columnIndexToLetter(col), row+2)
-
-	valueRange := &sheets.ValueRange{
-		Values: [][]interface{}{{value}},
+		cancel()
+		log.Printf("Failed to create import job for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to start import")
+		return
 	}
+	log.Printf("User %s started import job %d of %s source %s into directory %s",
+		userEmail, job.ID, source.Type(), binding.Location, directoryID)
 
-	_, err = srv.Spreadsheets.Values.Update(spreadsheetID, cellRange, valueRange).
-		ValueInputOption("USER_ENTERED").Do()
+	app.startImportJob(ctx, cancel, job, source, binding, columnNames, columnTypes, importColumnNormalizers(columns))
 
-	return err
+	utils2.RespondWithSuccess(w, job, "Import started")
 }
 
 func extractSpreadsheetID(url string) (string, error) {
@@ -418,32 +363,20 @@ func extractSpreadsheetID(url string) (string, error) {
 	return matches[1], nil
 }
 
-func (app *App) appendRowToSheet(spreadsheetID string, rowData []string, token *oauth2.Token) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	client := app.OAuthConfig.Client(ctx, token)
-
-	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return fmt.Errorf("unable to retrieve Sheets client: %v", err)
-	}
-
-	// Convert string slice to interface slice for Google Sheets API
-	values := make([]interface{}, len(rowData))
-	for i, v := range rowData {
-		values[i] = v
+// columnLetterToIndex converts a column letter such as "A" or "AB" to a 0-based index,
+// ignoring any row number that follows
+func columnLetterToIndex(column string) int {
+	index := 0
+	for _, r := range strings.ToUpper(column) {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A') + 1
 	}
-
-	valueRange := &sheets.ValueRange{
-		Values: [][]interface{}{values},
+	if index == 0 {
+		return 0
 	}
-
-	_, err = srv.Spreadsheets.Values.Append(spreadsheetID, "A:Z", valueRange).
-		ValueInputOption("USER_ENTERED").
-		InsertDataOption("INSERT_ROWS").
-		Do()
-
-	return err
+	return index - 1
 }
 
 func columnIndexToLetter(index int) string {
@@ -460,7 +393,7 @@ func columnIndexToLetter(index int) string {
 	return string(runes)
 }
 
-func (app *App) refreshTokenIfNeeded(token *oauth2.Token) (*oauth2.Token, error) {
+func (app *App) refreshTokenIfNeeded(userEmail string, token *oauth2.Token) (*oauth2.Token, error) {
 	if token.Valid() {
 		return token, nil
 	}
@@ -479,7 +412,7 @@ func (app *App) refreshTokenIfNeeded(token *oauth2.Token) (*oauth2.Token, error)
 	}
 
 	if newToken.AccessToken != token.AccessToken {
-		if err := app.saveRefreshedToken(newToken); err != nil {
+		if err := app.saveRefreshedToken(userEmail, newToken); err != nil {
 			log.Printf("Failed to save refreshed token: %v", err)
 		}
 	}
@@ -490,7 +423,7 @@ func (app *App) refreshTokenIfNeeded(token *oauth2.Token) (*oauth2.Token, error)
 // getDecryptedToken retrieves and decrypts an OAuth token for a user
 func (app *App) getDecryptedToken(userEmail string) (*oauth2.Token, error) {
 	var encryptedTokenJSON string
-	err := app.DB.QueryRow("SELECT token FROM admin_sessions WHERE user_email = ?", userEmail).Scan(&encryptedTokenJSON)
+	err := app.DB.QueryRow("SELECT token FROM admin_sessions WHERE user_email = ? ORDER BY created_at DESC LIMIT 1", userEmail).Scan(&encryptedTokenJSON)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token for user %s: %v", userEmail, err)
 	}
@@ -509,7 +442,8 @@ func (app *App) getDecryptedToken(userEmail string) (*oauth2.Token, error) {
 	return &token, nil
 }
 
-func (app *App) saveRefreshedToken(token *oauth2.Token) error {
+// saveRefreshedToken stores a refreshed OAuth token on the user's latest admin session
+func (app *App) saveRefreshedToken(userEmail string, token *oauth2.Token) error {
 	tokenJSON, err := json.Marshal(token)
 	if err != nil {
 		return fmt.Errorf("failed to marshal refreshed token: %v", err)
@@ -521,54 +455,21 @@ func (app *App) saveRefreshedToken(token *oauth2.Token) error {
 		return fmt.Errorf("failed to encrypt refreshed token: %v", err)
 	}
 
-	// Note: This update strategy is flawed - we should update by user_email instead
-	// For now, we'll leave it but this needs to be fixed in a future update
 	_, err = app.DB.Exec(`
 		UPDATE admin_sessions 
 		SET token = ? 
-		WHERE user_email = (
-			SELECT user_email FROM admin_sessions 
-			WHERE token = ? 
+		WHERE id = (
+			SELECT id FROM admin_sessions 
+			WHERE user_email = ? 
 			ORDER BY created_at DESC 
 			LIMIT 1
 		)
-	`, encryptedToken, encryptedToken)
-
-	return err
-}
-
-func (app *App) deleteSheetRow(spreadsheetID string, rowNumber int, token *oauth2.Token) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	client := app.OAuthConfig.Client(ctx, token)
-
-	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return fmt.Errorf("unable to retrieve Sheets client: %v", err)
-	}
-
-	// Create a delete dimension request
-	deleteRequest := &sheets.Request{
-		DeleteDimension: &sheets.DeleteDimensionRequest{
-			Range: &sheets.DimensionRange{
-				SheetId:    0, // Assuming first sheet
-				Dimension:  "ROWS",
-				StartIndex: int64(rowNumber - 1), // Convert to 0-based index
-				EndIndex:   int64(rowNumber),     // End is exclusive
-			},
-		},
-	}
-
-	batchUpdateRequest := &sheets.BatchUpdateSpreadsheetRequest{
-		Requests: []*sheets.Request{deleteRequest},
-	}
-
-	_, err = srv.Spreadsheets.BatchUpdate(spreadsheetID, batchUpdateRequest).Do()
+	`, encryptedToken, userEmail)
 
 	return err
 }
 
+// handlePreviewSheet reads the header and first rows of a source for the directory's owners
 func (app *App) handlePreviewSheet(w http.ResponseWriter, r *http.Request) {
 	userEmail, ok := utils2.RequireAuthentication(w, r)
 	if !ok {
@@ -582,100 +483,160 @@ func (app *App) handlePreviewSheet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sheetURL := SanitizeInput(previewReq.SheetURL)
-	if sheetURL == "" {
-		utils2.ValidationError(w, "Sheet URL is required")
-		return
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	if !ValidateSheetURL(sheetURL) {
-		log.Printf("Invalid sheet URL provided for preview: %s", sheetURL)
-		utils2.ValidationError(w, "Invalid Google Sheets URL format")
+	binding := requestedSource(previewReq.SourceType, SanitizeInput(previewReq.SheetURL), previewReq.FilePath,
+		previewReq.SheetTab, previewReq.ExtraTabs, previewReq.SheetRange)
+	binding.DirectoryID = utils2.GetDirectoryID(r)
+	binding.Header = previewReq.Header
+	source, ok := app.openRequestedSource(ctx, w, userEmail, binding)
+	if !ok {
 		return
 	}
+	location := binding.Location
 
-	spreadsheetID, err := extractSpreadsheetID(sheetURL)
+	preview, err := app.previewSource(ctx, source)
 	if err != nil {
-		log.Printf("Failed to extract spreadsheet ID from URL %s: %v", sheetURL, err)
-		utils2.ValidationError(w, "Invalid Google Sheets URL")
+		log.Printf("Failed to preview %s source %s: %v", source.Type(), location, err)
+		utils2.InternalServerError(w, fmt.Sprintf("Failed to preview sheet: %v", err))
 		return
 	}
 
-	token, err := app.getDecryptedToken(userEmail)
-	if err != nil {
-		log.Printf("Failed to get token for user %s: %v", userEmail, err)
-		utils2.InternalServerError(w, "Session not found")
-		return
+	utils2.RespondWithJSON(w, 200, preview)
+}
+
+// requestedSource builds the binding described by the source fields of a request
+func requestedSource(sourceType, sheetURL, filePath, sheetTab string, extraTabs []string, sheetRange string) *DirectorySource {
+	if sourceType == "" {
+		sourceType = SourceTypeGoogleSheet
 	}
 
-	refreshedToken, err := app.refreshTokenIfNeeded(token)
-	if err != nil {
-		log.Printf("Failed to refresh token for preview: %v", err)
-		utils2.InternalServerError(w, "Token refresh failed")
-		return
+	binding := &DirectorySource{SourceType: sourceType}
+	if sourceType == SourceTypeFile {
+		binding.Location = filePath
+	} else {
+		binding.Location = sheetURL
+		binding.SheetTab = strings.TrimSpace(sheetTab)
+		binding.ExtraTabs = cleanTabList(extraTabs)
+		binding.SheetRange = strings.ToUpper(strings.TrimSpace(sheetRange))
 	}
-	token = refreshedToken
+	return binding
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// openRequestedSource validates a requested binding and opens the data source it describes
+// using the requesting user's credentials, filling in the spreadsheet ID and sync user.
+// It writes an error response and returns false on failure.
+func (app *App) openRequestedSource(
+	ctx context.Context, w http.ResponseWriter, userEmail string, binding *DirectorySource,
+) (DataSource, bool) {
+	if err := binding.Header.validate(); err != nil {
+		utils2.ValidationError(w, err.Error())
+		return nil, false
+	}
+
+	switch binding.SourceType {
+	case SourceTypeGoogleSheet:
+		sheetURL := binding.Location
+		if sheetURL == "" {
+			utils2.ValidationError(w, "Sheet URL is required")
+			return nil, false
+		}
 
-	preview, err := app.previewSheet(ctx, spreadsheetID, refreshedToken)
-	if err != nil {
-		log.Printf("Failed to preview sheet %s: %v", spreadsheetID, err)
-		utils2.InternalServerError(w, fmt.Sprintf("Failed to preview sheet: %v", err))
-		return
-	}
+		if !ValidateSheetURL(sheetURL) {
+			log.Printf("Invalid sheet URL provided: %s", sheetURL)
+			utils2.ValidationError(w, "Invalid Google Sheets URL format")
+			return nil, false
+		}
 
-	utils2.RespondWithJSON(w, 200, preview)
-}
+		if err := validateSheetTabs(binding); err != nil {
+			utils2.ValidationError(w, err.Error())
+			return nil, false
+		}
 
-func (app *App) previewSheet(ctx context.Context, spreadsheetID string, token *oauth2.Token) (*PreviewResponse, error) {
-	client := app.OAuthConfig.Client(ctx, token)
+		if binding.SheetRange != "" && !ValidateSheetRange(binding.SheetRange) {
+			utils2.ValidationError(w, "Invalid sheet range: use columns such as A:Z, or A: for every column")
+			return nil, false
+		}
 
-	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve Sheets client: %v", err)
-	}
+		spreadsheetID, err := extractSpreadsheetID(sheetURL)
+		if err != nil {
+			log.Printf("Failed to extract spreadsheet ID from URL %s: %v", sheetURL, err)
+			utils2.ValidationError(w, "Invalid Google Sheets URL")
+			return nil, false
+		}
 
-	// Get spreadsheet metadata
-	spreadsheet, err := srv.Spreadsheets.Get(spreadsheetID).Do()
-	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve spreadsheet metadata: %v", err)
+		token, err := app.getDecryptedToken(userEmail)
+		if err != nil {
+			log.Printf("Failed to get token for user %s: %v", userEmail, err)
+			utils2.InternalServerError(w, "Session not found")
+			return nil, false
+		}
+
+		refreshedToken, err := app.refreshTokenIfNeeded(userEmail, token)
+		if err != nil {
+			log.Printf("Failed to refresh token: %v", err)
+			utils2.InternalServerError(w, "Token refresh failed")
+			return nil, false
+		}
+
+		binding.SpreadsheetID = spreadsheetID
+		source, err := app.newSheetSource(ctx, binding, app.OAuthConfig.TokenSource(ctx, refreshedToken))
+		if err != nil {
+			log.Printf("Failed to open spreadsheet %s: %v", spreadsheetID, err)
+			utils2.InternalServerError(w, "Failed to open sheet")
+			return nil, false
+		}
+
+		binding.SyncUserEmail = userEmail
+		return source, true
+
+	case SourceTypeFile:
+		source, err := app.newFileSource(binding.DirectoryID, binding.Location)
+		if err != nil {
+			log.Printf("Failed to open file source %s: %v", binding.Location, err)
+			utils2.ValidationError(w, err.Error())
+			return nil, false
+		}
+		return binding.Header.wrap(source), true
+
+	default:
+		utils2.ValidationError(w, fmt.Sprintf("Invalid source type: %s", binding.SourceType))
+		return nil, false
 	}
+}
 
-	sheetName := "Sheet1"
-	if len(spreadsheet.Sheets) > 0 && spreadsheet.Sheets[0].Properties != nil {
-		sheetName = spreadsheet.Sheets[0].Properties.Title
+func (app *App) previewSource(ctx context.Context, source DataSource) (*PreviewResponse, error) {
+	sheetName, err := source.Title(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	// Get first few rows to determine column structure
-	resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, app.Config.SheetRange).Do()
+	values, err := source.ReadAll(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve data from sheet: %v", err)
+		return nil, fmt.Errorf("unable to retrieve data from source: %v", err)
 	}
 
-	if len(resp.Values) == 0 {
-		return nil, fmt.Errorf("no data found in sheet")
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no data found in source")
 	}
 
+	// A row key column added by an earlier import is not offered as a directory column
+	values, _ = splitRowKeys(values)
+
 	// Extract column names from the first row
 	var columns []string
-	if len(resp.Values) > 0 {
-		for i, cell := range resp.Values[0] {
-			if cell != nil {
-				columnName := fmt.Sprintf("%v", cell)
-				if columnName == "" {
-					columnName = fmt.Sprintf("Column %d", i+1)
-				}
-				columns = append(columns, SanitizeInput(columnName))
-			} else {
-				columns = append(columns, fmt.Sprintf("Column %d", i+1))
-			}
+	for i, cell := range values[0] {
+		columnName := cell
+		if columnName == "" {
+			columnName = fmt.Sprintf("Column %d", i+1)
 		}
+		columns = append(columns, SanitizeInput(columnName))
 	}
 
 	// Count data rows (excluding header)
-	rowCount := len(resp.Values) - 1
+	rowCount := len(values) - 1
 	if rowCount < 0 {
 		rowCount = 0
 	}
@@ -693,3 +654,673 @@ func (app *App) previewSheet(ctx context.Context, spreadsheetID string, token *o
 		SheetName:   sheetName,
 	}, nil
 }
+
+// GoogleSheetSource is a DataSource backed by one tab of a Google Sheet
+type GoogleSheetSource struct {
+	srv           *sheets.Service
+	spreadsheetID string
+	sheetTab      string // empty means the first tab
+	sheetRange    string
+	startColumn   int  // index of the first column in sheetRange
+	endColumn     int  // index of the last column in sheetRange, or -1 until an open-ended range is resolved
+	openEnded     bool // the range runs to the tab's last column, however many it has
+	quota         *SheetsQuota
+}
+
+// newGoogleSheetSource creates a Sheets client for a tab and column range of the spreadsheet
+// using the given credentials. Empty tab and range select the first tab and SHEET_RANGE. A
+// range without an end column, such as "A:", runs to the last column of the tab.
+func (app *App) newGoogleSheetSource(
+	ctx context.Context, spreadsheetID, sheetTab, sheetRange string, tokenSource oauth2.TokenSource,
+) (*GoogleSheetSource, error) {
+	client := oauth2.NewClient(ctx, tokenSource)
+
+	srv, err := sheets.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Sheets client: %v", err)
+	}
+
+	if sheetRange == "" {
+		sheetRange = app.Config.SheetRange
+	}
+
+	bounds := strings.SplitN(sheetRange, ":", 2)
+	endColumn := -1
+	if len(bounds) == 2 && bounds[1] != "" {
+		endColumn = columnLetterToIndex(bounds[1])
+	}
+
+	return &GoogleSheetSource{
+		srv:           srv,
+		spreadsheetID: spreadsheetID,
+		sheetTab:      sheetTab,
+		sheetRange:    sheetRange,
+		startColumn:   columnLetterToIndex(bounds[0]),
+		endColumn:     endColumn,
+		openEnded:     endColumn < 0,
+		quota:         app.SheetsQuota,
+	}, nil
+}
+
+// newSheetSource opens the tab a sheet binding names, or a MultiTabSource when the binding
+// combines several tabs, laid out by the binding's header layout
+func (app *App) newSheetSource(ctx context.Context, binding *DirectorySource, tokenSource oauth2.TokenSource) (DataSource, error) {
+	if len(binding.ExtraTabs) > 0 {
+		return app.newMultiTabSource(ctx, binding, tokenSource)
+	}
+	source, err := app.newGoogleSheetSource(ctx, binding.SpreadsheetID, binding.SheetTab, binding.SheetRange, tokenSource)
+	if err != nil {
+		return nil, err
+	}
+	return binding.Header.wrap(source), nil
+}
+
+// resolveColumns pins an open-ended range to the columns the tab has, so it can be used
+// in A1 notation
+func (gs *GoogleSheetSource) resolveColumns(ctx context.Context) error {
+	if gs.endColumn >= 0 {
+		return nil
+	}
+
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	if properties.GridProperties == nil {
+		return fmt.Errorf("tab %q has no grid", properties.Title)
+	}
+
+	gs.setEndColumn(int(properties.GridProperties.ColumnCount) - 1)
+	return nil
+}
+
+// setEndColumn moves the end of the range to a column, keeping at least its first column
+func (gs *GoogleSheetSource) setEndColumn(endColumn int) {
+	if endColumn < gs.startColumn {
+		endColumn = gs.startColumn
+	}
+	gs.endColumn = endColumn
+	gs.sheetRange = columnIndexToLetter(gs.startColumn) + ":" + columnIndexToLetter(endColumn)
+}
+
+// growColumns adds columns to the end of the tab so it reaches endColumn
+func (gs *GoogleSheetSource) growColumns(ctx context.Context, endColumn int) error {
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	if properties.GridProperties == nil {
+		return fmt.Errorf("tab %q has no grid", properties.Title)
+	}
+
+	columnCount := int(properties.GridProperties.ColumnCount)
+	if endColumn >= columnCount {
+		insertRequest := &sheets.Request{
+			InsertDimension: &sheets.InsertDimensionRequest{
+				Range: &sheets.DimensionRange{
+					SheetId:    properties.SheetId,
+					Dimension:  "COLUMNS",
+					StartIndex: int64(columnCount),
+					EndIndex:   int64(endColumn + 1),
+				},
+				InheritFromBefore: true,
+			},
+		}
+
+		if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+			return err
+		}
+		_, err = gs.srv.Spreadsheets.BatchUpdate(gs.spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{insertRequest},
+		}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to add columns to tab %q: %v", properties.Title, err)
+		}
+	}
+
+	gs.setEndColumn(endColumn)
+	return nil
+}
+
+// a1 qualifies a range with the source's tab name
+func (gs *GoogleSheetSource) a1(cellRange string) string {
+	if gs.sheetTab == "" {
+		return cellRange
+	}
+	return "'" + strings.ReplaceAll(gs.sheetTab, "'", "''") + "'!" + cellRange
+}
+
+// sheetProperties returns the properties of the source's tab
+func (gs *GoogleSheetSource) sheetProperties(ctx context.Context) (*sheets.SheetProperties, error) {
+	if err := gs.quota.WaitRead(ctx, gs.spreadsheetID); err != nil {
+		return nil, err
+	}
+
+	spreadsheet, err := gs.srv.Spreadsheets.Get(gs.spreadsheetID).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve spreadsheet metadata: %v", err)
+	}
+
+	for _, sheet := range spreadsheet.Sheets {
+		if sheet.Properties == nil {
+			continue
+		}
+		if gs.sheetTab == "" || sheet.Properties.Title == gs.sheetTab {
+			return sheet.Properties, nil
+		}
+	}
+
+	if gs.sheetTab != "" {
+		return nil, fmt.Errorf("tab %q not found in spreadsheet", gs.sheetTab)
+	}
+	return nil, fmt.Errorf("spreadsheet has no tabs")
+}
+
+func (gs *GoogleSheetSource) Type() string {
+	return SourceTypeGoogleSheet
+}
+
+func (gs *GoogleSheetSource) Title(ctx context.Context) (string, error) {
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return "", err
+	}
+	return properties.Title, nil
+}
+
+func (gs *GoogleSheetSource) ReadAll(ctx context.Context) ([][]string, error) {
+	if err := gs.resolveColumns(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := gs.quota.WaitRead(ctx, gs.spreadsheetID); err != nil {
+		return nil, err
+	}
+
+	resp, err := gs.srv.Spreadsheets.Values.Get(gs.spreadsheetID, gs.a1(gs.sheetRange)).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve data from sheet: %v", err)
+	}
+
+	return sheetCells(resp.Values), nil
+}
+
+// ReadChunks reads the tab chunkRows rows at a time, up to the tab's last row. Ranges that
+// already name their rows are read in one request.
+func (gs *GoogleSheetSource) ReadChunks(ctx context.Context, chunkRows int, fn func(rows [][]string) error) error {
+	if err := gs.resolveColumns(ctx); err != nil {
+		return err
+	}
+
+	bounds := strings.SplitN(gs.sheetRange, ":", 2)
+	if len(bounds) != 2 || strings.ContainsAny(gs.sheetRange, "0123456789") {
+		rows, err := gs.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		return fn(rows)
+	}
+
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return err
+	}
+	if properties.GridProperties == nil {
+		return fmt.Errorf("tab %q has no grid", properties.Title)
+	}
+	rowCount := int(properties.GridProperties.RowCount)
+
+	// The API leaves out empty rows at the end of each chunk. They are held back until a
+	// later chunk shows they sit between data rows rather than at the end of the tab.
+	heldBack := 0
+	for start := 1; start <= rowCount; start += chunkRows {
+		end := start + chunkRows - 1
+		if end > rowCount {
+			end = rowCount
+		}
+
+		if err := gs.quota.WaitRead(ctx, gs.spreadsheetID); err != nil {
+			return err
+		}
+		chunkRange := fmt.Sprintf("%s%d:%s%d", bounds[0], start, bounds[1], end)
+		resp, err := gs.srv.Spreadsheets.Values.Get(gs.spreadsheetID, gs.a1(chunkRange)).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to retrieve rows %d to %d from sheet: %v", start, end, err)
+		}
+
+		if len(resp.Values) == 0 {
+			heldBack += end - start + 1
+			continue
+		}
+
+		rows := make([][]string, heldBack, heldBack+len(resp.Values))
+		for i := range rows {
+			rows[i] = []string{}
+		}
+		if err := fn(append(rows, sheetCells(resp.Values)...)); err != nil {
+			return err
+		}
+		heldBack = end - start + 1 - len(resp.Values)
+	}
+	return nil
+}
+
+// sheetCells converts the cells of a values response to strings
+func sheetCells(values [][]interface{}) [][]string {
+	rows := make([][]string, len(values))
+	for i, row := range values {
+		rows[i] = make([]string, len(row))
+		for j, cell := range row {
+			if cell != nil {
+				rows[i][j] = fmt.Sprintf("%v", cell)
+			}
+		}
+	}
+	return rows
+}
+
+// literalCellValue escapes text that USER_ENTERED writes would otherwise parse as a formula
+func literalCellValue(value string) string {
+	if strings.HasPrefix(value, "=") {
+		return "'" + value
+	}
+	return value
+}
+
+func (gs *GoogleSheetSource) UpdateCell(ctx context.Context, rowNumber, col int, value string) error {
+	cellRange := fmt.Sprintf("%s%d", columnIndexToLetter(gs.startColumn+col), rowNumber)
+
+	valueRange := &sheets.ValueRange{
+		Values: [][]interface{}{{literalCellValue(value)}},
+	}
+
+	if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err := gs.srv.Spreadsheets.Values.Update(gs.spreadsheetID, gs.a1(cellRange), valueRange).
+		ValueInputOption("USER_ENTERED").Context(ctx).Do()
+
+	return err
+}
+
+func (gs *GoogleSheetSource) UpdateColumn(ctx context.Context, col, firstRow int, values []string) error {
+	if err := gs.resolveColumns(ctx); err != nil {
+		return err
+	}
+
+	// An open-ended range grows with the tab; a fixed one must be widened by the owner
+	if gs.openEnded && gs.startColumn+col > gs.endColumn {
+		if err := gs.growColumns(ctx, gs.startColumn+col); err != nil {
+			return err
+		}
+	}
+	if gs.startColumn+col > gs.endColumn {
+		return fmt.Errorf("column %s is outside the range %s; widen the range to make room for it",
+			columnIndexToLetter(gs.startColumn+col), gs.sheetRange)
+	}
+
+	letter := columnIndexToLetter(gs.startColumn + col)
+	cellRange := fmt.Sprintf("%s%d:%s%d", letter, firstRow, letter, firstRow+len(values)-1)
+
+	rows := make([][]interface{}, len(values))
+	for i, value := range values {
+		rows[i] = []interface{}{value}
+	}
+
+	if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err := gs.srv.Spreadsheets.Values.Update(gs.spreadsheetID, gs.a1(cellRange), &sheets.ValueRange{Values: rows}).
+		ValueInputOption("RAW").Context(ctx).Do()
+
+	return err
+}
+
+// HideColumn hides a column of the tab from people viewing the sheet
+func (gs *GoogleSheetSource) HideColumn(ctx context.Context, col int) error {
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return err
+	}
+
+	hideRequest := &sheets.Request{
+		UpdateDimensionProperties: &sheets.UpdateDimensionPropertiesRequest{
+			Range: &sheets.DimensionRange{
+				SheetId:    properties.SheetId,
+				Dimension:  "COLUMNS",
+				StartIndex: int64(gs.startColumn + col),
+				EndIndex:   int64(gs.startColumn + col + 1),
+			},
+			Properties: &sheets.DimensionProperties{HiddenByUser: true},
+			Fields:     "hiddenByUser",
+		},
+	}
+
+	batchUpdateRequest := &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{hideRequest},
+	}
+
+	if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err = gs.srv.Spreadsheets.BatchUpdate(gs.spreadsheetID, batchUpdateRequest).Context(ctx).Do()
+
+	return err
+}
+
+// cellRuleFields limits the grid data read by ReadCellRules to formulas and validation rules
+const cellRuleFields = "sheets(properties(sheetId,title),protectedRanges," +
+	"data(startRow,startColumn,rowData(values(userEnteredValue(formulaValue),dataValidation))))"
+
+// ReadCellRules reads the formulas and validation rules of the range, or of the given rows
+// of it, along with the tab's protected ranges. Consecutive formula cells of a column are
+// reported as one rule, and so are consecutive cells with the same validation rule.
+// Protected ranges that refer to a named range are not resolved.
+func (gs *GoogleSheetSource) ReadCellRules(ctx context.Context, rows []int) ([]SourceCellRule, error) {
+	if err := gs.resolveColumns(ctx); err != nil {
+		return nil, err
+	}
+
+	ranges := []string{gs.a1(gs.sheetRange)}
+	if rows != nil {
+		ranges = make([]string, len(rows))
+		for i, row := range rows {
+			if gs.endColumn >= 0 {
+				ranges[i] = gs.a1(fmt.Sprintf("%s%d:%s%d", columnIndexToLetter(gs.startColumn), row, columnIndexToLetter(gs.endColumn), row))
+			} else {
+				ranges[i] = gs.a1(fmt.Sprintf("%d:%d", row, row))
+			}
+		}
+	}
+
+	if err := gs.quota.WaitRead(ctx, gs.spreadsheetID); err != nil {
+		return nil, err
+	}
+
+	spreadsheet, err := gs.srv.Spreadsheets.Get(gs.spreadsheetID).Ranges(ranges...).IncludeGridData(true).
+		Fields(cellRuleFields).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve cell metadata: %v", err)
+	}
+
+	var sheet *sheets.Sheet
+	for _, candidate := range spreadsheet.Sheets {
+		if candidate.Properties != nil && (gs.sheetTab == "" || candidate.Properties.Title == gs.sheetTab) {
+			sheet = candidate
+			break
+		}
+	}
+	if sheet == nil {
+		return nil, fmt.Errorf("tab %q not found in spreadsheet", gs.sheetTab)
+	}
+
+	var rules []SourceCellRule
+	for _, protected := range sheet.ProtectedRanges {
+		if protected.Range == nil {
+			continue
+		}
+		grid := protected.Range
+		rule := SourceCellRule{
+			Kind:        CellRuleProtected,
+			FirstRow:    int(grid.StartRowIndex) + 1,
+			LastRow:     int(grid.EndRowIndex),
+			FirstColumn: int(grid.StartColumnIndex) - gs.startColumn,
+			LastColumn:  -1,
+			Description: protected.Description,
+			WarningOnly: protected.WarningOnly,
+			Editable:    protected.RequestingUserCanEdit,
+		}
+		if grid.EndColumnIndex > 0 {
+			rule.LastColumn = int(grid.EndColumnIndex) - 1 - gs.startColumn
+			if rule.LastColumn < 0 || (gs.endColumn >= 0 && int(grid.StartColumnIndex) > gs.endColumn) {
+				continue // outside the range
+			}
+		}
+		if rule.FirstColumn < 0 {
+			rule.FirstColumn = 0
+		}
+		rules = append(rules, rule)
+	}
+
+	// Runs of formula or identically validated cells, by column, that the next row may extend
+	formulaRuns := make(map[int]*SourceCellRule)
+	validationRuns := make(map[int]*SourceCellRule)
+	var blocks []*SourceCellRule
+	extend := func(runs map[int]*SourceCellRule, row, col int, rule SourceCellRule, same func(*SourceCellRule) bool) {
+		if run := runs[col]; run != nil && run.LastRow == row-1 && same(run) {
+			run.LastRow = row
+			return
+		}
+		rule.FirstRow, rule.LastRow, rule.FirstColumn, rule.LastColumn = row, row, col, col
+		runs[col] = &rule
+		blocks = append(blocks, &rule)
+	}
+
+	for _, data := range sheet.Data {
+		for i, rowData := range data.RowData {
+			row := int(data.StartRow) + i + 1
+			for j, cell := range rowData.Values {
+				col := int(data.StartColumn) + j - gs.startColumn
+				if cell == nil || col < 0 || (gs.endColumn >= 0 && col > gs.endColumn-gs.startColumn) {
+					continue
+				}
+
+				if cell.UserEnteredValue != nil && cell.UserEnteredValue.FormulaValue != nil {
+					rule := SourceCellRule{Kind: CellRuleFormula, Formula: *cell.UserEnteredValue.FormulaValue}
+					extend(formulaRuns, row, col, rule, func(*SourceCellRule) bool { return true })
+				}
+
+				if cell.DataValidation != nil && cell.DataValidation.Condition != nil {
+					validation := &CellValidation{
+						Condition:    cell.DataValidation.Condition.Type,
+						Strict:       cell.DataValidation.Strict,
+						InputMessage: cell.DataValidation.InputMessage,
+					}
+					for _, value := range cell.DataValidation.Condition.Values {
+						if value != nil {
+							validation.Values = append(validation.Values, value.UserEnteredValue)
+						}
+					}
+					rule := SourceCellRule{Kind: CellRuleValidation, Validation: validation}
+					extend(validationRuns, row, col, rule, func(run *SourceCellRule) bool {
+						return reflect.DeepEqual(run.Validation, validation)
+					})
+				}
+			}
+		}
+	}
+
+	for _, block := range blocks {
+		rules = append(rules, *block)
+	}
+	return rules, nil
+}
+
+func (gs *GoogleSheetSource) AppendRow(ctx context.Context, rowData []string) error {
+	// Convert string slice to interface slice for Google Sheets API
+	values := make([]interface{}, len(rowData))
+	for i, v := range rowData {
+		values[i] = literalCellValue(v)
+	}
+
+	valueRange := &sheets.ValueRange{
+		Values: [][]interface{}{values},
+	}
+
+	if err := gs.resolveColumns(ctx); err != nil {
+		return err
+	}
+
+	if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err := gs.srv.Spreadsheets.Values.Append(gs.spreadsheetID, gs.a1(gs.sheetRange), valueRange).
+		ValueInputOption("USER_ENTERED").
+		InsertDataOption("INSERT_ROWS").
+		Context(ctx).
+		Do()
+
+	return err
+}
+
+// ApplyBatch sends every write as one spreadsheets.batchUpdate call, which the API applies
+// atomically
+func (gs *GoogleSheetSource) ApplyBatch(ctx context.Context, writes []SourceWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	requests, err := gs.batchRequests(ctx, writes)
+	if err != nil {
+		return err
+	}
+
+	if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err = gs.srv.Spreadsheets.BatchUpdate(gs.spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).
+		Context(ctx).Do()
+
+	return err
+}
+
+// batchRequests converts writes to the tab into batchUpdate requests, in the same order
+func (gs *GoogleSheetSource) batchRequests(ctx context.Context, writes []SourceWrite) ([]*sheets.Request, error) {
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []*sheets.Request
+	for _, write := range writes {
+		switch write.Kind {
+		case SyncJobUpdateCell:
+			requests = append(requests, &sheets.Request{
+				UpdateCells: &sheets.UpdateCellsRequest{
+					Start: &sheets.GridCoordinate{
+						SheetId:     properties.SheetId,
+						RowIndex:    int64(write.RowNumber - 1),
+						ColumnIndex: int64(gs.startColumn + write.Column),
+					},
+					Rows:   []*sheets.RowData{{Values: []*sheets.CellData{userEnteredCell(write.Value)}}},
+					Fields: "userEnteredValue",
+				},
+			})
+		case SyncJobDeleteRow:
+			requests = append(requests, &sheets.Request{
+				DeleteDimension: &sheets.DeleteDimensionRequest{
+					Range: &sheets.DimensionRange{
+						SheetId:    properties.SheetId,
+						Dimension:  "ROWS",
+						StartIndex: int64(write.RowNumber - 1), // Convert to 0-based index
+						EndIndex:   int64(write.RowNumber),     // End is exclusive
+					},
+				},
+			})
+		case SyncJobAppendRow:
+			// Pad up to the start of the range, since appended cells begin in column A
+			cells := make([]*sheets.CellData, gs.startColumn, gs.startColumn+len(write.Values))
+			for i := range cells {
+				cells[i] = &sheets.CellData{}
+			}
+			for _, value := range write.Values {
+				cells = append(cells, userEnteredCell(value))
+			}
+			requests = append(requests, &sheets.Request{
+				AppendCells: &sheets.AppendCellsRequest{
+					SheetId: properties.SheetId,
+					Rows:    []*sheets.RowData{{Values: cells}},
+					Fields:  "userEnteredValue",
+				},
+			})
+		case sourceWriteInsertRow:
+			cells := make([]*sheets.CellData, 0, len(write.Values))
+			for _, value := range write.Values {
+				cells = append(cells, userEnteredCell(value))
+			}
+			requests = append(requests, &sheets.Request{
+				InsertDimension: &sheets.InsertDimensionRequest{
+					Range: &sheets.DimensionRange{
+						SheetId:    properties.SheetId,
+						Dimension:  "ROWS",
+						StartIndex: int64(write.RowNumber - 1),
+						EndIndex:   int64(write.RowNumber),
+					},
+					InheritFromBefore: true, // take the formatting of the data row above
+				},
+			}, &sheets.Request{
+				UpdateCells: &sheets.UpdateCellsRequest{
+					Start: &sheets.GridCoordinate{
+						SheetId:     properties.SheetId,
+						RowIndex:    int64(write.RowNumber - 1),
+						ColumnIndex: int64(gs.startColumn),
+					},
+					Rows:   []*sheets.RowData{{Values: cells}},
+					Fields: "userEnteredValue",
+				},
+			})
+		default:
+			return nil, fmt.Errorf("unknown write %q", write.Kind)
+		}
+	}
+
+	return requests, nil
+}
+
+// numericCellPattern matches plain decimal numbers, which the sheet would store as numbers
+var numericCellPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// userEnteredCell builds a cell holding value as if it had been typed into the sheet, so
+// numbers and booleans keep their type like USER_ENTERED value updates. Text that looks like
+// a formula is written as text, so an edit made on the site can't compute anything in the sheet.
+func userEnteredCell(value string) *sheets.CellData {
+	cell := &sheets.ExtendedValue{}
+	switch {
+	case value == "TRUE" || value == "FALSE":
+		boolValue := value == "TRUE"
+		cell.BoolValue = &boolValue
+	default:
+		if number, err := strconv.ParseFloat(value, 64); err == nil && numericCellPattern.MatchString(value) {
+			cell.NumberValue = &number
+		} else {
+			cell.StringValue = &value
+		}
+	}
+	return &sheets.CellData{UserEnteredValue: cell}
+}
+
+func (gs *GoogleSheetSource) DeleteRow(ctx context.Context, rowNumber int) error {
+	properties, err := gs.sheetProperties(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Create a delete dimension request
+	deleteRequest := &sheets.Request{
+		DeleteDimension: &sheets.DeleteDimensionRequest{
+			Range: &sheets.DimensionRange{
+				SheetId:    properties.SheetId,
+				Dimension:  "ROWS",
+				StartIndex: int64(rowNumber - 1), // Convert to 0-based index
+				EndIndex:   int64(rowNumber),     // End is exclusive
+			},
+		},
+	}
+
+	batchUpdateRequest := &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{deleteRequest},
+	}
+
+	if err := gs.quota.WaitWrite(ctx, gs.spreadsheetID); err != nil {
+		return err
+	}
+
+	_, err = gs.srv.Spreadsheets.BatchUpdate(gs.spreadsheetID, batchUpdateRequest).Context(ctx).Do()
+
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// sheetsQuotaBurst is how many calls a spreadsheet may make at once before being paced
+const sheetsQuotaBurst = 10
+
+// SheetsQuota paces Google Sheets API calls per spreadsheet so that bulk write-back stays
+// within the API's per-minute read and write quotas. Calls wait for a token instead of
+// being rejected.
+type SheetsQuota struct {
+	reads  *RateLimiter
+	writes *RateLimiter
+}
+
+// NewSheetsQuota creates per-spreadsheet read and write token buckets
+func NewSheetsQuota(readsPerMinute, writesPerMinute int) *SheetsQuota {
+	quota := &SheetsQuota{
+		reads:  NewRateLimiter(readsPerMinute, sheetsQuotaBurst),
+		writes: NewRateLimiter(writesPerMinute, sheetsQuotaBurst),
+	}
+	quota.reads.StartCleanupRoutine()
+	quota.writes.StartCleanupRoutine()
+	return quota
+}
+
+// WaitRead blocks until the spreadsheet may make another read call
+func (q *SheetsQuota) WaitRead(ctx context.Context, spreadsheetID string) error {
+	if q == nil {
+		return nil
+	}
+	return waitForToken(ctx, q.reads, spreadsheetID)
+}
+
+// WaitWrite blocks until the spreadsheet may make another write call
+func (q *SheetsQuota) WaitWrite(ctx context.Context, spreadsheetID string) error {
+	if q == nil {
+		return nil
+	}
+	return waitForToken(ctx, q.writes, spreadsheetID)
+}
+
+// waitForToken takes a token from the key's bucket, waiting for a refill while it is empty
+func waitForToken(ctx context.Context, limiter *RateLimiter, key string) error {
+	for !limiter.Allow(key) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(limiter.rate):
+		}
+	}
+	return nil
+}
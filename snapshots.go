@@ -0,0 +1,767 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Snapshot reason constants
+const (
+	SnapshotReasonImport    = "import"    // taken before an import replaced the rows
+	SnapshotReasonScheduled = "scheduled" // taken by the snapshot scheduler
+	SnapshotReasonRestore   = "restore"   // taken before another snapshot was restored over the rows
+	SnapshotReasonDelete    = "delete"    // taken before the directory was deleted; kept on disk only
+	SnapshotReasonSchema    = "schema"    // taken before a schema change migrated the directory table
+)
+
+const (
+	snapshotTimeout = 10 * time.Minute
+
+	// The backup copies this many pages at a time and pauses in between, so that writers
+	// aren't locked out of a large directory for the whole copy
+	snapshotStepPages = 256
+	snapshotStepPause = 10 * time.Millisecond
+)
+
+// errSnapshotNotFound is returned for a snapshot that doesn't exist or belongs to another directory
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot is a copy of a directory database taken with the SQLite online backup API. Snapshots
+// are kept next to the directory databases, in snapshots/<directory ID>/.
+type Snapshot struct {
+	ID          int64     `json:"id"`
+	DirectoryID string    `json:"directory_id"`
+	Reason      string    `json:"reason"`
+	RowCount    int       `json:"row_count"`
+	SizeBytes   int64     `json:"size_bytes"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	path        string
+	fingerprint string // hash of the directory's columns and rows, see directoryFingerprint
+}
+
+// SnapshotRow is a directory row as stored in a snapshot
+type SnapshotRow struct {
+	Key      string            `json:"key"`
+	SheetRow int               `json:"sheet_row"`
+	Values   map[string]string `json:"values"`
+}
+
+// SnapshotRowChange is a row whose values differ between two snapshots, with only the
+// columns that changed
+type SnapshotRowChange struct {
+	Key       string            `json:"key"`
+	SheetRow  int               `json:"sheet_row"` // in the newer snapshot
+	OldValues map[string]string `json:"old_values"`
+	NewValues map[string]string `json:"new_values"`
+}
+
+// SnapshotDiff compares the rows of two snapshots. Rows are matched by their row key, or by
+// their row ID in directories without row keys (prefixed with #). Row IDs survive imports
+// but not a change of header, after which every row shows as removed and added again.
+type SnapshotDiff struct {
+	From           *Snapshot           `json:"from"`
+	To             *Snapshot           `json:"to,omitempty"` // nil for the directory as it is now
+	ColumnsAdded   []string            `json:"columns_added"`
+	ColumnsRemoved []string            `json:"columns_removed"`
+	Added          []SnapshotRow       `json:"added"`
+	Removed        []SnapshotRow       `json:"removed"`
+	Changed        []SnapshotRowChange `json:"changed"`
+	Unchanged      int                 `json:"unchanged"`
+}
+
+// SnapshotRestoreResult reports a restore, with the snapshot taken of the rows it replaced so
+// that it can be undone
+type SnapshotRestoreResult struct {
+	Restored *Snapshot `json:"restored"`
+	Previous *Snapshot `json:"previous,omitempty"`
+}
+
+// SnapshotScheduler periodically snapshots every directory whose rows changed since its last
+// snapshot
+type SnapshotScheduler struct {
+	app      *App
+	interval time.Duration
+}
+
+// NewSnapshotScheduler creates a scheduler that snapshots every interval
+func NewSnapshotScheduler(app *App, interval time.Duration) *SnapshotScheduler {
+	return &SnapshotScheduler{app: app, interval: interval}
+}
+
+// Start begins taking snapshots in the background
+func (ss *SnapshotScheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(ss.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ss.snapshotAll()
+		}
+	}()
+}
+
+// snapshotAll snapshots each directory in turn
+func (ss *SnapshotScheduler) snapshotAll() {
+	rows, err := ss.app.DB.Query("SELECT id FROM directories ORDER BY id")
+	if err != nil {
+		log.Printf("Failed to list directories to snapshot: %v", err)
+		return
+	}
+
+	var directoryIDs []string
+	for rows.Next() {
+		var directoryID string
+		if err := rows.Scan(&directoryID); err != nil {
+			log.Printf("Failed to scan directory to snapshot: %v", err)
+			continue
+		}
+		directoryIDs = append(directoryIDs, directoryID)
+	}
+	rows.Close()
+
+	for _, directoryID := range directoryIDs {
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		_, err := ss.app.snapshotDirectory(ctx, directoryID, SnapshotReasonScheduled, "")
+		cancel()
+		if err != nil {
+			log.Printf("Scheduled snapshot of directory %s failed: %v", directoryID, err)
+		}
+	}
+}
+
+// backupDatabase copies the whole of src over dst with the SQLite online backup API. Writes
+// made to src by other connections while it runs restart the copy, so dst always ends up
+// with a consistent state of src.
+func backupDatabase(ctx context.Context, dst, src *sql.DB) error {
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup destination: %v", err)
+	}
+	defer dstConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup source: %v", err)
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			dstSQLite, ok := dstDriver.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return fmt.Errorf("online backup needs SQLite connections")
+			}
+
+			backup, err := dstSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %v", err)
+			}
+
+			// Busy or locked steps report not done without an error and are simply retried
+			for {
+				done, err := backup.Step(snapshotStepPages)
+				if err != nil {
+					backup.Close()
+					return fmt.Errorf("backup failed: %v", err)
+				}
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					backup.Close()
+					return ctx.Err()
+				case <-time.After(snapshotStepPause):
+				}
+			}
+
+			if err := backup.Finish(); err != nil {
+				return fmt.Errorf("failed to finish backup: %v", err)
+			}
+			return nil
+		})
+	})
+}
+
+// openSnapshot opens a snapshot file read-only
+func openSnapshot(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("snapshot file is missing: %v", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %v", err)
+	}
+	return db, nil
+}
+
+// directoryFingerprint hashes a directory's columns and every stored field of its rows, and
+// counts the rows. The fingerprint is empty for a directory that was never imported.
+func directoryFingerprint(q queryer, directoryID string) (string, int, error) {
+	tables, err := q.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", directoryID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to look up directory table: %v", err)
+	}
+	hasTable := tables.Next()
+	tables.Close()
+	if !hasTable {
+		return "", 0, nil
+	}
+
+	columns, err := loadDirectoryColumns(q, directoryID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := sha256.New()
+	// Each field is written with its length, so that no two different rows hash alike
+	write := func(field string) {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		hash.Write(length[:])
+		hash.Write([]byte(field))
+	}
+	for _, column := range columns {
+		write(column.Name)
+		write(column.Type)
+	}
+
+	rows, err := q.Query(fmt.Sprintf("SELECT * FROM '%s' ORDER BY rowID", directoryID))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read directory rows: %v", err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read directory rows: %v", err)
+	}
+	for _, name := range names {
+		write(name)
+	}
+
+	count := 0
+	values := make([]sql.NullString, len(names))
+	targets := make([]interface{}, len(names))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(targets...); err != nil {
+			return "", 0, fmt.Errorf("failed to scan directory row: %v", err)
+		}
+		for _, value := range values {
+			if value.Valid {
+				write("v" + value.String)
+			} else {
+				write("")
+			}
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, fmt.Errorf("failed to read directory rows: %v", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), count, nil
+}
+
+// snapshotDirectory copies a directory database into a new snapshot. When the rows are the
+// same as in the directory's latest snapshot, that snapshot is returned instead of keeping
+// another copy; a directory that was never imported has nothing to snapshot, and gives nil.
+// Older snapshots taken for the same reason are pruned down to SNAPSHOT_KEEP.
+func (app *App) snapshotDirectory(ctx context.Context, directoryID, reason, createdBy string) (*Snapshot, error) {
+	directory, err := app.GetDirectory(directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory database: %v", err)
+	}
+
+	snapshotDir := filepath.Join(filepath.Dir(directory.DatabasePath), "snapshots", directoryID)
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+
+	createdAt := time.Now().UTC()
+	path := filepath.Join(snapshotDir, fmt.Sprintf("%s-%s.db", createdAt.Format("20060102T150405.000000000Z"), reason))
+	if err := app.copyDatabase(ctx, db, path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	// The copy is fingerprinted rather than the live database, which may have moved on since
+	snapshotDB, err := openSnapshot(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	fingerprint, rowCount, err := directoryFingerprint(snapshotDB, directoryID)
+	snapshotDB.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	latest, err := app.latestSnapshot(directoryID)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if fingerprint == "" || (latest != nil && latest.fingerprint == fingerprint) {
+		os.Remove(path)
+		return latest, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to inspect snapshot: %v", err)
+	}
+
+	snapshot := &Snapshot{
+		DirectoryID: directoryID,
+		Reason:      reason,
+		RowCount:    rowCount,
+		SizeBytes:   info.Size(),
+		CreatedBy:   createdBy,
+		CreatedAt:   createdAt,
+		path:        path,
+		fingerprint: fingerprint,
+	}
+	result, err := app.DB.Exec(`
+		INSERT INTO directory_snapshots (directory_id, reason, path, fingerprint, row_count, size_bytes, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, directoryID, reason, path, fingerprint, rowCount, snapshot.SizeBytes, createdBy, createdAt)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to record snapshot: %v", err)
+	}
+	if snapshot.ID, err = result.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("failed to get snapshot ID: %v", err)
+	}
+
+	if err := app.pruneSnapshots(directoryID, reason); err != nil {
+		log.Printf("Failed to prune snapshots of directory %s: %v", directoryID, err)
+	}
+
+	return snapshot, nil
+}
+
+// pruneSnapshots deletes a directory's oldest snapshots taken for a reason, beyond the number kept
+func (app *App) pruneSnapshots(directoryID, reason string) error {
+	rows, err := app.DB.Query(`
+		SELECT id, path FROM directory_snapshots
+		WHERE directory_id = ? AND reason = ?
+		ORDER BY id DESC LIMIT -1 OFFSET ?
+	`, directoryID, reason, app.Config.SnapshotKeep)
+	if err != nil {
+		return fmt.Errorf("failed to list old snapshots: %v", err)
+	}
+
+	paths := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan old snapshot: %v", err)
+		}
+		paths[id] = path
+	}
+	rows.Close()
+
+	for id, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete snapshot file %s: %v", path, err)
+		}
+		if _, err := app.DB.Exec("DELETE FROM directory_snapshots WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete snapshot %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+const snapshotColumns = `id, directory_id, reason, path, fingerprint, row_count, size_bytes, COALESCE(created_by, ''), created_at`
+
+func scanSnapshot(scanner rowScanner) (*Snapshot, error) {
+	var snapshot Snapshot
+	err := scanner.Scan(&snapshot.ID, &snapshot.DirectoryID, &snapshot.Reason, &snapshot.path, &snapshot.fingerprint,
+		&snapshot.RowCount, &snapshot.SizeBytes, &snapshot.CreatedBy, &snapshot.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// listSnapshots returns a directory's snapshots, newest first
+func (app *App) listSnapshots(directoryID string) ([]Snapshot, error) {
+	rows, err := app.DB.Query(`SELECT `+snapshotColumns+` FROM directory_snapshots
+		WHERE directory_id = ? ORDER BY id DESC`, directoryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshots: %v", err)
+	}
+	defer rows.Close()
+
+	snapshots := []Snapshot{}
+	for rows.Next() {
+		snapshot, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %v", err)
+		}
+		snapshots = append(snapshots, *snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+// getSnapshot returns one of a directory's snapshots
+func (app *App) getSnapshot(directoryID string, snapshotID int64) (*Snapshot, error) {
+	row := app.DB.QueryRow(`SELECT `+snapshotColumns+` FROM directory_snapshots
+		WHERE id = ? AND directory_id = ?`, snapshotID, directoryID)
+
+	snapshot, err := scanSnapshot(row)
+	if err == sql.ErrNoRows {
+		return nil, errSnapshotNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// latestSnapshot returns a directory's most recent snapshot, or nil if it has none
+func (app *App) latestSnapshot(directoryID string) (*Snapshot, error) {
+	row := app.DB.QueryRow(`SELECT `+snapshotColumns+` FROM directory_snapshots
+		WHERE directory_id = ? ORDER BY id DESC LIMIT 1`, directoryID)
+
+	snapshot, err := scanSnapshot(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query latest snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// readSnapshotRows reads a directory's columns and rows, in sheet order, from a snapshot or
+// from the live database
+func readSnapshotRows(q queryer, directoryID string) ([]string, []SnapshotRow, error) {
+	columns, err := loadDirectoryColumns(q, directoryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+
+	tables, err := q.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", directoryID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up directory table: %v", err)
+	}
+	hasTable := tables.Next()
+	tables.Close()
+	if !hasTable {
+		return names, nil, nil
+	}
+
+	selects := []string{"rowID", "COALESCE(_sheetRow, 0)", "COALESCE(_rowKey, '')"}
+	for _, name := range names {
+		selects = append(selects, fmt.Sprintf("COALESCE([%s], '')", name))
+	}
+	rows, err := q.Query(fmt.Sprintf("SELECT %s FROM '%s' ORDER BY COALESCE(_sheetRow, 0), rowID",
+		strings.Join(selects, ", "), directoryID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read directory rows: %v", err)
+	}
+	defer rows.Close()
+
+	var result []SnapshotRow
+	cells := make([]string, len(names))
+	for rows.Next() {
+		var rowID int64
+		var row SnapshotRow
+		targets := []interface{}{&rowID, &row.SheetRow, &row.Key}
+		for i := range cells {
+			targets = append(targets, &cells[i])
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan directory row: %v", err)
+		}
+		if row.Key == "" {
+			row.Key = "#" + strconv.FormatInt(rowID, 10)
+		}
+		row.Values = make(map[string]string, len(names))
+		for i, name := range names {
+			row.Values[name] = cells[i]
+		}
+		result = append(result, row)
+	}
+	return names, result, rows.Err()
+}
+
+// diffSnapshotRows compares the rows read from two snapshots
+func diffSnapshotRows(fromColumns []string, fromRows []SnapshotRow, toColumns []string, toRows []SnapshotRow) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		ColumnsAdded:   []string{},
+		ColumnsRemoved: []string{},
+		Added:          []SnapshotRow{},
+		Removed:        []SnapshotRow{},
+		Changed:        []SnapshotRowChange{},
+	}
+
+	inFrom := make(map[string]bool, len(fromColumns))
+	for _, name := range fromColumns {
+		inFrom[name] = true
+	}
+	inTo := make(map[string]bool, len(toColumns))
+	for _, name := range toColumns {
+		inTo[name] = true
+		if !inFrom[name] {
+			diff.ColumnsAdded = append(diff.ColumnsAdded, name)
+		}
+	}
+	for _, name := range fromColumns {
+		if !inTo[name] {
+			diff.ColumnsRemoved = append(diff.ColumnsRemoved, name)
+		}
+	}
+
+	previous := make(map[string]SnapshotRow, len(fromRows))
+	for _, row := range fromRows {
+		previous[row.Key] = row
+	}
+
+	matched := make(map[string]bool, len(toRows))
+	for _, row := range toRows {
+		old, ok := previous[row.Key]
+		if !ok {
+			diff.Added = append(diff.Added, row)
+			continue
+		}
+		matched[row.Key] = true
+
+		// Added and removed columns are reported once above rather than on every row
+		change := SnapshotRowChange{Key: row.Key, SheetRow: row.SheetRow,
+			OldValues: map[string]string{}, NewValues: map[string]string{}}
+		for _, name := range toColumns {
+			if inFrom[name] && old.Values[name] != row.Values[name] {
+				change.OldValues[name] = old.Values[name]
+				change.NewValues[name] = row.Values[name]
+			}
+		}
+		if len(change.NewValues) > 0 {
+			diff.Changed = append(diff.Changed, change)
+		} else {
+			diff.Unchanged++
+		}
+	}
+
+	for _, row := range fromRows {
+		if !matched[row.Key] {
+			diff.Removed = append(diff.Removed, row)
+		}
+	}
+
+	return diff
+}
+
+// diffSnapshots compares two of a directory's snapshots row by row; toID 0 compares with the
+// directory as it is now
+func (app *App) diffSnapshots(directoryID string, fromID, toID int64) (*SnapshotDiff, error) {
+	from, err := app.getSnapshot(directoryID, fromID)
+	if err != nil {
+		return nil, err
+	}
+	fromDB, err := openSnapshot(from.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fromDB.Close()
+
+	fromColumns, fromRows, err := readSnapshotRows(fromDB, directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	var to *Snapshot
+	var toDB *sql.DB
+	if toID == 0 {
+		if toDB, err = app.DirectoryDBManager.GetDirectoryDB(directoryID); err != nil {
+			return nil, fmt.Errorf("failed to get directory database: %v", err)
+		}
+	} else {
+		if to, err = app.getSnapshot(directoryID, toID); err != nil {
+			return nil, err
+		}
+		if toDB, err = openSnapshot(to.path); err != nil {
+			return nil, err
+		}
+		defer toDB.Close()
+	}
+
+	toColumns, toRows, err := readSnapshotRows(toDB, directoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := diffSnapshotRows(fromColumns, fromRows, toColumns, toRows)
+	diff.From = from
+	diff.To = to
+	return diff, nil
+}
+
+// restoreSnapshot copies a snapshot back over a directory database, after snapshotting the
+// rows it replaces. Rows still in the directory's source come back with its next sync, so a
+// bad import should be fixed in the source too.
+func (app *App) restoreSnapshot(ctx context.Context, directoryID string, snapshotID int64, userEmail string) (*SnapshotRestoreResult, error) {
+	snapshot, err := app.getSnapshot(directoryID, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep imports and write-back off the directory while its database is replaced
+	unlock := lockDirectorySync(directoryID)
+	defer unlock()
+
+	previous, err := app.snapshotDirectory(ctx, directoryID, SnapshotReasonRestore, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot directory before restoring: %v", err)
+	}
+
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory database: %v", err)
+	}
+
+	snapshotDB, err := openSnapshot(snapshot.path)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshotDB.Close()
+
+	if err := backupDatabase(ctx, db, snapshotDB); err != nil {
+		return nil, fmt.Errorf("failed to restore snapshot %d: %v", snapshotID, err)
+	}
+
+	// The snapshot may have been taken by a build with or without FTS5
+	if err := app.indexSearch(directoryID); err != nil {
+		return nil, fmt.Errorf("failed to rebuild search index: %v", err)
+	}
+
+	return &SnapshotRestoreResult{Restored: snapshot, Previous: previous}, nil
+}
+
+// snapshotIDParam parses a snapshot ID query parameter
+func snapshotIDParam(r *http.Request, name string) (int64, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid snapshot ID %q", param)
+	}
+	return id, nil
+}
+
+// handleListSnapshots lists the directory's snapshots, newest first
+func (app *App) handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	snapshots, err := app.listSnapshots(directoryID)
+	if err != nil {
+		log.Printf("Failed to list snapshots of directory %s: %v", directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	utils2.RespondWithSuccess(w, snapshots, "")
+}
+
+// handleDiffSnapshots compares two snapshots row by row. Pass ?from=<snapshot ID> and
+// ?to=<snapshot ID>, or leave out to to compare with the directory as it is now.
+func (app *App) handleDiffSnapshots(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	fromID, err := snapshotIDParam(r, "from")
+	if err != nil {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+	if fromID == 0 {
+		utils2.ValidationError(w, "from is required")
+		return
+	}
+	toID, err := snapshotIDParam(r, "to")
+	if err != nil {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+
+	diff, err := app.diffSnapshots(directoryID, fromID, toID)
+	if errors.Is(err, errSnapshotNotFound) {
+		utils2.NotFoundError(w, "Snapshot")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to diff snapshots of directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to compare snapshots")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, diff, "")
+}
+
+// handleRestoreSnapshot restores the directory to one of its snapshots
+func (app *App) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+	userEmail, _ := utils2.GetUserEmail(r)
+
+	var req struct {
+		SnapshotID int64 `json:"snapshot_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	result, err := app.restoreSnapshot(ctx, directoryID, req.SnapshotID, userEmail)
+	if errors.Is(err, errSnapshotNotFound) {
+		utils2.NotFoundError(w, "Snapshot")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore snapshot %d of directory %s: %v", req.SnapshotID, directoryID, err)
+		utils2.InternalServerError(w, "Failed to restore snapshot")
+		return
+	}
+
+	log.Printf("User %s restored directory %s to snapshot %d", userEmail, directoryID, req.SnapshotID)
+	utils2.RespondWithSuccess(w, result, "Directory restored")
+}
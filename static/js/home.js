@@ -1,4 +1,3 @@
-let db;
 let directoryData = [];
 let columnNames = [];
 let columnTypes = [];
@@ -9,7 +8,18 @@ let csrfToken = null;
 let deleteRowIndex = -1;
 let currentDirectoryID = 'default';
 let formControlGenerator = null;
-let filteredData = [];
+let totalRows = 0;
+let unfilteredTotal = 0;
+let nextCursor = null;
+let queryGeneration = 0;
+
+// Rows are fetched from the server a page at a time, filtered and searched there
+const pageSize = 100;
+let currentQuery = {
+    filters: [],
+    search: '',
+    search_columns: []
+};
 
 // Get directory ID from URL parameters
 function getCurrentDirectoryID() {
@@ -39,159 +49,136 @@ function getCSRFToken() {
 csrfToken = getCSRFToken();
 currentDirectoryID = getCurrentDirectoryID();
 
-// Initialize SQL.js and load the database
-initSqlJs({
-    locateFile: file => `https://cdnjs.cloudflare.com/ajax/libs/sql.js/1.8.0/${file}`
-}).then(function(SQL){
-    loadUserDirectories();
-    loadDirectory();
-});
+loadUserDirectories();
+loadDirectory();
 
 async function loadDirectory() {
     try {
-        // Load column metadata first
-        await loadColumnMetadata();
-        
-        const response = await fetch(buildAPIURL('/download/directory.db'), {
-            method: 'GET',
-            credentials: 'same-origin'
-        });
-        if (!response.ok) {
-            if (response.status === 401 || response.status === 403) {
-                document.getElementById('loading').textContent = 'Access denied. Please login to view the directory.';
-            } else if (response.status === 404) {
-                document.getElementById('loading').textContent = 'Directory not found. Please check the URL or contact the administrator.';
-            } else {
-                document.getElementById('loading').textContent = 'No directory data available yet. Please check with the administrator.';
-            }
+        const result = await queryDirectory(null);
+        if (!result) {
             return;
         }
         
-        const arrayBuffer = await response.arrayBuffer();
-        const uInt8Array = new Uint8Array(arrayBuffer);
+        columnNames = result.columns.map(column => column.name);
+        columnTypes = result.columns.map(column => column.type);
+        unfilteredTotal = result.total;
         
-        const SQL = await initSqlJs({
-            locateFile: file => `https://cdnjs.cloudflare.com/ajax/libs/sql.js/1.8.0/${file}`
-        });
+        // Generate filtering controls if we have column types
+        generateFilteringControls();
         
-        db = new SQL.Database(uInt8Array);
+        showQueryResult(result, false);
         
-        loadDirectoryData();
+        document.getElementById('directoryTable').style.display = 'table';
         
     } catch (error) {
-        console.error('Error loading database:', error);
+        console.error('Error loading directory:', error);
         const errorMessage = error.message || 'Unknown error';
         document.getElementById('loading').textContent = `Error loading directory data: ${errorMessage}`;
     }
 }
 
-async function loadColumnMetadata() {
-    try {
-        // Load column metadata from the _meta_directory_column_types table
-        const response = await fetch(buildAPIURL('/download/directory.db'), {
-            method: 'GET',
-            credentials: 'same-origin'
-        });
-        if (!response.ok) {
-            columnNames = [];
-            columnTypes = [];
-            return;
+// Fetch the page of rows after the cursor, or the first page, matching the current filters and search
+async function queryDirectory(cursor) {
+    const response = await fetch(buildAPIURL('/api/directory/query'), {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        credentials: 'same-origin',
+        body: JSON.stringify({
+            ...currentQuery,
+            limit: pageSize,
+            cursor: cursor || ''
+        })
+    });
+    if (!response.ok) {
+        if (response.status === 401 || response.status === 403) {
+            document.getElementById('loading').textContent = 'Access denied. Please login to view the directory.';
+        } else if (response.status === 404) {
+            document.getElementById('loading').textContent = 'Directory not found. Please check the URL or contact the administrator.';
+        } else if (response.status === 400) {
+            const error = await response.json().catch(() => ({}));
+            showErrorMessage('Invalid filter: ' + (error.message || 'unknown error'));
+        } else {
+            document.getElementById('loading').textContent = 'No directory data available yet. Please check with the administrator.';
         }
-        
-        const arrayBuffer = await response.arrayBuffer();
-        const uInt8Array = new Uint8Array(arrayBuffer);
-        
-        const SQL = await initSqlJs({
-            locateFile: file => `https://cdnjs.cloudflare.com/ajax/libs/sql.js/1.8.0/${file}`
-        });
-        
-        const metaDb = new SQL.Database(uInt8Array);
-        
-        // Get column metadata for the current directory
-        const tableName = getCurrentDirectoryID();
-        const stmt = metaDb.prepare(`SELECT columnName, columnType FROM _meta_directory_column_types WHERE columnTable = ? ORDER BY columnName`);
-        stmt.bind([tableName]);
-        
-        const columns = [];
-        const types = [];
-        
-        while (stmt.step()) {
-            const row = stmt.getAsObject();
-            columns.push(row.columnName);
-            types.push(row.columnType);
+        return null;
+    }
+    
+    return response.json();
+}
+
+// Run the current filters and search again from the first page
+async function refreshDirectory() {
+    const generation = ++queryGeneration;
+    try {
+        const result = await queryDirectory(null);
+        // A newer search may have been started while this one ran
+        if (result && generation === queryGeneration) {
+            showQueryResult(result, false);
         }
-        
-        stmt.free();
-        metaDb.close();
-        
-        columnNames = columns;
-        columnTypes = types;
-        
     } catch (error) {
-        console.error('Error loading column metadata:', error);
-        columnNames = [];
-        columnTypes = [];
+        console.error('Error querying directory:', error);
+        showErrorMessage('Network error loading the directory. Please check your connection and try again.');
     }
 }
 
-function loadDirectoryData() {
+// Fetch the next page of the current results
+async function loadMoreRows() {
+    if (!nextCursor) {
+        return;
+    }
+    
+    const generation = queryGeneration;
     try {
-        const tableName = getCurrentDirectoryID();
-        
-        // Build dynamic SELECT statement using column names
-        let selectColumns;
-        if (columnNames.length > 0) {
-            selectColumns = columnNames.map(col => `\`${col}\``).join(', ');
-        } else {
-            selectColumns = '*';
+        const result = await queryDirectory(nextCursor);
+        if (result && generation === queryGeneration) {
+            showQueryResult(result, true);
         }
-        
-        const stmt = db.prepare(`SELECT ${selectColumns} FROM \`${tableName}\``);
-        const rows = [];
-        
-        while (stmt.step()) {
-            const row = stmt.getAsObject();
-            // Convert row object to array format for compatibility with existing rendering code
-            const dataArray = columnNames.length > 0 
-                ? columnNames.map(col => row[col] || '')
-                : Object.values(row);
-            
-            rows.push({
-                id: rows.length, // Use array index as ID since we don't have a dedicated ID column
-                data: dataArray
-            });
-        }
-        
-        stmt.free();
-        
-        directoryData = rows;
-        filteredData = [...rows]; // Initialize filtered data
-        
-        // Generate filtering controls if we have column types
-        generateFilteringControls();
-        
-        renderTable();
-        
-        document.getElementById('loading').style.display = 'none';
-        document.getElementById('directoryTable').style.display = 'table';
-        
-        updateRecordCount();
-        
     } catch (error) {
-        console.error('Error processing directory data:', error);
-        document.getElementById('loading').textContent = 'Error processing directory data.';
+        console.error('Error loading more rows:', error);
+        showErrorMessage('Network error loading more rows. Please check your connection and try again.');
     }
 }
 
+// Show a page of query results, replacing the rows shown or after them
+function showQueryResult(result, append) {
+    directoryData = append ? directoryData.concat(result.rows) : result.rows;
+    totalRows = result.total;
+    nextCursor = result.next_cursor || null;
+    
+    renderTable();
+    updateRecordCount();
+    updateLoadMoreButton();
+}
+
+// Show the load more button below the table while there are more pages
+function updateLoadMoreButton() {
+    let button = document.getElementById('loadMoreBtn');
+    if (!button) {
+        button = document.createElement('button');
+        button.id = 'loadMoreBtn';
+        button.className = 'btn btn-secondary';
+        button.textContent = 'Load more';
+        button.addEventListener('click', loadMoreRows);
+        document.getElementById('directoryTable').after(button);
+    }
+    button.style.display = nextCursor ? 'block' : 'none';
+}
+
 function renderTable() {
-    renderFilteredTable(filteredData.length > 0 ? filteredData : directoryData);
+    renderFilteredTable(directoryData);
 }
 
 function renderFilteredTable(dataToRender) {
+    const loading = document.getElementById('loading');
     if (!dataToRender || dataToRender.length === 0) {
-        document.getElementById('loading').textContent = 'No directory entries found.';
+        document.getElementById('tableBody').innerHTML = '';
+        loading.textContent = 'No directory entries found.';
+        loading.style.display = 'block';
         return;
     }
+    loading.style.display = 'none';
     
     // Determine the maximum number of columns
     maxColumns = columnNames.length > 0 ? columnNames.length : 0;
@@ -226,19 +213,19 @@ function renderFilteredTable(dataToRender) {
     const tbody = document.getElementById('tableBody');
     tbody.innerHTML = '';
     
-    dataToRender.forEach((entry, rowIndex) => {
+    dataToRender.forEach(entry => {
         const tr = document.createElement('tr');
         
         for (let colIndex = 0; colIndex < maxColumns; colIndex++) {
             const td = document.createElement('td');
             const cellValue = entry.data[colIndex] || '';
             td.textContent = cellValue;
-            td.dataset.row = rowIndex;
+            td.dataset.row = entry.index;
             td.dataset.col = colIndex;
             
-            // Add click handler for corrections
+            // Add click handler for corrections, which refer to the row by its index in the whole directory
             td.addEventListener('click', function() {
-                openCorrectionModal(rowIndex, colIndex, cellValue);
+                openCorrectionModal(entry.index, colIndex, cellValue);
             });
             
             tr.appendChild(td);
@@ -254,7 +241,7 @@ function renderFilteredTable(dataToRender) {
         deleteBtn.title = 'Delete this row';
         deleteBtn.addEventListener('click', function(e) {
             e.stopPropagation();
-            openDeleteModal(rowIndex, entry.data);
+            openDeleteModal(entry.index, entry.data);
         });
         
         deleteCell.appendChild(deleteBtn);
@@ -265,15 +252,20 @@ function renderFilteredTable(dataToRender) {
 }
 
 function updateRecordCount() {
-    const displayCount = filteredData.length;
-    const totalCount = directoryData.length;
+    const recordCount = document.getElementById('recordCount');
+    if (!recordCount) {
+        return;
+    }
     
-    let countText = `${displayCount} records`;
-    if (displayCount !== totalCount) {
-        countText += ` (filtered from ${totalCount} total)`;
+    let countText = `${totalRows} records`;
+    if (directoryData.length < totalRows) {
+        countText = `${directoryData.length} of ${countText}`;
+    }
+    if (totalRows !== unfilteredTotal) {
+        countText += ` (filtered from ${unfilteredTotal} total)`;
     }
     
-    document.getElementById('recordCount').textContent = countText;
+    recordCount.textContent = countText;
 }
 
 function openCorrectionModal(row, col, currentValue) {
@@ -599,12 +591,8 @@ function applyFilters() {
         return;
     }
     
-    const filterValues = formControlGenerator.getAllValues();
-    filteredData = directoryData.filter(row => {
-        return matchesFilters(row, filterValues);
-    });
-    
-    renderTable();
+    currentQuery.filters = buildQueryFilters(formControlGenerator.getAllValues());
+    refreshDirectory();
 }
 
 // Clear all filters
@@ -614,101 +602,82 @@ function clearFilters() {
         generateFilteringControls();
     }
     
-    filteredData = [...directoryData];
-    renderTable();
-    
     // Clear search box as well
     const searchBox = document.getElementById('searchBox');
     if (searchBox) {
         searchBox.value = '';
     }
+    
+    currentQuery.filters = [];
+    currentQuery.search = '';
+    refreshDirectory();
 }
 
-// Check if a row matches the current filters
-function matchesFilters(row, filterValues) {
+// Convert the filtering controls' values into the column filters of the query API
+function buildQueryFilters(filterValues) {
+    const filterTypes = {
+        tag: 'tags',
+        category: 'categories',
+        location: 'locations'
+    };
+    const filters = [];
+    
     for (const [columnName, filterData] of Object.entries(filterValues.controls)) {
-        const columnIndex = columnNames.indexOf(columnName);
-        if (columnIndex === -1) continue;
-        
-        const cellValue = row.data[columnIndex] || '';
+        const column = { type: 'single', value: columnName };
         
         switch (filterData.type) {
             case 'tag':
             case 'category':
             case 'location':
                 if (filterData.value && filterData.value.length > 0) {
-                    const cellTags = cellValue.split(',').map(tag => tag.trim().toLowerCase());
-                    const filterTags = filterData.value.map(tag => tag.toLowerCase());
-                    const hasMatch = filterTags.some(filterTag => 
-                        cellTags.some(cellTag => cellTag.includes(filterTag))
-                    );
-                    if (!hasMatch) return false;
+                    filters.push({
+                        column: column,
+                        filter: { type: filterTypes[filterData.type], values: [].concat(filterData.value) }
+                    });
                 }
                 break;
                 
             case 'numeric':
-                const numValue = parseFloat(cellValue);
-                if (!isNaN(numValue) && filterData.value) {
-                    if (filterData.value.min !== null && numValue < filterData.value.min) {
-                        return false;
-                    }
-                    if (filterData.value.max !== null && numValue > filterData.value.max) {
-                        return false;
-                    }
+                const value = filterData.value || {};
+                const hasMin = value.min !== null && value.min !== undefined;
+                const hasMax = value.max !== null && value.max !== undefined;
+                let range = null;
+                if (hasMin && hasMax) {
+                    range = { type: 'between', min: value.min, max: value.max };
+                } else if (hasMin) {
+                    range = { type: 'above', threshold: value.min };
+                } else if (hasMax) {
+                    range = { type: 'below', threshold: value.max };
+                }
+                if (range) {
+                    filters.push({
+                        column: column,
+                        filter: { type: 'numeric_range', range: range }
+                    });
                 }
                 break;
         }
     }
     
-    return true;
+    return filters;
 }
 
-// Update search to use debounced function and work with filtered data
-// Search only applies to basic fields (non-control fields)
+// Update search to use debounced function and run on the server with the current filters
+// Search only applies to basic fields (non-control fields), or to every field if there are none
 const debouncedSearch = debounce(function(searchTerm) {
-    if (searchTerm.trim() === '') {
-        // If no search term, show all filtered data
-        renderFilteredTable(filteredData);
-        return;
-    }
-    
-    // Get basic field indices (fields that don't have special controls)
-    const basicFieldIndices = [];
-    if (formControlGenerator && formControlGenerator.basicFields) {
-        formControlGenerator.basicFields.forEach(fieldName => {
-            const index = columnNames.indexOf(fieldName);
-            if (index !== -1) {
-                basicFieldIndices.push(index);
-            }
-        });
-    }
-    
-    // If no basic fields are defined, fall back to searching all fields
-    if (basicFieldIndices.length === 0) {
-        const searchFiltered = filteredData.filter(row => {
-            return row.data.some(cellValue => {
-                return cellValue && cellValue.toString().toLowerCase().includes(searchTerm);
-            });
-        });
-        renderFilteredTable(searchFiltered);
-        return;
-    }
-    
-    // Filter the already filtered data by search term, but only in basic fields
-    const searchFiltered = filteredData.filter(row => {
-        return basicFieldIndices.some(columnIndex => {
-            const cellValue = row.data[columnIndex];
-            return cellValue && cellValue.toString().toLowerCase().includes(searchTerm);
-        });
-    });
-    
-    renderFilteredTable(searchFiltered);
+    currentQuery.search = searchTerm.trim();
+    currentQuery.search_columns = formControlGenerator && formControlGenerator.basicFields
+        ? [...formControlGenerator.basicFields]
+        : [];
+    refreshDirectory();
 }, 300);
 
-document.getElementById('searchBox').addEventListener('input', function(e) {
-    const searchTerm = e.target.value.toLowerCase();
-    debouncedSearch(searchTerm);
-});
+const searchBox = document.getElementById('searchBox');
+if (searchBox) {
+    searchBox.addEventListener('input', function(e) {
+        debouncedSearch(e.target.value);
+    });
+}
 
 // Delete row functionality
 function openDeleteModal(rowIndex, rowData) {
@@ -112,10 +112,17 @@ function displayPendingChanges(changes) {
             html += '<div class="change-content">';
             html += '<strong>Row ID:</strong> ' + change.row_id + '<br>';
             html += '<strong>Column:</strong> ' + escapeHtml(change.column_name) + '<br>';
-            if (change.old_value) {
-                html += '<strong>Old Value:</strong> ' + escapeHtml(change.old_value) + '<br>';
+            if (change.change_type === 'conflict') {
+                html += '<strong>Original Value:</strong> ' + escapeHtml(change.old_value) + '<br>';
+                html += '<strong>Value Now in Sheet:</strong> ' + escapeHtml(change.sheet_value) + '<br>';
+                html += '<strong>Proposed Value:</strong> ' + escapeHtml(change.new_value) + '<br>';
+                html += '<em>The sheet was edited after this change was made. Approve to write the proposed value, reject to keep the sheet\'s value.</em>';
+            } else {
+                if (change.old_value) {
+                    html += '<strong>Old Value:</strong> ' + escapeHtml(change.old_value) + '<br>';
+                }
+                html += '<strong>New Value:</strong> ' + escapeHtml(change.new_value);
             }
-            html += '<strong>New Value:</strong> ' + escapeHtml(change.new_value);
             html += '</div>';
             
             html += '<div class="change-actions">';
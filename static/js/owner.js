@@ -6,13 +6,41 @@ if (!window.ownerConfig) {
     throw new Error('Configuration not found');
 }
 
-const { csrfToken, previewURL, importURL, ownerURL, directoryId } = window.ownerConfig;
+const { csrfToken, previewURL, importURL, validateImportURL, ownerURL, directoryId } = window.ownerConfig;
+
+// Set once the owner has seen the validation report for the current column settings
+let importValidated = false;
 
 // Sheet Import Functions
+document.getElementById('source_type').addEventListener('change', function() {
+    const isFile = this.value === 'file';
+    document.getElementById('sheetSourceFields').style.display = isFile ? 'none' : 'block';
+    document.getElementById('fileSourceFields').style.display = isFile ? 'block' : 'none';
+});
+
 document.getElementById('previewBtn').addEventListener('click', async function() {
+    const sourceType = document.getElementById('source_type').value;
     const sheetUrl = document.getElementById('sheet_url').value;
+    const filePath = document.getElementById('file_path').value;
+    const sheetTab = document.getElementById('sheet_tab').value;
+    const sheetRange = document.getElementById('sheet_range').value;
+    const extraTabs = document.getElementById('extra_tabs').value.split('\n')
+        .map(tab => tab.trim())
+        .filter(tab => tab !== '');
+    const header = {
+        header_row: parseInt(document.getElementById('header_row').value, 10) || 0,
+        header_lines: parseInt(document.getElementById('header_lines').value, 10) || 0,
+        skip_rows: parseInt(document.getElementById('skip_rows').value, 10) || 0,
+        footer_marker: document.getElementById('footer_marker').value.trim(),
+        merged_header: document.getElementById('merged_header').value
+    };
+    
+    if (sourceType === 'file' && !filePath) {
+        alert('Please enter a file path');
+        return;
+    }
     
-    if (!sheetUrl) {
+    if (sourceType !== 'file' && !sheetUrl) {
         alert('Please enter a Google Sheets URL');
         return;
     }
@@ -29,7 +57,13 @@ document.getElementById('previewBtn').addEventListener('click', async function()
             },
             credentials: 'same-origin',
             body: JSON.stringify({
-                sheet_url: sheetUrl
+                source_type: sourceType,
+                sheet_url: sheetUrl,
+                file_path: filePath,
+                sheet_tab: sheetTab,
+                extra_tabs: extraTabs,
+                sheet_range: sheetRange,
+                header: header
             })
         });
         
@@ -53,22 +87,52 @@ document.getElementById('confirmImport').addEventListener('click', async functio
     const form = document.getElementById('importForm');
     const formData = new FormData(form);
     
-    // Add column names and types from the preview section
+    // Add column settings from the preview section
     const previewContent = document.getElementById('previewContent');
     if (previewContent) {
-        // Get all column type selects and hidden column name inputs
-        const columnTypeSelects = previewContent.querySelectorAll('select[name^="column_type_"]');
-        const columnNameInputs = previewContent.querySelectorAll('input[name^="column_name_"]');
-        
-        columnTypeSelects.forEach(select => {
-            formData.append(select.name, select.value);
-        });
-        
-        columnNameInputs.forEach(input => {
-            formData.append(input.name, input.value);
+        previewContent.querySelectorAll('select[name^="column_"], input[name^="column_"]').forEach(input => {
+            if (input.type === 'checkbox') {
+                if (input.checked) {
+                    formData.append(input.name, 'on');
+                }
+            } else {
+                formData.append(input.name, input.value);
+            }
         });
     }
     
+    // Check every cell before anything is imported; the owner can still import anyway
+    if (!importValidated) {
+        this.textContent = 'Checking...';
+        this.disabled = true;
+        try {
+            const response = await fetch(validateImportURL, {
+                method: 'POST',
+                body: formData,
+                credentials: 'same-origin'
+            });
+            
+            if (!response.ok) {
+                alert('Validation failed: ' + await response.text());
+                return;
+            }
+            
+            const result = await response.json();
+            if (result.data.issue_count > 0) {
+                showValidationReport(result.data);
+                importValidated = true;
+                return;
+            }
+        } catch (error) {
+            console.error('Validation error:', error);
+            alert('Validation failed due to network error');
+            return;
+        } finally {
+            this.textContent = importValidated ? 'Import Anyway' : 'Confirm Import';
+            this.disabled = false;
+        }
+    }
+    
     try {
         const response = await fetch(importURL, {
             method: 'POST',
@@ -76,12 +140,11 @@ document.getElementById('confirmImport').addEventListener('click', async functio
             credentials: 'same-origin'
         });
         
-        if (response.redirected) {
-            // Follow the redirect manually
-            window.location.href = response.url;
-        } else if (response.ok) {
-            // If no redirect but successful, go to owner with success
-            window.location.href = ownerURL + '&imported=true';
+        if (response.ok) {
+            // The import runs in the background; follow its progress until it finishes
+            const result = await response.json();
+            document.getElementById('previewSection').style.display = 'none';
+            trackImportJob(result.data);
         } else {
             alert('Import failed: ' + await response.text());
         }
@@ -91,12 +154,133 @@ document.getElementById('confirmImport').addEventListener('click', async functio
     }
 });
 
+// Import Job Progress
+const importPhaseLabels = {
+    queued: 'Waiting for other syncs of this directory to finish',
+    reading: 'Reading the source',
+    row_keys: 'Adding row IDs to the source',
+    writing: 'Writing rows',
+    done: 'Finishing'
+};
+
+let importJobTimer = null;
+
+function trackImportJob(job) {
+    document.getElementById('importProgress').style.display = 'block';
+    document.getElementById('cancelImportJob').dataset.jobId = job.id;
+    showImportProgress(job);
+    if (job.status !== 'running') {
+        return;
+    }
+    
+    clearTimeout(importJobTimer);
+    importJobTimer = setTimeout(async function poll() {
+        try {
+            const response = await fetch('/api/import/jobs?dir=' + directoryId + '&id=' + job.id, {
+                credentials: 'same-origin'
+            });
+            if (response.ok) {
+                const result = await response.json();
+                job = result.data;
+                showImportProgress(job);
+                if (job.status !== 'running') {
+                    finishImportJob(job);
+                    return;
+                }
+            }
+        } catch (error) {
+            console.error('Error polling import job:', error);
+        }
+        importJobTimer = setTimeout(poll, 1000);
+    }, 1000);
+}
+
+function showImportProgress(job) {
+    const bar = document.getElementById('importProgressBar');
+    let text = importPhaseLabels[job.phase] || job.phase;
+    if (job.rows_read > 0) {
+        text += ' - ' + job.rows_written + ' of ' + job.rows_read + ' rows written';
+        bar.value = Math.round(100 * job.rows_written / job.rows_read);
+    } else {
+        bar.removeAttribute('value');
+    }
+    document.getElementById('importProgressText').textContent = text;
+}
+
+function finishImportJob(job) {
+    document.getElementById('importProgress').style.display = 'none';
+    if (job.status === 'completed') {
+        window.location.href = ownerURL + (ownerURL.includes('?') ? '&' : '?') + 'imported=true';
+    } else if (job.status === 'cancelled') {
+        alert('Import cancelled.');
+    } else {
+        alert('Import failed: ' + job.error);
+    }
+}
+
+document.getElementById('cancelImportJob').addEventListener('click', async function() {
+    const jobId = this.dataset.jobId;
+    this.disabled = true;
+    
+    try {
+        const response = await fetch('/api/import/jobs/cancel?dir=' + directoryId, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken
+            },
+            credentials: 'same-origin',
+            body: JSON.stringify({ job_id: parseInt(jobId, 10) })
+        });
+        
+        if (!response.ok) {
+            alert('Failed to cancel import: ' + await response.text());
+        }
+    } catch (error) {
+        console.error('Error cancelling import:', error);
+        alert('Network error occurred');
+    } finally {
+        this.disabled = false;
+    }
+});
+
+// Pick up an import that is still running, e.g. after the page was reloaded
+(async function() {
+    try {
+        const response = await fetch('/api/import/jobs?dir=' + directoryId, {
+            credentials: 'same-origin'
+        });
+        if (response.ok) {
+            const result = await response.json();
+            if (result.data && result.data.status === 'running') {
+                trackImportJob(result.data);
+            }
+        }
+    } catch (error) {
+        console.error('Error loading import job:', error);
+    }
+})();
+
 document.getElementById('cancelPreview').addEventListener('click', function() {
+    resetImportValidation();
     document.getElementById('previewSection').style.display = 'none';
     document.getElementById('previewBtn').style.display = 'inline-block';
     document.getElementById('importBtn').style.display = 'none';
 });
 
+// defaultNormalizers mirrors the normalisers the server gives each column type
+function defaultNormalizers(columnType) {
+    switch (columnType) {
+        case 'numeric':
+            return 'whitespace, number';
+        case 'tag':
+        case 'location':
+            return 'whitespace, dedupe_tags';
+        default:
+            return '';
+    }
+}
+
 function showPreview(preview) {
     const content = document.getElementById('previewContent');
     
@@ -123,19 +307,87 @@ function showPreview(preview) {
         html += '<option value="category"' + (preview.column_types[index] === 'category' ? ' selected' : '') + '>Category</option>';
         html += '</select>';
         html += '</div>';
+        html += '<div class="column-rules">';
+        html += '<label><input type="checkbox" name="column_required_' + index + '"> Required</label>';
+        html += '<input type="text" name="column_vocabulary_' + index + '" placeholder="Allowed categories, comma separated (optional)"' +
+            (preview.column_types[index] === 'category' ? '' : ' style="display:none;"') + '>';
+        html += '<input type="text" name="column_normalizers_' + index + '" value="' + defaultNormalizers(preview.column_types[index]) + '"' +
+            ' placeholder="Normalisers, comma separated (optional)"' +
+            ' title="whitespace, number, decimal_comma, lowercase, uppercase, titlecase, dedupe_tags">';
+        html += '</div>';
         html += '<input type="hidden" name="column_name_' + index + '" value="' + escapeHtml(column) + '">';
         html += '</div>';
     });
     html += '</div>';
     html += '</div>';
     
+    html += '<div id="validationReport" style="display:none;"></div>';
+    
     content.innerHTML = html;
+    resetImportValidation();
+    
+    // Any change to the column settings needs a fresh validation
+    content.querySelectorAll('select[name^="column_type_"]').forEach(select => {
+        select.addEventListener('change', function() {
+            const index = this.name.substring('column_type_'.length);
+            content.querySelector('input[name="column_vocabulary_' + index + '"]').style.display =
+                this.value === 'category' ? '' : 'none';
+            const normalizers = content.querySelector('input[name="column_normalizers_' + index + '"]');
+            if (!normalizers.dataset.edited) {
+                normalizers.value = defaultNormalizers(this.value);
+            }
+            resetImportValidation();
+        });
+    });
+    content.querySelectorAll('input[name^="column_"]').forEach(input => {
+        input.addEventListener('change', resetImportValidation);
+    });
+    content.querySelectorAll('input[name^="column_normalizers_"]').forEach(input => {
+        input.addEventListener('input', function() {
+            this.dataset.edited = 'true';
+        });
+    });
     
     document.getElementById('previewSection').style.display = 'block';
     document.getElementById('previewBtn').style.display = 'none';
     document.getElementById('importBtn').style.display = 'inline-block';
 }
 
+function showValidationReport(report) {
+    const container = document.getElementById('validationReport');
+    
+    let html = '<h4>Problems found</h4>';
+    html += '<p>' + report.issue_count + ' problem(s) in ' + report.rows_with_issues + ' of ' +
+        report.rows_checked + ' rows. Fix them in the source and preview again, or import anyway.</p>';
+    if (report.truncated) {
+        html += '<p>Only the first ' + report.issues.length + ' problems are listed.</p>';
+    }
+    
+    html += '<table><thead><tr><th>Row</th><th>Column</th><th>Value</th><th>Problem</th></tr></thead><tbody>';
+    report.issues.forEach(issue => {
+        html += '<tr>';
+        html += '<td>' + issue.row + '</td>';
+        html += '<td>' + escapeHtml(issue.column || '') + '</td>';
+        html += '<td>' + escapeHtml(issue.value || '') + '</td>';
+        html += '<td>' + escapeHtml(issue.message) + '</td>';
+        html += '</tr>';
+    });
+    html += '</tbody></table>';
+    
+    container.innerHTML = html;
+    container.style.display = 'block';
+}
+
+function resetImportValidation() {
+    importValidated = false;
+    const report = document.getElementById('validationReport');
+    if (report) {
+        report.style.display = 'none';
+        report.innerHTML = '';
+    }
+    document.getElementById('confirmImport').textContent = 'Confirm Import';
+}
+
 // Moderator Management Functions
 document.getElementById('showModeratorForm').addEventListener('click', async function() {
     document.getElementById('moderatorForm').style.display = 'block';
@@ -243,16 +495,10 @@ async function loadDirectoryRows() {
                 
                 directory.forEach(row => {
                     // Parse the row data to show a preview
-                    let rowDataPreview = '';
-                    try {
-                        const data = JSON.parse(row.data);
-                        // Show first few fields as preview
-                        rowDataPreview = Object.values(data).slice(0, 3).join(' | ');
-                        if (rowDataPreview.length > 50) {
-                            rowDataPreview = rowDataPreview.substring(0, 50) + '...';
-                        }
-                    } catch (e) {
-                        rowDataPreview = 'Row ' + row.id;
+                    // Show first few fields as preview
+                    let rowDataPreview = (row.data || []).slice(0, 3).join(' | ');
+                    if (rowDataPreview.length > 50) {
+                        rowDataPreview = rowDataPreview.substring(0, 50) + '...';
                     }
                     
                     const checkboxDiv = document.createElement('div');
@@ -535,6 +781,44 @@ function clearModerationRuleForm() {
     document.getElementById('rangeInputs').style.display = 'none';
 }
 
+// Credential Health
+const checkCredentialButton = document.getElementById('checkCredentialHealth');
+if (checkCredentialButton) {
+    checkCredentialButton.addEventListener('click', async function() {
+        this.textContent = 'Checking...';
+        this.disabled = true;
+        
+        try {
+            const response = await fetch('/api/directory-source/credential-health/check?dir=' + directoryId, {
+                method: 'POST',
+                headers: {
+                    'X-CSRF-Token': csrfToken
+                },
+                credentials: 'same-origin'
+            });
+            
+            if (response.ok) {
+                const result = await response.json();
+                if (!result.data || result.data.state === 'healthy') {
+                    document.getElementById('credentialHealthBanner').style.display = 'none';
+                    alert('Sync credentials are working again.');
+                } else {
+                    alert('Sync credentials are still ' + result.data.state + ': ' + result.data.message);
+                }
+            } else {
+                const error = await response.text();
+                alert('Credential check failed: ' + error);
+            }
+        } catch (error) {
+            console.error('Error checking credentials:', error);
+            alert('Network error occurred');
+        } finally {
+            this.textContent = 'Check Again';
+            this.disabled = false;
+        }
+    });
+}
+
 // Utility Functions
 function escapeHtml(text) {
     const div = document.createElement('div');
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleGetSyncJobs lists a directory's queued, failed, dead, conflicting and refused write-back jobs.
+// Pass ?status=completed,discarded (or any other comma-separated list) to see other states.
+func (app *App) handleGetSyncJobs(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	statuses := []string{SyncStatusPending, SyncStatusRunning, SyncStatusFailed, SyncStatusDead, SyncStatusConflict, SyncStatusRefused}
+	if param := r.URL.Query().Get("status"); param != "" {
+		statuses = strings.Split(param, ",")
+	}
+
+	jobs, err := app.GetSyncJobs(directoryID, statuses)
+	if err != nil {
+		log.Printf("Failed to get sync jobs for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to get sync jobs")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, jobs, "")
+}
+
+// handleRetrySyncJob requeues a failed or dead write-back job
+func (app *App) handleRetrySyncJob(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req SyncJobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode retry sync job request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	if err := app.RetrySyncJob(directoryID, req.JobID); err != nil {
+		log.Printf("Failed to retry sync job %d: %v", req.JobID, err)
+		utils2.NotFoundError(w, "Failed sync job")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, nil, "Sync job queued for retry")
+}
+
+// handleDiscardSyncJob drops a write-back job that has not been applied yet
+func (app *App) handleDiscardSyncJob(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	var req SyncJobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode discard sync job request: %v", err)
+		utils2.BadRequestError(w, "Invalid request body")
+		return
+	}
+
+	if err := app.DiscardSyncJob(directoryID, req.JobID); err != nil {
+		log.Printf("Failed to discard sync job %d: %v", req.JobID, err)
+		utils2.NotFoundError(w, "Pending sync job")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, nil, "Sync job discarded")
+}
+
+// handleGetSyncEvents returns the directory's last pull and the edits detected in its source.
+// Accepts ?since=<RFC 3339 time> (default: the last 7 days) and ?limit=<n> (default 100).
+func (app *App) handleGetSyncEvents(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	since := time.Now().AddDate(0, 0, -7)
+	if param := r.URL.Query().Get("since"); param != "" {
+		parsed, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			utils2.ValidationError(w, "Invalid since parameter: use an RFC 3339 time")
+			return
+		}
+		since = parsed
+	}
+
+	limit := 100
+	if param := r.URL.Query().Get("limit"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			utils2.ValidationError(w, "Invalid limit parameter: must be between 1 and 1000")
+			return
+		}
+		limit = parsed
+	}
+
+	status, err := app.GetSyncStatus(directoryID, since, limit)
+	if err != nil {
+		log.Printf("Failed to get sync events for directory %s: %v", directoryID, err)
+		utils2.InternalServerError(w, "Failed to get sync events")
+		return
+	}
+
+	utils2.RespondWithSuccess(w, status, "")
+}
+
+// handlePullDirectory pulls the directory's source immediately instead of waiting for the scheduler
+func (app *App) handlePullDirectory(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	result, err := app.pullDirectory(ctx, directoryID)
+	if err != nil {
+		log.Printf("Manual pull of directory %s failed: %v", directoryID, err)
+		utils2.InternalServerError(w, fmt.Sprintf("Failed to pull source: %v", err))
+		return
+	}
+
+	utils2.RespondWithSuccess(w, result, "Directory pulled from source")
+}
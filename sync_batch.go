@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// syncBatchSize caps how many queued jobs of one directory are written in a single batch
+const syncBatchSize = 100
+
+// SourceWrite is one change in a batch written to a data source. Row numbers are absolute
+// and refer to the source as it was before the batch.
+type SourceWrite struct {
+	Kind      string   // one of the SyncJob type constants
+	RowNumber int      // cell updates, deletes and inserts
+	Column    int      // cell updates
+	Value     string   // cell updates
+	Values    []string // appends and inserts
+}
+
+// sourceWriteInsertRow is a write that inserts Values as a new row at RowNumber, moving the
+// rows from there down. It is never planned from sync jobs; a HeaderLayoutSource uses it to
+// add rows above a footer.
+const sourceWriteInsertRow = "insert_row"
+
+// plannedRow is a source row as it will be once the jobs planned so far are applied
+type plannedRow struct {
+	rowNumber int // row number before the batch, or 0 for a row the batch appends
+	values    []string
+	dirty     []int // columns changed by the batch, in the order they were first changed
+	deleted   bool
+}
+
+// syncBatch is the outcome of planning a run of queued jobs against one read of the source
+type syncBatch struct {
+	applied   []*SyncJob                      // jobs whose changes are in writes, or that needed none
+	conflicts map[*SyncJob]*SyncConflictError // jobs stopped because the source changed
+	refused   map[*SyncJob]error              // jobs the source's cell rules don't allow
+	failed    *SyncJob                        // first job that could not be applied
+	failErr   error
+	skipped   []*SyncJob // jobs after the failed one, left for a later batch
+	writes    []SourceWrite
+}
+
+// planSyncBatch works out the writes that apply jobs, in queue order, to the source rows
+// read at the start of the batch. Each job sees the changes of the jobs before it, exactly
+// as if they had been written one at a time. Cell updates come first in the plan, then
+// deletes from the bottom up and finally appends, so that every row number stays valid
+// while the writes are applied in order. Jobs that would write a formula cell, a protected
+// cell or a value the source's validation rules reject are refused.
+func planSyncBatch(values [][]string, jobs []*SyncJob, rules cellRules) *syncBatch {
+	batch := &syncBatch{
+		conflicts: make(map[*SyncJob]*SyncConflictError),
+		refused:   make(map[*SyncJob]error),
+	}
+
+	keyIndex := -1
+	if len(values) > 0 {
+		keyIndex = rowKeyIndex(values[0])
+	}
+
+	var rows []*plannedRow
+	for i := 1; i < len(values); i++ {
+		rows = append(rows, &plannedRow{rowNumber: i + 1, values: append([]string{}, values[i]...)})
+	}
+	var all []*plannedRow
+	all = append(all, rows...)
+
+	for i, job := range jobs {
+		var err error
+		rows, all, err = planSyncJob(batch, rows, all, keyIndex, rules, job)
+		if err != nil {
+			batch.failed = job
+			batch.failErr = err
+			batch.skipped = jobs[i+1:]
+			break
+		}
+	}
+
+	// Cell updates of rows that existed before the batch and are kept
+	for _, row := range all {
+		if row.rowNumber == 0 || row.deleted {
+			continue
+		}
+		for _, col := range row.dirty {
+			batch.writes = append(batch.writes, SourceWrite{
+				Kind:      SyncJobUpdateCell,
+				RowNumber: row.rowNumber,
+				Column:    col,
+				Value:     cellValue(row.values, col),
+			})
+		}
+	}
+
+	// Deletes from the bottom up, so earlier deletes don't move later rows
+	var deletes []int
+	for _, row := range all {
+		if row.rowNumber > 0 && row.deleted {
+			deletes = append(deletes, row.rowNumber)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(deletes)))
+	for _, rowNumber := range deletes {
+		batch.writes = append(batch.writes, SourceWrite{Kind: SyncJobDeleteRow, RowNumber: rowNumber})
+	}
+
+	// Appended rows that were not deleted again, with any later edits folded in
+	for _, row := range all {
+		if row.rowNumber == 0 && !row.deleted {
+			batch.writes = append(batch.writes, SourceWrite{Kind: SyncJobAppendRow, Values: row.values})
+		}
+	}
+
+	return batch
+}
+
+// planSyncJob applies one job to the planned rows. It returns an error if the job cannot
+// be applied; conflicts and refusals are recorded on the batch instead. Rows the batch
+// appends are not checked against the cell rules.
+func planSyncJob(
+	batch *syncBatch, rows, all []*plannedRow, keyIndex int, rules cellRules, job *SyncJob,
+) ([]*plannedRow, []*plannedRow, error) {
+	if job.JobType == SyncJobAppendRow {
+		// A row whose key is already in the source was appended by an earlier attempt
+		if job.Payload.RowKey != "" && keyIndex >= 0 && findPlannedRow(rows, keyIndex, job.Payload.RowKey) >= 0 {
+			batch.applied = append(batch.applied, job)
+			return rows, all, nil
+		}
+
+		values := job.Payload.Values
+		if job.Payload.RowKey != "" && keyIndex >= 0 {
+			values = withRowKey(values, keyIndex, job.Payload.RowKey)
+		}
+		row := &plannedRow{values: append([]string{}, values...)}
+		batch.applied = append(batch.applied, job)
+		return append(rows, row), append(all, row), nil
+	}
+
+	// Rows with a key are found by it, so rows moved, added or removed in the source since
+	// the job was queued don't send the write to the wrong row
+	index := -1
+	if job.Payload.RowKey != "" && keyIndex >= 0 {
+		index = findPlannedRow(rows, keyIndex, job.Payload.RowKey)
+		if index < 0 {
+			if job.JobType == SyncJobDeleteRow {
+				batch.applied = append(batch.applied, job)
+				return rows, all, nil
+			}
+			return rows, all, errSourceRowNotFound
+		}
+	} else {
+		index = job.Payload.Row
+		if index < 0 || index >= len(rows) {
+			// Add 2 to account for header row and 0-indexing
+			return rows, all, fmt.Errorf("row %d is out of range (source has %d rows)", index+2, len(rows)+1)
+		}
+	}
+	row := rows[index]
+
+	switch job.JobType {
+	case SyncJobUpdateCell:
+		column := sourceColumn(job.Payload.Column, keyIndex)
+		current := cellValue(row.values, column)
+		if current == job.Payload.Value {
+			batch.applied = append(batch.applied, job)
+			return rows, all, nil
+		}
+		if job.Payload.BaseValue != nil && current != *job.Payload.BaseValue {
+			batch.conflicts[job] = &SyncConflictError{SheetValue: current}
+			return rows, all, nil
+		}
+		if row.rowNumber > 0 {
+			if err := rules.checkWrite(row.rowNumber, column, job.Payload.Value); err != nil {
+				batch.refused[job] = err
+				return rows, all, nil
+			}
+		}
+
+		for len(row.values) <= column {
+			row.values = append(row.values, "")
+		}
+		row.values[column] = job.Payload.Value
+		if !containsInt(row.dirty, column) {
+			row.dirty = append(row.dirty, column)
+		}
+
+	case SyncJobDeleteRow:
+		if row.rowNumber > 0 {
+			if err := rules.checkDelete(row.rowNumber); err != nil {
+				batch.refused[job] = err
+				return rows, all, nil
+			}
+		}
+		row.deleted = true
+		rows = append(rows[:index:index], rows[index+1:]...)
+
+	default:
+		return rows, all, fmt.Errorf("unknown sync job type %q", job.JobType)
+	}
+
+	batch.applied = append(batch.applied, job)
+	return rows, all, nil
+}
+
+// writtenRows lists the rows that existed before the batch and that its writes update or
+// delete, in order
+func (batch *syncBatch) writtenRows() []int {
+	var rows []int
+	for _, write := range batch.writes {
+		if write.Kind != SyncJobAppendRow && !containsInt(rows, write.RowNumber) {
+			rows = append(rows, write.RowNumber)
+		}
+	}
+	sort.Ints(rows)
+	return rows
+}
+
+// findPlannedRow returns the index of the row holding key, or -1
+func findPlannedRow(rows []*plannedRow, keyIndex int, key string) int {
+	for i, row := range rows {
+		if strings.TrimSpace(cellValue(row.values, keyIndex)) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// cellValue returns a cell of a row, or "" if the row is shorter
+func cellValue(values []string, col int) string {
+	if col < len(values) {
+		return values[col]
+	}
+	return ""
+}
+
+// containsInt reports whether a slice holds a value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
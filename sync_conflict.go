@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SyncConflictError reports that a cell changed in the source after the edit was based on it
+type SyncConflictError struct {
+	SheetValue string
+}
+
+func (e *SyncConflictError) Error() string {
+	return fmt.Sprintf("cell was changed in the source to %q", e.SheetValue)
+}
+
+// recordSyncConflict parks a conflicting write in the moderation queue so a human can
+// choose between the source's value and the proposed one
+func (sw *SyncWorker) recordSyncConflict(job *SyncJob, conflict *SyncConflictError) {
+	if err := sw.app.createConflictChange(job, conflict.SheetValue); err != nil {
+		sw.recordFailure(job, fmt.Errorf("failed to record conflict: %v", err))
+		return
+	}
+
+	_, err := sw.app.DB.Exec("UPDATE sync_jobs SET status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		SyncStatusConflict, conflict.Error(), time.Now().UTC(), job.ID)
+	if err != nil {
+		log.Printf("Failed to mark sync job %d as conflicting: %v", job.ID, err)
+	}
+
+	log.Printf("Sync job %d for directory %s stopped on a conflict: %v", job.ID, job.DirectoryID, conflict)
+}
+
+// createConflictChange inserts a conflict into pending_changes with the base, sheet and proposed values
+func (app *App) createConflictChange(job *SyncJob, sheetValue string) error {
+	columnSchema, err := app.getCurrentColumnSchema(job.DirectoryID)
+	if err != nil {
+		return fmt.Errorf("failed to get column schema: %v", err)
+	}
+
+	columnSchemaJSON, err := json.Marshal(columnSchema)
+	if err != nil {
+		return fmt.Errorf("failed to marshal column schema: %v", err)
+	}
+
+	var columnName string
+	if job.Payload.Column < len(columnSchema) {
+		columnName = columnSchema[job.Payload.Column]
+	} else {
+		columnName = fmt.Sprintf("Column_%d", job.Payload.Column)
+	}
+
+	var baseValue string
+	if job.Payload.BaseValue != nil {
+		baseValue = *job.Payload.BaseValue
+	}
+
+	_, err = app.DB.Exec(`
+		INSERT INTO pending_changes
+		(directory_id, row_id, column_name, old_value, new_value, sheet_value, change_type, submitted_by, column_schema, sync_job_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.DirectoryID, job.Payload.RowID, columnName, baseValue, job.Payload.Value, sheetValue,
+		ChangeTypeConflict, job.CreatedBy, string(columnSchemaJSON), job.ID, time.Now())
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConstraint, "failed to insert conflict", err)
+	}
+
+	return nil
+}
+
+// resolveConflictWithProposed queues the proposed value of an approved conflict again. The
+// sheet value the reviewer saw becomes the new base, so a further edit in the source in the
+// meantime raises a fresh conflict instead of being overwritten. The job is queued with tx,
+// so that it commits together with the approval.
+func (app *App) resolveConflictWithProposed(tx *sql.Tx, change PendingChange, syncJobID int) error {
+	job, err := app.getSyncJob(syncJobID)
+	if err != nil {
+		return err
+	}
+
+	payload := job.Payload
+	sheetValue := change.SheetValue
+	payload.BaseValue = &sheetValue
+
+	if _, err := app.insertSyncJob(tx, job.DirectoryID, job.JobType, payload, job.CreatedBy); err != nil {
+		return err
+	}
+	return nil
+}
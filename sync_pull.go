@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Sync event type constants
+const (
+	SyncEventExternalEdit = "external_edit"
+)
+
+// directorySyncLocks keeps the write-back worker, scheduled pulls and re-links of one
+// directory from re-importing it at the same time
+var directorySyncLocks sync.Map
+
+// lockDirectorySync takes the sync lock of a directory and returns its unlock function
+func lockDirectorySync(directoryID string) func() {
+	mutex, _ := directorySyncLocks.LoadOrStore(directoryID, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock
+}
+
+// SyncEvent records a row that changed in the source outside the app
+type SyncEvent struct {
+	ID          int               `json:"id"`
+	DirectoryID string            `json:"directory_id"`
+	EventType   string            `json:"event_type"`
+	ChangeType  string            `json:"change_type"`
+	RowID       int64             `json:"row_id"`
+	SheetRow    int               `json:"sheet_row"`
+	OldValues   map[string]string `json:"old_values,omitempty"`
+	NewValues   map[string]string `json:"new_values,omitempty"`
+	DetectedAt  time.Time         `json:"detected_at"`
+}
+
+// SyncStatus summarises a directory's pull sync state for owners
+type SyncStatus struct {
+	LastPulledAt   *time.Time  `json:"last_pulled_at,omitempty"`
+	LastPullError  string      `json:"last_pull_error,omitempty"`
+	WatchExpiresAt *time.Time  `json:"watch_expires_at,omitempty"` // Drive notifies the app of sheet changes until then
+	LastNotifiedAt *time.Time  `json:"last_notified_at,omitempty"`
+	Events         []SyncEvent `json:"events"`
+}
+
+// PullScheduler periodically re-imports every bound directory to pick up edits made
+// directly in the source
+type PullScheduler struct {
+	app      *App
+	interval time.Duration
+}
+
+// NewPullScheduler creates a scheduler that pulls every interval
+func NewPullScheduler(app *App, interval time.Duration) *PullScheduler {
+	return &PullScheduler{app: app, interval: interval}
+}
+
+// Start begins pulling in the background
+func (ps *PullScheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(ps.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ps.pullAll()
+		}
+	}()
+}
+
+// pullAll pulls each bound directory in turn
+func (ps *PullScheduler) pullAll() {
+	rows, err := ps.app.DB.Query("SELECT directory_id FROM directory_sources ORDER BY directory_id")
+	if err != nil {
+		log.Printf("Failed to list directories for pull sync: %v", err)
+		return
+	}
+
+	var directoryIDs []string
+	for rows.Next() {
+		var directoryID string
+		if err := rows.Scan(&directoryID); err != nil {
+			log.Printf("Failed to scan directory for pull sync: %v", err)
+			continue
+		}
+		directoryIDs = append(directoryIDs, directoryID)
+	}
+	rows.Close()
+
+	for _, directoryID := range directoryIDs {
+		deferred, err := ps.app.pullDeferred(directoryID)
+		if err != nil {
+			log.Printf("Failed to check whether directory %s can be pulled: %v", directoryID, err)
+			continue
+		}
+		if deferred {
+			continue
+		}
+
+		// Directories whose sheet is watched are synced when Drive reports a change
+		watched, err := ps.app.hasOpenDriveChannel(directoryID)
+		if err != nil {
+			log.Printf("Failed to check Drive watch of directory %s: %v", directoryID, err)
+		}
+		if watched {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+		result, err := ps.app.pullDirectory(ctx, directoryID)
+		cancel()
+		if err != nil {
+			log.Printf("Pull sync of directory %s failed: %v", directoryID, err)
+			if isCredentialError(err) {
+				ps.app.recordCredentialFailure(directoryID, err)
+			}
+			continue
+		}
+
+		if len(result.Changes) > 0 {
+			log.Printf("Pull sync of directory %s: %d inserted, %d updated, %d deleted",
+				directoryID, result.Inserted, result.Updated, result.Deleted)
+		}
+	}
+}
+
+// pullDeferred reports whether a directory's pull should wait. Queued writes re-import the
+// directory themselves once they are applied, unless they are held until a schema change is
+// confirmed; the pull then notices when the source's header is put back. A directory whose
+// credential is broken waits for the credential monitor to resume it.
+func (app *App) pullDeferred(directoryID string) (bool, error) {
+	outstanding, err := app.countOutstandingSyncJobs(directoryID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check sync queue: %v", err)
+	}
+	if outstanding > 0 {
+		proposal, err := app.GetPendingSchemaProposal(directoryID)
+		if err != nil {
+			return false, fmt.Errorf("failed to check schema proposals: %v", err)
+		}
+		if proposal == nil {
+			return true, nil
+		}
+	}
+
+	health, err := app.GetCredentialHealth(directoryID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check credential health: %v", err)
+	}
+	return health != nil && health.State == CredentialBroken, nil
+}
+
+// pullDirectory re-imports a directory from its source and records every row that changed
+// as an external edit
+func (app *App) pullDirectory(ctx context.Context, directoryID string) (*ImportResult, error) {
+	unlock := lockDirectorySync(directoryID)
+	defer unlock()
+
+	source, err := app.resolveWriteBackSource(ctx, directoryID)
+	if err == nil {
+		var result *ImportResult
+		result, err = app.reimportDirectory(ctx, source, directoryID)
+		if err == nil {
+			if err := app.recordSyncEvents(directoryID, SyncEventExternalEdit, result.Changes); err != nil {
+				return nil, err
+			}
+			app.recordPull(directoryID, nil)
+			return result, nil
+		}
+	}
+
+	app.recordPull(directoryID, err)
+	return nil, err
+}
+
+// recordPull stores the time and outcome of a directory's latest pull
+func (app *App) recordPull(directoryID string, pullErr error) {
+	var errorText string
+	if pullErr != nil {
+		errorText = pullErr.Error()
+	}
+
+	_, err := app.DB.Exec(`
+		UPDATE directory_sources SET last_pulled_at = ?, last_pull_error = ? WHERE directory_id = ?
+	`, time.Now().UTC(), errorText, directoryID)
+	if err != nil {
+		log.Printf("Failed to record pull of directory %s: %v", directoryID, err)
+	}
+}
+
+// recordSyncEvents stores the row changes of a sync as events of the given type
+func (app *App) recordSyncEvents(directoryID, eventType string, changes []RowChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return app.WithTransaction(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		for _, change := range changes {
+			oldJSON, err := json.Marshal(change.OldValues)
+			if err != nil {
+				return fmt.Errorf("failed to marshal old values: %v", err)
+			}
+			newJSON, err := json.Marshal(change.NewValues)
+			if err != nil {
+				return fmt.Errorf("failed to marshal new values: %v", err)
+			}
+
+			_, err = tx.Exec(`
+				INSERT INTO sync_events (directory_id, event_type, change_type, row_id, sheet_row, old_values, new_values, detected_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			`, directoryID, eventType, change.ChangeType, change.RowID, change.SheetRow, string(oldJSON), string(newJSON), now)
+			if err != nil {
+				return WrapDatabaseError(ErrTypeConstraint, "failed to record sync event", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetSyncStatus returns a directory's last pull and the external edits detected since the given time
+func (app *App) GetSyncStatus(directoryID string, since time.Time, limit int) (*SyncStatus, error) {
+	status := &SyncStatus{Events: []SyncEvent{}}
+
+	var lastPulledAt sql.NullTime
+	var lastPullError sql.NullString
+	err := app.DB.QueryRow(`
+		SELECT last_pulled_at, last_pull_error FROM directory_sources WHERE directory_id = ?
+	`, directoryID).Scan(&lastPulledAt, &lastPullError)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query pull status", err)
+	}
+	if lastPulledAt.Valid {
+		status.LastPulledAt = &lastPulledAt.Time
+	}
+	status.LastPullError = lastPullError.String
+
+	var watchExpiresAt, lastNotifiedAt sql.NullTime
+	err = app.DB.QueryRow(`
+		SELECT expires_at, last_notified_at FROM drive_watch_channels
+		WHERE directory_id = ? ORDER BY expires_at DESC LIMIT 1
+	`, directoryID).Scan(&watchExpiresAt, &lastNotifiedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query Drive watch", err)
+	}
+	if watchExpiresAt.Valid {
+		status.WatchExpiresAt = &watchExpiresAt.Time
+	}
+	if lastNotifiedAt.Valid {
+		status.LastNotifiedAt = &lastNotifiedAt.Time
+	}
+
+	rows, err := app.DB.Query(`
+		SELECT id, directory_id, event_type, change_type, row_id, sheet_row, old_values, new_values, detected_at
+		FROM sync_events
+		WHERE directory_id = ? AND detected_at >= ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, directoryID, since.UTC(), limit)
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query sync events", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event SyncEvent
+		var oldJSON, newJSON string
+		if err := rows.Scan(&event.ID, &event.DirectoryID, &event.EventType, &event.ChangeType, &event.RowID,
+			&event.SheetRow, &oldJSON, &newJSON, &event.DetectedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan sync event: %v", err)
+		}
+		json.Unmarshal([]byte(oldJSON), &event.OldValues)
+		json.Unmarshal([]byte(newJSON), &event.NewValues)
+		status.Events = append(status.Events, event)
+	}
+
+	return status, rows.Err()
+}
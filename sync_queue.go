@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Sync job type constants
+const (
+	SyncJobUpdateCell = "update_cell"
+	SyncJobAppendRow  = "append_row"
+	SyncJobDeleteRow  = "delete_row"
+)
+
+// Sync job status constants
+const (
+	SyncStatusPending   = "pending"   // waiting for its first attempt
+	SyncStatusRunning   = "running"   // claimed by the worker
+	SyncStatusFailed    = "failed"    // last attempt failed, will be retried
+	SyncStatusDead      = "dead"      // gave up after too many attempts
+	SyncStatusCompleted = "completed" // written to the source
+	SyncStatusDiscarded = "discarded" // dropped by an owner
+	SyncStatusConflict  = "conflict"  // stopped because the source changed; see pending_changes
+	SyncStatusRefused   = "refused"   // the source doesn't allow the write, e.g. to a formula cell
+)
+
+const (
+	syncWorkerInterval = 5 * time.Second
+	syncJobTimeout     = 2 * time.Minute
+	syncBackoffBase    = 30 * time.Second
+	syncBackoffMax     = time.Hour
+)
+
+// errSourceReadOnly is returned when an edit is made to a directory whose source is only read
+var errSourceReadOnly = errors.New("this directory is only read from its source; make the change in the source instead")
+
+// SyncJob is a queued write of a directory edit back to its data source
+type SyncJob struct {
+	ID            int            `json:"id"`
+	DirectoryID   string         `json:"directory_id"`
+	JobType       string         `json:"job_type"`
+	Payload       SyncJobPayload `json:"payload"`
+	Status        string         `json:"status"`
+	Attempts      int            `json:"attempts"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	LastError     string         `json:"last_error,omitempty"`
+	CreatedBy     string         `json:"created_by"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+// SyncJobPayload holds the arguments of a sync job. Row is the 0-based data row index and
+// RowID the directory row it refers to. When RowKey is set, the row is located by its key in
+// the source instead of by Row. When BaseValue is set, a cell update is only written if the
+// source still holds that value.
+type SyncJobPayload struct {
+	Row       int      `json:"row,omitempty"`
+	RowID     int      `json:"row_id,omitempty"`
+	RowKey    string   `json:"row_key,omitempty"`
+	Column    int      `json:"column,omitempty"`
+	Value     string   `json:"value,omitempty"`
+	BaseValue *string  `json:"base_value,omitempty"`
+	Values    []string `json:"values,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// SyncJobActionRequest identifies a sync job to retry or discard
+type SyncJobActionRequest struct {
+	JobID int `json:"job_id"`
+}
+
+// SyncWorker drains the sync_jobs queue in the background
+type SyncWorker struct {
+	app  *App
+	wake chan struct{}
+}
+
+// NewSyncWorker creates a worker for the app's sync queue
+func NewSyncWorker(app *App) *SyncWorker {
+	return &SyncWorker{
+		app:  app,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Start requeues jobs interrupted by a restart and begins processing in the background
+func (sw *SyncWorker) Start() {
+	_, err := sw.app.DB.Exec("UPDATE sync_jobs SET status = ?, updated_at = ? WHERE status = ?",
+		SyncStatusPending, time.Now().UTC(), SyncStatusRunning)
+	if err != nil {
+		log.Printf("Failed to requeue interrupted sync jobs: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(syncWorkerInterval)
+		defer ticker.Stop()
+		for {
+			sw.processDueJobs()
+			select {
+			case <-ticker.C:
+			case <-sw.wake:
+			}
+		}
+	}()
+}
+
+// Notify wakes the worker so newly queued jobs run without waiting for the next tick
+func (sw *SyncWorker) Notify() {
+	select {
+	case sw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// execer runs statements against a database or within a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// enqueueSyncJob persists a write-back job and wakes the worker. Directories whose source is
+// read-only take no jobs.
+func (app *App) enqueueSyncJob(directoryID, jobType string, payload SyncJobPayload, createdBy string) (int64, error) {
+	jobID, err := app.insertSyncJob(app.DB, directoryID, jobType, payload, createdBy)
+	if err != nil {
+		return 0, err
+	}
+
+	if app.SyncWorker != nil {
+		app.SyncWorker.Notify()
+	}
+
+	return jobID, nil
+}
+
+// insertSyncJob persists a write-back job with db, which may be a transaction the job must
+// commit with. The worker isn't woken; callers notify it once the job is committed.
+func (app *App) insertSyncJob(db execer, directoryID, jobType string, payload SyncJobPayload, createdBy string) (int64, error) {
+	// The next sync would undo an edit that can't be written to the source
+	binding, err := app.getDirectorySource(directoryID)
+	if err != nil {
+		return 0, err
+	}
+	if binding != nil && binding.ReadOnly {
+		return 0, errSourceReadOnly
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal sync job payload: %v", err)
+	}
+
+	now := time.Now().UTC()
+	result, err := db.Exec(`
+		INSERT INTO sync_jobs (directory_id, job_type, payload, status, next_attempt_at, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, directoryID, jobType, string(payloadJSON), SyncStatusPending, now, createdBy, now, now)
+	if err != nil {
+		return 0, WrapDatabaseError(ErrTypeConstraint, "failed to enqueue sync job", err)
+	}
+
+	jobID, err := result.LastInsertId()
+	if err != nil {
+		return 0, WrapDatabaseError(ErrTypeConnection, "failed to get sync job ID", err)
+	}
+
+	return jobID, nil
+}
+
+// processDueJobs runs every job whose retry time has passed. Jobs of one directory run in
+// the order they were queued, so a later write never overtakes an earlier one that is
+// still waiting to be retried.
+func (sw *SyncWorker) processDueJobs() {
+	for sw.processNextJobs() > 0 {
+	}
+}
+
+// processNextJobs writes the leading due jobs of each directory as one batch per directory
+// and returns how many jobs ran
+func (sw *SyncWorker) processNextJobs() int {
+	batches, err := sw.dueJobBatches()
+	if err != nil {
+		log.Printf("Failed to query due sync jobs: %v", err)
+		return 0
+	}
+
+	ran := 0
+	for _, jobIDs := range batches {
+		var jobs []*SyncJob
+		for _, jobID := range jobIDs {
+			job, err := sw.claimJob(jobID)
+			if err != nil {
+				log.Printf("Failed to claim sync job %d: %v", jobID, err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			jobs = append(jobs, job)
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		ran += sw.runBatch(jobs)
+	}
+	return ran
+}
+
+// dueJobBatches returns, per directory, the IDs of the queued jobs that can run now: the
+// due jobs at the head of its queue, up to the first one that is running or still backing off.
+// Directories waiting for a schema change to be confirmed or whose credential is broken are
+// left alone.
+func (sw *SyncWorker) dueJobBatches() ([][]int, error) {
+	rows, err := sw.app.DB.Query(`
+		SELECT id, directory_id, status, next_attempt_at FROM sync_jobs
+		WHERE status IN (?, ?, ?)
+		  AND directory_id NOT IN (SELECT directory_id FROM schema_proposals WHERE status = ?)
+		  AND directory_id NOT IN (SELECT directory_id FROM credential_health WHERE state = ?)
+		ORDER BY directory_id, id
+	`, SyncStatusPending, SyncStatusFailed, SyncStatusRunning, SchemaProposalPending, CredentialBroken)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	var batches [][]int
+	var currentDirectory string
+	blocked := false
+	for rows.Next() {
+		var jobID int
+		var directoryID, status string
+		var nextAttemptAt time.Time
+		if err := rows.Scan(&jobID, &directoryID, &status, &nextAttemptAt); err != nil {
+			return nil, err
+		}
+
+		if len(batches) == 0 || directoryID != currentDirectory {
+			currentDirectory = directoryID
+			blocked = false
+			batches = append(batches, nil)
+		}
+		batch := &batches[len(batches)-1]
+
+		if blocked || status == SyncStatusRunning || nextAttemptAt.After(now) || len(*batch) >= syncBatchSize {
+			blocked = true
+			continue
+		}
+		*batch = append(*batch, jobID)
+	}
+
+	return batches, rows.Err()
+}
+
+// claimJob marks a job as running, returning nil if it was changed by someone else meanwhile
+func (sw *SyncWorker) claimJob(jobID int) (*SyncJob, error) {
+	result, err := sw.app.DB.Exec(`
+		UPDATE sync_jobs SET status = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = ? AND status IN (?, ?)
+	`, SyncStatusRunning, time.Now().UTC(), jobID, SyncStatusPending, SyncStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, err
+	}
+
+	return sw.app.getSyncJob(jobID)
+}
+
+// releaseJob hands a claimed job back to the queue without counting the attempt
+func (sw *SyncWorker) releaseJob(job *SyncJob) {
+	_, err := sw.app.DB.Exec(`
+		UPDATE sync_jobs SET status = ?, attempts = attempts - 1, updated_at = ? WHERE id = ?
+	`, SyncStatusPending, time.Now().UTC(), job.ID)
+	if err != nil {
+		log.Printf("Failed to release sync job %d: %v", job.ID, err)
+	}
+}
+
+// runBatch reads the directory's source once, writes every job it can in a single call,
+// re-imports the directory once and records each job's outcome. It returns how many jobs
+// reached an outcome; jobs after one that failed are released for a later batch.
+func (sw *SyncWorker) runBatch(jobs []*SyncJob) int {
+	directoryID := jobs[0].DirectoryID
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	unlock := lockDirectorySync(directoryID)
+	defer unlock()
+
+	source, err := sw.app.resolveWriteBackSource(ctx, directoryID)
+	var values [][]string
+	if err == nil {
+		values, err = source.ReadAll(ctx)
+	}
+	if err == nil {
+		err = sw.app.checkSourceHeader(directoryID, values)
+	}
+	var mismatch *HeaderMismatchError
+	if errors.As(err, &mismatch) {
+		return sw.holdForSchemaChange(jobs, mismatch)
+	}
+	if isCredentialError(err) {
+		return sw.holdForCredentials(jobs, err)
+	}
+	if err != nil {
+		for _, job := range jobs {
+			sw.recordFailure(job, err)
+		}
+		return len(jobs)
+	}
+
+	batch := planSyncBatch(values, jobs, nil)
+
+	// Formulas, protected ranges and validation rules are read fresh for the rows the batch
+	// writes, as the source rejects a whole batch if one of its writes breaks them
+	if reader, ok := source.(cellRuleReader); ok {
+		if rows := batch.writtenRows(); len(rows) > 0 {
+			rules, err := reader.ReadCellRules(ctx, rows)
+			if isCredentialError(err) {
+				return sw.holdForCredentials(jobs, err)
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to read cell rules from source: %v", err)
+				for _, job := range jobs {
+					sw.recordFailure(job, err)
+				}
+				return len(jobs)
+			}
+			batch = planSyncBatch(values, jobs, rules)
+		}
+	}
+	for job, err := range batch.refused {
+		sw.recordRefusal(job, err)
+	}
+
+	if err := sw.applyBatchWrites(ctx, source, batch); err != nil {
+		if isCredentialError(err) {
+			return sw.holdForCredentials(jobs, err)
+		}
+		for _, job := range batch.applied {
+			sw.recordFailure(job, err)
+		}
+		if batch.failed != nil {
+			sw.recordFailure(batch.failed, batch.failErr)
+		}
+		for job := range batch.conflicts {
+			sw.releaseJob(job)
+		}
+		for _, job := range batch.skipped {
+			sw.releaseJob(job)
+		}
+		return len(jobs) - len(batch.conflicts) - len(batch.skipped)
+	}
+
+	for job, conflict := range batch.conflicts {
+		sw.recordSyncConflict(job, conflict)
+	}
+	if batch.failed != nil {
+		sw.recordFailure(batch.failed, batch.failErr)
+	}
+	for _, job := range batch.skipped {
+		sw.releaseJob(job)
+	}
+
+	if len(batch.applied) == 0 {
+		return len(jobs) - len(batch.skipped)
+	}
+
+	// The writes went through, so a failed refresh must not cause them to be repeated
+	var note string
+	if result, err := sw.app.reimportDirectory(ctx, source, directoryID); err != nil {
+		note = fmt.Sprintf("written to source, but re-import failed: %v", err)
+		log.Printf("Failed to re-import directory %s after sync jobs: %v", directoryID, err)
+	} else {
+		log.Printf("Wrote %d sync jobs for directory %s in %d changes: %d inserted, %d updated, %d deleted",
+			len(batch.applied), directoryID, len(batch.writes), result.Inserted, result.Updated, result.Deleted)
+	}
+
+	for _, job := range batch.applied {
+		_, err = sw.app.DB.Exec("UPDATE sync_jobs SET status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+			SyncStatusCompleted, note, time.Now().UTC(), job.ID)
+		if err != nil {
+			log.Printf("Failed to mark sync job %d completed: %v", job.ID, err)
+		}
+	}
+
+	return len(jobs) - len(batch.skipped)
+}
+
+// holdForCredentials hands a batch back to the queue without counting the attempt when the
+// source refused the directory's credentials, and pauses the directory's write-back until
+// they work again
+func (sw *SyncWorker) holdForCredentials(jobs []*SyncJob, cause error) int {
+	sw.app.recordCredentialFailure(jobs[0].DirectoryID, cause)
+	for _, job := range jobs {
+		sw.releaseJob(job)
+	}
+	return 0
+}
+
+// applyBatchWrites sends a batch's writes to the source, if it has any
+func (sw *SyncWorker) applyBatchWrites(ctx context.Context, source DataSource, batch *syncBatch) error {
+	if len(batch.writes) == 0 {
+		return nil
+	}
+	if err := source.ApplyBatch(ctx, batch.writes); err != nil {
+		return fmt.Errorf("failed to write to source: %v", err)
+	}
+	return nil
+}
+
+// recordRefusal stops a job the source's cell rules don't allow. Retrying it makes sense
+// once the rule is lifted in the source.
+func (sw *SyncWorker) recordRefusal(job *SyncJob, cause error) {
+	_, err := sw.app.DB.Exec("UPDATE sync_jobs SET status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		SyncStatusRefused, cause.Error(), time.Now().UTC(), job.ID)
+	if err != nil {
+		log.Printf("Failed to mark sync job %d as refused: %v", job.ID, err)
+	}
+
+	log.Printf("Sync job %d for directory %s was refused by the source: %v", job.ID, job.DirectoryID, cause)
+}
+
+// recordFailure schedules a retry with exponential backoff, or dead-letters the job
+func (sw *SyncWorker) recordFailure(job *SyncJob, jobErr error) {
+	status := SyncStatusFailed
+	if job.Attempts >= sw.app.Config.SyncMaxAttempts {
+		status = SyncStatusDead
+	}
+
+	nextAttempt := time.Now().UTC().Add(syncBackoff(job.Attempts))
+	_, err := sw.app.DB.Exec(`
+		UPDATE sync_jobs SET status = ?, last_error = ?, next_attempt_at = ?, updated_at = ?
+		WHERE id = ?
+	`, status, jobErr.Error(), nextAttempt, time.Now().UTC(), job.ID)
+	if err != nil {
+		log.Printf("Failed to record failure of sync job %d: %v", job.ID, err)
+	}
+
+	log.Printf("Sync job %d (%s) for directory %s failed on attempt %d (%s): %v",
+		job.ID, job.JobType, job.DirectoryID, job.Attempts, status, jobErr)
+}
+
+// syncBackoff returns the delay before the next attempt after the given number of attempts
+func syncBackoff(attempts int) time.Duration {
+	delay := syncBackoffBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= syncBackoffMax {
+			return syncBackoffMax
+		}
+	}
+	return delay
+}
+
+// getSyncJob loads a single sync job
+func (app *App) getSyncJob(jobID int) (*SyncJob, error) {
+	row := app.DB.QueryRow(`
+		SELECT id, directory_id, job_type, payload, status, attempts, next_attempt_at,
+		       COALESCE(last_error, ''), COALESCE(created_by, ''), created_at, updated_at
+		FROM sync_jobs WHERE id = ?
+	`, jobID)
+
+	job, err := scanSyncJob(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sync job %d not found", jobID)
+	}
+	return job, err
+}
+
+// GetSyncJobs lists a directory's sync jobs with the given statuses, newest first
+func (app *App) GetSyncJobs(directoryID string, statuses []string) ([]SyncJob, error) {
+	query := `
+		SELECT id, directory_id, job_type, payload, status, attempts, next_attempt_at,
+		       COALESCE(last_error, ''), COALESCE(created_by, ''), created_at, updated_at
+		FROM sync_jobs WHERE directory_id = ?`
+	args := []interface{}{directoryID}
+
+	if len(statuses) > 0 {
+		query += " AND status IN (?" + strings.Repeat(", ?", len(statuses)-1) + ")"
+		for _, status := range statuses {
+			args = append(args, status)
+		}
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := app.DB.Query(query, args...)
+	if err != nil {
+		return nil, WrapDatabaseError(ErrTypeConnection, "failed to query sync jobs", err)
+	}
+	defer rows.Close()
+
+	var jobs []SyncJob
+	for rows.Next() {
+		job, err := scanSyncJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// countOutstandingSyncJobs returns how many of a directory's jobs have not been written or given up on
+func (app *App) countOutstandingSyncJobs(directoryID string) (int, error) {
+	var count int
+	err := app.DB.QueryRow(`
+		SELECT COUNT(*) FROM sync_jobs WHERE directory_id = ? AND status IN (?, ?, ?)
+	`, directoryID, SyncStatusPending, SyncStatusRunning, SyncStatusFailed).Scan(&count)
+	if err != nil {
+		return 0, WrapDatabaseError(ErrTypeConnection, "failed to count sync jobs", err)
+	}
+	return count, nil
+}
+
+// RetrySyncJob puts a failed, dead or refused job back in the queue with a fresh attempt count
+func (app *App) RetrySyncJob(directoryID string, jobID int) error {
+	now := time.Now().UTC()
+	result, err := app.DB.Exec(`
+		UPDATE sync_jobs SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ?
+		WHERE id = ? AND directory_id = ? AND status IN (?, ?, ?)
+	`, SyncStatusPending, now, now, jobID, directoryID, SyncStatusFailed, SyncStatusDead, SyncStatusRefused)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConnection, "failed to retry sync job", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("no failed sync job %d in directory %s", jobID, directoryID)
+	}
+
+	if app.SyncWorker != nil {
+		app.SyncWorker.Notify()
+	}
+	return nil
+}
+
+// DiscardSyncJob drops a job that has not been written yet
+func (app *App) DiscardSyncJob(directoryID string, jobID int) error {
+	result, err := app.DB.Exec(`
+		UPDATE sync_jobs SET status = ?, updated_at = ?
+		WHERE id = ? AND directory_id = ? AND status IN (?, ?, ?, ?)
+	`, SyncStatusDiscarded, time.Now().UTC(), jobID, directoryID,
+		SyncStatusPending, SyncStatusFailed, SyncStatusDead, SyncStatusRefused)
+	if err != nil {
+		return WrapDatabaseError(ErrTypeConnection, "failed to discard sync job", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("no discardable sync job %d in directory %s", jobID, directoryID)
+	}
+	return nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSyncJob(scanner rowScanner) (*SyncJob, error) {
+	var job SyncJob
+	var payloadJSON string
+	err := scanner.Scan(&job.ID, &job.DirectoryID, &job.JobType, &payloadJSON, &job.Status, &job.Attempts,
+		&job.NextAttemptAt, &job.LastError, &job.CreatedBy, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(payloadJSON), &job.Payload); err != nil {
+		return nil, fmt.Errorf("failed to parse payload of sync job %d: %v", job.ID, err)
+	}
+
+	return &job, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"database/sql"
+	utils2 "directoryCommunityWebsite/internal/utils"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errNotTagColumn is returned when tags are asked for of a column that isn't a tag or location column
+var errNotTagColumn = errors.New("not a tag or location column")
+
+// TagCount is a distinct tag of a tag or location column and how many rows carry it
+type TagCount struct {
+	Column string `json:"column"`
+	Tag    string `json:"tag"`
+	Count  int    `json:"count"`
+}
+
+// tagTableName returns the index table for a tag or location column
+func tagTableName(directoryID, columnName string) string {
+	return fmt.Sprintf("_meta_%s_tag_%s", directoryID, columnName)
+}
+
+// isTagColumnType reports whether a column type is indexed in a tag table
+func isTagColumnType(columnType string) bool {
+	return columnType == "tag" || columnType == "location"
+}
+
+// ensureTagTable creates the index table of a tag or location column unless it exists, and
+// reports whether it was created. Each entry is one tag of one row's cell. Tags compare
+// case-insensitively, as filters match them, and a row carries each tag once. The unique
+// key serves clearing a row's tags and the tag index serves finding the rows with a tag.
+func ensureTagTable(tx *sql.Tx, directoryID, columnName string) (bool, error) {
+	tableName := tagTableName(directoryID, columnName)
+	exists, err := tableExists(tx, tableName)
+	if err != nil || exists {
+		return false, err
+	}
+
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE '%s' (
+			columnTable TEXT NOT NULL,
+			rowID INTEGER NOT NULL,
+			tag TEXT NOT NULL COLLATE NOCASE,
+			UNIQUE (rowID, tag)
+		)`, tableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS '%[1]s_by_tag' ON '%[1]s' (tag, rowID)", tableName),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return false, fmt.Errorf("failed to create tag table %v: %v", tableName, err)
+		}
+	}
+	return true, nil
+}
+
+// indexTagColumn rebuilds the index of a tag or location column from the stored rows
+func indexTagColumn(tx *sql.Tx, directoryID, columnName, columnType string) error {
+	tableName := tagTableName(directoryID, columnName)
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM '%s'", tableName)); err != nil {
+		return fmt.Errorf("failed to clear tag table %v: %v", tableName, err)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowID, COALESCE([%s], '') FROM '%s'", columnName, directoryID))
+	if err != nil {
+		return fmt.Errorf("failed to read column %s: %v", columnName, err)
+	}
+	values := make(map[int64]string)
+	for rows.Next() {
+		var rowID int64
+		var value string
+		if err := rows.Scan(&rowID, &value); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan column %s: %v", columnName, err)
+		}
+		values[rowID] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read column %s: %v", columnName, err)
+	}
+
+	tags, err := newTagIndexer(tx, directoryID, []string{columnName}, []string{columnType})
+	if err != nil {
+		return err
+	}
+	defer tags.Close()
+	for rowID, value := range values {
+		if err := tags.add(rowID, []string{value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexTagColumns creates and fills the tag tables a directory's tag and location columns
+// are missing, as for directories imported while tag tables couldn't be created
+func (app *App) indexTagColumns(directoryID string) error {
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return fmt.Errorf("failed to get directory database: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN (?, ?)",
+		directoryID, "_meta_directory_column_types").Scan(&count); err != nil {
+		return fmt.Errorf("failed to look up directory table: %v", err)
+	}
+	if count < 2 {
+		return nil // never imported
+	}
+
+	columns, err := loadDirectoryColumns(db, directoryID)
+	if err != nil {
+		return err
+	}
+
+	return app.WithDirectoryTransaction(directoryID, func(tx *sql.Tx) error {
+		for _, column := range columns {
+			if !isTagColumnType(column.Type) {
+				continue
+			}
+			created, err := ensureTagTable(tx, directoryID, column.Name)
+			if err != nil {
+				return err
+			}
+			if created {
+				if err := indexTagColumn(tx, directoryID, column.Name, column.Type); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// tagIndexer maintains the tag and location tables during an import, with one prepared
+// insert and delete per table rather than a statement built for every tag
+type tagIndexer struct {
+	directoryID string
+	columns     []int // indexes of the tag and location columns
+	inserts     []*sql.Stmt
+	deletes     []*sql.Stmt
+}
+
+// newTagIndexer prepares the tag table statements of a directory's tag and location columns
+func newTagIndexer(tx *sql.Tx, directoryID string, columnNames, columnTypes []string) (*tagIndexer, error) {
+	indexer := &tagIndexer{directoryID: directoryID}
+	for j, columnType := range columnTypes {
+		if !isTagColumnType(columnType) {
+			continue
+		}
+
+		tableName := tagTableName(directoryID, columnNames[j])
+		insert, err := tx.Prepare(fmt.Sprintf("INSERT OR IGNORE INTO '%s' (columnTable, rowID, tag) VALUES (?, ?, ?)", tableName))
+		if err != nil {
+			indexer.Close()
+			return nil, fmt.Errorf("failed to prepare tag insert for column %s: %v", columnNames[j], err)
+		}
+		remove, err := tx.Prepare(fmt.Sprintf("DELETE FROM '%s' WHERE rowID = ?", tableName))
+		if err != nil {
+			insert.Close()
+			indexer.Close()
+			return nil, fmt.Errorf("failed to prepare tag delete for column %s: %v", columnNames[j], err)
+		}
+
+		indexer.columns = append(indexer.columns, j)
+		indexer.inserts = append(indexer.inserts, insert)
+		indexer.deletes = append(indexer.deletes, remove)
+	}
+	return indexer, nil
+}
+
+// add indexes the comma-separated values of a row's tag and location columns
+func (ti *tagIndexer) add(rowID int64, values []string) error {
+	for i, j := range ti.columns {
+		if j >= len(values) {
+			continue
+		}
+		for _, tag := range splitListCell(values[j]) {
+			if _, err := ti.inserts[i].Exec(ti.directoryID, rowID, tag); err != nil {
+				return fmt.Errorf("failed to insert tag %s: %v", tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// remove drops a row's entries from every tag and location table
+func (ti *tagIndexer) remove(rowID int64) error {
+	for _, remove := range ti.deletes {
+		if _, err := remove.Exec(rowID); err != nil {
+			return fmt.Errorf("failed to clear tags of row %d: %v", rowID, err)
+		}
+	}
+	return nil
+}
+
+// Close releases the prepared statements
+func (ti *tagIndexer) Close() {
+	for i := range ti.inserts {
+		ti.inserts[i].Close()
+		ti.deletes[i].Close()
+	}
+}
+
+// tagTable returns the index table of a tag or location column, or "" if the column hasn't
+// been indexed yet
+func (repo *RowRepository) tagTable(column string) (string, error) {
+	index := repo.ColumnIndex(column)
+	if index < 0 || !isTagColumnType(repo.columns[index].Type) {
+		return "", fmt.Errorf("column %q: %w", column, errNotTagColumn)
+	}
+
+	tableName := tagTableName(repo.directoryID, column)
+	var count int
+	if err := repo.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).
+		Scan(&count); err != nil {
+		return "", fmt.Errorf("failed to look up tag table: %v", err)
+	}
+	if count == 0 || !repo.hasTable {
+		return "", nil
+	}
+	return tableName, nil
+}
+
+// TagCounts lists the distinct tags of a tag or location column, most used first. Tags that
+// differ only in case are counted together under one of their spellings.
+func (repo *RowRepository) TagCounts(column string) ([]TagCount, error) {
+	tableName, err := repo.tagTable(column)
+	if err != nil || tableName == "" {
+		return nil, err
+	}
+
+	rows, err := repo.db.Query(fmt.Sprintf(
+		"SELECT MIN(tag), COUNT(*) FROM '%s' GROUP BY tag ORDER BY COUNT(*) DESC, MIN(tag)", tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tags: %v", err)
+	}
+	defer rows.Close()
+
+	var counts []TagCount
+	for rows.Next() {
+		count := TagCount{Column: column}
+		if err := rows.Scan(&count.Tag, &count.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan tag count: %v", err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// RowsWithTag returns the rows carrying any of the given tags in a tag or location column,
+// in source order
+func (repo *RowRepository) RowsWithTag(column string, tags ...string) ([]*DirectoryRow, error) {
+	tableName, err := repo.tagTable(column)
+	if err != nil || tableName == "" || len(tags) == 0 {
+		return nil, err
+	}
+
+	args := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		args[i] = strings.TrimSpace(tag)
+	}
+	return repo.query(fmt.Sprintf("WHERE rowID IN (SELECT rowID FROM '%s' WHERE tag IN (?%s))",
+		tableName, strings.Repeat(", ?", len(tags)-1)), "", args...)
+}
+
+// RowIDsWithTag returns the IDs of the rows carrying any of the given tags in a tag or
+// location column
+func (repo *RowRepository) RowIDsWithTag(column string, tags ...string) (map[int64]bool, error) {
+	tableName, err := repo.tagTable(column)
+	if err != nil || tableName == "" || len(tags) == 0 {
+		return map[int64]bool{}, err
+	}
+
+	args := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		args[i] = strings.TrimSpace(tag)
+	}
+	rows, err := repo.db.Query(fmt.Sprintf("SELECT DISTINCT rowID FROM '%s' WHERE tag IN (?%s)",
+		tableName, strings.Repeat(", ?", len(tags)-1)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tagged rows: %v", err)
+	}
+	defer rows.Close()
+
+	rowIDs := make(map[int64]bool)
+	for rows.Next() {
+		var rowID int64
+		if err := rows.Scan(&rowID); err != nil {
+			return nil, fmt.Errorf("failed to scan tagged row: %v", err)
+		}
+		rowIDs[rowID] = true
+	}
+	return rowIDs, rows.Err()
+}
+
+// handleGetTags lists the distinct tags of a directory's tag and location columns with the
+// number of rows carrying each, most used first. ?column= limits the list to one column.
+func (app *App) handleGetTags(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	var columns []string
+	if column := r.URL.Query().Get("column"); column != "" {
+		columns = []string{column}
+	} else {
+		for _, column := range repo.Columns() {
+			if isTagColumnType(column.Type) {
+				columns = append(columns, column.Name)
+			}
+		}
+	}
+
+	counts := []TagCount{}
+	for _, column := range columns {
+		columnCounts, err := repo.TagCounts(column)
+		if errors.Is(err, errNotTagColumn) {
+			utils2.ValidationError(w, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to count tags of column %s in directory %s: %v", column, directoryID, err)
+			utils2.DatabaseError(w)
+			return
+		}
+		counts = append(counts, columnCounts...)
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	utils2.RespondWithJSON(w, 200, counts)
+}
+
+// handleGetTagRows returns the rows carrying a tag, ?tag=, in a tag or location column, ?column=
+func (app *App) handleGetTagRows(w http.ResponseWriter, r *http.Request) {
+	directoryID := utils2.GetDirectoryID(r)
+	column := r.URL.Query().Get("column")
+	tag := strings.TrimSpace(r.URL.Query().Get("tag"))
+	if column == "" || tag == "" {
+		utils2.ValidationError(w, "column and tag are required")
+		return
+	}
+
+	repo, err := app.rowRepository(directoryID)
+	if err != nil {
+		log.Printf("Failed to open rows of directory %s: %v", directoryID, err)
+		utils2.NotFoundError(w, "Directory")
+		return
+	}
+
+	rows, err := repo.RowsWithTag(column, tag)
+	if errors.Is(err, errNotTagColumn) {
+		utils2.ValidationError(w, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to find rows tagged %q in column %s of directory %s: %v", tag, column, directoryID, err)
+		utils2.DatabaseError(w)
+		return
+	}
+
+	entries := make([]DirectoryEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = DirectoryEntry{ID: row.ID, SheetRow: row.SheetRow, Data: row.Cells(repo.Columns()), Values: row.Values}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	utils2.RespondWithJSON(w, 200, entries)
+}
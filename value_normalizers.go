@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Normaliser constants. A column's normalisers are applied in this order, whatever order
+// they are listed in.
+const (
+	NormalizeWhitespace   = "whitespace"    // trim and collapse runs of whitespace
+	NormalizeNumber       = "number"        // strip currency symbols and thousands separators
+	NormalizeDecimalComma = "decimal_comma" // read numbers with a decimal comma, as in 1.200,50
+	NormalizeLowercase    = "lowercase"
+	NormalizeUppercase    = "uppercase"
+	NormalizeTitlecase    = "titlecase"
+	NormalizeDedupeTags   = "dedupe_tags" // drop repeated entries of a list, ignoring case
+)
+
+// validNormalizers are the normalisers a column can have
+var validNormalizers = map[string]bool{
+	NormalizeWhitespace: true, NormalizeNumber: true, NormalizeDecimalComma: true,
+	NormalizeLowercase: true, NormalizeUppercase: true, NormalizeTitlecase: true,
+	NormalizeDedupeTags: true,
+}
+
+// rawValuesColumn stores, as a JSON object by column name, the source values of a directory
+// row that its columns' normalisers changed
+const rawValuesColumn = "_rawValues"
+
+// columnNormalizersTableQuery creates the directory database table holding the normalisers
+// the owner chose for each column. Columns without an entry use defaultNormalizers.
+const columnNormalizersTableQuery = `
+	CREATE TABLE IF NOT EXISTS _meta_column_normalizers (
+		columnName TEXT PRIMARY KEY,
+		normalizers TEXT NOT NULL
+	);
+`
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ColumnNormalizers lists the normalisers applied to a column's values on import and on
+// every edit made on the site
+type ColumnNormalizers []string
+
+// defaultNormalizers returns the normalisers of a column type: numbers are read whatever
+// their currency or thousands separators, and lists lose repeated entries
+func defaultNormalizers(columnType string) ColumnNormalizers {
+	switch {
+	case columnType == "numeric":
+		return ColumnNormalizers{NormalizeWhitespace, NormalizeNumber}
+	case isTagColumnType(columnType):
+		return ColumnNormalizers{NormalizeWhitespace, NormalizeDedupeTags}
+	default:
+		return nil
+	}
+}
+
+// parseNormalizers reads a comma-separated list of normalisers
+func parseNormalizers(list string) (ColumnNormalizers, error) {
+	normalizers := ColumnNormalizers{}
+	for _, name := range splitListCell(strings.ToLower(list)) {
+		if !validNormalizers[name] {
+			return nil, fmt.Errorf("unknown normaliser %q", name)
+		}
+		if !normalizers.has(name) {
+			normalizers = append(normalizers, name)
+		}
+	}
+
+	cases := 0
+	for _, name := range []string{NormalizeLowercase, NormalizeUppercase, NormalizeTitlecase} {
+		if normalizers.has(name) {
+			cases++
+		}
+	}
+	if cases > 1 {
+		return nil, fmt.Errorf("choose one of lowercase, uppercase and titlecase")
+	}
+	return normalizers, nil
+}
+
+func (normalizers ColumnNormalizers) has(name string) bool {
+	for _, n := range normalizers {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readsNumbers reports whether the column's values are read as numbers
+func (normalizers ColumnNormalizers) readsNumbers() bool {
+	return normalizers.has(NormalizeNumber) || normalizers.has(NormalizeDecimalComma)
+}
+
+// apply normalises a value. A value that should be a number but can't be read as one is
+// returned with only the other normalisers applied, along with the error.
+func (normalizers ColumnNormalizers) apply(value string) (string, error) {
+	if len(normalizers) == 0 || value == "" {
+		return value, nil
+	}
+
+	if normalizers.has(NormalizeWhitespace) {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+
+	var numberErr error
+	if normalizers.readsNumbers() && strings.TrimSpace(value) != "" {
+		if number, err := normalizeNumber(value, normalizers.has(NormalizeDecimalComma)); err == nil {
+			value = number
+		} else {
+			numberErr = err
+		}
+	}
+
+	switch {
+	case normalizers.has(NormalizeLowercase):
+		value = strings.ToLower(value)
+	case normalizers.has(NormalizeUppercase):
+		value = strings.ToUpper(value)
+	case normalizers.has(NormalizeTitlecase):
+		value = titleCase(value)
+	}
+
+	if normalizers.has(NormalizeDedupeTags) {
+		value = dedupeListCell(value)
+	}
+
+	return value, numberErr
+}
+
+// normalizeNumber reads a number written with currency symbols or codes, thousands
+// separators and either decimal separator, such as "$1,200", "1.200,50 €" or "(45)", and
+// returns it in plain decimal form
+func normalizeNumber(value string, decimalComma bool) (string, error) {
+	text := strings.TrimSpace(value)
+
+	negative := false
+	if strings.HasPrefix(text, "(") && strings.HasSuffix(text, ")") {
+		negative = true
+		text = text[1 : len(text)-1]
+	}
+
+	// Currency symbols and the spaces and apostrophes some locales group digits with
+	text = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Sc, r) || unicode.IsSpace(r) || r == '\'' || r == '’' || r == '_' {
+			return -1
+		}
+		return r
+	}, text)
+
+	// Currency codes and abbreviations before or after the number, such as USD or kr
+	text = strings.TrimFunc(text, unicode.IsLetter)
+
+	// Thousands separators group three digits and come before the decimal separator, so
+	// anything else means the other convention was meant
+	decimal, thousands := ".", ","
+	if decimalComma {
+		decimal, thousands = ",", "."
+	}
+	integer := text
+	if point := strings.Index(text, decimal); point >= 0 {
+		if strings.Contains(text[point+1:], thousands) {
+			return "", fmt.Errorf("%q is not a number", value)
+		}
+		integer = text[:point]
+	}
+	for _, group := range strings.Split(integer, thousands)[1:] {
+		if len(group) != 3 {
+			return "", fmt.Errorf("%q is not a number", value)
+		}
+	}
+	text = strings.ReplaceAll(text, thousands, "")
+	text = strings.Replace(text, decimal, ".", 1)
+
+	if strings.HasPrefix(text, "-") {
+		negative = !negative
+		text = text[1:]
+	}
+	text = strings.TrimPrefix(text, "+")
+
+	if !numericCellPattern.MatchString(text) && !strings.HasPrefix(text, ".") {
+		return "", fmt.Errorf("%q is not a number", value)
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a number", value)
+	}
+	if negative {
+		number = -number
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64), nil
+}
+
+// parseNumericValue reads a number for comparison when the convention it is written in is
+// unknown. Plain numbers are read as they are; otherwise the last separator is taken as the
+// decimal one, unless it is a lone comma followed by three digits, as in "$1,200".
+func parseNumericValue(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number, true
+	}
+
+	lastComma, lastPoint := strings.LastIndex(value, ","), strings.LastIndex(value, ".")
+	decimalComma := false
+	switch {
+	case lastComma >= 0 && lastPoint >= 0:
+		decimalComma = lastComma > lastPoint
+	case lastComma >= 0:
+		decimals := strings.TrimRightFunc(value[lastComma+1:], func(r rune) bool { return !unicode.IsDigit(r) })
+		decimalComma = strings.Count(value, ",") == 1 && len(decimals) != 3
+	case strings.Count(value, ".") > 1:
+		decimalComma = true
+	}
+
+	normalized, err := normalizeNumber(value, decimalComma)
+	if err != nil {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(normalized, 64)
+	return number, err == nil
+}
+
+// titleCase capitalises the first letter of every word and lowers the rest
+func titleCase(value string) string {
+	start := true
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r) || r == '-':
+			start = true
+			return r
+		case start:
+			start = false
+			return unicode.ToUpper(r)
+		default:
+			return unicode.ToLower(r)
+		}
+	}, value)
+}
+
+// dedupeListCell drops empty and repeated entries of a comma-separated list, keeping the
+// first spelling of each
+func dedupeListCell(value string) string {
+	seen := make(map[string]bool)
+	var entries []string
+	for _, entry := range splitListCell(value) {
+		if key := strings.ToLower(entry); !seen[key] {
+			seen[key] = true
+			entries = append(entries, entry)
+		}
+	}
+	return strings.Join(entries, ", ")
+}
+
+// normalizeRow normalises the cells of a row and returns the source values the normalisers
+// changed, as stored in rawValuesColumn, or "" if none changed
+func normalizeRow(columnNames []string, normalizers []ColumnNormalizers, values []string) (string, error) {
+	raw := make(map[string]string)
+	for j, value := range values {
+		if j >= len(normalizers) {
+			break
+		}
+		normalized, _ := normalizers[j].apply(value)
+		if normalized != value {
+			raw[columnNames[j]] = value
+			values[j] = normalized
+		}
+	}
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	rawJSON, err := json.Marshal(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal raw values: %v", err)
+	}
+	return string(rawJSON), nil
+}
+
+// saveColumnNormalizers replaces the normalisers stored for a directory's columns
+func saveColumnNormalizers(tx *sql.Tx, normalizers map[string]ColumnNormalizers) error {
+	if _, err := tx.Exec("DELETE FROM _meta_column_normalizers"); err != nil {
+		return fmt.Errorf("failed to clear column normalisers: %v", err)
+	}
+
+	for name, columnNormalizers := range normalizers {
+		normalizersJSON, err := json.Marshal(columnNormalizers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal normalisers of column %s: %v", name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO _meta_column_normalizers (columnName, normalizers) VALUES (?, ?)",
+			name, string(normalizersJSON)); err != nil {
+			return fmt.Errorf("failed to insert normalisers of column %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// loadColumnNormalizers returns the normalisers of each column, using the defaults of the
+// column's type where the owner chose none
+func loadColumnNormalizers(q queryer, columnNames, columnTypes []string) ([]ColumnNormalizers, error) {
+	stored := make(map[string]ColumnNormalizers)
+	rows, err := q.Query("SELECT columnName, normalizers FROM _meta_column_normalizers")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query column normalisers: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, normalizersJSON string
+		if err := rows.Scan(&name, &normalizersJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan column normalisers: %v", err)
+		}
+		var columnNormalizers ColumnNormalizers
+		if err := json.Unmarshal([]byte(normalizersJSON), &columnNormalizers); err != nil {
+			return nil, fmt.Errorf("failed to parse normalisers of column %s: %v", name, err)
+		}
+		stored[name] = columnNormalizers
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read column normalisers: %v", err)
+	}
+
+	normalizers := make([]ColumnNormalizers, len(columnNames))
+	for i, name := range columnNames {
+		if columnNormalizers, ok := stored[name]; ok {
+			normalizers[i] = columnNormalizers
+		} else {
+			normalizers[i] = defaultNormalizers(columnTypes[i])
+		}
+	}
+	return normalizers, nil
+}
+
+// invalidValueError reports a value submitted on the site that its column's normalisers reject
+type invalidValueError struct {
+	column string
+	err    error
+}
+
+func (e *invalidValueError) Error() string {
+	return fmt.Sprintf("column %s: %v", e.column, e.err)
+}
+
+// validateSubmittedValues checks that the normalisers of a directory's columns accept values
+// submitted on the site, the first of which is in column first. The values are written back
+// as submitted; the import after the write-back stores them normalised, with the submitted
+// value kept alongside. A value that should be a number but can't be read as one is an
+// *invalidValueError.
+func (app *App) validateSubmittedValues(directoryID string, first int, values []string) error {
+	columnNames, normalizers, err := app.getColumnNormalizers(directoryID)
+	if err != nil {
+		return err
+	}
+
+	for i, value := range values {
+		col := first + i
+		if col >= len(normalizers) {
+			break
+		}
+		if _, err := normalizers[col].apply(value); err != nil {
+			return &invalidValueError{column: columnNames[col], err: err}
+		}
+	}
+	return nil
+}
+
+// getColumnNormalizers returns the column names of a directory and the normalisers of each
+func (app *App) getColumnNormalizers(directoryID string) ([]string, []ColumnNormalizers, error) {
+	columnNames, columnTypes, err := app.getDirectoryColumnConfig(directoryID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := app.DirectoryDBManager.GetDirectoryDB(directoryID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get directory database: %v", err)
+	}
+	if _, err := db.Exec(columnNormalizersTableQuery); err != nil {
+		return nil, nil, fmt.Errorf("failed to create _meta_column_normalizers: %v", err)
+	}
+
+	normalizers, err := loadColumnNormalizers(db, columnNames, columnTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return columnNames, normalizers, nil
+}